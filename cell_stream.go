@@ -0,0 +1,212 @@
+package nbsim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/tmc/nbsim/nbhtml"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// patchScript is written after the preamble. It applies the fragments that
+// replace, insert or remove cells that were already sent to the browser.
+const patchScript = `<script>
+function nbsimPatch(op, id, prev) {
+  var script = document.currentScript;
+  var t = script.previousElementSibling;
+  if (!t || t.tagName !== "TEMPLATE") t = null;
+  var node = t ? t.content.firstElementChild : null;
+  var old = document.getElementById(id);
+  if (op === "remove" && old) old.remove();
+  if (op === "replace" && old && node) old.replaceWith(node);
+  if (op === "insert" && node) {
+    if (old) old.remove();
+    var after = prev && document.getElementById(prev);
+    if (after) after.after(node); else script.closest("main").prepend(node);
+  }
+  if (t) t.remove();
+  script.remove();
+  if (node && window.MathJax && MathJax.typesetPromise) MathJax.typesetPromise([node]);
+}
+</script>
+`
+
+type patchOp int
+
+const (
+	opAppend patchOp = iota
+	opInsert
+	opReplace
+	opRemove
+)
+
+// renderedCell is the HTML of a finished cell keyed by its DOM id.
+type renderedCell struct {
+	id   string
+	hash string
+	html string
+}
+
+type patch struct {
+	op   patchOp
+	html string
+}
+
+// cellStream tracks which cells have been sent to a client, in order.
+type cellStream struct {
+	sent []renderedCell
+}
+
+// diff returns the patches that bring the client from the cells sent so far
+// to cells, and records cells as sent.
+func (s *cellStream) diff(cells []renderedCell) []patch {
+	var patches []patch
+	want := make(map[string]bool, len(cells))
+	for _, c := range cells {
+		want[c.id] = true
+	}
+	old := make(map[string]int, len(s.sent))
+	for _, c := range s.sent {
+		if !want[c.id] {
+			patches = append(patches, patch{opRemove, scriptCall("remove", c.id, "")})
+			continue
+		}
+		old[c.id] = len(old)
+	}
+	hashes := make(map[string]string, len(s.sent))
+	for _, c := range s.sent {
+		hashes[c.id] = c.hash
+	}
+
+	// Cells that were sent and are still in their original relative order
+	// stay in place; everything else is placed directly after its
+	// predecessor.
+	last := -1
+	for i, c := range cells {
+		prev := ""
+		if i > 0 {
+			prev = cells[i-1].id
+		}
+		j, sent := old[c.id]
+		switch {
+		case sent && j > last:
+			last = j
+			if hashes[c.id] != c.hash {
+				patches = append(patches, patch{opReplace, "<template>" + c.html + "</template>" + scriptCall("replace", c.id, "")})
+			}
+		case !sent && !anySent(cells[i+1:], old):
+			patches = append(patches, patch{opAppend, c.html})
+		default:
+			patches = append(patches, patch{opInsert, "<template>" + c.html + "</template>" + scriptCall("insert", c.id, prev)})
+		}
+	}
+	s.sent = cells
+	return patches
+}
+
+func anySent(cells []renderedCell, old map[string]int) bool {
+	for _, c := range cells {
+		if _, ok := old[c.id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func scriptCall(op, id, prev string) string {
+	args, _ := json.Marshal([]string{op, id, prev})
+	return fmt.Sprintf("<script>nbsimPatch(%s)</script>\n", strings.Trim(string(args), "[]"))
+}
+
+// cellKeys returns a stable key for each cell: its ID, or its index when the
+// ID is missing or duplicated.
+func cellKeys(cells []notebooks.Cell) []string {
+	keys := make([]string, len(cells))
+	seen := make(map[string]bool, len(cells))
+	for i, c := range cells {
+		key := c.ID
+		if key == "" || seen[key] {
+			key = fmt.Sprintf("idx-%d", i)
+		}
+		seen[key] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+// renderCells renders the finished cells of nb. Unless the notebook is done,
+// the last cell may still be written to and is left out.
+func (h *Handler) renderCells(nb *notebooks.Notebook, notebookDone bool) ([]renderedCell, error) {
+	cells := nb.Cells
+	if !notebookDone && len(cells) > 0 {
+		cells = cells[:len(cells)-1]
+	}
+	keys := cellKeys(cells)
+	r := nbhtml.New(nb)
+	var out []renderedCell
+	for i, c := range cells {
+		c.ID = keys[i]
+		var (
+			cellHTML string
+			err      error
+		)
+		if h.UseNbconvert {
+			cellHTML, err = nbconvertCell(nb, c)
+		} else {
+			buf := new(bytes.Buffer)
+			err = r.WriteCell(buf, &c)
+			cellHTML = buf.String()
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, renderedCell{
+			id:   "cell-" + c.ID,
+			hash: fmt.Sprintf("%x", sha256.Sum256([]byte(cellHTML))),
+			html: cellHTML,
+		})
+	}
+	return out, nil
+}
+
+// renderPreamble renders everything before the first cell of nb.
+func (h *Handler) renderPreamble(nb *notebooks.Notebook) (string, error) {
+	if h.UseNbconvert {
+		in, err := json.Marshal(&notebooks.Notebook{Metadata: nb.Metadata, NBFormat: 4, NBFormatMinor: nb.NBFormatMinor, Cells: []notebooks.Cell{}})
+		if err != nil {
+			return "", err
+		}
+		htmlBody, err := generateNotebookHTML(in)
+		if err != nil {
+			return "", err
+		}
+		return getPreamble(htmlBody), nil
+	}
+	buf := new(bytes.Buffer)
+	if err := nbhtml.New(nb).WriteHeader(buf, nb.Metadata.Title); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// nbconvertCell converts a single cell with nbconvert and wraps its divs in a
+// div carrying the cell's DOM id.
+func nbconvertCell(nb *notebooks.Notebook, c notebooks.Cell) (string, error) {
+	in, err := json.Marshal(&notebooks.Notebook{Metadata: nb.Metadata, NBFormat: 4, NBFormatMinor: nb.NBFormatMinor, Cells: []notebooks.Cell{c}})
+	if err != nil {
+		return "", err
+	}
+	htmlBody, err := generateNotebookHTML(in)
+	if err != nil {
+		return "", err
+	}
+	divs, err := getTopLevelDivs(htmlBody)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`<div class="cell" id="cell-%s">%s</div>`, html.EscapeString(c.ID), strings.Join(divs, "")), nil
+}
@@ -0,0 +1,170 @@
+package nbsim
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// rendered returns the cells described by spec, space-separated ids with an
+// optional ":version" that changes their hash.
+func rendered(spec string) []renderedCell {
+	var cells []renderedCell
+	for _, f := range strings.Fields(spec) {
+		id, version, _ := strings.Cut(f, ":")
+		cells = append(cells, renderedCell{id: id, hash: id + version, html: "<" + id + ">"})
+	}
+	return cells
+}
+
+var (
+	patchCall = regexp.MustCompile(`nbsimPatch\((.*)\)`)
+	cellID    = regexp.MustCompile(`^<div class="cell [^"]*" id="([^"]+)"`)
+)
+
+// describe returns p as "append a", "insert b after a", "insert a first",
+// "replace a" or "remove a".
+func describe(t *testing.T, p patch) string {
+	t.Helper()
+	if p.op == opAppend {
+		if m := cellID.FindStringSubmatch(p.html); m != nil {
+			return "append " + m[1]
+		}
+		return "append " + strings.Trim(p.html, "<>")
+	}
+	m := patchCall.FindStringSubmatch(p.html)
+	if m == nil {
+		t.Fatalf("patch %q calls no nbsimPatch", p.html)
+	}
+	var args []string
+	if err := json.Unmarshal([]byte("["+m[1]+"]"), &args); err != nil {
+		t.Fatal(err)
+	}
+	op, id, prev := args[0], args[1], args[2]
+	if op == "insert" {
+		if prev == "" {
+			return "insert " + id + " first"
+		}
+		return "insert " + id + " after " + prev
+	}
+	return op + " " + id
+}
+
+// apply applies patches to the ids of cells in a page, as nbsimPatch does.
+func apply(t *testing.T, page []string, patches []patch) []string {
+	t.Helper()
+	for _, p := range patches {
+		var op, id, prev string
+		switch f := strings.Fields(describe(t, p)); {
+		case f[0] == "insert" && f[2] == "after":
+			op, id, prev = f[0], f[1], f[3]
+		default:
+			op, id = f[0], f[1]
+		}
+		switch op {
+		case "append":
+			page = append(page, id)
+		case "remove":
+			page = slices.DeleteFunc(page, func(s string) bool { return s == id })
+		case "insert":
+			page = slices.DeleteFunc(page, func(s string) bool { return s == id })
+			i := slices.Index(page, prev) + 1 // 0 if first or prev is missing
+			page = slices.Insert(page, i, id)
+		}
+	}
+	return page
+}
+
+func TestCellStreamDiff(t *testing.T) {
+	tests := []struct {
+		name      string
+		sent, now string
+		want      []string
+	}{
+		{"first", "", "a b", []string{"append a", "append b"}},
+		{"grow", "a", "a b", []string{"append b"}},
+		{"unchanged", "a b", "a b", nil},
+		{"changed", "a b", "a:2 b", []string{"replace a"}},
+		{"insert", "a c", "a b c", []string{"insert b after a"}},
+		{"insert first", "b", "a b", []string{"insert a first"}},
+		{"remove", "a b c", "a c", []string{"remove b"}},
+		{"remove all", "a b", "", []string{"remove a", "remove b"}},
+		{"move last to front", "a b c", "c a b", []string{"insert a after c", "insert b after a"}},
+		{"swap", "a b", "b a", []string{"insert a after b"}},
+		{"reorder and change", "a b c", "b:2 a c", []string{"replace b", "insert a after b"}},
+		{"replace and remove", "a b c", "a:2 c:2", []string{"remove b", "replace a", "replace c"}},
+		{"insert and append", "a c", "a b c d", []string{"insert b after a", "append d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &cellStream{sent: rendered(tt.sent)}
+			patches := s.diff(rendered(tt.now))
+			var got []string
+			for _, p := range patches {
+				got = append(got, describe(t, p))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("diff = %q, want %q", got, tt.want)
+			}
+			page := apply(t, strings.Fields(strings.NewReplacer(":2", "").Replace(tt.sent)), patches)
+			want := strings.Fields(strings.NewReplacer(":2", "").Replace(tt.now))
+			if !slices.Equal(page, want) {
+				t.Errorf("patched page = %q, want %q", page, want)
+			}
+			if len(s.sent) != len(want) {
+				t.Errorf("%d cells recorded as sent, want %d", len(s.sent), len(want))
+			}
+		})
+	}
+}
+
+func TestCellKeys(t *testing.T) {
+	cells := []notebooks.Cell{{ID: ""}, {ID: "x"}, {ID: "x"}, {ID: "y"}, {ID: ""}}
+	want := []string{"idx-0", "x", "idx-2", "y", "idx-4"}
+	if got := cellKeys(cells); !slices.Equal(got, want) {
+		t.Errorf("cellKeys = %q, want %q", got, want)
+	}
+}
+
+// TestRenderCellsWithoutIDs streams a notebook whose cells have no IDs:
+// they are keyed by index, so a cell that changes is replaced and a cell
+// inserted before others shifts their keys.
+func TestRenderCellsWithoutIDs(t *testing.T) {
+	notebook := func(sources ...string) *notebooks.Notebook {
+		nb := &notebooks.Notebook{NBFormat: 4, NBFormatMinor: 4}
+		for _, s := range sources {
+			nb.Cells = append(nb.Cells, notebooks.Cell{CellType: "markdown", Source: &notebooks.MultilineString{Value: s}})
+		}
+		return nb
+	}
+	h := &Handler{}
+	s := &cellStream{}
+	steps := []struct {
+		nb   *notebooks.Notebook
+		done bool
+		want []string
+	}{
+		// the last cell may still be written to until the notebook is done
+		{notebook("one", "tw"), false, []string{"append cell-idx-0"}},
+		{notebook("one", "two"), true, []string{"append cell-idx-1"}},
+		{notebook("one", "2"), true, []string{"replace cell-idx-1"}},
+		{notebook("zero", "one", "2"), true, []string{"replace cell-idx-0", "replace cell-idx-1", "append cell-idx-2"}},
+	}
+	for i, step := range steps {
+		cells, err := h.renderCells(step.nb, step.done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range s.diff(cells) {
+			got = append(got, describe(t, p))
+		}
+		if !slices.Equal(got, step.want) {
+			t.Errorf("step %d: diff = %q, want %q", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// generationJob is a queued or running generation and the cancellation of
+// its context.
+type generationJob struct {
+	gen    registry.Generation
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// enqueue queues the registered generation gen. Generations of a URL are
+// queued under its notebook, so only one runs at a time; edits are queued
+// under their own ID. It reports whether gen was queued.
+func (s *Server) enqueue(gen registry.Generation) bool {
+	key := gen.Base
+	if gen.EditOf != "" {
+		key = gen.ID
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	job := &generationJob{gen: gen, ctx: ctx, cancel: cancel}
+	s.jobsMu.Lock()
+	s.jobs[gen.ID] = job
+	s.jobsMu.Unlock()
+	s.events.Reset(gen.ID)
+	if _, ok := s.scheduler.Submit(key, gen.ID, func() { s.run(job) }); !ok {
+		s.forget(job)
+		return false
+	}
+	return true
+}
+
+// run runs the generation of job and forgets it.
+func (s *Server) run(job *generationJob) {
+	defer s.forget(job)
+	s.generate(job.ctx, job.gen)
+}
+
+func (s *Server) forget(job *generationJob) {
+	job.cancel(nil)
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	delete(s.jobs, job.gen.ID)
+}
+
+// cancel cancels the queued or running generation id with cause, which
+// wraps registry.ErrCancelled, and reports whether there was one. A queued
+// generation is taken out of the queue and finished as cancelled right away,
+// without taking up a worker.
+func (s *Server) cancel(id string, cause error) bool {
+	s.jobsMu.Lock()
+	job, ok := s.jobs[id]
+	s.jobsMu.Unlock()
+	if !ok {
+		return false
+	}
+	job.cancel(cause)
+	if s.scheduler.Remove(id) {
+		s.cancelQueued(job, cause)
+	}
+	return true
+}
+
+// cancelQueued finishes job, which never started, as cancelled with cause.
+func (s *Server) cancelQueued(job *generationJob, cause error) {
+	defer s.forget(job)
+	id := job.gen.ID
+	if err := s.markCancelled(id, cause); err != nil {
+		fmt.Println("error marking notebook cancelled:", err)
+	}
+	if _, err := s.registry.Finish(id, nil, cause); err != nil {
+		fmt.Println("error recording generation:", err)
+	}
+	s.events.Publish(id, nbsim.Event{Type: nbsim.EventCancelled, Error: cause.Error()})
+	fmt.Println("stopped generation", id+":", cause)
+}
+
+// handleCancel cancels the generation named by the "id" path value. Its
+// notebook keeps the cells written so far.
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.cancel(id, fmt.Errorf("%w by request", registry.ErrCancelled)) {
+		gen, ok := s.registry.Get(id)
+		if !ok {
+			http.Error(w, registry.ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("generation %s is %s", id, gen.Status), http.StatusConflict)
+		return
+	}
+	fmt.Println("cancelling generation", id)
+	gen, _ := s.registry.Get(id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(gen)
+}
+
+// cancelIdle cancels the generations whose events nobody has watched for
+// timeout, checking periodically.
+func (s *Server) cancelIdle(timeout time.Duration) {
+	for range time.Tick(max(timeout/10, time.Second)) {
+		s.cancelUnwatched(timeout)
+	}
+}
+
+// cancelUnwatched cancels the generations whose events nobody has watched
+// for timeout and returns their IDs.
+func (s *Server) cancelUnwatched(timeout time.Duration) []string {
+	s.jobsMu.Lock()
+	ids := make([]string, 0, len(s.jobs))
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	s.jobsMu.Unlock()
+	var cancelled []string
+	for _, id := range ids {
+		if idle := s.events.Idle(id); idle >= timeout {
+			fmt.Println("cancelling unwatched generation", id)
+			if s.cancel(id, fmt.Errorf("%w: nobody watched it for %s", registry.ErrCancelled, idle.Round(time.Second))) {
+				cancelled = append(cancelled, id)
+			}
+		}
+	}
+	return cancelled
+}
+
+// markCancelled records in the metadata of the partial notebook of the
+// generation id that it was cancelled, and why.
+func (s *Server) markCancelled(id string, cause error) error {
+	nb, err := readNotebook(id)
+	if err != nil {
+		// cancelled before the model wrote a notebook
+		if nb, err = notebooks.NewBuilder().Python().Build(); err != nil {
+			return err
+		}
+	}
+	m := nbsim.ReadGenerationMetadata(nb)
+	m.Cancelled, m.CancelReason = true, cause.Error()
+	if err := nbsim.SetGenerationMetadata(nb, m); err != nil {
+		return err
+	}
+	b, err := notebooks.Marshal(nb)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(*flagGenDir, id+".ipynb"), b, 0644)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/registry"
+)
+
+// slowServer returns a server whose replay model takes seconds to write the
+// notebook of each of urls.
+func slowServer(t *testing.T, workers int, urls ...string) (*Server, *httptest.Server) {
+	t.Helper()
+	setFlag(t, flagWorkers, workers)
+	recordings := map[string]string{}
+	for _, url := range urls {
+		recordings[url] = jsonRecording(t, testNotebook(t))
+	}
+	s, llm := newTestServer(t, recordings)
+	llm.Delay = 50 * time.Millisecond
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// waitStatus waits for generation id to have status.
+func waitStatus(t *testing.T, s *Server, id string, status registry.Status) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if gen, _ := s.registry.Get(id); gen.Status == status {
+			return
+		}
+	}
+	t.Fatalf("generation %s never became %s", id, status)
+}
+
+func deleteGen(t *testing.T, srv *httptest.Server, id string) int {
+	t.Helper()
+	req, _ := http.NewRequest("DELETE", srv.URL+"/_gen/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// checkCancelled checks that generation id ended cancelled for reason, in
+// the registry and in its notebook.
+func checkCancelled(t *testing.T, s *Server, srv *httptest.Server, id, reason string) registry.Generation {
+	t.Helper()
+	if types := watch(t, srv, id); types[len(types)-1] != nbsim.EventCancelled {
+		t.Errorf("events of %s = %q, want it cancelled", id, types)
+	}
+	gen := wait(t, s, id)
+	if gen.Status != registry.StatusCancelled || !strings.Contains(gen.Error, reason) {
+		t.Errorf("generation %s = %s %q, want cancelled %s", id, gen.Status, gen.Error, reason)
+	}
+	nb, err := readNotebook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := nbsim.ReadGenerationMetadata(nb); !m.Cancelled || !strings.Contains(m.CancelReason, reason) {
+		t.Errorf("notebook of %s metadata = %+v, want it cancelled %s", id, m, reason)
+	}
+	return gen
+}
+
+func TestHandleCancel(t *testing.T) {
+	const running, queued = "/notebooks/a/running.ipynb", "/notebooks/a/queued.ipynb"
+	s, srv := slowServer(t, 1, running, queued)
+	runningID, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": running})["id"].(string)
+	waitStatus(t, s, runningID, registry.StatusRunning)
+	queuedID, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": queued})["id"].(string)
+	if pos := s.scheduler.Position(queuedID); pos != 1 {
+		t.Fatalf("queue position of %s = %d, want 1", queuedID, pos)
+	}
+
+	// A queued generation is finished as cancelled at once, without
+	// running.
+	if code := deleteGen(t, srv, queuedID); code != http.StatusAccepted {
+		t.Fatalf("DELETE queued generation = %d, want %d", code, http.StatusAccepted)
+	}
+	if gen, _ := s.registry.Get(queuedID); gen.Status != registry.StatusCancelled {
+		t.Errorf("queued generation is %s after DELETE, want cancelled", gen.Status)
+	}
+	if gen := checkCancelled(t, s, srv, queuedID, "by request"); gen.StartedAt != nil {
+		t.Errorf("cancelled queued generation started at %v", gen.StartedAt)
+	}
+	if gen, _ := s.registry.Get(runningID); gen.Status != registry.StatusRunning {
+		t.Errorf("cancelling the queued generation left the running one %s", gen.Status)
+	}
+
+	// A running generation stops, keeping what it wrote.
+	if code := deleteGen(t, srv, runningID); code != http.StatusAccepted {
+		t.Fatalf("DELETE running generation = %d, want %d", code, http.StatusAccepted)
+	}
+	checkCancelled(t, s, srv, runningID, "by request")
+
+	if code := deleteGen(t, srv, runningID); code != http.StatusConflict {
+		t.Errorf("DELETE cancelled generation = %d, want %d", code, http.StatusConflict)
+	}
+	if code := deleteGen(t, srv, "gen-missing"); code != http.StatusNotFound {
+		t.Errorf("DELETE unknown generation = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestCancelUnwatched(t *testing.T) {
+	const unwatched, watched = "/notebooks/a/unwatched.ipynb", "/notebooks/a/watched.ipynb"
+	s, srv := slowServer(t, 2, unwatched, watched)
+	unwatchedID, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": unwatched})["id"].(string)
+	watchedID, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": watched})["id"].(string)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/_events/"+watchedID, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ids := s.cancelUnwatched(time.Hour); len(ids) != 0 {
+		t.Fatalf("cancelled %q before the idle timeout", ids)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ids := s.cancelUnwatched(10 * time.Millisecond); !slices.Equal(ids, []string{unwatchedID}) {
+		t.Fatalf("cancelled %q after the idle timeout, want only %s", ids, unwatchedID)
+	}
+	checkCancelled(t, s, srv, unwatchedID, "nobody watched it")
+	if gen, _ := s.registry.Get(watchedID); !gen.Active() {
+		t.Errorf("watched generation is %s, want it still generating", gen.Status)
+	}
+	stop()
+	s.cancel(watchedID, registry.ErrCancelled)
+	wait(t, s, watchedID)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
+)
+
+// handleCell starts a new version of a notebook that regenerates one cell of
+// a generated version, named like in handleEdit. The instruction is
+// optional.
+func (s *Server) handleCell(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID          string `json:"id"`
+		URL         string `json:"url"`
+		Index       *int   `json:"index"`
+		Instruction string `json:"instruction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.Index == nil {
+		http.Error(w, "missing index", http.StatusBadRequest)
+		return
+	}
+	s.startEdit(w, payload.ID, payload.URL, payload.Instruction, payload.Index)
+}
+
+// runCell implements the cell subcommand, which regenerates one cell of a
+// generated notebook as a new version of it.
+func runCell(llm llms.Model, model string, args []string) error {
+	fs := flag.NewFlagSet("cell", flag.ExitOnError)
+	instruction := fs.String("i", "", "what to change about the cell")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: nbsim [flags] cell [-i instruction] version-id|url index")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	index, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("invalid cell index: %w", err)
+	}
+	s, err := newServer(llm, model)
+	if err != nil {
+		return err
+	}
+	src, ok := s.registry.Get(fs.Arg(0))
+	if !ok {
+		if src, ok = s.registry.Canonical(nbsim.GenerationID(fs.Arg(0))); !ok {
+			return fmt.Errorf("%w: %s", registry.ErrNotFound, fs.Arg(0))
+		}
+	}
+	gen, err := s.createEdit(src, *instruction, &index)
+	if err != nil {
+		return err
+	}
+	s.generate(context.Background(), gen)
+	gen, _ = s.registry.Get(gen.ID)
+	if gen.Status != registry.StatusDone {
+		return fmt.Errorf("regenerating cell %d of %s: %s", index, src.ID, gen.Error)
+	}
+	fmt.Println("wrote", path.Join(*flagGenDir, gen.ID+".ipynb"))
+	return nil
+}
+
+// generateCell runs the registered generation gen, which regenerates one
+// cell of the version it edits, and records its outcome in the registry. Its
+// events are the model's tokens and the events of the regenerated cell only.
+func (s *Server) generateCell(ctx context.Context, gen registry.Generation) {
+	id := gen.ID
+
+	if _, err := s.registry.Start(id); err != nil {
+		fmt.Println("error starting generation:", err)
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventError, Error: err.Error()})
+		return
+	}
+
+	var log io.Writer = io.Discard
+	lf, err := os.Create(path.Join(*flagGenDir, id+replay.LogSuffix))
+	if err != nil {
+		fmt.Println("error opening log file:", err)
+	} else {
+		defer lf.Close()
+		log = lf
+	}
+	res, nb, err := s.regenerateCell(ctx, gen, log)
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		if merr := s.markCancelled(id, err); merr != nil {
+			fmt.Println("error marking notebook cancelled:", merr)
+		}
+	}
+	s.recordResult(gen, res)
+	gen, rerr := s.registry.Finish(id, res.Usage, err)
+	if rerr != nil {
+		fmt.Println("error recording generation:", rerr)
+	} else if gen.Canonical {
+		if err := s.writeCanonical(gen); err != nil {
+			fmt.Println("error writing canonical notebook:", err)
+		}
+	}
+	if errors.Is(err, registry.ErrCancelled) {
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventCancelled, Error: err.Error()})
+		fmt.Println("cancelled regenerating cell:", err)
+		return
+	}
+	if err != nil {
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventError, Error: err.Error()})
+		fmt.Println("error regenerating cell:", err)
+		return
+	}
+	s.events.PublishCell(id, nb, *gen.Cell)
+	s.events.Publish(id, nbsim.Event{Type: nbsim.EventFinished, Index: len(nb.Cells)})
+	if *flagExecute != "" {
+		s.execute(ctx, gen)
+	}
+}
+
+// regenerateCell asks the model for the cell gen regenerates and writes the
+// notebook of gen: the version it edits with the new cell in place of the
+// old one, under the old cell's ID.
+func (s *Server) regenerateCell(ctx context.Context, gen registry.Generation, log io.Writer) (generationResult, *notebooks.Notebook, error) {
+	format := nbsim.FormatJSON
+	history, nb, err := s.history(gen, format)
+	if err != nil {
+		return generationResult{}, nil, err
+	}
+	cw := &cellWriter{emit: func(e nbsim.Event) { s.events.Publish(gen.ID, e) }}
+	res, err := generateNotebook(ctx, s.llm, history, format, cw, log)
+	if err != nil {
+		return res, nil, err
+	}
+	if res.Truncated {
+		return res, nil, errors.New("the cell is cut off by the max-tokens limit")
+	}
+	c, err := nbsim.ParseCell(format.Prefill() + cw.String())
+	if err != nil {
+		return res, nil, err
+	}
+	patched, err := notebooks.Patch{{Op: "replace", ID: nb.Cells[*gen.Cell].ID, Cell: c}}.Apply(nb)
+	if err != nil {
+		return res, nil, err
+	}
+	s.recordValidation(gen.ID, patched.Cells[*gen.Cell].Validate())
+	patched.Normalize()
+	b, err := notebooks.Marshal(patched)
+	if err != nil {
+		return res, nil, err
+	}
+	return res, patched, os.WriteFile(path.Join(*flagGenDir, gen.ID+".ipynb"), b, 0644)
+}
+
+// cellWriter collects the model's response for a regenerated cell and emits
+// it as token events.
+type cellWriter struct {
+	strings.Builder
+	emit func(nbsim.Event)
+}
+
+func (cw *cellWriter) AddPart(part string) {
+	cw.WriteString(part)
+	cw.emit(nbsim.Event{Type: nbsim.EventToken, Text: part})
+}
+
+func (cw *cellWriter) AddCell(arguments string) (int, error) {
+	return 0, errors.New("cells are regenerated as JSON")
+}
+
+func (cw *cellWriter) Flush() {}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
+)
+
+func TestHandleCell(t *testing.T) {
+	const url = "/notebooks/a/loading.ipynb"
+	orig, err := notebooks.NewBuilder().Python().
+		Markdown("# Loading").
+		Code("df = load()\ndf.shape").Output(notebooks.NewExecuteResult(0, notebooks.MimeBundle{"text/plain": {Value: "(3, 2)"}})).Executed().
+		Markdown("Done.").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, llm := newTestServer(t, map[string]string{url: jsonRecording(t, orig)})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+	before, err := readNotebook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The model now answers with the new cell.
+	recording := `"cell_type": "code", "source": "df = load(cache=True)"}`
+	if err := os.WriteFile(filepath.Join(llm.Dir, nbsim.GenerationID(url)+replay.LogSuffix), []byte(recording), 0644); err != nil {
+		t.Fatal(err)
+	}
+	body := postJSON(t, srv.URL+"/_cell", map[string]any{"id": id, "index": 1})
+	cellID, _ := body["id"].(string)
+	if types := watch(t, srv, cellID); types[len(types)-1] != nbsim.EventFinished {
+		t.Fatalf("events = %q, want the regeneration to finish", types)
+	}
+	gen := wait(t, s, cellID)
+	if gen.Status != registry.StatusDone || gen.EditOf != id || gen.Cell == nil || *gen.Cell != 1 {
+		t.Fatalf("generation = %+v, want a done regeneration of cell 1 of %s", gen, id)
+	}
+	after, err := readNotebook(cellID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Cells) != len(before.Cells) {
+		t.Fatalf("regenerated notebook has %d cells, want %d", len(after.Cells), len(before.Cells))
+	}
+	for _, i := range []int{0, 2} {
+		if got, want := cellJSON(t, after.Cells[i]), cellJSON(t, before.Cells[i]); got != want {
+			t.Errorf("cell %d changed from %s to %s", i, want, got)
+		}
+	}
+	c := after.Cells[1]
+	if c.ID != before.Cells[1].ID {
+		t.Errorf("regenerated cell ID = %q, want %q", c.ID, before.Cells[1].ID)
+	}
+	if got := c.Source.String(); got != "df = load(cache=True)" {
+		t.Errorf("regenerated cell source = %q", got)
+	}
+	if len(c.Outputs) != 0 || c.ExecutionCount != nil {
+		t.Errorf("regenerated cell kept the old outputs %s and execution count %v", cellJSON(t, c), c.ExecutionCount)
+	}
+	if again, err := readNotebook(id); err != nil || cellJSON(t, again.Cells[1]) != cellJSON(t, before.Cells[1]) {
+		t.Errorf("regenerating a cell changed the version it edits")
+	}
+}
+
+func TestHandleCellErrors(t *testing.T) {
+	const url = "/notebooks/a/short.ipynb"
+	s, _ := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+
+	tests := []struct {
+		payload string
+		want    int
+	}{
+		{`{"id": "` + id + `", "index": 3}`, http.StatusBadRequest},
+		{`{"id": "` + id + `", "index": -1}`, http.StatusBadRequest},
+		{`{"id": "` + id + `"}`, http.StatusBadRequest},
+		{`{"id": "missing", "index": 0}`, http.StatusNotFound},
+		{`{"url": "` + url + `", "index": `, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(srv.URL+"/_cell", "application/json", strings.NewReader(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("POST /_cell %s = %s, want %d", tt.payload, resp.Status, tt.want)
+		}
+	}
+	if versions := s.registry.Versions(nbsim.GenerationID(url)); len(versions) != 1 {
+		t.Errorf("%d versions after rejected regenerations, want 1", len(versions))
+	}
+}
+
+func cellJSON(t *testing.T, c notebooks.Cell) string {
+	t.Helper()
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// runConvert implements the convert subcommand, which converts a notebook
+// between ipynb and the percent, MyST and markdown text formats. The input
+// format follows from the file extension; markdown files with {code-cell}
+// directives are read as MyST.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "", "output format: ipynb, percent, myst or markdown (default percent, or ipynb for text input)")
+	out := fs.String("o", "", "file to write to (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: nbsim convert [-to format] [-o file] notebook")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	name := fs.Arg(0)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	from := inputFormat(name, data)
+	nb, err := readFormat(from, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	format := *to
+	if format == "" {
+		format = "percent"
+		if from != "ipynb" {
+			format = "ipynb"
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeFormat(&buf, format, nb); err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(*out, buf.Bytes(), 0644)
+}
+
+func inputFormat(name string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ipynb":
+		return "ipynb"
+	case ".md", ".markdown":
+		if bytes.Contains(data, []byte("{code-cell}")) {
+			return "myst"
+		}
+		return "markdown"
+	}
+	return "percent"
+}
+
+func readFormat(format string, data []byte) (*notebooks.Notebook, error) {
+	switch format {
+	case "ipynb":
+		repaired, _ := notebooks.RepairNotebookJSON(string(data))
+		nb := &notebooks.Notebook{}
+		if err := json.Unmarshal([]byte(repaired), nb); err != nil {
+			return nil, err
+		}
+		return nb, nil
+	case "myst":
+		return notebooks.ReadMyST(bytes.NewReader(data))
+	case "markdown":
+		return notebooks.ReadMarkdown(bytes.NewReader(data))
+	}
+	return notebooks.ReadPercent(bytes.NewReader(data))
+}
+
+func writeFormat(w io.Writer, format string, nb *notebooks.Notebook) error {
+	switch format {
+	case "ipynb":
+		data, err := notebooks.Marshal(nb)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	case "percent":
+		return notebooks.WritePercent(w, nb)
+	case "myst":
+		return notebooks.WriteMyST(w, nb)
+	case "markdown":
+		return notebooks.WriteMarkdown(w, nb)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
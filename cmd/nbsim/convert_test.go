@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// cellSources returns the type and source of each cell of nb.
+func cellSources(nb *notebooks.Notebook) [][2]string {
+	var cells [][2]string
+	for _, c := range nb.Cells {
+		source := ""
+		if c.Source != nil {
+			source = c.Source.String()
+		}
+		cells = append(cells, [2]string{c.CellType, source})
+	}
+	return cells
+}
+
+// TestConvertRoundTrip converts a notebook to each format and back to ipynb.
+func TestConvertRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.ipynb")
+	data, err := notebooks.Marshal(testNotebook(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := cellSources(testNotebook(t))
+
+	tests := []struct {
+		to, ext  string
+		wantFrom string // the format the converted file is read as
+	}{
+		{"ipynb", ".ipynb", "ipynb"},
+		{"percent", ".py", "percent"},
+		{"myst", ".md", "myst"},
+		{"markdown", ".md", "markdown"},
+	}
+	for _, tt := range tests {
+		converted := filepath.Join(dir, tt.to+tt.ext)
+		if err := runConvert([]string{"-to", tt.to, "-o", converted, in}); err != nil {
+			t.Errorf("converting to %s: %v", tt.to, err)
+			continue
+		}
+		text, err := os.ReadFile(converted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from := inputFormat(converted, text); from != tt.wantFrom {
+			t.Errorf("%s output is read as %s", tt.to, from)
+		}
+		back := filepath.Join(dir, tt.to+"-back.ipynb")
+		if err := runConvert([]string{"-to", "ipynb", "-o", back, converted}); err != nil {
+			t.Errorf("converting %s back: %v", tt.to, err)
+			continue
+		}
+		data, err := os.ReadFile(back)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nb, err := readFormat("ipynb", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cellSources(nb); !slices.Equal(got, want) {
+			t.Errorf("%s round trip has cells %q, want %q", tt.to, got, want)
+		}
+	}
+}
+
+func TestConvertUnknownFormat(t *testing.T) {
+	in := filepath.Join(t.TempDir(), "in.py")
+	if err := os.WriteFile(in, []byte("# %%\nx = 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runConvert([]string{"-to", "html", "-o", in + ".html", in}); err == nil {
+		t.Errorf("converting to an unknown format succeeded")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// handleEdit starts a new version of a notebook that revises a generated
+// version as an instruction asks. The version is named by "id", or by "url"
+// for its canonical version.
+func (s *Server) handleEdit(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ID          string `json:"id"`
+		URL         string `json:"url"`
+		Instruction string `json:"instruction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if payload.Instruction == "" {
+		http.Error(w, "missing instruction", http.StatusBadRequest)
+		return
+	}
+	s.startEdit(w, payload.ID, payload.URL, payload.Instruction, nil)
+}
+
+// startEdit starts an edit of the version named by id, or of the canonical
+// version of url if id is empty, and responds like handleGen.
+func (s *Server) startEdit(w http.ResponseWriter, id, url, instruction string, cell *int) {
+	src, ok := s.registry.Get(id)
+	if id == "" {
+		src, ok = s.registry.Canonical(nbsim.GenerationID(url))
+	}
+	if !ok {
+		http.Error(w, registry.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	gen, err := s.createEdit(src, instruction, cell)
+	if errors.Is(err, errNotGenerated) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, nbsim.ErrNoCell) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cell != nil {
+		fmt.Println("regenerating cell", *cell, "of notebook", src.ID, "as", gen.ID)
+	} else {
+		fmt.Println("editing notebook", src.ID, "as", gen.ID+":", instruction)
+	}
+	s.enqueue(gen)
+	s.respondGeneration(w, gen)
+}
+
+// errNotGenerated is returned for edits of versions that are not done.
+var errNotGenerated = errors.New("the notebook has not been generated")
+
+// createEdit records a new pending version of the notebook of src that
+// revises src as instruction asks or, if cell is not nil, regenerates only
+// that cell of src.
+func (s *Server) createEdit(src registry.Generation, instruction string, cell *int) (registry.Generation, error) {
+	if src.Status != registry.StatusDone {
+		return registry.Generation{}, fmt.Errorf("%w: %s is %s", errNotGenerated, src.ID, src.Status)
+	}
+	gen := registry.Generation{
+		Base:        src.Base,
+		URL:         src.URL,
+		Referrer:    src.Referrer,
+		Model:       s.model,
+		Format:      string(nbsim.FormatJSON),
+		EditOf:      src.ID,
+		Instruction: instruction,
+		Cell:        cell,
+	}
+	history, _, err := s.history(gen, nbsim.FormatJSON)
+	if err != nil {
+		return registry.Generation{}, err
+	}
+	gen.PromptHash = promptHash(history)
+	gen, _, err = s.registry.Create(gen, true)
+	return gen, err
+}
+
+// history returns the messages that ask the model for the notebook of gen in
+// format, or for its cell if gen regenerates one. For an edit, it also
+// returns the notebook being revised.
+func (s *Server) history(gen registry.Generation, format nbsim.Format) ([]llms.MessageContent, *notebooks.Notebook, error) {
+	if gen.EditOf == "" {
+		return s.generationHistory(gen.URL, gen.Referrer, format), nil, nil
+	}
+	nb, err := readNotebook(gen.EditOf)
+	if err != nil {
+		return nil, nil, err
+	}
+	var prompt string
+	if gen.Cell != nil {
+		prompt, err = nbsim.CellPrompt(nb, *gen.Cell, gen.Instruction)
+	} else {
+		prompt, err = nbsim.EditPrompt(nb, gen.Instruction)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	history := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, format.SystemPrompt()),
+		llms.TextParts(llms.ChatMessageTypeHuman, prompt, gen.URL),
+	}
+	if prefill := format.Prefill(); prefill != "" {
+		history = append(history, llms.TextParts(llms.ChatMessageTypeAI, prefill))
+	}
+	return history, nb, nil
+}
+
+// applyEdit applies the patch of response, the model's answer to the edit
+// generation id, to the revised notebook nb and writes the result as the
+// notebook of id. It returns nil if the answer is a full notebook, which the
+// notebook writer has written already.
+func (s *Server) applyEdit(id string, nb *notebooks.Notebook, response string) (*notebooks.Notebook, error) {
+	patch, err := nbsim.ParseEditPatch(response)
+	if err != nil || patch == nil {
+		return nil, err
+	}
+	patched, err := patch.Apply(nb)
+	if err != nil {
+		return nil, err
+	}
+	s.recordValidation(id, patched.Validate())
+	patched.Normalize()
+	b, err := notebooks.Marshal(patched)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path.Join(*flagGenDir, id+".ipynb"), b, 0644); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
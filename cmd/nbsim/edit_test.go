@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
+)
+
+// answerEdits has the replay model answer the edits of url with response,
+// after the json format's prefill.
+func answerEdits(t *testing.T, llm *replay.LLM, url, response string) {
+	t.Helper()
+	name := filepath.Join(llm.Dir, nbsim.GenerationID(url)+replay.LogSuffix)
+	if err := os.WriteFile(name, []byte(strings.TrimPrefix(response, nbsim.FormatJSON.Prefill())), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleEdit(t *testing.T) {
+	const url = "/notebooks/a/edit.ipynb"
+	s, llm := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+	before, err := readNotebook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, last := before.Cells[0].ID, before.Cells[2].ID
+
+	answerEdits(t, llm, url, `{"patch": [`+
+		`{"op": "replace", "id": "`+last+`", "cell": {"cell_type": "markdown", "source": "All done."}},`+
+		`{"op": "insert", "after": "`+first+`", "cell": {"cell_type": "markdown", "source": "## Setup"}}]}`)
+	editID, _ := postJSON(t, srv.URL+"/_edit", map[string]any{"url": url, "instruction": "add a setup heading"})["id"].(string)
+	gen := wait(t, s, editID)
+	if gen.Status != registry.StatusDone || gen.EditOf != id || gen.Instruction != "add a setup heading" {
+		t.Fatalf("edit = %+v, want a done edit of %s", gen, id)
+	}
+	versions := s.registry.Versions(nbsim.GenerationID(url))
+	if len(versions) != 2 || versions[1].ID != editID || versions[1].Version != 2 {
+		t.Fatalf("versions = %+v, want the edit as version 2", versions)
+	}
+	after, err := readNotebook(editID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{
+		{"markdown", "# Fine-tuning\n\nSteps: ünïcode."},
+		{"markdown", "## Setup"},
+		{"code", "import torch\nprint(torch.__version__)"},
+		{"markdown", "All done."},
+	}
+	if got := cellSources(after); !slices.Equal(got, want) {
+		t.Errorf("edited cells = %q, want %q", got, want)
+	}
+	if after.Cells[3].ID != last {
+		t.Errorf("replaced cell ID = %q, want %q", after.Cells[3].ID, last)
+	}
+	if again, err := readNotebook(id); err != nil || !slices.Equal(cellSources(again), cellSources(before)) {
+		t.Errorf("the edit changed the version it revises")
+	}
+
+	// Editing the first version again, now that the edit supersedes it,
+	// revises the first version rather than the edit.
+	answerEdits(t, llm, url, `{"patch": [{"op": "delete", "id": "`+first+`"}]}`)
+	staleID, _ := postJSON(t, srv.URL+"/_edit", map[string]any{"id": id, "instruction": "drop the title"})["id"].(string)
+	gen = wait(t, s, staleID)
+	if gen.Status != registry.StatusDone || gen.EditOf != id || gen.Version != 3 {
+		t.Fatalf("edit of version 1 = %+v, want a done version 3 revising %s", gen, id)
+	}
+	stale, err := readNotebook(staleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cellSources(stale); !slices.Equal(got, cellSources(before)[1:]) {
+		t.Errorf("edit of version 1 cells = %q, want version 1 without its title", got)
+	}
+}
+
+func TestHandleEditErrors(t *testing.T) {
+	const url = "/notebooks/a/edit-errors.ipynb"
+	s, llm := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+	// a version still waiting to be generated
+	pending, _, err := s.registry.Create(registry.Generation{Base: nbsim.GenerationID(url), URL: url, Model: "fake"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []struct {
+		payload string
+		want    int
+	}{
+		{`{"id": "` + id + `"}`, http.StatusBadRequest},
+		{`{"id": "` + id + `", "instruction": `, http.StatusBadRequest},
+		{`{"id": "missing", "instruction": "shorter"}`, http.StatusNotFound},
+		{`{"url": "/notebooks/a/missing.ipynb", "instruction": "shorter"}`, http.StatusNotFound},
+		{`{"id": "` + pending.ID + `", "instruction": "shorter"}`, http.StatusConflict},
+	}
+	for _, tt := range requests {
+		resp, err := http.Post(srv.URL+"/_edit", "application/json", strings.NewReader(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("POST /_edit %s = %s, want %d", tt.payload, resp.Status, tt.want)
+		}
+	}
+	if versions := s.registry.Versions(nbsim.GenerationID(url)); len(versions) != 2 {
+		t.Fatalf("%d versions after rejected edits, want 2", len(versions))
+	}
+
+	// Edits whose patch cannot be applied fail and leave the version they
+	// revise as it was.
+	patches := []struct {
+		name, response, wantErr string
+	}{
+		{"bad cell id", `{"patch": [{"op": "delete", "id": "no-such-cell"}]}`, `no cell "no-such-cell"`},
+		{"malformed patch", `{"patch": [{"op": "replace", "id": 3}]}`, "invalid patch"},
+		{"unknown op", `{"patch": [{"op": "rename", "id": "x", "cell": {}}]}`, `unknown op "rename"`},
+	}
+	for _, tt := range patches {
+		answerEdits(t, llm, url, tt.response)
+		editID, _ := postJSON(t, srv.URL+"/_edit", map[string]any{"id": id, "instruction": tt.name})["id"].(string)
+		gen := wait(t, s, editID)
+		if gen.Status != registry.StatusFailed || !strings.Contains(gen.Error, tt.wantErr) {
+			t.Errorf("%s: edit = %s %q, want failed with %q", tt.name, gen.Status, gen.Error, tt.wantErr)
+		}
+		if gen.Canonical {
+			t.Errorf("%s: failed edit became canonical", tt.name)
+		}
+	}
+	if canonical, _ := s.registry.Canonical(nbsim.GenerationID(url)); canonical.ID != id {
+		t.Errorf("canonical version = %s, want %s", canonical.ID, id)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tmc/nbsim/kernel"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+var (
+	flagExecute        = flag.String("execute", "", "execute the model-written code cells of generated notebooks: subprocess or zmq (off if empty)")
+	flagKernelCmd      = flag.String("kernel-cmd", "", "command starting the kernel; for zmq, {connection_file} is replaced by the connection file path (default: the built-in Python driver for subprocess, ipykernel for zmq)")
+	flagKernelConnFile = flag.String("kernel-connection-file", "", "connect to the running Jupyter kernel described by this connection file instead of starting one; it is not sandboxed")
+	flagCellTimeout    = flag.Duration("cell-timeout", 30*time.Second, "maximum execution time of a code cell")
+	flagExecTimeout    = flag.Duration("exec-timeout", 10*time.Minute, "maximum execution time of a notebook, after which its kernel is killed")
+
+	flagKernelIsolate  = flag.Bool("kernel-isolate", runtime.GOOS == "linux", "run kernels in their own user, network, mount and PID namespaces, without network access (Linux only)")
+	flagKernelUID      = flag.Int("kernel-uid", 0, "run kernels as this user ID, which needs root (0 keeps nbsim's)")
+	flagKernelGID      = flag.Int("kernel-gid", 0, "run kernels as this group ID, which needs root (0 keeps nbsim's)")
+	flagKernelMemory   = flag.Int64("kernel-memory", 0, "address space limit of kernel processes, in MiB (0 for none)")
+	flagKernelFileSize = flag.Int64("kernel-file-size", 100, "size limit of the files kernel processes write, in MiB (0 for none)")
+	flagKernelCPU      = flag.Duration("kernel-cpu", 0, "CPU time limit of kernel processes (0 for none)")
+	flagKernelEnv      = flag.String("kernel-env", "", "comma-separated names of environment variables passed to kernels, which otherwise get only PATH, HOME, TMPDIR and LANG")
+)
+
+// executedID is the notebook ID of the executed version of generation id.
+func executedID(id string) string {
+	return id + ".executed"
+}
+
+// kernelSandbox returns the sandbox of kernels as set by the -kernel flags.
+func kernelSandbox() *kernel.Sandbox {
+	sb := &kernel.Sandbox{
+		CPUTime:  *flagKernelCPU,
+		Memory:   *flagKernelMemory << 20,
+		FileSize: *flagKernelFileSize << 20,
+		UID:      *flagKernelUID,
+		GID:      *flagKernelGID,
+		Isolate:  *flagKernelIsolate,
+	}
+	for _, name := range strings.Split(*flagKernelEnv, ",") {
+		if v, ok := os.LookupEnv(strings.TrimSpace(name)); ok {
+			sb.Env = append(sb.Env, strings.TrimSpace(name)+"="+v)
+		}
+	}
+	return sb
+}
+
+// startKernel starts a fresh kernel for one notebook, in the temporary
+// directory dir so that files written by cells stay out of the generation
+// directory. The kernel is killed when ctx is done.
+func startKernel(ctx context.Context, dir string) (kernel.Kernel, string, error) {
+	argv := strings.Fields(*flagKernelCmd)
+	switch *flagExecute {
+	case "subprocess":
+		if len(argv) == 0 {
+			argv = []string{"python3", "-c", kernel.PythonDriver}
+		}
+		k, err := kernel.Subprocess(ctx, dir, argv, kernelSandbox())
+		return k, "subprocess", err
+	case "zmq":
+		if *flagKernelConnFile != "" {
+			info, err := kernel.ReadConnectionFile(*flagKernelConnFile)
+			if err != nil {
+				return nil, "", err
+			}
+			k, err := kernel.Connect(ctx, info)
+			return k, "zmq:" + *flagKernelConnFile, err
+		}
+		if len(argv) == 0 {
+			argv = []string{"python3", "-m", "ipykernel_launcher", "-f", "{connection_file}"}
+		}
+		k, err := kernel.Launch(ctx, dir, argv, kernelSandbox())
+		return k, "zmq", err
+	default:
+		return nil, "", fmt.Errorf("unknown -execute mode %q (want subprocess or zmq)", *flagExecute)
+	}
+}
+
+// execute runs the code cells of the notebook of gen, a finished generation,
+// and writes the result as its executed version. The execution stops when
+// ctx, the generation's context, is done or after -exec-timeout.
+func (s *Server) execute(ctx context.Context, gen registry.Generation) {
+	if err := s.runExecution(ctx, gen); err != nil {
+		fmt.Println("error executing notebook:", err)
+		if _, rerr := s.registry.FinishExecution(gen.ID, err); rerr != nil {
+			fmt.Println("error recording execution:", rerr)
+		}
+		return
+	}
+	if _, err := s.registry.FinishExecution(gen.ID, nil); err != nil {
+		fmt.Println("error recording execution:", err)
+	}
+}
+
+func (s *Server) runExecution(ctx context.Context, gen registry.Generation) error {
+	ctx, cancel := context.WithTimeoutCause(ctx, *flagExecTimeout, fmt.Errorf("execution did not finish within %v", *flagExecTimeout))
+	defer cancel()
+	nb, err := readNotebook(gen.ID)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "nbsim-exec-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	k, name, err := startKernel(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("starting kernel: %w", err)
+	}
+	defer k.Close()
+	if _, err := s.registry.StartExecution(gen.ID, name); err != nil {
+		return err
+	}
+	executed, err := kernel.Execute(ctx, k, nb, *flagCellTimeout)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	if executed != nil {
+		contents, merr := notebooks.Marshal(executed)
+		if merr != nil {
+			return merr
+		}
+		if werr := os.WriteFile(path.Join(*flagGenDir, executedID(gen.ID)+".ipynb"), contents, 0644); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
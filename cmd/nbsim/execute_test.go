@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// TestExecuteContext checks that executing a notebook stops when the
+// generation's context is done, or after -exec-timeout.
+func TestExecuteContext(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not found")
+	}
+	const url = "/notebooks/a/slow.ipynb"
+	nb, err := notebooks.NewBuilder().Python().
+		Code("import time\ntime.sleep(60)").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(t, map[string]string{url: jsonRecording(t, nb)})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	gen := wait(t, s, id)
+	setFlag(t, flagExecute, "subprocess")
+	setFlag(t, flagKernelIsolate, false)
+	setFlag(t, flagCellTimeout, time.Minute)
+	setFlag(t, flagExecTimeout, time.Minute)
+
+	cause := errors.New("cancelled by the test")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(500*time.Millisecond, func() { cancel(cause) })
+	tests := []struct {
+		ctx     context.Context
+		timeout time.Duration
+		want    string
+	}{
+		{ctx, time.Minute, cause.Error()},
+		{context.Background(), 500 * time.Millisecond, "execution did not finish within 500ms"},
+	}
+	for _, tt := range tests {
+		*flagExecTimeout = tt.timeout
+		start := time.Now()
+		s.execute(tt.ctx, gen)
+		if elapsed := time.Since(start); elapsed > 30*time.Second {
+			t.Errorf("execution stopped after %v", elapsed)
+		}
+		got, _ := s.registry.Get(id)
+		if e := got.Execution; e == nil || e.Status != registry.StatusFailed || !strings.Contains(e.Error, tt.want) {
+			t.Errorf("execution = %+v, want failed with %q", e, tt.want)
+		}
+	}
+}
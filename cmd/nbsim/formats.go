@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/registry"
+)
+
+// formatStats summarizes the generations made in one format.
+type formatStats struct {
+	generations, done, failed, invalid int
+	cells, outputTokens, usageCount    int
+	turns                              int
+	duration                           time.Duration
+}
+
+// runFormats implements the formats subcommand, which compares the
+// generations of each generation format, as picked with -gen-format ab.
+func runFormats(args []string) error {
+	fs := flag.NewFlagSet("formats", flag.ExitOnError)
+	fs.Parse(args)
+
+	reg, err := registry.Open(path.Join(*flagGenDir, "index.json"))
+	if err != nil {
+		return err
+	}
+	return writeFormatStats(os.Stdout, reg)
+}
+
+// writeFormatStats writes a table of the generations of reg per format.
+func writeFormatStats(w io.Writer, reg *registry.Registry) error {
+	stats := map[nbsim.Format]*formatStats{}
+	for _, gen := range reg.List() {
+		format, err := nbsim.ParseFormat(gen.Format)
+		if err != nil {
+			continue
+		}
+		st := stats[format]
+		if st == nil {
+			st = &formatStats{}
+			stats[format] = st
+		}
+		st.generations++
+		switch gen.Status {
+		case registry.StatusFailed:
+			st.failed++
+			continue
+		case registry.StatusDone:
+		default:
+			continue
+		}
+		st.done++
+		st.turns += gen.Turns
+		if len(gen.ValidationErrors) > 0 {
+			st.invalid++
+		}
+		if gen.StartedAt != nil && gen.FinishedAt != nil {
+			st.duration += gen.FinishedAt.Sub(*gen.StartedAt)
+		}
+		if gen.Usage != nil {
+			st.outputTokens += gen.Usage.OutputTokens
+			st.usageCount++
+		}
+		if nb, err := readNotebook(gen.ID); err == nil {
+			st.cells += len(nb.Cells)
+		}
+	}
+
+	formats := make([]string, 0, len(stats))
+	for f := range stats {
+		formats = append(formats, string(f))
+	}
+	sort.Strings(formats)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FORMAT\tGENERATIONS\tDONE\tFAILED\tINVALID\tCELLS/NB\tOUTPUT TOKENS/NB\tTURNS/NB\tDURATION/NB")
+	for _, f := range formats {
+		st := stats[nbsim.Format(f)]
+		turns := "-"
+		if nbsim.Format(f) == nbsim.FormatTools {
+			turns = mean(float64(st.turns), st.done)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", f,
+			st.generations, st.done, st.failed, st.invalid,
+			mean(float64(st.cells), st.done),
+			mean(float64(st.outputTokens), st.usageCount),
+			turns,
+			meanDuration(st.duration, st.done))
+	}
+	return tw.Flush()
+}
+
+func mean(sum float64, n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", sum/float64(n))
+}
+
+func meanDuration(sum time.Duration, n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return (sum / time.Duration(n)).Round(100 * time.Millisecond).String()
+}
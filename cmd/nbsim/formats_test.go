@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/replay"
+)
+
+// formatRecordings are recordings of a model writing the notebook of
+// testNotebook in each generation format.
+func formatRecordings(t *testing.T) map[nbsim.Format]string {
+	t.Helper()
+	var tools []string
+	for _, c := range testNotebook(t).Cells {
+		args, _ := json.Marshal(map[string]string{"cell_type": c.CellType, "source": c.Source.String()})
+		call, _ := json.Marshal(map[string]string{"name": "add_cell", "arguments": string(args)})
+		tools = append(tools, string(call))
+	}
+	return map[nbsim.Format]string{
+		nbsim.FormatJSON: jsonRecording(t, testNotebook(t)),
+		// after the ":::cell" prefill
+		nbsim.FormatCells: " markdown\n# Fine-tuning\n\nSteps: ünïcode.\n:::\n" +
+			":::cell code\nimport torch\nprint(torch.__version__)\n:::\n" +
+			":::cell markdown\nDone.\n:::\n",
+		nbsim.FormatTools: strings.Join(tools, "\n"),
+	}
+}
+
+// TestFormatsRoundTrip generates the same notebook in each generation format
+// and checks that each gives it back and is counted by the formats command.
+func TestFormatsRoundTrip(t *testing.T) {
+	want := cellSources(testNotebook(t))
+	s, llm := newTestServer(t, nil)
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	for format, recording := range formatRecordings(t) {
+		url := "/notebooks/formats/" + string(format) + ".ipynb"
+		if err := os.WriteFile(filepath.Join(llm.Dir, nbsim.GenerationID(url)+replay.LogSuffix), []byte(recording), 0644); err != nil {
+			t.Fatal(err)
+		}
+		setFlag(t, flagFormat, string(format))
+		id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+		gen := wait(t, s, id)
+		if gen.Format != string(format) || gen.Error != "" {
+			t.Errorf("%s: generation = %+v", format, gen)
+			continue
+		}
+		nb, err := readNotebook(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cellSources(nb); !slices.Equal(got, want) {
+			t.Errorf("%s: generated cells %q, want %q", format, got, want)
+		}
+		if errs := nb.Validate(); errs != nil {
+			t.Errorf("%s: generated notebook is invalid:\n%v", format, errs)
+		}
+	}
+
+	var b strings.Builder
+	if err := writeFormatStats(&b, s.registry); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "FORMAT") {
+		t.Fatalf("formats table =\n%s\nwant a header and a row per format", b.String())
+	}
+	for i, format := range []string{"cells", "json", "tools"} {
+		// format, generations, done, failed, invalid, cells per notebook
+		if got := strings.Fields(lines[i+1]); len(got) < 6 || !slices.Equal(got[:6], []string{format, "1", "1", "0", "0", "3.0"}) {
+			t.Errorf("formats row %q, want one valid generation of 3 cells in %s", lines[i+1], format)
+		}
+	}
+	// the replay model makes a call per turn, and a last turn without calls
+	// ends the generation
+	if got := strings.Fields(lines[3]); len(got) < 8 || got[7] != "4.0" {
+		t.Errorf("tools row %q, want 4.0 turns per notebook", lines[3])
+	}
+}
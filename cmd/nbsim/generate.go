@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/registry"
+)
+
+var flagMaxContinuations = flag.Int("max-continuations", 4, "maximum number of requests continuing a notebook cut off by the max-tokens limit")
+
+// maxTokens is the output limit of each request for a notebook.
+const maxTokens = 4096
+
+// generationResult is the outcome of asking the model for a notebook.
+type generationResult struct {
+	Usage *registry.Usage
+	// Continuations is the number of requests that continued the notebook
+	// after the max-tokens limit cut it off.
+	Continuations int
+	// Truncated reports whether the notebook was still cut off after the
+	// last continuation allowed.
+	Truncated bool
+	// Turns is the number of requests of a generation in the tools format.
+	Turns int
+	// Latency is how long the model took to answer, over all requests, and
+	// FirstToken how long until the first token arrived.
+	Latency, FirstToken time.Duration
+	start               time.Time
+}
+
+// addUsage adds the usage reported in info to the result, or if info reports
+// none, the usage estimated for a request of messages answered with output.
+func (r *generationResult) addUsage(info map[string]any, messages []llms.MessageContent, output string) {
+	u := registry.UsageFromGenerationInfo(info)
+	if u == nil {
+		u = estimateUsage(messages, output)
+	}
+	if r.Usage == nil {
+		r.Usage = &registry.Usage{}
+	}
+	r.Usage.InputTokens += u.InputTokens
+	r.Usage.OutputTokens += u.OutputTokens
+	if u.Estimated {
+		r.Usage.Estimated, r.Usage.Estimator = true, u.Estimator
+	}
+}
+
+// tokenArrived records the time to the first token, if it is the first.
+func (r *generationResult) tokenArrived() {
+	if r.FirstToken == 0 {
+		r.FirstToken = time.Since(r.start)
+	}
+}
+
+// generateNotebook asks llm for the notebook of history in format and writes
+// it to nw. The model's output is also written to log, which the fake
+// provider replays.
+//
+// A response cut off by the max-tokens limit is continued by asking again
+// with everything written so far prefilled, up to -max-continuations times.
+func generateNotebook(ctx context.Context, llm llms.Model, history []llms.MessageContent, format nbsim.Format, nw notebookWriter, log io.Writer) (generationResult, error) {
+	res := generationResult{start: time.Now()}
+	var err error
+	if format == nbsim.FormatTools {
+		// Each tool call is its own request, so there is nothing to continue.
+		err = generateWithTools(ctx, llm, history, nw, log, &res)
+	} else {
+		err = generateText(ctx, llm, history, format, nw, log, &res)
+	}
+	res.Latency = time.Since(res.start)
+	return res, err
+}
+
+// generateText is generateNotebook for the formats the model writes as text.
+func generateText(ctx context.Context, llm llms.Model, history []llms.MessageContent, format nbsim.Format, nw notebookWriter, log io.Writer, res *generationResult) error {
+	written := new(strings.Builder)
+	// trimmed is the whitespace a continuation's prefill left off what was
+	// written, which the model may write again.
+	var trimmed string
+	for {
+		messages := history
+		if res.Continuations > 0 {
+			var prefill string
+			prefill, trimmed = trimPrefill(format.Prefill() + written.String())
+			messages = continuationHistory(history, prefill)
+		}
+		// start is where the output of this request begins in written
+		start := written.Len()
+		resp, err := llm.GenerateContent(ctx,
+			messages,
+			llms.WithTemperature(1),
+			llms.WithMaxTokens(maxTokens),
+			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+				res.tokenArrived()
+				var text string
+				text, trimmed = skipRewritten(string(chunk), trimmed)
+				if text == "" {
+					return nil
+				}
+				log.Write([]byte(text))
+				written.WriteString(text)
+				nw.AddPart(text)
+				return nil
+			}),
+		)
+		if err != nil {
+			nw.Flush()
+			if output := written.String()[start:]; output != "" {
+				// the request was cancelled or failed after the model
+				// started answering, which is still paid for
+				res.addUsage(nil, messages, output)
+			}
+			return err
+		}
+		if len(resp.Choices) == 0 {
+			break
+		}
+		res.addUsage(resp.Choices[0].GenerationInfo, messages, resp.Choices[0].Content)
+		if !hitMaxTokens(resp.Choices[0]) {
+			break
+		}
+		if res.Continuations == *flagMaxContinuations {
+			res.Truncated = true
+			break
+		}
+		res.Continuations++
+	}
+	nw.Flush()
+	return nil
+}
+
+// continuationHistory returns history with the response prefilled with
+// partial, the model's output so far, for the model to continue it.
+func continuationHistory(history []llms.MessageContent, partial string) []llms.MessageContent {
+	n := len(history)
+	if n > 0 && history[n-1].Role == llms.ChatMessageTypeAI {
+		// replace the format's prefill, which partial starts with
+		n--
+	}
+	messages := append(history[:n:n], llms.MessageContent{Role: llms.ChatMessageTypeAI})
+	prefill, _ := trimPrefill(partial)
+	messages[n].Parts = []llms.ContentPart{llms.TextContent{Text: prefill}}
+	return messages
+}
+
+// trimPrefill splits partial into the prefill of a continuation and the
+// whitespace it ends in, which Anthropic rejects in prefills.
+func trimPrefill(partial string) (prefill, trimmed string) {
+	prefill = strings.TrimRight(partial, " \t\r\n")
+	return prefill, partial[len(prefill):]
+}
+
+// skipRewritten drops from the start of chunk what the model wrote again of
+// trimmed, the whitespace left off the prefill of a continuation but already
+// written, and returns the rest of chunk and of trimmed. Once the model
+// writes anything else, trimmed is done with.
+func skipRewritten(chunk, trimmed string) (string, string) {
+	n := 0
+	for n < len(chunk) && n < len(trimmed) && chunk[n] == trimmed[n] {
+		n++
+	}
+	if n == len(chunk) {
+		return "", trimmed[n:]
+	}
+	return chunk[n:], ""
+}
+
+// hitMaxTokens reports whether the response stopped at the max-tokens limit,
+// as each provider words it.
+func hitMaxTokens(choice *llms.ContentChoice) bool {
+	switch choice.StopReason {
+	case "max_tokens", "length", "FinishReasonMaxTokens":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/replay"
+)
+
+// replayHistory returns the request history of a generation of url in the
+// json format, and a directory where the replay model finds recording as the
+// answer to it.
+func replayHistory(t *testing.T, url, recording string) ([]llms.MessageContent, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, nbsim.GenerationID(url)+replay.LogSuffix), []byte(recording), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "system prompt"),
+		llms.TextParts(llms.ChatMessageTypeHuman, url),
+		llms.TextParts(llms.ChatMessageTypeAI, nbsim.FormatJSON.Prefill()),
+	}, dir
+}
+
+// TestContinuations checks that a notebook cut off by the max-tokens limit
+// is continued until it is complete, whatever the whitespace the cuts fall
+// in, which continuations leave off their prefill.
+func TestContinuations(t *testing.T) {
+	recording := jsonRecording(t, testNotebook(t))
+	history, dir := replayHistory(t, "/notebooks/long.ipynb", recording)
+	setFlag(t, flagMaxContinuations, len(recording))
+	for maxBytes := 16; maxBytes < 48; maxBytes++ {
+		llm := &replay.LLM{Dir: dir, ChunkSize: 3, MaxBytes: maxBytes}
+		nw := nbsim.NewNotebookWriter(t.TempDir(), "gen", nbsim.FormatJSON)
+		var log strings.Builder
+		res, err := generateNotebook(context.Background(), llm, history, nbsim.FormatJSON, nw, &log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log.String() != recording {
+			t.Fatalf("MaxBytes %d: continued notebook =\n%s\nwant\n%s", maxBytes, log.String(), recording)
+		}
+		if min := len(recording)/maxBytes - 1; res.Continuations < min || res.Truncated {
+			t.Errorf("MaxBytes %d: %d continuations, truncated %v; want at least %d, not truncated", maxBytes, res.Continuations, res.Truncated, min)
+		}
+	}
+}
+
+func TestContinuationsLimit(t *testing.T) {
+	recording := jsonRecording(t, testNotebook(t))
+	history, dir := replayHistory(t, "/notebooks/long.ipynb", recording)
+	setFlag(t, flagMaxContinuations, 2)
+	llm := &replay.LLM{Dir: dir, ChunkSize: 16, MaxBytes: 40}
+	nw := nbsim.NewNotebookWriter(t.TempDir(), "gen", nbsim.FormatJSON)
+	var log strings.Builder
+	res, err := generateNotebook(context.Background(), llm, history, nbsim.FormatJSON, nw, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Continuations != 2 || !res.Truncated {
+		t.Errorf("%d continuations, truncated %v; want 2, truncated", res.Continuations, res.Truncated)
+	}
+	if got := log.String(); !strings.HasPrefix(recording, got) || len(got) > 3*llm.MaxBytes || len(got) < 2*llm.MaxBytes {
+		t.Errorf("truncated notebook = %q, want the first three responses of %q", got, recording)
+	}
+}
+
+// cancelAfter is a log that cancels its generation once n bytes are written.
+type cancelAfter struct {
+	strings.Builder
+	n      int
+	cancel context.CancelFunc
+}
+
+func (w *cancelAfter) Write(p []byte) (int, error) {
+	if w.Len() >= w.n {
+		w.cancel()
+	}
+	return w.Builder.Write(p)
+}
+
+// TestGenerateCancelledUsage checks that a request cancelled while the model
+// answers records the usage of what the model wrote.
+func TestGenerateCancelledUsage(t *testing.T) {
+	recording := jsonRecording(t, testNotebook(t))
+	history, dir := replayHistory(t, "/notebooks/cancelled.ipynb", recording)
+	llm := &replay.LLM{Dir: dir, ChunkSize: 16, Delay: time.Millisecond}
+	nw := nbsim.NewNotebookWriter(t.TempDir(), "gen", nbsim.FormatJSON)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := &cancelAfter{n: 64, cancel: cancel}
+	res, err := generateNotebook(ctx, llm, history, nbsim.FormatJSON, nw, log)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("generation error = %v, want it cancelled", err)
+	}
+	if len(log.String()) >= len(recording) {
+		t.Fatalf("the cancelled generation wrote the whole notebook")
+	}
+	if res.Usage == nil {
+		t.Fatal("the cancelled generation recorded no usage")
+	}
+	counter := tokens()
+	if res.Usage.Estimator == charCounter.name {
+		// estimated before the encoding loaded
+		counter = charCounter
+	}
+	want := counter.estimate(history, log.String())
+	if res.Usage.OutputTokens != want.OutputTokens || res.Usage.InputTokens != want.InputTokens {
+		t.Errorf("usage = %+v, want %+v for the partial answer", res.Usage, want)
+	}
+}
+
+func TestSkipRewritten(t *testing.T) {
+	tests := []struct {
+		chunk, trimmed      string
+		wantChunk, wantRest string
+	}{
+		{`"cells"`, "", `"cells"`, ""},
+		{"\n  \"cells\"", "\n  ", `"cells"`, ""},
+		{"\n", "\n  ", "", "  "},
+		{"\n \n", "\n  ", "\n", ""},
+		{`"cells"`, "\n", `"cells"`, ""},
+	}
+	for _, tt := range tests {
+		chunk, rest := skipRewritten(tt.chunk, tt.trimmed)
+		if chunk != tt.wantChunk || rest != tt.wantRest {
+			t.Errorf("skipRewritten(%q, %q) = %q, %q; want %q, %q", tt.chunk, tt.trimmed, chunk, rest, tt.wantChunk, tt.wantRest)
+		}
+	}
+}
+
+// TestContinuationMetadata checks that the continuations of a generation are
+// recorded in the registry and the notebook's metadata.
+func TestContinuationMetadata(t *testing.T) {
+	const url = "/notebooks/a/long.ipynb"
+	s, llm := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	llm.MaxBytes = 64
+	setFlag(t, flagMaxContinuations, 1)
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	gen := wait(t, s, id)
+	if gen.Continuations != 1 || !gen.Truncated {
+		t.Errorf("generation has %d continuations, truncated %v; want 1, truncated", gen.Continuations, gen.Truncated)
+	}
+	nb, err := readNotebook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := nbsim.ReadGenerationMetadata(nb); m.Continuations != 1 || !m.Truncated {
+		t.Errorf("notebook metadata has %d continuations, truncated %v; want 1, truncated", m.Continuations, m.Truncated)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/tmc/nbsim/linkgraph"
+	"github.com/tmc/nbsim/registry"
+)
+
+// buildGraph builds the link graph of the notebooks in the registry. Each URL
+// is represented by its canonical version, or its latest version if it has no
+// canonical one.
+func buildGraph(reg *registry.Registry) *linkgraph.Graph {
+	latest := map[string]registry.Generation{}
+	var bases []string
+	for _, gen := range reg.List() {
+		cur, ok := latest[gen.Base]
+		if !ok {
+			bases = append(bases, gen.Base)
+		}
+		if !ok || !cur.Canonical && (gen.Canonical || gen.Version > cur.Version) {
+			latest[gen.Base] = gen
+		}
+	}
+	var pages []linkgraph.Page
+	for _, base := range bases {
+		gen := latest[base]
+		page := linkgraph.Page{URL: gen.URL, ID: gen.ID}
+		if gen.Status == registry.StatusDone {
+			nb, err := readNotebook(gen.ID)
+			if err != nil {
+				fmt.Println("error reading notebook:", err)
+			} else {
+				page.Notebook = nb
+			}
+		}
+		pages = append(pages, page)
+	}
+	return linkgraph.Build(pages)
+}
+
+func (s *Server) handleGraph(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	buildGraph(s.registry).WriteJSON(w)
+}
+
+// runGraph implements the graph subcommand, which exports the link graph of
+// the generation directory.
+func runGraph(args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := fs.String("format", "dot", "output format: dot or json")
+	fs.Parse(args)
+
+	reg, err := registry.Open(path.Join(*flagGenDir, "index.json"))
+	if err != nil {
+		return err
+	}
+	g := buildGraph(reg)
+	switch *format {
+	case "dot":
+		return g.WriteDOT(os.Stdout)
+	case "json":
+		return g.WriteJSON(os.Stdout)
+	}
+	return fmt.Errorf("unknown graph format %q", *format)
+}
@@ -3,26 +3,42 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand/v2"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/cors"
 	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/llms/anthropic"
 	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/nbhtml"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
 )
 
 var (
-	flagServe  = flag.Bool("serve", true, "run in serve mode")
-	flagModel  = flag.String("model", "claude-3-opus-20240229", "model to use")
-	flagGenDir = flag.String("gen-dir", "generated", "directory to write generated notebooks to")
+	flagServe    = flag.Bool("serve", true, "run in serve mode")
+	flagProvider = flag.String("provider", "anthropic", "LLM provider to use (anthropic, openai, ollama, googleai, fake)")
+	flagModel    = flag.String("model", "", "model to use (overrides the provider's -<provider>-model flag)")
+	flagGenDir   = flag.String("gen-dir", "generated", "directory to write generated notebooks to")
+	flagWorkers  = flag.Int("workers", 2, "number of notebooks generated at once; further generations wait in a queue")
+	flagIdle     = flag.Duration("idle-timeout", 5*time.Minute, "cancel generations whose events nobody has watched for this long (0 never cancels)")
+	flagFormat   = flag.String("gen-format", "json", "format the model writes notebooks in: json, cells, tools (one add_cell tool call per cell), or ab to pick json or cells at random per generation")
+
+	flagNbconvert = flag.Bool("nbconvert", false, "render notebooks with jupyter nbconvert instead of the built-in renderer")
 )
 
 func main() {
@@ -35,41 +51,121 @@ func main() {
 
 func run() error {
 	ctx := context.Background()
-	llm, err := anthropic.New(
-		anthropic.WithModel(*flagModel),
-	)
+	if flag.Arg(0) == "graph" {
+		return runGraph(flag.Args()[1:])
+	}
+	if flag.Arg(0) == "convert" {
+		return runConvert(flag.Args()[1:])
+	}
+	if flag.Arg(0) == "formats" {
+		return runFormats(flag.Args()[1:])
+	}
+	if *flagFormat == string(nbsim.FormatTools) && !supportsTools(*flagProvider) {
+		return fmt.Errorf("the %s provider does not support tools, which -gen-format tools needs", *flagProvider)
+	}
+	llm, model, err := newLLM(ctx, *flagProvider, *flagModel)
 	if err != nil {
 		return err
 	}
 
+	if flag.Arg(0) == "cell" {
+		return runCell(llm, model, flag.Args()[1:])
+	}
 	if *flagServe {
-		return serve(ctx, llm)
+		return serve(ctx, llm, model)
 	} else {
-		return repl(ctx, llm)
+		return repl(ctx, llm, model)
 	}
 }
 
 type Server struct {
-	llm              llms.Model
-	alreadyGenerated map[string]string
+	llm       llms.Model
+	model     string
+	registry  *registry.Registry
+	events    *nbsim.EventHub
+	scheduler *nbsim.Scheduler
+	prices    priceTable // of -prices, for /_stats
+
+	// mu makes looking for a running generation of a notebook and
+	// creating one atomic.
+	mu sync.Mutex
+
+	jobsMu sync.Mutex
+	jobs   map[string]*generationJob // queued and running generations by ID
+}
+
+// newServer returns a server of the generations recorded in -gen-dir.
+func newServer(llm llms.Model, model string) (*Server, error) {
+	if err := os.MkdirAll(*flagGenDir, 0755); err != nil {
+		return nil, err
+	}
+	reg, err := registry.Open(path.Join(*flagGenDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		llm:       llm,
+		model:     model,
+		registry:  reg,
+		events:    nbsim.NewEventHub(),
+		scheduler: nbsim.NewScheduler(*flagWorkers),
+		jobs:      map[string]*generationJob{},
+	}
+	s.scheduler.OnQueue = func(id string, position int) {
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventQueued, Index: position})
+	}
+	s.migrateVersionFiles()
+	return s, nil
 }
 
-func serve(ctx context.Context, llm llms.Model) error {
+func serve(ctx context.Context, llm llms.Model, model string) error {
 	ch := cors.AllowAll()
 
-	s := &Server{
-		llm:              llm,
-		alreadyGenerated: map[string]string{},
+	s, err := newServer(llm, model)
+	if err != nil {
+		return err
+	}
+	if s.prices, err = loadPrices(*flagPrices); err != nil {
+		return err
+	}
+	s.resume()
+	if *flagIdle > 0 {
+		go s.cancelIdle(*flagIdle)
 	}
 	assetsFS, err := nbsim.GetViewerFileAssets()
 	if err != nil {
 		return err
 	}
-	assetServer := handleAssetsWithRootFallback(assetsFS)
+	return http.ListenAndServe(":8080", ch.Handler(s.handler(handleAssetsWithRootFallback(assetsFS))))
+}
 
-	http.HandleFunc("/_gen", s.handleGen)
-	http.Handle("/", nbsim.NewNotebookConversionHandler(*flagGenDir, assetServer))
-	return http.ListenAndServe(":8080", ch.Handler(http.DefaultServeMux))
+// handler returns the handler of the server's endpoints and of the generated
+// notebooks, which serves assets for the paths of no notebook.
+func (s *Server) handler(assets http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_gen", s.handleGen)
+	mux.HandleFunc("DELETE /_gen/{id}", s.handleCancel)
+	mux.Handle("/_events/{id}", s.events)
+	mux.HandleFunc("POST /_edit", s.handleEdit)
+	mux.HandleFunc("POST /_cell", s.handleCell)
+	mux.HandleFunc("/_generations", s.handleGenerations)
+	mux.HandleFunc("/_generations/{id}", s.handleGeneration)
+	mux.HandleFunc("GET /_graph", s.handleGraph)
+	mux.HandleFunc("GET /_stats", s.handleStats)
+	mux.HandleFunc("GET /_versions/{base}", s.handleVersions)
+	mux.HandleFunc("GET /_versions/{base}/compare", s.handleCompareVersions)
+	mux.HandleFunc("POST /_versions/{base}/canonical", s.handleSetCanonical)
+	mux.HandleFunc("/_nbhtml.css", handleNotebookCSS)
+	nbHandler := nbsim.NewNotebookConversionHandler(*flagGenDir, assets)
+	nbHandler.UseNbconvert = *flagNbconvert
+	nbHandler.Events = s.events
+	mux.Handle("/", nbHandler)
+	return mux
+}
+
+func handleNotebookCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	nbhtml.New(nil).WriteCSS(w)
 }
 
 func handleAssetsWithRootFallback(assets fs.FS) http.Handler {
@@ -90,39 +186,56 @@ func handleAssetsWithRootFallback(assets fs.FS) http.Handler {
 	})
 }
 
-func repl(ctx context.Context, llm llms.Model) error {
-	scanner := bufio.NewScanner(os.Stdin)
-	history := []llms.MessageContent{
-		llms.TextParts(llms.ChatMessageTypeSystem, nbsim.SystemPrompt),
+// repl generates a new version of the notebook of each URL read from stdin.
+// A line ":edit <instruction>" instead revises the notebook generated last
+// as a new version of it, and ":cell <index> [instruction]" regenerates one
+// of its cells.
+func repl(ctx context.Context, llm llms.Model, model string) error {
+	s, err := newServer(llm, model)
+	if err != nil {
+		return err
 	}
-	nw := nbsim.NewNotebookWriter(*flagGenDir, "generated")
+	scanner := bufio.NewScanner(os.Stdin)
+	var last registry.Generation
 	for {
-		ctx, cancelFn := context.WithCancel(ctx)
 		fmt.Print("$ ")
 		if !scanner.Scan() {
 			break
 		}
 		input := strings.TrimSpace(scanner.Text())
 		if input == "" {
-			cancelFn()
 			continue
 		}
-		history = append(history, llms.TextParts(llms.ChatMessageTypeHuman, input))
-		history = append(history, llms.TextParts(llms.ChatMessageTypeAI, "{"))
-		_, err := llm.GenerateContent(ctx,
-			history,
-			llms.WithTemperature(1),
-			llms.WithMaxTokens(4096),
-			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-				nw.AddPart(string(chunk))
-				return nil
-			}),
-		)
-		cancelFn()
+		var gen registry.Generation
+		if cmd, ok := strings.CutPrefix(input, ":"); ok && last.ID == "" {
+			fmt.Println("no notebook to edit yet:", cmd)
+			continue
+		}
+		if instruction, ok := strings.CutPrefix(input, ":edit "); ok {
+			gen, err = s.createEdit(last, instruction, nil)
+		} else if args, ok := strings.CutPrefix(input, ":cell "); ok {
+			index, instruction, _ := strings.Cut(strings.TrimSpace(args), " ")
+			i, aerr := strconv.Atoi(index)
+			if aerr != nil {
+				fmt.Println("invalid cell index:", aerr)
+				continue
+			}
+			gen, err = s.createEdit(last, instruction, &i)
+		} else {
+			gen, _, err = s.createGeneration(input, "", true)
+		}
+		if errors.Is(err, nbsim.ErrNoCell) {
+			fmt.Println(err)
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		fmt.Println()
+		s.generate(ctx, gen)
+		if gen, _ = s.registry.Get(gen.ID); gen.Status == registry.StatusDone {
+			last = gen
+		}
+		fmt.Println("\nwrote", path.Join(*flagGenDir, gen.ID+".ipynb"))
 	}
 	return nil
 }
@@ -134,70 +247,288 @@ func (s *Server) handleGen(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// md5 the url to get a unique identifier:
-	nbBase := fmt.Sprintf("gen-%x", md5.Sum([]byte(payload["url"].(string))))
-	nbHTMLPath := fmt.Sprintf("%s.html", nbBase)
-
-	nw := nbsim.NewNotebookWriter(*flagGenDir, nbBase)
-	nw.TouchOutputFile()
-
-	if s.isAlreadyGenerated(nbBase) {
-		json.NewEncoder(w).Encode(map[string]string{"url": nbHTMLPath})
+	input, ok := payload["url"].(string)
+	if !ok {
+		input = "/notebooks/super-hyped/finetune-llama-7.ipynb"
+	}
+	regenerate, _ := payload["regenerate"].(bool)
+	referrer, _ := payload["referrer"].(string)
+	gen, created, err := s.submitGeneration(input, referrer, regenerate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if created {
+		fmt.Println("generating notebook", gen.ID, "for", input)
+	} else if !gen.Active() && !s.events.Has(gen.ID) {
+		s.publishGenerated(gen.ID)
+	}
+	s.respondGeneration(w, gen)
+}
+
+// respondGeneration responds with gen, the URL of its notebook and its queue
+// position, 0 unless it waits for a worker.
+func (s *Server) respondGeneration(w http.ResponseWriter, gen registry.Generation) {
+	nbHTMLPath := fmt.Sprintf("%s.html", gen.ID)
+	json.NewEncoder(w).Encode(map[string]any{
+		"url":        nbHTMLPath,
+		"id":         gen.ID,
+		"generation": gen,
+		"position":   s.scheduler.Position(gen.ID),
+	})
+}
 
-	s.setAlreadyGenerated(nbBase, nbHTMLPath)
-	fmt.Println("generating notebook", nbBase, "for", payload["url"])
+// submitGeneration is like createGeneration but queues the new generation,
+// and if a generation of the notebook is queued or running already, it is
+// returned instead so that concurrent viewers share it.
+func (s *Server) submitGeneration(url, referrer string, regenerate bool) (registry.Generation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.scheduler.Active(nbsim.GenerationID(url)); ok {
+		if gen, ok := s.registry.Get(id); ok {
+			return gen, false, nil
+		}
+	}
+	gen, created, err := s.createGeneration(url, referrer, regenerate)
+	if err != nil || !created {
+		return gen, false, err
+	}
+	s.enqueue(gen)
+	return gen, true, nil
+}
 
-	go func() {
-		ctx, cancelFn := context.WithCancel(context.Background())
-		defer cancelFn()
+// createGeneration records a new pending version of the notebook at url
+// unless regenerate is false and the notebook has a canonical version, which
+// is returned instead.
+func (s *Server) createGeneration(url, referrer string, regenerate bool) (registry.Generation, bool, error) {
+	format, err := generationFormat()
+	if err != nil {
+		return registry.Generation{}, false, err
+	}
+	return s.registry.Create(registry.Generation{
+		Base:       nbsim.GenerationID(url),
+		URL:        url,
+		Referrer:   referrer,
+		Model:      s.model,
+		Format:     string(format),
+		PromptHash: promptHash(s.generationHistory(url, referrer, format)),
+	}, regenerate)
+}
 
-		input, ok := payload["url"].(string)
-		if !ok {
-			input = "/notebooks/super-hyped/finetune-llama-7.ipynb"
+// generationFormat returns the format of a new generation as set by the
+// -gen-format flag. With "ab", each generation gets json or cells at random
+// so that the two can be compared with the formats subcommand.
+func generationFormat() (nbsim.Format, error) {
+	if *flagFormat == "ab" {
+		if rand.IntN(2) == 0 {
+			return nbsim.FormatJSON, nil
 		}
-		history := []llms.MessageContent{
-			llms.TextParts(llms.ChatMessageTypeSystem, nbsim.SystemPrompt),
-			llms.TextParts(llms.ChatMessageTypeHuman, input),
-			llms.TextParts(llms.ChatMessageTypeAI, "{"),
+		return nbsim.FormatCells, nil
+	}
+	return nbsim.ParseFormat(*flagFormat)
+}
+
+// generationHistory returns the messages that ask the model for the notebook
+// at url in format. If the notebook at referrer has been generated, a
+// condensed form of it precedes the url.
+func (s *Server) generationHistory(url, referrer string, format nbsim.Format) []llms.MessageContent {
+	human := []string{url}
+	if ctx := s.referrerContext(referrer, url); ctx != "" {
+		human = []string{ctx, url}
+	}
+	history := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, format.SystemPrompt()),
+		llms.TextParts(llms.ChatMessageTypeHuman, human...),
+	}
+	if prefill := format.Prefill(); prefill != "" {
+		history = append(history, llms.TextParts(llms.ChatMessageTypeAI, prefill))
+	}
+	return history
+}
+
+// referrerContext returns the condensed canonical notebook of referrer, which
+// may be given as a full URL or as the path the notebook was requested with.
+func (s *Server) referrerContext(referrer, url string) string {
+	if referrer == "" {
+		return ""
+	}
+	candidates := []string{referrer}
+	if u, err := neturl.Parse(referrer); err == nil && u.Host != "" {
+		candidates = append(candidates, u.RequestURI())
+	}
+	for _, candidate := range candidates {
+		gen, ok := s.registry.Canonical(nbsim.GenerationID(candidate))
+		if !ok || gen.Status != registry.StatusDone {
+			continue
 		}
-		// open log file for append:
-		lf, err := os.OpenFile(path.Join(*flagGenDir, nbBase+".claude.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			fmt.Println("error opening log file:", err)
-		}
-		_, err = s.llm.GenerateContent(ctx,
-			history,
-			llms.WithTemperature(1),
-			llms.WithMaxTokens(4096),
-			llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-				// append to .claude.log:
-				if lf != nil {
-					lf.Write(chunk)
-				}
-				nw.AddPart(string(chunk))
-				return nil
-			}),
-		)
+		nb, err := readNotebook(gen.ID)
 		if err != nil {
-			fmt.Println("error generating content:", err)
-			return
+			fmt.Println("error reading referrer notebook:", err)
+			continue
 		}
-	}()
-	json.NewEncoder(w).Encode(map[string]string{"url": nbHTMLPath})
+		return nbsim.ReferrerContext(gen.URL, nb, url)
+	}
+	return ""
+}
+
+// promptHash identifies the prompt a generation was made with.
+func promptHash(history []llms.MessageContent) string {
+	h := sha256.New()
+	for _, m := range history {
+		fmt.Fprintf(h, "%s\n", m.Role)
+		for _, part := range m.Parts {
+			if t, ok := part.(llms.TextContent); ok {
+				fmt.Fprintf(h, "%s\n", t.Text)
+			}
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func (s *Server) isAlreadyGenerated(key string) bool {
-	_, ok := s.alreadyGenerated[key]
+// generate runs the registered generation gen and records its outcome in the
+// registry.
+func (s *Server) generate(ctx context.Context, gen registry.Generation) {
+	if gen.Cell != nil {
+		s.generateCell(ctx, gen)
+		return
+	}
+	id := gen.ID
+	if _, err := s.registry.Start(id); err != nil {
+		fmt.Println("error starting generation:", err)
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventError, Error: err.Error()})
+		return
+	}
+	format, err := nbsim.ParseFormat(gen.Format)
+	if err != nil {
+		fmt.Println("error starting generation:", err)
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventError, Error: err.Error()})
+		return
+	}
+	nw := nbsim.NewNotebookWriter(*flagGenDir, id, format)
+	nw.OnEvent = func(e nbsim.Event) {
+		s.events.Publish(id, e)
+	}
+	nw.TouchOutputFile()
+
+	// open log file, replacing the log of an earlier attempt:
+	var log io.Writer = io.Discard
+	lf, err := os.Create(path.Join(*flagGenDir, id+replay.LogSuffix))
+	if err != nil {
+		fmt.Println("error opening log file:", err)
+	} else {
+		defer lf.Close()
+		log = lf
+	}
+	history, edited, err := s.history(gen, format)
+	var res generationResult
+	response := new(strings.Builder)
+	if err == nil && ctx.Err() == nil {
+		res, err = generateNotebook(ctx, s.llm, history, format, nw, io.MultiWriter(log, response))
+	}
+	cancelled := ctx.Err() != nil
+	if cancelled {
+		err = context.Cause(ctx)
+		if merr := s.markCancelled(id, err); merr != nil {
+			fmt.Println("error marking notebook cancelled:", merr)
+		}
+	}
+	if res.Truncated {
+		fmt.Printf("generated notebook %s is still cut off after %d continuations\n", id, res.Continuations)
+	}
+	var patched *notebooks.Notebook
+	if err == nil && edited != nil {
+		patched, err = s.applyEdit(id, edited, format.Prefill()+response.String())
+	}
+	s.recordResult(gen, res)
+	if err == nil && patched == nil {
+		s.recordValidation(id, nw.Validate())
+	}
+	gen, rerr := s.registry.Finish(id, res.Usage, err)
+	if rerr != nil {
+		fmt.Println("error recording generation:", rerr)
+	} else if gen.Canonical {
+		if err := s.writeCanonical(gen); err != nil {
+			fmt.Println("error writing canonical notebook:", err)
+		}
+	}
+	switch {
+	case cancelled:
+		s.events.Publish(id, nbsim.Event{Type: nbsim.EventCancelled, Error: err.Error()})
+	case patched != nil:
+		// the patch streamed no cells
+		s.events.PublishNotebook(id, patched)
+	default:
+		nw.Finish(err)
+	}
+	if cancelled {
+		fmt.Println("stopped generation", id+":", err)
+		return
+	}
+	if err != nil {
+		fmt.Println("error generating content:", err)
+		return
+	}
+	if *flagExecute != "" {
+		s.execute(ctx, gen)
+	}
+}
+
+// recordValidation records the schema violations of a generated notebook.
+func (s *Server) recordValidation(id string, errs notebooks.ValidationErrors) {
+	if len(errs) == 0 {
+		return
+	}
+	fmt.Printf("generated notebook %s is not valid nbformat (%d errors):\n%v\n", id, len(errs), errs)
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	if _, err := s.registry.Update(id, func(g *registry.Generation) {
+		g.ValidationErrors = msgs
+	}); err != nil {
+		fmt.Println("error recording validation errors:", err)
+	}
+}
+
+// resume restarts the generations that were pending or running when the
+// server last stopped.
+func (s *Server) resume() {
+	for _, gen := range s.registry.List() {
+		if !gen.Active() {
+			continue
+		}
+		fmt.Println("resuming generation", gen.ID, "for", gen.URL)
+		if !s.enqueue(gen) {
+			err := errors.New("superseded by another generation of the notebook")
+			if _, err := s.registry.Finish(gen.ID, nil, err); err != nil {
+				fmt.Println("error recording generation:", err)
+			}
+		}
+	}
+}
+
+func (s *Server) handleGenerations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.registry.List())
+}
+
+func (s *Server) handleGeneration(w http.ResponseWriter, r *http.Request) {
+	gen, ok := s.registry.Get(r.PathValue("id"))
 	if !ok {
-		// stat the file to see if it exists:
-		_, err := os.Stat(path.Join(*flagGenDir, key+".ipynb"))
-		ok = err == nil
+		http.Error(w, registry.ErrNotFound.Error(), http.StatusNotFound)
+		return
 	}
-	return ok
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gen)
 }
 
-func (s *Server) setAlreadyGenerated(key, value string) {
-	s.alreadyGenerated[key] = value
+// publishGenerated publishes the events of a notebook generated by an earlier
+// run so that event subscribers can render it.
+func (s *Server) publishGenerated(key string) {
+	nb, err := readNotebook(key)
+	if err != nil {
+		s.events.Publish(key, nbsim.Event{Type: nbsim.EventError, Error: err.Error()})
+		return
+	}
+	s.events.PublishNotebook(key, nb)
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
+)
+
+// setFlag sets the flag at p to v for the duration of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// newTestServer returns a server generating into a new -gen-dir with the
+// replay model, which replays recordings by the URL they answer.
+func newTestServer(t *testing.T, recordings map[string]string) (*Server, *replay.LLM) {
+	t.Helper()
+	setFlag(t, flagGenDir, t.TempDir())
+	setFlag(t, flagFormat, "json")
+	setFlag(t, flagExecute, "")
+	dir := t.TempDir()
+	for url, recording := range recordings {
+		name := filepath.Join(dir, nbsim.GenerationID(url)+replay.LogSuffix)
+		if err := os.WriteFile(name, []byte(recording), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	llm := &replay.LLM{Dir: dir, ChunkSize: 16}
+	s, err := newServer(llm, "fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.prices, err = loadPrices(""); err != nil {
+		t.Fatal(err)
+	}
+	return s, llm
+}
+
+// jsonRecording returns the recording of a model writing nb in the json
+// format, which the format's prefill starts.
+func jsonRecording(t *testing.T, nb *notebooks.Notebook) string {
+	t.Helper()
+	b, err := notebooks.Marshal(nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(string(b), nbsim.FormatJSON.Prefill())
+}
+
+func testNotebook(t *testing.T) *notebooks.Notebook {
+	t.Helper()
+	nb, err := notebooks.NewBuilder().Python().
+		Markdown("# Fine-tuning\n\nSteps: ünïcode.").
+		Code("import torch\nprint(torch.__version__)").
+		Markdown("Done.").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nb
+}
+
+func postJSON(t *testing.T, url string, payload any) map[string]any {
+	t.Helper()
+	b, _ := json.Marshal(payload)
+	resp, err := http.Post(url, "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST %s = %s", url, resp.Status)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// watch returns the types of the events of generation id up to the one that
+// ends it.
+func watch(t *testing.T, srv *httptest.Server, id string) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/_events/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var types []string
+	for scanner := bufio.NewScanner(resp.Body); scanner.Scan(); {
+		typ, ok := strings.CutPrefix(scanner.Text(), "event: ")
+		if !ok {
+			continue
+		}
+		types = append(types, typ)
+		switch typ {
+		case nbsim.EventFinished, nbsim.EventCancelled, nbsim.EventError:
+			return types
+		}
+	}
+	t.Fatalf("events of %s ended without the generation: %q", id, types)
+	return nil
+}
+
+// wait waits for the scheduler to finish the generation id.
+func wait(t *testing.T, s *Server, id string) registry.Generation {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if gen, ok := s.registry.Get(id); ok && !gen.Active() && s.scheduler.Position(id) == 0 {
+			s.jobsMu.Lock()
+			_, running := s.jobs[id]
+			s.jobsMu.Unlock()
+			if !running {
+				return gen
+			}
+		}
+	}
+	t.Fatalf("generation %s did not finish", id)
+	return registry.Generation{}
+}
+
+func TestHandleGen(t *testing.T) {
+	const url = "/notebooks/a/fine-tuning.ipynb"
+	want := testNotebook(t)
+	s, _ := newTestServer(t, map[string]string{url: jsonRecording(t, want)})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+
+	body := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})
+	id, _ := body["id"].(string)
+	if id == "" || body["url"] != id+".html" {
+		t.Fatalf("/_gen = %v, want the id and the URL of the notebook", body)
+	}
+	types := watch(t, srv, id)
+	if types[len(types)-1] != nbsim.EventFinished {
+		t.Fatalf("events = %q, want the generation to finish", types)
+	}
+	cells := 0
+	for _, typ := range types {
+		if typ == nbsim.EventCellDone {
+			cells++
+		}
+	}
+	if cells != len(want.Cells) {
+		t.Errorf("%d cell-completed events, want %d", cells, len(want.Cells))
+	}
+
+	gen := wait(t, s, id)
+	if gen.Status != registry.StatusDone || !gen.Canonical || gen.URL != url || gen.Model != "fake" {
+		t.Errorf("generation = %+v, want a canonical done generation of %s by fake", gen, url)
+	}
+	nb, err := readNotebook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nb.Cells) != len(want.Cells) {
+		t.Fatalf("notebook has %d cells, want %d", len(nb.Cells), len(want.Cells))
+	}
+	for i := range nb.Cells {
+		if got, want := nb.Cells[i].Source.String(), want.Cells[i].Source.String(); got != want {
+			t.Errorf("cell %d source = %q, want %q", i, got, want)
+		}
+	}
+
+	// The page is served, and asking again returns the canonical
+	// notebook rather than generating another.
+	resp, err := http.Get(srv.URL + "/" + id + ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET of the notebook page = %s", resp.Status)
+	}
+	if again := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url}); again["id"] != id {
+		t.Errorf("/_gen again = %v, want generation %s", again["id"], id)
+	}
+	if versions := s.registry.Versions(gen.Base); len(versions) != 1 {
+		t.Errorf("%d versions after asking again, want 1", len(versions))
+	}
+}
+
+// TestReferrerContext checks that the notebook a generation was linked from
+// is found by its URL, absolute as browsers send it or a path.
+func TestReferrerContext(t *testing.T) {
+	const url = "/notebooks/a/referrer.ipynb"
+	s, _ := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+
+	tests := []struct {
+		referrer string
+		want     bool
+	}{
+		{"http://localhost:5173" + url, true},
+		{url, true},
+		{"", false},
+		{"/notebooks/a/unknown.ipynb", false},
+		{"http://localhost:5173/notebooks/a/unknown.ipynb", false},
+	}
+	for _, tt := range tests {
+		got := s.referrerContext(tt.referrer, "/notebooks/a/next.ipynb")
+		if want := `<referrer url="` + url + `">`; tt.want != strings.HasPrefix(got, want) || !tt.want && got != "" {
+			t.Errorf("referrerContext(%q) = %q, want context: %v", tt.referrer, got, tt.want)
+		}
+		if tt.want && !strings.Contains(got, "Title: Fine-tuning") {
+			t.Errorf("referrerContext(%q) lacks the referrer's title:\n%s", tt.referrer, got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/anthropic"
+	"github.com/tmc/langchaingo/llms/googleai"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+	"github.com/tmc/nbsim/replay"
+)
+
+// provider builds the llms.Model for one backend.
+type provider struct {
+	model  *string
+	newLLM func(ctx context.Context, model string) (llms.Model, error)
+	// tools reports whether the backend's langchaingo client passes tools
+	// to the model.
+	tools bool
+}
+
+var providers = map[string]*provider{}
+
+// registerProvider adds a provider and its -<name>-model flag.
+func registerProvider(name, defaultModel string, newLLM func(ctx context.Context, model string) (llms.Model, error)) *provider {
+	p := &provider{
+		model:  flag.String(name+"-model", defaultModel, fmt.Sprintf("model to use with the %s provider", name)),
+		newLLM: newLLM,
+	}
+	providers[name] = p
+	return p
+}
+
+// supportsTools reports whether the named provider supports tool calls.
+func supportsTools(name string) bool {
+	p, ok := providers[name]
+	return ok && p.tools
+}
+
+func providerNames() string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// newLLM builds the model of the named provider. A non-empty model overrides
+// the provider's -<name>-model flag. It also returns the "provider/model" name
+// recorded with generations.
+func newLLM(ctx context.Context, name, model string) (llms.Model, string, error) {
+	p, ok := providers[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown provider %q (available: %s)", name, providerNames())
+	}
+	if model == "" {
+		model = *p.model
+	}
+	llm, err := p.newLLM(ctx, model)
+	return llm, path.Join(name, model), err
+}
+
+var (
+	flagAnthropicAPIKey = flag.String("anthropic-api-key", "", "Anthropic API key (defaults to $ANTHROPIC_API_KEY)")
+	flagOpenAIAPIKey    = flag.String("openai-api-key", "", "OpenAI API key (defaults to $OPENAI_API_KEY)")
+	flagOpenAIBaseURL   = flag.String("openai-base-url", "", "base URL of an OpenAI compatible API")
+	flagOllamaURL       = flag.String("ollama-url", "", "Ollama server URL (defaults to $OLLAMA_HOST or http://localhost:11434)")
+	flagGoogleAIAPIKey  = flag.String("googleai-api-key", "", "Google AI API key (defaults to $GOOGLE_API_KEY)")
+	flagFakeDir         = flag.String("fake-dir", "", "directory of recorded generations replayed by the fake provider (defaults to -gen-dir)")
+	flagFakeChunkSize   = flag.Int("fake-chunk-size", 64, "bytes per streamed chunk of the fake provider (0 streams each recording at once)")
+	flagFakeDelay       = flag.Duration("fake-delay", 20*time.Millisecond, "delay before each chunk streamed by the fake provider")
+	flagFakeMaxBytes    = flag.Int("fake-max-bytes", 0, "bytes after which the fake provider stops a response as if it hit the max-tokens limit (0 for no limit)")
+)
+
+func init() {
+	registerProvider("anthropic", "claude-3-opus-20240229", func(ctx context.Context, model string) (llms.Model, error) {
+		opts := []anthropic.Option{anthropic.WithModel(model)}
+		if *flagAnthropicAPIKey != "" {
+			opts = append(opts, anthropic.WithToken(*flagAnthropicAPIKey))
+		}
+		return anthropic.New(opts...)
+	})
+	registerProvider("openai", "gpt-4-turbo", func(ctx context.Context, model string) (llms.Model, error) {
+		opts := []openai.Option{openai.WithModel(model)}
+		if *flagOpenAIAPIKey != "" {
+			opts = append(opts, openai.WithToken(*flagOpenAIAPIKey))
+		}
+		if *flagOpenAIBaseURL != "" {
+			opts = append(opts, openai.WithBaseURL(*flagOpenAIBaseURL))
+		}
+		return openai.New(opts...)
+	}).tools = true
+	registerProvider("ollama", "llama3", func(ctx context.Context, model string) (llms.Model, error) {
+		opts := []ollama.Option{ollama.WithModel(model)}
+		if *flagOllamaURL != "" {
+			opts = append(opts, ollama.WithServerURL(*flagOllamaURL))
+		}
+		return ollama.New(opts...)
+	})
+	registerProvider("googleai", "gemini-1.5-pro-latest", func(ctx context.Context, model string) (llms.Model, error) {
+		apiKey := *flagGoogleAIAPIKey
+		if apiKey == "" {
+			apiKey = os.Getenv("GOOGLE_API_KEY")
+		}
+		return googleai.New(ctx, googleai.WithDefaultModel(model), googleai.WithAPIKey(apiKey))
+	}).tools = true
+	registerProvider("fake", "", func(ctx context.Context, model string) (llms.Model, error) {
+		dir := *flagFakeDir
+		if dir == "" {
+			dir = *flagGenDir
+		}
+		llm, err := replay.New(dir)
+		if err != nil {
+			return nil, err
+		}
+		llm.ChunkSize = *flagFakeChunkSize
+		llm.Delay = *flagFakeDelay
+		llm.MaxBytes = *flagFakeMaxBytes
+		return llm, nil
+	}).tools = true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/replay"
+)
+
+func TestNewLLM(t *testing.T) {
+	setFlag(t, flagAnthropicAPIKey, "test-key")
+	setFlag(t, flagOpenAIAPIKey, "test-key")
+	setFlag(t, flagGoogleAIAPIKey, "test-key")
+	setFlag(t, flagOllamaURL, "http://localhost:1")
+	setFlag(t, flagFakeDir, t.TempDir())
+	if err := os.WriteFile(filepath.Join(*flagFakeDir, "gen-a"+replay.LogSuffix), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		provider, model string
+		wantModel       string // the recorded provider/model name
+		wantType        string
+		wantTools       bool
+	}{
+		{"anthropic", "", "anthropic/claude-3-opus-20240229", "*anthropic.LLM", false},
+		{"anthropic", "claude-3-haiku-20240307", "anthropic/claude-3-haiku-20240307", "*anthropic.LLM", false},
+		{"openai", "", "openai/gpt-4-turbo", "*openai.LLM", true},
+		{"openai", "gpt-4o", "openai/gpt-4o", "*openai.LLM", true},
+		{"ollama", "", "ollama/llama3", "*ollama.LLM", false},
+		{"googleai", "", "googleai/gemini-1.5-pro-latest", "*googleai.GoogleAI", true},
+		{"fake", "", "fake", "*replay.LLM", true},
+	}
+	for _, tt := range tests {
+		llm, model, err := newLLM(context.Background(), tt.provider, tt.model)
+		if err != nil {
+			t.Errorf("newLLM(%q, %q): %v", tt.provider, tt.model, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", llm); got != tt.wantType || model != tt.wantModel {
+			t.Errorf("newLLM(%q, %q) = %s, %q; want %s, %q", tt.provider, tt.model, got, model, tt.wantType, tt.wantModel)
+		}
+		if got := supportsTools(tt.provider); got != tt.wantTools {
+			t.Errorf("supportsTools(%q) = %v, want %v", tt.provider, got, tt.wantTools)
+		}
+	}
+}
+
+// TestNewLLMModelFlag checks that the -<provider>-model flag sets the model
+// used without -model.
+func TestNewLLMModelFlag(t *testing.T) {
+	setFlag(t, flagOpenAIAPIKey, "test-key")
+	setFlag(t, providers["openai"].model, "gpt-4o-mini")
+	if _, model, err := newLLM(context.Background(), "openai", ""); err != nil || model != "openai/gpt-4o-mini" {
+		t.Errorf("newLLM with -openai-model = %q, %v; want openai/gpt-4o-mini", model, err)
+	}
+}
+
+func TestNewLLMUnknownProvider(t *testing.T) {
+	_, _, err := newLLM(context.Background(), "mistral", "")
+	if err == nil || !strings.Contains(err.Error(), `unknown provider "mistral"`) || !strings.Contains(err.Error(), "anthropic, fake, googleai, ollama, openai") {
+		t.Errorf("newLLM of an unknown provider = %v, want an error listing the providers", err)
+	}
+	if supportsTools("mistral") {
+		t.Errorf("unknown provider supports tools")
+	}
+}
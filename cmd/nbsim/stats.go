@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/tmc/nbsim/registry"
+)
+
+var flagPrices = flag.String("prices", "", `JSON file of model prices in USD per million tokens, as {"provider/model": {"input": 3, "output": 15}}, overriding the built-in prices; a "provider" key prices all of its models`)
+
+// price is the cost of a model in USD per million tokens.
+type price struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultPrices are the list prices of the default models and of providers
+// that charge nothing.
+var defaultPrices = map[string]price{
+	"anthropic/claude-3-opus-20240229":     {Input: 15, Output: 75},
+	"anthropic/claude-3-5-sonnet-20240620": {Input: 3, Output: 15},
+	"anthropic/claude-3-haiku-20240307":    {Input: 0.25, Output: 1.25},
+	"openai/gpt-4-turbo":                   {Input: 10, Output: 30},
+	"openai/gpt-4o":                        {Input: 5, Output: 15},
+	"googleai/gemini-1.5-pro-latest":       {Input: 3.5, Output: 10.5},
+	"ollama":                               {},
+	"fake":                                 {},
+}
+
+// priceTable maps models, or providers for all of their models, to prices.
+type priceTable map[string]price
+
+// loadPrices returns the default prices overridden by those in the JSON file
+// name, if it is non-empty.
+func loadPrices(name string) (priceTable, error) {
+	prices := priceTable{}
+	for model, p := range defaultPrices {
+		prices[model] = p
+	}
+	if name == "" {
+		return prices, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &prices); err != nil {
+		return nil, fmt.Errorf("reading prices: %s: %w", name, err)
+	}
+	return prices, nil
+}
+
+// lookup returns the price of model, or of its provider.
+func (t priceTable) lookup(model string) (price, bool) {
+	if p, ok := t[model]; ok {
+		return p, true
+	}
+	provider, _, _ := strings.Cut(model, "/")
+	p, ok := t[provider]
+	return p, ok
+}
+
+// usageStats sums the usage and cost of generations.
+type usageStats struct {
+	Generations  int     `json:"generations"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	// Estimated counts the generations whose tokens were estimated, and
+	// Unpriced those of models without a price, which cost nothing here.
+	Estimated int `json:"estimated,omitempty"`
+	Unpriced  int `json:"unpriced,omitempty"`
+	// Turns is the number of requests of the generations in the tools
+	// format.
+	Turns int `json:"turns,omitempty"`
+}
+
+func (u *usageStats) add(gen registry.Generation, p price, priced bool) {
+	usage := gen.Usage
+	u.Generations++
+	u.Turns += gen.Turns
+	u.InputTokens += usage.InputTokens
+	u.OutputTokens += usage.OutputTokens
+	u.CostUSD += (float64(usage.InputTokens)*p.Input + float64(usage.OutputTokens)*p.Output) / 1e6
+	if usage.Estimated {
+		u.Estimated++
+	}
+	if !priced {
+		u.Unpriced++
+	}
+}
+
+// stats is the response of /_stats.
+type stats struct {
+	Total  usageStats             `json:"total"`
+	Models map[string]*usageStats `json:"models"`
+	Days   map[string]*usageStats `json:"days"` // by UTC date the generation finished
+}
+
+// handleStats serves the token usage and cost of the finished generations,
+// per model and per day.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	st := stats{Models: map[string]*usageStats{}, Days: map[string]*usageStats{}}
+	for _, gen := range s.registry.List() {
+		if gen.Usage == nil || gen.FinishedAt == nil {
+			continue
+		}
+		p, priced := s.prices.lookup(gen.Model)
+		day := gen.FinishedAt.UTC().Format("2006-01-02")
+		if st.Models[gen.Model] == nil {
+			st.Models[gen.Model] = &usageStats{}
+		}
+		if st.Days[day] == nil {
+			st.Days[day] = &usageStats{}
+		}
+		st.Total.add(gen, p, priced)
+		st.Models[gen.Model].add(gen, p, priced)
+		st.Days[day].add(gen, p, priced)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim/registry"
+)
+
+func TestLoadPrices(t *testing.T) {
+	tests := []struct {
+		file    string // the -prices file, if any
+		model   string
+		want    price
+		wantErr bool
+	}{
+		{"", "anthropic/claude-3-haiku-20240307", price{Input: 0.25, Output: 1.25}, false},
+		{`{"anthropic/claude-3-haiku-20240307": {"input": 1, "output": 2}}`, "anthropic/claude-3-haiku-20240307", price{Input: 1, Output: 2}, false},
+		{`{"mistral/large": {"input": 4}}`, "mistral/large", price{Input: 4}, false},
+		{`{"mistral/large": {"input": 4}}`, "openai/gpt-4o", price{Input: 5, Output: 15}, false},
+		{`{"mistral/large": `, "", price{}, true},
+	}
+	for _, tt := range tests {
+		name := ""
+		if tt.file != "" {
+			name = filepath.Join(t.TempDir(), "prices.json")
+			if err := os.WriteFile(name, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		prices, err := loadPrices(name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadPrices(%s) error = %v, want error %v", tt.file, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := prices[tt.model]; got != tt.want {
+			t.Errorf("loadPrices(%s)[%q] = %+v, want %+v", tt.file, tt.model, got, tt.want)
+		}
+	}
+	if _, err := loadPrices(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("loadPrices of a missing file succeeded")
+	}
+	if defaultPrices["openai/gpt-4o"] != (price{Input: 5, Output: 15}) {
+		t.Errorf("loadPrices changed the default prices")
+	}
+}
+
+func TestPriceLookup(t *testing.T) {
+	prices := priceTable{
+		"openai/gpt-4o": {Input: 5, Output: 15},
+		"ollama":        {},
+		"openai":        {Input: 1, Output: 2},
+	}
+	tests := []struct {
+		model  string
+		want   price
+		wantOK bool
+	}{
+		{"openai/gpt-4o", price{Input: 5, Output: 15}, true},
+		{"openai/gpt-4-turbo", price{Input: 1, Output: 2}, true},
+		{"ollama/llama3", price{}, true},
+		{"ollama", price{}, true},
+		{"anthropic/claude-3-opus-20240229", price{}, false},
+		{"", price{}, false},
+	}
+	for _, tt := range tests {
+		if got, ok := prices.lookup(tt.model); got != tt.want || ok != tt.wantOK {
+			t.Errorf("lookup(%q) = %+v, %v; want %+v, %v", tt.model, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	s.prices = priceTable{"openai/gpt-4o": {Input: 5, Output: 15}, "fake": {}}
+	day1 := time.Date(2024, 6, 1, 23, 30, 0, 0, time.FixedZone("PDT", -7*3600)) // June 2 in UTC
+	day2 := time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC)
+	gens := []struct {
+		base, model string
+		usage       *registry.Usage
+		finished    time.Time
+		turns       int // of a generation in the tools format
+	}{
+		{"a", "openai/gpt-4o", &registry.Usage{InputTokens: 1000, OutputTokens: 2000}, day1, 0},
+		{"b", "openai/gpt-4o", &registry.Usage{InputTokens: 3000, OutputTokens: 0}, day2, 0},
+		{"c", "fake", &registry.Usage{InputTokens: 10, OutputTokens: 20, Estimated: true, Estimator: charCounter.name}, day2, 3},
+		{"d", "mistral/large", &registry.Usage{InputTokens: 7, OutputTokens: 8}, day2, 0},
+		{"e", "openai/gpt-4o", nil, day2, 0}, // failed before the model answered
+	}
+	for _, g := range gens {
+		gen, _, err := s.registry.Create(registry.Generation{Base: g.base, URL: "/" + g.base, Model: g.model}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.registry.Finish(gen.ID, g.usage, nil)
+		finished, turns := g.finished, g.turns
+		s.registry.Update(gen.ID, func(g *registry.Generation) { g.FinishedAt, g.Turns = &finished, turns })
+	}
+	// a running generation is left out
+	s.registry.Create(registry.Generation{Base: "f", URL: "/f", Model: "openai/gpt-4o"}, false)
+
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/_stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got stats
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	gpt := usageStats{Generations: 2, InputTokens: 4000, OutputTokens: 2000, CostUSD: 0.05}
+	want := stats{
+		Total: usageStats{Generations: 4, InputTokens: 4017, OutputTokens: 2028, CostUSD: 0.05, Estimated: 1, Unpriced: 1, Turns: 3},
+		Models: map[string]*usageStats{
+			"openai/gpt-4o": &gpt,
+			"fake":          {Generations: 1, InputTokens: 10, OutputTokens: 20, Estimated: 1, Turns: 3},
+			"mistral/large": {Generations: 1, InputTokens: 7, OutputTokens: 8, Unpriced: 1},
+		},
+		Days: map[string]*usageStats{
+			"2024-06-02": {Generations: 1, InputTokens: 1000, OutputTokens: 2000, CostUSD: 0.035},
+			"2024-06-03": {Generations: 3, InputTokens: 3017, OutputTokens: 28, CostUSD: 0.015, Estimated: 1, Unpriced: 1, Turns: 3},
+		},
+	}
+	// costs are sums of floats
+	all := []*usageStats{&got.Total}
+	for _, m := range []map[string]*usageStats{got.Models, got.Days} {
+		for _, u := range m {
+			all = append(all, u)
+		}
+	}
+	for _, u := range all {
+		u.CostUSD = math.Round(u.CostUSD*1e6) / 1e6
+	}
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(want)
+		t.Errorf("/_stats =\n%s\nwant\n%s", g, w)
+	}
+}
+
+func TestEstimateUsage(t *testing.T) {
+	tests := []struct {
+		messages   []llms.MessageContent
+		output     string
+		wantInput  int
+		wantOutput int
+	}{
+		{nil, "", 0, 0},
+		{nil, "abcde", 0, 2},
+		{[]llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "abcd", "ünïc")}, "ab", 2, 1},
+		{
+			[]llms.MessageContent{
+				llms.TextParts(llms.ChatMessageTypeSystem, "12345678"),
+				{Role: llms.ChatMessageTypeAI, Parts: []llms.ContentPart{
+					llms.ToolCall{ID: "a", FunctionCall: &llms.FunctionCall{Name: "add_cell", Arguments: `{"x":1}`}},
+					llms.ToolCall{ID: "b"},
+				}},
+				{Role: llms.ChatMessageTypeTool, Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: "a", Content: "added cell 0"}}},
+				{Role: llms.ChatMessageTypeHuman, Parts: []llms.ContentPart{llms.ImageURLContent{URL: "https://example.com/a.png"}}},
+			},
+			"",
+			2 + 2 + 3, 0,
+		},
+	}
+	for i, tt := range tests {
+		got := charCounter.estimate(tt.messages, tt.output)
+		want := &registry.Usage{InputTokens: tt.wantInput, OutputTokens: tt.wantOutput, Estimated: true, Estimator: charCounter.name}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: estimate = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// The tokenizer's encoding is loaded in the background, or fails to
+	// load offline, so either may count the tokens.
+	got := estimateUsage([]llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "a notebook about sales")}, "# Sales")
+	switch {
+	case got.Estimator != charCounter.name && got.Estimator != "tiktoken/cl100k_base":
+		t.Errorf("estimateUsage estimator = %q", got.Estimator)
+	case got.InputTokens == 0 || got.OutputTokens == 0 || !got.Estimated:
+		t.Errorf("estimateUsage = %+v, want estimated tokens", got)
+	}
+}
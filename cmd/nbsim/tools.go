@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+)
+
+// notebookWriter is what a generation writes the model's notebook to, as
+// returned by nbsim.NewNotebookWriter.
+type notebookWriter interface {
+	AddPart(part string)
+	AddCell(arguments string) (int, error)
+	Flush()
+}
+
+// maxToolTurns bounds the requests of a generation in the tools format. Each
+// request resends the whole conversation so far, so its input grows with
+// every turn.
+const maxToolTurns = 40
+
+// errNoToolCalls is returned when the model answers without calling
+// add_cell, typically because the provider ignores tools.
+var errNoToolCalls = errors.New("the model did not call the add_cell tool")
+
+// generateWithTools has the model add the notebook's cells by calling the
+// add_cell tool. Each call is answered with the index of the added cell or
+// with why the cell was rejected, and the model is asked again until it stops
+// calling the tool. Each call is logged as a line of JSON.
+func generateWithTools(ctx context.Context, llm llms.Model, history []llms.MessageContent, nw notebookWriter, log io.Writer, res *generationResult) error {
+	history = history[:len(history):len(history)]
+	for turn := 0; turn < maxToolTurns; turn++ {
+		res.Turns++
+		resp, err := llm.GenerateContent(ctx,
+			history,
+			llms.WithTemperature(1),
+			llms.WithMaxTokens(maxTokens),
+			llms.WithTools([]llms.Tool{nbsim.AddCellTool}),
+		)
+		if err != nil {
+			return err
+		}
+		res.tokenArrived()
+		if len(resp.Choices) == 0 {
+			return errors.New("the model returned no choices")
+		}
+		choice := resp.Choices[0]
+		output := choice.Content
+		for _, call := range choice.ToolCalls {
+			if call.FunctionCall != nil {
+				output += call.FunctionCall.Arguments
+			}
+		}
+		res.addUsage(choice.GenerationInfo, history, output)
+		if len(choice.ToolCalls) == 0 {
+			if turn == 0 {
+				return errNoToolCalls
+			}
+			return nil
+		}
+
+		ai := llms.MessageContent{Role: llms.ChatMessageTypeAI}
+		if choice.Content != "" {
+			nw.AddPart(choice.Content)
+			ai.Parts = append(ai.Parts, llms.TextContent{Text: choice.Content})
+		}
+		for _, call := range choice.ToolCalls {
+			ai.Parts = append(ai.Parts, call)
+		}
+		history = append(history, ai)
+		for _, call := range choice.ToolCalls {
+			history = append(history, llms.MessageContent{
+				Role:  llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{toolCallResponse(call, nw, log)},
+			})
+		}
+	}
+	return fmt.Errorf("the model was still adding cells after %d requests", maxToolTurns)
+}
+
+// toolCallResponse runs a tool call of the model and returns its response.
+func toolCallResponse(call llms.ToolCall, nw notebookWriter, log io.Writer) llms.ToolCallResponse {
+	resp := llms.ToolCallResponse{ToolCallID: call.ID}
+	if call.FunctionCall == nil {
+		resp.Content = "error: not a function call"
+		return resp
+	}
+	resp.Name = call.FunctionCall.Name
+	if line, err := json.Marshal(call.FunctionCall); err == nil {
+		log.Write(append(line, '\n'))
+	}
+	if call.FunctionCall.Name != nbsim.AddCellTool.Function.Name {
+		resp.Content = fmt.Sprintf("error: unknown tool %q", call.FunctionCall.Name)
+		return resp
+	}
+	i, err := nw.AddCell(call.FunctionCall.Arguments)
+	if err != nil {
+		resp.Content = "error: the cell was not added: " + err.Error()
+		return resp
+	}
+	resp.Content = fmt.Sprintf("added cell %d", i)
+	return resp
+}
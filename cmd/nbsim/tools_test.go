@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// toolModel answers the i-th request with the tool calls of turns[i], and
+// later requests with none.
+type toolModel struct {
+	turns    [][]llms.ToolCall
+	requests [][]llms.MessageContent
+}
+
+func (m *toolModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	m.requests = append(m.requests, messages)
+	var calls []llms.ToolCall
+	if i := len(m.requests) - 1; i < len(m.turns) {
+		calls = m.turns[i]
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{ToolCalls: calls}}}, nil
+}
+
+func (m *toolModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func toolCall(id, name, arguments string) llms.ToolCall {
+	return llms.ToolCall{ID: id, Type: "function", FunctionCall: &llms.FunctionCall{Name: name, Arguments: arguments}}
+}
+
+// toolResponses returns the contents of the tool responses in messages.
+func toolResponses(messages []llms.MessageContent) []string {
+	var contents []string
+	for _, m := range messages {
+		for _, p := range m.Parts {
+			if r, ok := p.(llms.ToolCallResponse); ok {
+				contents = append(contents, r.ToolCallID+": "+r.Content)
+			}
+		}
+	}
+	return contents
+}
+
+func TestGenerateWithTools(t *testing.T) {
+	llm := &toolModel{turns: [][]llms.ToolCall{
+		{
+			toolCall("a", "add_cell", `{"cell_type": "markdown", "source": "# Sales"}`),
+			toolCall("b", "add_cell", `{"cell_type": "code", "source": "df = load(`),
+			toolCall("c", "delete_cell", `{"index": 0}`),
+		},
+		{
+			toolCall("d", "add_cell", `{"cell_type": "code", "source": "df = load()", "outputs": "[{\"output_type\": \"stream\", \"name\": \"stdout\", \"text\": \"loaded\\n\"}]"}`),
+			{ID: "e", Type: "function"},
+		},
+	}}
+	dir := t.TempDir()
+	nw := nbsim.NewNotebookWriter(dir, "gen", nbsim.FormatTools)
+	history := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "a notebook about sales")}
+	var log bytes.Buffer
+	res, err := generateNotebook(context.Background(), llm, history, nbsim.FormatTools, nw, &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(llm.requests) != 3 || res.Turns != 3 {
+		t.Fatalf("%d requests in %d turns, want 3", len(llm.requests), res.Turns)
+	}
+	want := []string{
+		"a: added cell 0",
+		"b: error: the cell was not added: invalid arguments: unexpected end of JSON input",
+		`c: error: unknown tool "delete_cell"`,
+		"d: added cell 1",
+		"e: error: not a function call",
+	}
+	if got := toolResponses(llm.requests[2]); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tool responses =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(llm.requests[0]) != 1 {
+		t.Errorf("generateWithTools changed the history it was given")
+	}
+	if got := strings.Count(log.String(), "\n"); got != 4 {
+		t.Errorf("log has %d calls, want 4:\n%s", got, log.String())
+	}
+	if res.Usage == nil || res.Usage.OutputTokens == 0 {
+		t.Errorf("usage = %+v, want the estimated usage of the requests", res.Usage)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "gen.ipynb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nb notebooks.Notebook
+	if err := json.Unmarshal(data, &nb); err != nil {
+		t.Fatal(err)
+	}
+	if len(nb.Cells) != 2 || nb.Cells[0].Source.String() != "# Sales" || nb.Cells[1].Source.String() != "df = load()" {
+		t.Fatalf("notebook = %s", data)
+	}
+	if got := nb.Cells[1].Outputs[0].(*notebooks.StreamOutput).Text.String(); got != "loaded\n" {
+		t.Errorf("code cell output = %q, want loaded", got)
+	}
+}
+
+func TestGenerateWithToolsErrors(t *testing.T) {
+	history := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "a notebook")}
+	nw := nbsim.NewNotebookWriter(t.TempDir(), "gen", nbsim.FormatTools)
+	if _, err := generateNotebook(context.Background(), &toolModel{}, history, nbsim.FormatTools, nw, new(bytes.Buffer)); !errors.Is(err, errNoToolCalls) {
+		t.Errorf("generation without tool calls = %v, want errNoToolCalls", err)
+	}
+
+	forever := &toolModel{}
+	for i := 0; i < maxToolTurns+1; i++ {
+		forever.turns = append(forever.turns, []llms.ToolCall{toolCall("x", "add_cell", `{"cell_type": "raw"`)})
+	}
+	res, err := generateNotebook(context.Background(), forever, history, nbsim.FormatTools, nw, new(bytes.Buffer))
+	if err == nil {
+		t.Errorf("generation that never stops calling tools succeeded")
+	}
+	if len(forever.requests) != maxToolTurns || res.Turns != maxToolTurns {
+		t.Errorf("%d requests in %d turns, want %d", len(forever.requests), res.Turns, maxToolTurns)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// tokenCounter counts the tokens of text for providers that report no
+// usage, such as googleai and the fake provider. Its name is recorded with
+// the usage it estimates.
+type tokenCounter struct {
+	name  string
+	count func(text string) int
+}
+
+// charCounter counts four characters a token. It stands in for the
+// tokenizer until its encoding is loaded, or if it cannot be.
+var charCounter = tokenCounter{"chars/4", func(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}}
+
+var (
+	// encoding is the tokenizer's encoding once loaded. tiktoken fetches
+	// it on first use, so it is loaded in the background.
+	encoding     atomic.Pointer[tokenCounter]
+	loadEncoding sync.Once
+)
+
+// tokens returns the tiktoken counter if its encoding is loaded and
+// charCounter otherwise, starting to load the encoding on first use.
+func tokens() tokenCounter {
+	loadEncoding.Do(func() {
+		go func() {
+			e, err := tiktoken.GetEncoding("cl100k_base")
+			if err != nil {
+				fmt.Println("error loading token encoding, estimating tokens from characters:", err)
+				return
+			}
+			encoding.Store(&tokenCounter{"tiktoken/cl100k_base", func(text string) int {
+				return len(e.Encode(text, nil, nil))
+			}})
+		}()
+	})
+	if c := encoding.Load(); c != nil {
+		return *c
+	}
+	return charCounter
+}
+
+// estimateUsage estimates the usage of a request of messages answered with
+// output.
+func estimateUsage(messages []llms.MessageContent, output string) *registry.Usage {
+	return tokens().estimate(messages, output)
+}
+
+func (c tokenCounter) estimate(messages []llms.MessageContent, output string) *registry.Usage {
+	u := &registry.Usage{OutputTokens: c.count(output), Estimated: true, Estimator: c.name}
+	for _, m := range messages {
+		for _, part := range m.Parts {
+			switch p := part.(type) {
+			case llms.TextContent:
+				u.InputTokens += c.count(p.Text)
+			case llms.ToolCall:
+				if p.FunctionCall != nil {
+					u.InputTokens += c.count(p.FunctionCall.Arguments)
+				}
+			case llms.ToolCallResponse:
+				u.InputTokens += c.count(p.Content)
+			}
+		}
+	}
+	return u
+}
+
+// recordResult records the timings of res in the registry, and the model,
+// usage and timings of res in the metadata of the notebook of gen.
+func (s *Server) recordResult(gen registry.Generation, res generationResult) {
+	if _, err := s.registry.Update(gen.ID, func(g *registry.Generation) {
+		g.Continuations, g.Truncated, g.Turns = res.Continuations, res.Truncated, res.Turns
+		g.LatencyMS, g.TimeToFirstTokenMS = res.Latency.Milliseconds(), res.FirstToken.Milliseconds()
+	}); err != nil {
+		fmt.Println("error recording generation:", err)
+	}
+	nb, err := readNotebook(gen.ID)
+	if err != nil {
+		// the model wrote no notebook
+		return
+	}
+	m := nbsim.ReadGenerationMetadata(nb)
+	m.Model, m.Usage = gen.Model, res.Usage
+	m.LatencyMS, m.TimeToFirstTokenMS = res.Latency.Milliseconds(), res.FirstToken.Milliseconds()
+	m.Continuations, m.Truncated, m.Turns = res.Continuations, res.Truncated, res.Turns
+	if err := nbsim.SetGenerationMetadata(nb, m); err != nil {
+		fmt.Println("error recording generation metadata:", err)
+		return
+	}
+	b, err := notebooks.Marshal(nb)
+	if err == nil {
+		err = os.WriteFile(path.Join(*flagGenDir, gen.ID+".ipynb"), b, 0644)
+	}
+	if err != nil {
+		fmt.Println("error recording generation metadata:", err)
+	}
+}
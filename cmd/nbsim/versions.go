@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// writeCanonical copies the notebook of gen, a canonical version, to the
+// unversioned gen-<md5>.ipynb path.
+func (s *Server) writeCanonical(gen registry.Generation) error {
+	contents, err := os.ReadFile(path.Join(*flagGenDir, gen.ID+".ipynb"))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(*flagGenDir, gen.Base+".ipynb"), contents, 0644)
+}
+
+// migrateVersionFiles copies notebooks generated before versioning to the
+// path of their first version.
+func (s *Server) migrateVersionFiles() {
+	for _, gen := range s.registry.List() {
+		versioned := path.Join(*flagGenDir, gen.ID+".ipynb")
+		if _, err := os.Stat(versioned); !os.IsNotExist(err) {
+			continue
+		}
+		contents, err := os.ReadFile(path.Join(*flagGenDir, gen.Base+".ipynb"))
+		if err != nil {
+			continue
+		}
+		if err := os.WriteFile(versioned, contents, 0644); err != nil {
+			fmt.Println("error migrating notebook:", err)
+		}
+	}
+}
+
+func (s *Server) handleVersions(w http.ResponseWriter, r *http.Request) {
+	versions := s.registry.Versions(r.PathValue("base"))
+	if len(versions) == 0 {
+		http.Error(w, registry.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// handleCompareVersions compares the cells of versions a and b of a notebook.
+func (s *Server) handleCompareVersions(w http.ResponseWriter, r *http.Request) {
+	base := r.PathValue("base")
+	var nbs [2]*notebooks.Notebook
+	for i, param := range []string{"a", "b"} {
+		version, err := strconv.Atoi(r.URL.Query().Get(param))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid version %q: %v", param, err), http.StatusBadRequest)
+			return
+		}
+		nb, err := s.readVersion(base, version)
+		if errors.Is(err, registry.ErrNotFound) || os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nbs[i] = nb
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notebooks.DiffCells(nbs[0].Cells, nbs[1].Cells))
+}
+
+func (s *Server) handleSetCanonical(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	base := r.PathValue("base")
+	gen, ok := s.registry.Get(registry.VersionID(base, payload.Version))
+	if !ok {
+		http.Error(w, registry.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if gen.Status != registry.StatusDone {
+		http.Error(w, fmt.Sprintf("version %d is %s", gen.Version, gen.Status), http.StatusConflict)
+		return
+	}
+	gen, err := s.registry.SetCanonical(base, payload.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.writeCanonical(gen); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gen)
+}
+
+func (s *Server) readVersion(base string, version int) (*notebooks.Notebook, error) {
+	gen, ok := s.registry.Get(registry.VersionID(base, version))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", registry.ErrNotFound, registry.VersionID(base, version))
+	}
+	return readNotebook(gen.ID)
+}
+
+// readNotebook reads the notebook generated under id from the generation
+// directory, repairing it if it is incomplete.
+func readNotebook(id string) (*notebooks.Notebook, error) {
+	contents, err := os.ReadFile(path.Join(*flagGenDir, id+".ipynb"))
+	if err != nil {
+		return nil, err
+	}
+	repaired, _ := notebooks.RepairNotebookJSON(string(contents))
+	nb := &notebooks.Notebook{}
+	if err := json.Unmarshal([]byte(repaired), nb); err != nil {
+		return nil, err
+	}
+	return nb, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+	"github.com/tmc/nbsim/replay"
+)
+
+// getJSON gets url and decodes its JSON response into v, returning the status
+// code.
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// generateVersions generates two versions of url, the second from a
+// notebook with its middle cell changed, and returns the test server.
+func generateVersions(t *testing.T, url string) (*Server, *httptest.Server) {
+	t.Helper()
+	s, llm := newTestServer(t, map[string]string{url: jsonRecording(t, testNotebook(t))})
+	srv := httptest.NewServer(s.handler(http.NotFoundHandler()))
+	t.Cleanup(srv.Close)
+	id, _ := postJSON(t, srv.URL+"/_gen", map[string]any{"url": url})["id"].(string)
+	wait(t, s, id)
+
+	nb, err := notebooks.NewBuilder().Python().
+		Markdown("# Fine-tuning\n\nSteps: ünïcode.").
+		Code("import torch").
+		Markdown("Done.").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(llm.Dir, nbsim.GenerationID(url)+replay.LogSuffix), []byte(jsonRecording(t, nb)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = postJSON(t, srv.URL+"/_gen", map[string]any{"url": url, "regenerate": true})["id"].(string)
+	wait(t, s, id)
+	return s, srv
+}
+
+func TestHandleVersions(t *testing.T) {
+	const url = "/notebooks/a/versions.ipynb"
+	s, srv := generateVersions(t, url)
+	base := nbsim.GenerationID(url)
+
+	var versions []registry.Generation
+	if code := getJSON(t, srv.URL+"/_versions/"+base, &versions); code != http.StatusOK {
+		t.Fatalf("GET /_versions/%s = %d", base, code)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("%d versions, want 2", len(versions))
+	}
+	for i, v := range versions {
+		if v.Version != i+1 || v.ID != registry.VersionID(base, i+1) || v.Status != registry.StatusDone || v.Canonical != (i == 0) {
+			t.Errorf("versions[%d] = %+v, want done version %d, canonical only if first", i, v, i+1)
+		}
+	}
+	if code := getJSON(t, srv.URL+"/_versions/gen-missing", &versions); code != http.StatusNotFound {
+		t.Errorf("GET /_versions of a missing notebook = %d, want 404", code)
+	}
+
+	var gen registry.Generation
+	if code := getJSON(t, srv.URL+"/_generations/"+registry.VersionID(base, 2), &gen); code != http.StatusOK || gen.Version != 2 || gen.URL != url {
+		t.Errorf("GET /_generations of version 2 = %d, %+v", code, gen)
+	}
+	nb, err := s.readVersion(base, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nb.Cells) != 3 || nb.Cells[1].Source.String() != "import torch" {
+		t.Errorf("notebook of version 2 has cells %+v", nb.Cells)
+	}
+	if _, err := s.readVersion(base, 3); !errors.Is(err, registry.ErrNotFound) {
+		t.Errorf("reading a missing version = %v, want ErrNotFound", err)
+	}
+}
+
+func TestHandleCompareVersions(t *testing.T) {
+	const url = "/notebooks/a/compare.ipynb"
+	_, srv := generateVersions(t, url)
+	base := nbsim.GenerationID(url)
+
+	var diffs []notebooks.CellDiff
+	if code := getJSON(t, srv.URL+"/_versions/"+base+"/compare?a=1&b=2", &diffs); code != http.StatusOK {
+		t.Fatalf("compare = %d", code)
+	}
+	var changes []string
+	for _, d := range diffs {
+		changes = append(changes, string(d.Change))
+	}
+	if got := strings.Join(changes, " "); got != "same changed same" {
+		t.Errorf("compare = %s, want same changed same", got)
+	}
+	for query, want := range map[string]int{
+		"a=1&b=3": http.StatusNotFound,
+		"a=1":     http.StatusBadRequest,
+		"a=x&b=2": http.StatusBadRequest,
+	} {
+		if code := getJSON(t, srv.URL+"/_versions/"+base+"/compare?"+query, &diffs); code != want {
+			t.Errorf("compare?%s = %d, want %d", query, code, want)
+		}
+	}
+}
+
+func TestHandleSetCanonical(t *testing.T) {
+	const url = "/notebooks/a/canonical.ipynb"
+	s, srv := generateVersions(t, url)
+	base := nbsim.GenerationID(url)
+
+	gen := postJSON(t, srv.URL+"/_versions/"+base+"/canonical", map[string]any{"version": 2})
+	if gen["canonical"] != true || gen["version"] != 2.0 {
+		t.Fatalf("canonicalizing version 2 = %v", gen)
+	}
+	for _, v := range s.registry.Versions(base) {
+		if v.Canonical != (v.Version == 2) {
+			t.Errorf("version %d canonical = %v after canonicalizing version 2", v.Version, v.Canonical)
+		}
+	}
+	canonical, err := os.ReadFile(filepath.Join(*flagGenDir, base+".ipynb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := os.ReadFile(filepath.Join(*flagGenDir, registry.VersionID(base, 2)+".ipynb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(canonical) != string(v2) {
+		t.Errorf("canonical notebook is not version 2")
+	}
+
+	// a pending version cannot be canonical
+	pending, _, err := s.registry.Create(registry.Generation{Base: base, URL: url}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for body, want := range map[string]int{
+		`{"version": 9}`: http.StatusNotFound,
+		fmt.Sprintf(`{"version": %d}`, pending.Version): http.StatusConflict,
+		`{"version": `: http.StatusBadRequest,
+	} {
+		resp, err := http.Post(srv.URL+"/_versions/"+base+"/canonical", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("canonicalizing %s = %s, want %d", body, resp.Status, want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -8,7 +9,10 @@ import (
 	"github.com/tmc/nbsim/notebooks"
 )
 
+var flagValidate = flag.Bool("validate", false, "report the nbformat schema violations of the input on stderr and exit with status 2 if there are any")
+
 func main() {
+	flag.Parse()
 	err, ret := run()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -27,5 +31,11 @@ func run() (error, int) {
 	if !ok {
 		return nil, 1
 	}
+	if *flagValidate {
+		if errs := notebooks.ValidateJSON(in); len(errs) > 0 {
+			fmt.Fprintln(os.Stderr, errs)
+			return nil, 2
+		}
+	}
 	return nil, 0
 }
@@ -0,0 +1,103 @@
+package nbsim
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+var (
+	//go:embed edit-prompt.txt
+	editPrompt string
+	//go:embed cell-prompt.txt
+	cellPrompt string
+)
+
+// cellPromptContext is the number of cells on each side of a regenerated
+// cell that CellPrompt shows.
+const cellPromptContext = 4
+
+// EditPrompt returns the request to revise nb as instruction asks. The model
+// answers in FormatJSON with either the full revised notebook or a patch,
+// which ParseEditPatch tells apart.
+func EditPrompt(nb *notebooks.Notebook, instruction string) (string, error) {
+	b, err := notebooks.Marshal(nb)
+	if err != nil {
+		return "", err
+	}
+	var s strings.Builder
+	fmt.Fprintf(&s, "<notebook>\n%s\n</notebook>\n", b)
+	fmt.Fprintf(&s, "<instruction>\n%s\n</instruction>\n", strings.TrimSpace(instruction))
+	s.WriteString(editPrompt)
+	return s.String(), nil
+}
+
+// ParseEditPatch returns the patch of response, the model's answer to an
+// EditPrompt, or nil if the answer is a full notebook.
+func ParseEditPatch(response string) (notebooks.Patch, error) {
+	dec := json.NewDecoder(strings.NewReader(response))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil
+	}
+	if key, err := dec.Token(); err != nil || key != "patch" {
+		return nil, nil
+	}
+	var answer struct {
+		Patch notebooks.Patch `json:"patch"`
+	}
+	if err := json.Unmarshal([]byte(response), &answer); err != nil {
+		return nil, fmt.Errorf("invalid patch: %w", err)
+	}
+	if answer.Patch == nil {
+		answer.Patch = notebooks.Patch{}
+	}
+	return answer.Patch, nil
+}
+
+// ErrNoCell is returned by CellPrompt for cell indexes out of range.
+var ErrNoCell = errors.New("no cell")
+
+// CellPrompt returns the request to write a new version of cell i of nb,
+// shown between the cells around it, as instruction asks if it is not empty.
+// The model answers in FormatJSON with the cell, which ParseCell decodes.
+func CellPrompt(nb *notebooks.Notebook, i int, instruction string) (string, error) {
+	if i < 0 || i >= len(nb.Cells) {
+		return "", fmt.Errorf("%w %d in a notebook of %d cells", ErrNoCell, i, len(nb.Cells))
+	}
+	var s strings.Builder
+	if nb.Metadata.Title != "" {
+		fmt.Fprintf(&s, "<title>%s</title>\n", nb.Metadata.Title)
+	}
+	for j := max(0, i-cellPromptContext); j < min(len(nb.Cells), i+cellPromptContext+1); j++ {
+		b, err := json.Marshal(nb.Cells[j])
+		if err != nil {
+			return "", err
+		}
+		if j == i {
+			fmt.Fprintf(&s, "<regenerate>\n%s\n</regenerate>\n", b)
+		} else {
+			fmt.Fprintf(&s, "<cell>\n%s\n</cell>\n", b)
+		}
+	}
+	if instruction = strings.TrimSpace(instruction); instruction != "" {
+		fmt.Fprintf(&s, "<instruction>\n%s\n</instruction>\n", instruction)
+	}
+	s.WriteString(cellPrompt)
+	return s.String(), nil
+}
+
+// ParseCell decodes response, the model's answer to a CellPrompt.
+func ParseCell(response string) (*notebooks.Cell, error) {
+	c := &notebooks.Cell{}
+	if err := json.Unmarshal([]byte(response), c); err != nil {
+		return nil, fmt.Errorf("invalid cell: %w", err)
+	}
+	if c.CellType == "" {
+		return nil, errors.New("invalid cell: missing cell_type")
+	}
+	return c, nil
+}
@@ -0,0 +1,45 @@
+package nbsim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEditPatch(t *testing.T) {
+	tests := []struct {
+		name, response string
+		wantOps        int // -1 for a full notebook
+		wantErr        string
+	}{
+		{"patch", `{"patch": [{"op": "delete", "id": "a"}, {"op": "insert", "cell": {"cell_type": "markdown", "source": "x"}}]}`, 2, ""},
+		{"empty patch", `{"patch": []}`, 0, ""},
+		{"null patch", `{"patch": null}`, 0, ""},
+		{"notebook", `{"cells": [], "metadata": {}, "nbformat": 4, "nbformat_minor": 5}`, -1, ""},
+		{"not json", `Here is the notebook.`, -1, ""},
+		{"malformed patch", `{"patch": [{"op": "delete", "id": 1}]}`, 0, "invalid patch"},
+		{"cut off patch", `{"patch": [{"op": "delete"`, 0, "invalid patch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := ParseEditPatch(tt.response)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseEditPatch() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantOps < 0 {
+				if patch != nil {
+					t.Errorf("ParseEditPatch() = %+v, want nil for a full notebook", patch)
+				}
+				return
+			}
+			if patch == nil || len(patch) != tt.wantOps {
+				t.Errorf("ParseEditPatch() = %+v, want %d ops", patch, tt.wantOps)
+			}
+		})
+	}
+}
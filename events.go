@@ -0,0 +1,296 @@
+package nbsim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tmc/nbsim/nbhtml"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// Event types sent while a notebook is generated. A queued event, whose
+// Index is the queue position, precedes the others while the generation
+// waits for a worker.
+const (
+	EventQueued    = "queued"
+	EventToken     = "token"
+	EventCellStart = "cell-started"
+	EventCellDone  = "cell-completed"
+	EventFinished  = "generation-finished"
+	EventCancelled = "generation-cancelled"
+	EventError     = "error"
+)
+
+// Event is a progress event of a notebook generation.
+type Event struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text,omitempty"`
+	Index int             `json:"index"`
+	Cell  *notebooks.Cell `json:"cell,omitempty"`
+	HTML  string          `json:"html,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// EventHub records the events of each generation and fans them out to
+// subscribers. Subscribers that connect late receive the events they missed.
+//
+// Once a generation ends, its events are compacted into a snapshot of the
+// finished notebook: the last cell-completed event of each cell and the final
+// event. The snapshot is dropped after TTL; the notebook is on disk by then.
+type EventHub struct {
+	// TTL is how long the events of an ended generation are kept.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*eventStream
+	// watchers counts the subscribers of each generation, and watched is
+	// when the last one left or the events were reset.
+	watchers map[string]int
+	watched  map[string]time.Time
+}
+
+type eventStream struct {
+	events []Event
+	// seqs are the sequence numbers of events, starting at 1, which
+	// compaction leaves unchanged so that clients can resume.
+	seqs    []int
+	next    int
+	done    bool
+	changed chan struct{}
+}
+
+// NewEventHub returns an empty EventHub that keeps the events of ended
+// generations for 10 minutes.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		TTL:      10 * time.Minute,
+		streams:  map[string]*eventStream{},
+		watchers: map[string]int{},
+		watched:  map[string]time.Time{},
+	}
+}
+
+func (h *EventHub) stream(id string) *eventStream {
+	s, ok := h.streams[id]
+	if !ok {
+		s = &eventStream{next: 1, changed: make(chan struct{})}
+		h.streams[id] = s
+	}
+	return s
+}
+
+// evict drops the events of id if they are still s.
+func (h *EventHub) evict(id string, s *eventStream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[id] != s {
+		return
+	}
+	delete(h.streams, id)
+	if h.watchers[id] == 0 {
+		delete(h.watchers, id)
+		delete(h.watched, id)
+	}
+}
+
+// compact keeps the events of a snapshot of the ended generation: the last
+// cell-completed event of each cell and the final event.
+func (s *eventStream) compact() {
+	last := map[int]int{} // cell index to position of its last cell-completed event
+	for i, e := range s.events {
+		if e.Type == EventCellDone {
+			last[e.Index] = i
+		}
+	}
+	var events []Event
+	var seqs []int
+	for i, e := range s.events {
+		keep := i == len(s.events)-1
+		if e.Type == EventCellDone {
+			keep = last[e.Index] == i
+		}
+		if keep {
+			events = append(events, e)
+			seqs = append(seqs, s.seqs[i])
+		}
+	}
+	s.events, s.seqs = events, seqs
+}
+
+// Has reports whether any events have been published for id.
+func (h *EventHub) Has(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.streams[id]
+	return ok && len(s.events) > 0
+}
+
+// Reset discards the events of id and starts a new stream of them, for
+// example before it is generated or regenerated. It also restarts the idle
+// time of id.
+func (h *EventHub) Reset(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	next := 1
+	if s, ok := h.streams[id]; ok {
+		close(s.changed)
+		delete(h.streams, id)
+		// continue the sequence for subscribers waiting on the old stream
+		next = s.next
+	}
+	h.stream(id).next = next
+	h.watched[id] = time.Now()
+}
+
+// Idle returns for how long the events of id have had no subscribers, since
+// the last one left or the events were reset, or 0 while subscribers are
+// connected.
+func (h *EventHub) Idle(id string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers[id] > 0 {
+		return 0
+	}
+	t, ok := h.watched[id]
+	if !ok {
+		t = time.Now()
+		h.watched[id] = t
+	}
+	return time.Since(t)
+}
+
+// watch counts a subscriber of id until the returned function is called.
+func (h *EventHub) watch(id string) (unwatch func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchers[id]++
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.watchers[id]--
+		h.watched[id] = time.Now()
+	}
+}
+
+// Publish appends e to the events of id. Events published after a
+// generation-finished, generation-cancelled or error event are dropped.
+func (h *EventHub) Publish(id string, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stream(id)
+	if s.done {
+		return
+	}
+	s.events = append(s.events, e)
+	s.seqs = append(s.seqs, s.next)
+	s.next++
+	s.done = e.Type == EventFinished || e.Type == EventCancelled || e.Type == EventError
+	if s.done {
+		s.compact()
+		time.AfterFunc(h.TTL, func() { h.evict(id, s) })
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// since returns the events of id after sequence number n with their
+// sequence numbers, whether the stream is done, and a channel that is closed
+// when more events arrive. It reports false if id has no stream.
+func (h *EventHub) since(id string, n int) (events []Event, seqs []int, done bool, changed <-chan struct{}, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.streams[id]
+	if !ok {
+		return nil, nil, false, nil, false
+	}
+	i := sort.SearchInts(s.seqs, n+1)
+	return append([]Event(nil), s.events[i:]...), append([]int(nil), s.seqs[i:]...), s.done, s.changed, true
+}
+
+// Progress reports whether the generation id has ended, and returns a
+// channel that is closed when more of its events arrive. It reports false if
+// id has no events, because it is unknown or its events were dropped.
+func (h *EventHub) Progress(id string) (done bool, changed <-chan struct{}, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.streams[id]
+	if !ok {
+		return false, nil, false
+	}
+	return s.done, s.changed, true
+}
+
+// ServeHTTP streams the events of the generation named by the "id" path
+// value as Server-Sent Events. The event id is the sequence number, so
+// reconnecting clients resume where they left off. Generations without
+// events, because they are unknown or their events were dropped, are not
+// found.
+func (h *EventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id := r.PathValue("id")
+	n, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	events, seqs, done, changed, ok := h.since(id, n)
+	if !ok {
+		http.Error(w, "no events for generation "+id, http.StatusNotFound)
+		return
+	}
+	defer h.watch(id)()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	for {
+		for i, e := range events {
+			n = seqs[i]
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", n, e.Type, data)
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		if events, seqs, done, changed, ok = h.since(id, n); !ok {
+			// dropped while the client waited
+			return
+		}
+	}
+}
+
+// PublishNotebook publishes the events of an already generated notebook: a
+// cell-started and cell-completed event per cell followed by
+// generation-finished.
+func (h *EventHub) PublishNotebook(id string, nb *notebooks.Notebook) {
+	for i := range nb.Cells {
+		h.PublishCell(id, nb, i)
+	}
+	h.Publish(id, Event{Type: EventFinished, Index: len(nb.Cells)})
+}
+
+// PublishCell publishes the cell-started and cell-completed events of cell i
+// of nb. A generation that regenerates one cell publishes only that cell's
+// events, for viewers to swap the cell in place.
+func (h *EventHub) PublishCell(id string, nb *notebooks.Notebook, i int) {
+	cell := nb.Cells[i]
+	buf := new(bytes.Buffer)
+	nbhtml.New(nb).WriteCell(buf, &cell)
+	h.Publish(id, Event{Type: EventCellStart, Index: i})
+	h.Publish(id, Event{Type: EventCellDone, Index: i, Cell: &cell, HTML: buf.String()})
+}
@@ -0,0 +1,170 @@
+package nbsim
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestEventHubConcurrent publishes and reads events from many goroutines;
+// run with -race.
+func TestEventHubConcurrent(t *testing.T) {
+	h := NewEventHub()
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		id := fmt.Sprint(i % 2)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				h.Publish(id, Event{Type: EventToken, Text: "x"})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				h.since(id, n)
+				h.Has(id)
+			}
+		}()
+	}
+	wg.Wait()
+	h.Reset("0")
+	if events, _, _, _, _ := h.since("1", 0); len(events) != 200 {
+		t.Errorf("got %d events, want 200", len(events))
+	}
+	if h.Has("0") {
+		t.Errorf("events of a reset stream remain")
+	}
+}
+
+func TestEventHubIdle(t *testing.T) {
+	h := NewEventHub()
+	h.Reset("a")
+	time.Sleep(10 * time.Millisecond)
+	if idle := h.Idle("a"); idle < 10*time.Millisecond {
+		t.Errorf("Idle = %s, want at least 10ms", idle)
+	}
+	unwatch := h.watch("a")
+	if idle := h.Idle("a"); idle != 0 {
+		t.Errorf("Idle while watched = %s, want 0", idle)
+	}
+	unwatch()
+	if idle := h.Idle("a"); idle >= 10*time.Millisecond {
+		t.Errorf("Idle after the last watcher left = %s, want less than 10ms", idle)
+	}
+}
+
+func TestEventHubUnknown(t *testing.T) {
+	h := NewEventHub()
+	mux := http.NewServeMux()
+	mux.Handle("/_events/{id}", h)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/_events/nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown id = %d, want 404", rec.Code)
+	}
+	if _, _, _, _, ok := h.since("nope", 0); ok {
+		t.Errorf("GET of an unknown id created a stream")
+	}
+}
+
+// TestEventHubCompact checks that the events of an ended generation are
+// compacted into the last cell-completed event of each cell and the final
+// event, which keep their sequence numbers.
+func TestEventHubCompact(t *testing.T) {
+	h := NewEventHub()
+	h.Reset("a")
+	for _, e := range []Event{
+		{Type: EventQueued, Index: 1},
+		{Type: EventToken, Text: "x"},
+		{Type: EventCellStart, Index: 0},
+		{Type: EventCellDone, Index: 0, HTML: "old"},
+		{Type: EventToken, Text: "y"},
+		{Type: EventCellDone, Index: 0, HTML: "new"},
+		{Type: EventCellDone, Index: 1, HTML: "second"},
+		{Type: EventFinished, Index: 2},
+	} {
+		h.Publish("a", e)
+	}
+	h.Publish("a", Event{Type: EventToken, Text: "after the end"})
+	events, seqs, done, _, ok := h.since("a", 0)
+	if !ok || !done {
+		t.Fatalf("since = ok %v, done %v; want both", ok, done)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Type+":"+e.HTML)
+	}
+	want := []string{"cell-completed:new", "cell-completed:second", "generation-finished:"}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if !slices.Equal(seqs, []int{6, 7, 8}) {
+		t.Errorf("sequence numbers = %v, want [6 7 8]", seqs)
+	}
+	if events, _, _, _, _ := h.since("a", 6); len(events) != 2 {
+		t.Errorf("since 6 = %d events, want 2", len(events))
+	}
+}
+
+func TestEventHubEvict(t *testing.T) {
+	h := NewEventHub()
+	h.TTL = 10 * time.Millisecond
+	h.Reset("a")
+	h.Publish("a", Event{Type: EventToken})
+	time.Sleep(30 * time.Millisecond)
+	if !h.Has("a") {
+		t.Fatalf("events of a running generation were dropped")
+	}
+	h.Publish("a", Event{Type: EventFinished})
+	time.Sleep(30 * time.Millisecond)
+	if _, _, _, _, ok := h.since("a", 0); ok {
+		t.Errorf("events of an ended generation are kept after the TTL")
+	}
+}
+
+// TestEventHubResume streams events over HTTP, and resumes after a reset
+// with the sequence numbers of the old stream.
+func TestEventHubResume(t *testing.T) {
+	h := NewEventHub()
+	mux := http.NewServeMux()
+	mux.Handle("/_events/{id}", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	get := func(lastID string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/_events/a", nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	h.Reset("a")
+	h.Publish("a", Event{Type: EventToken, Text: "x"})
+	h.Publish("a", Event{Type: EventError, Error: "failed"})
+	h.Reset("a") // regenerated
+	h.Publish("a", Event{Type: EventCellDone, Index: 0, HTML: "cell"})
+	h.Publish("a", Event{Type: EventFinished, Index: 1})
+
+	body := get("")
+	if !strings.Contains(body, "id: 3\nevent: cell-completed\n") || !strings.Contains(body, "id: 4\nevent: generation-finished\n") {
+		t.Errorf("events =\n%s\nwant cell-completed and generation-finished as 3 and 4", body)
+	}
+	if body := get("3"); strings.Contains(body, "cell-completed") || !strings.Contains(body, "id: 4\n") {
+		t.Errorf("events after 3 =\n%s\nwant generation-finished only", body)
+	}
+}
@@ -0,0 +1,62 @@
+package nbsim
+
+import (
+	_ "embed"
+	"fmt"
+)
+
+// Format is the format the model is asked to write notebooks in.
+type Format string
+
+const (
+	// FormatJSON asks for the notebook as nbformat JSON.
+	FormatJSON Format = "json"
+	// FormatCells asks for the notebook in the cell markup parsed by
+	// notebooks.CellParser.
+	FormatCells Format = "cells"
+	// FormatTools asks the model to add the notebook's cells by calling
+	// AddCellTool, one call per cell.
+	FormatTools Format = "tools"
+)
+
+var (
+	//go:embed cell-format-prompt.txt
+	cellFormatPrompt string
+	//go:embed tool-format-prompt.txt
+	toolFormatPrompt string
+)
+
+// ParseFormat returns the format named s. The empty string names FormatJSON,
+// the format of generations recorded before formats could be chosen.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatCells, FormatTools:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown generation format %q (available: json, cells, tools)", s)
+}
+
+// SystemPrompt returns the system prompt that asks for notebooks in f.
+func (f Format) SystemPrompt() string {
+	switch f {
+	case FormatCells:
+		return SystemPrompt + "\n" + cellFormatPrompt
+	case FormatTools:
+		return SystemPrompt + "\n" + toolFormatPrompt
+	}
+	return SystemPrompt
+}
+
+// Prefill returns the start of the model's response, which is written for it
+// to hold it to the format, or "" if the response is not prefilled.
+func (f Format) Prefill() string {
+	switch f {
+	case FormatCells:
+		return ":::cell"
+	case FormatTools:
+		return ""
+	}
+	return "{"
+}
@@ -0,0 +1,63 @@
+# Minimal Python kernel for nbsim's subprocess protocol.
+#
+# Reads one JSON request per line from stdin, {"code": "..."}, and writes one
+# JSON response per line, {"execution_count": n, "outputs": [...]}, where the
+# outputs are nbformat v4 output objects.
+import ast
+import io
+import json
+import os
+import sys
+import traceback
+
+proto = os.fdopen(os.dup(1), "w")
+os.dup2(2, 1)
+namespace = {"__name__": "__main__"}
+count = 0
+
+
+def run(code):
+    outputs = []
+    stdout, stderr = io.StringIO(), io.StringIO()
+    sys.stdout, sys.stderr = stdout, stderr
+    result = None
+    try:
+        tree = ast.parse(code, mode="exec")
+        last = None
+        if tree.body and isinstance(tree.body[-1], ast.Expr):
+            last = ast.Expression(tree.body.pop().value)
+        exec(compile(tree, "<cell>", "exec"), namespace)
+        if last is not None:
+            result = eval(compile(last, "<cell>", "eval"), namespace)
+    except BaseException as e:
+        error = {
+            "output_type": "error",
+            "ename": type(e).__name__,
+            "evalue": str(e),
+            "traceback": traceback.format_exception(type(e), e, e.__traceback__),
+        }
+    else:
+        error = None
+    finally:
+        sys.stdout, sys.stderr = sys.__stdout__, sys.__stderr__
+    for name, buf in (("stdout", stdout), ("stderr", stderr)):
+        if buf.getvalue():
+            outputs.append({"output_type": "stream", "name": name, "text": buf.getvalue()})
+    if error is not None:
+        outputs.append(error)
+    elif result is not None:
+        outputs.append({
+            "output_type": "execute_result",
+            "execution_count": count,
+            "data": {"text/plain": repr(result)},
+            "metadata": {},
+        })
+    return outputs
+
+
+for line in sys.stdin:
+    request = json.loads(line)
+    count += 1
+    outputs = run(request["code"])
+    proto.write(json.dumps({"execution_count": count, "outputs": outputs}) + "\n")
+    proto.flush()
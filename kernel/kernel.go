@@ -0,0 +1,70 @@
+// Package kernel executes the code cells of notebooks, either against a
+// Jupyter kernel over the ZMQ wire protocol or against a local subprocess
+// speaking a line-delimited JSON protocol.
+package kernel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// Kernel runs code and reports its outputs.
+type Kernel interface {
+	// Execute runs code and returns its outputs. If ctx is done before the
+	// code finishes, Execute interrupts the kernel and returns ctx.Err().
+	Execute(ctx context.Context, code string) (*Result, error)
+	// Close shuts the kernel down.
+	Close() error
+}
+
+// Result is the outcome of executing one cell.
+type Result struct {
+	ExecutionCount *int
+	Outputs        notebooks.Outputs
+}
+
+// ErrTimeout is reported in the error output of a cell that exceeded its
+// timeout.
+var ErrTimeout = errors.New("cell execution timed out")
+
+// Execute runs the code cells of nb in order and returns a copy of nb whose
+// code cells have the real outputs and execution counts. Cells that raise are
+// kept with their error output and execution continues. A cell that exceeds
+// cellTimeout gets a timeout error output and the remaining cells are left
+// unexecuted, since the kernel state is unknown; the returned error is then
+// ErrTimeout.
+func Execute(ctx context.Context, k Kernel, nb *notebooks.Notebook, cellTimeout time.Duration) (*notebooks.Notebook, error) {
+	out := *nb
+	out.Cells = make([]notebooks.Cell, len(nb.Cells))
+	copy(out.Cells, nb.Cells)
+	for i := range out.Cells {
+		c := &out.Cells[i]
+		if c.CellType != "code" {
+			continue
+		}
+		c.Outputs, c.ExecutionCount = notebooks.Outputs{}, nil
+	}
+	for i := range out.Cells {
+		c := &out.Cells[i]
+		if c.CellType != "code" || c.Source == nil {
+			continue
+		}
+		cellCtx, cancel := context.WithTimeout(ctx, cellTimeout)
+		res, err := k.Execute(cellCtx, c.Source.String())
+		cancel()
+		switch {
+		case err == nil:
+			c.ExecutionCount, c.Outputs = res.ExecutionCount, res.Outputs
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			c.Outputs = append(c.Outputs, notebooks.NewErrorOutput("TimeoutError", fmt.Sprintf("cell did not finish within %v", cellTimeout)))
+			return &out, ErrTimeout
+		default:
+			return &out, fmt.Errorf("cells[%d]: %w", i, err)
+		}
+	}
+	return &out, nil
+}
@@ -0,0 +1,268 @@
+package kernel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// stubEnv makes the test binary run as a stub kernel speaking the subprocess
+// protocol.
+const stubEnv = "NBSIM_STUB_KERNEL=1"
+
+// stubCommands are the cells the stub kernel understands, by their first
+// word; the rest of the cell is the argument.
+var stubCommands = map[string]func(arg string) notebooks.Outputs{
+	"print": func(arg string) notebooks.Outputs {
+		return notebooks.Outputs{notebooks.NewStreamOutput("stdout", arg+"\n")}
+	},
+	"value": func(arg string) notebooks.Outputs {
+		return notebooks.Outputs{
+			notebooks.NewStreamOutput("stdout", "computing\n"),
+			notebooks.NewExecuteResult(0, notebooks.MimeBundle{"text/plain": {Value: arg}}),
+		}
+	},
+	"raise": func(arg string) notebooks.Outputs {
+		return notebooks.Outputs{notebooks.NewErrorOutput("ValueError", arg, "Traceback", "ValueError: "+arg)}
+	},
+	"env": func(string) notebooks.Outputs {
+		return notebooks.Outputs{notebooks.NewStreamOutput("stdout", strings.Join(os.Environ(), "\n"))}
+	},
+	"sleep": func(arg string) notebooks.Outputs {
+		d, _ := time.ParseDuration(arg)
+		time.Sleep(d)
+		return notebooks.Outputs{}
+	},
+	"crash": func(string) notebooks.Outputs {
+		os.Exit(3)
+		return nil
+	},
+}
+
+func TestMain(m *testing.M) {
+	if slices.Contains(os.Environ(), stubEnv) {
+		runStub()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runStub answers cells on stdin until it is closed.
+func runStub() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		var req struct{ Code string }
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			os.Exit(2)
+		}
+		name, arg, _ := strings.Cut(req.Code, " ")
+		outputs := notebooks.Outputs{}
+		if cmd, ok := stubCommands[name]; ok {
+			outputs = cmd(arg)
+		}
+		for _, o := range outputs {
+			if r, ok := o.(*notebooks.ExecuteResult); ok {
+				r.ExecutionCount = &n
+			}
+		}
+		b, _ := json.Marshal(map[string]any{"execution_count": n, "outputs": outputs})
+		fmt.Printf("%s\n", b)
+	}
+}
+
+func startStub(t *testing.T, ctx context.Context, sb *Sandbox) Kernel {
+	t.Helper()
+	if sb == nil {
+		sb = &Sandbox{}
+	}
+	sb.Env = append(sb.Env, stubEnv)
+	k, err := Subprocess(ctx, t.TempDir(), []string{os.Args[0]}, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { k.Close() })
+	return k
+}
+
+func outputsJSON(t *testing.T, outputs notebooks.Outputs) string {
+	t.Helper()
+	b, err := json.Marshal(outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSubprocess(t *testing.T) {
+	k := startStub(t, context.Background(), nil)
+	tests := []struct {
+		code string
+		want notebooks.Outputs
+	}{
+		{"print hello", notebooks.Outputs{notebooks.NewStreamOutput("stdout", "hello\n")}},
+		{"value 42", notebooks.Outputs{
+			notebooks.NewStreamOutput("stdout", "computing\n"),
+			notebooks.NewExecuteResult(2, notebooks.MimeBundle{"text/plain": {Value: "42"}}),
+		}},
+		{"raise bad", notebooks.Outputs{notebooks.NewErrorOutput("ValueError", "bad", "Traceback", "ValueError: bad")}},
+		{"nothing", notebooks.Outputs{}},
+	}
+	for i, tt := range tests {
+		res, err := k.Execute(context.Background(), tt.code)
+		if err != nil {
+			t.Fatalf("Execute(%q): %v", tt.code, err)
+		}
+		if res.ExecutionCount == nil || *res.ExecutionCount != i+1 {
+			t.Errorf("Execute(%q) execution count = %v, want %d", tt.code, res.ExecutionCount, i+1)
+		}
+		if got, want := outputsJSON(t, res.Outputs), outputsJSON(t, tt.want); got != want {
+			t.Errorf("Execute(%q) outputs = %s, want %s", tt.code, got, want)
+		}
+	}
+}
+
+// TestSubprocessEnv checks that the kernel gets a minimal environment, so
+// that secrets such as API keys do not leak into it.
+func TestSubprocessEnv(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "secret")
+	k := startStub(t, context.Background(), &Sandbox{Env: []string{"EXTRA=1"}})
+	res, err := k.Execute(context.Background(), "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := strings.Split(res.Outputs[0].(*notebooks.StreamOutput).Text.String(), "\n")
+	for _, v := range env {
+		name, _, _ := strings.Cut(v, "=")
+		switch name {
+		case "PATH", "HOME", "TMPDIR", "LANG", "EXTRA", "NBSIM_STUB_KERNEL":
+		default:
+			t.Errorf("kernel environment has %s", v)
+		}
+	}
+	if !slices.Contains(env, "EXTRA=1") {
+		t.Errorf("kernel environment %q lacks the sandbox's EXTRA=1", env)
+	}
+}
+
+func TestSubprocessCrash(t *testing.T) {
+	k := startStub(t, context.Background(), nil)
+	if _, err := k.Execute(context.Background(), "print before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Execute(context.Background(), "crash"); err == nil {
+		t.Errorf("Execute of a crashing cell succeeded")
+	}
+	if _, err := k.Execute(context.Background(), "print after"); err == nil {
+		t.Errorf("Execute after a crash succeeded")
+	}
+	if err := k.Close(); err != nil {
+		t.Errorf("Close after a crash = %v", err)
+	}
+}
+
+// TestSubprocessContext checks that the kernel is killed when the context it
+// was started with is done.
+func TestSubprocessContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	k := startStub(t, ctx, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := k.Execute(context.Background(), "sleep 1h")
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Execute in a killed kernel succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("kernel still runs after its context is done")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	nb, err := notebooks.NewBuilder().Python().
+		Markdown("# Title").
+		Code("print one").Output(notebooks.NewStreamOutput("stdout", "made up\n")).Executed().
+		Code("raise oops").
+		Code("value 3").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startStub(t, context.Background(), nil)
+	out, err := Execute(context.Background(), k, nb, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`[]`,
+		`[{"name":"stdout","output_type":"stream","text":"one\n"}]`,
+		`[{"ename":"ValueError","evalue":"oops","output_type":"error","traceback":["Traceback","ValueError: oops"]}]`,
+		`[{"name":"stdout","output_type":"stream","text":"computing\n"},{"data":{"text/plain":"3"},"execution_count":3,"metadata":{},"output_type":"execute_result"}]`,
+	}
+	for i, c := range out.Cells {
+		if c.CellType != "code" {
+			continue
+		}
+		if got := outputsJSON(t, c.Outputs); got != want[i] {
+			t.Errorf("cell %d outputs = %s, want %s", i, got, want[i])
+		}
+		if c.ExecutionCount == nil || *c.ExecutionCount != i {
+			t.Errorf("cell %d execution count = %v, want %d", i, c.ExecutionCount, i)
+		}
+	}
+	if got := outputsJSON(t, nb.Cells[1].Outputs); !strings.Contains(got, "made up") {
+		t.Errorf("Execute changed the notebook it was given")
+	}
+}
+
+// TestExecuteTimeout checks that a cell over the timeout gets a timeout error
+// and that the cells after it are left unexecuted.
+func TestExecuteTimeout(t *testing.T) {
+	nb, err := notebooks.NewBuilder().Python().
+		Code("print one").
+		Code("sleep 1h").
+		Code("print three").Output(notebooks.NewStreamOutput("stdout", "made up\n")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startStub(t, context.Background(), nil)
+	out, err := Execute(context.Background(), k, nb, 100*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Execute = %v, want ErrTimeout", err)
+	}
+	if got := outputsJSON(t, out.Cells[1].Outputs); !strings.Contains(got, "TimeoutError") {
+		t.Errorf("timed out cell outputs = %s, want a TimeoutError", got)
+	}
+	if c := out.Cells[2]; len(c.Outputs) != 0 || c.ExecutionCount != nil {
+		t.Errorf("cell after the timeout = %s, %v; want it unexecuted", outputsJSON(t, c.Outputs), c.ExecutionCount)
+	}
+}
+
+func TestExecuteCrash(t *testing.T) {
+	nb, err := notebooks.NewBuilder().Python().Code("print one").Code("crash").Code("print three").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := startStub(t, context.Background(), nil)
+	out, err := Execute(context.Background(), k, nb, time.Minute)
+	if err == nil || !strings.HasPrefix(err.Error(), "cells[1]: ") {
+		t.Fatalf("Execute = %v, want an error in cells[1]", err)
+	}
+	if got := outputsJSON(t, out.Cells[0].Outputs); !strings.Contains(got, "one") {
+		t.Errorf("cell before the crash outputs = %s", got)
+	}
+}
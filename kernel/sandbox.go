@@ -0,0 +1,98 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Sandbox restricts the process of a kernel started by Subprocess or Launch,
+// which runs code written by a model.
+//
+// Every kernel process gets a minimal environment, so that secrets in nbsim's
+// environment such as API keys are not visible to cells, and is killed along
+// with the processes it started when its context is done. The fields add
+// further restrictions; the zero Sandbox adds none.
+type Sandbox struct {
+	// Env is added to the minimal environment, as "key=value" pairs.
+	Env []string
+	// CPUTime, Memory and FileSize limit the CPU time, the address space
+	// in bytes and the size of the files written by each process of the
+	// kernel, if positive.
+	CPUTime          time.Duration
+	Memory, FileSize int64
+	// UID and GID, if positive, run the kernel as another user and group,
+	// which needs nbsim to run as root. The kernel's directory is given to
+	// them.
+	UID, GID int
+	// Isolate runs the kernel in new user, network, mount, IPC, UTS and PID
+	// namespaces: it has no network access and cannot see or signal other
+	// processes. It can still read the files its user can, which UID
+	// restricts. Only Linux supports it.
+	Isolate bool
+}
+
+// environ returns the environment of a kernel process running in dir.
+func (sb *Sandbox) environ(dir string) []string {
+	path := os.Getenv("PATH")
+	if path == "" {
+		path = "/usr/local/bin:/usr/bin:/bin"
+	}
+	env := []string{
+		"PATH=" + path,
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+		"LANG=C.UTF-8",
+	}
+	return append(env, sb.Env...)
+}
+
+// command returns the command running argv in dir within the sandbox. It is
+// killed along with its processes when ctx is done.
+func (sb *Sandbox) command(ctx context.Context, dir string, argv []string) (*exec.Cmd, error) {
+	attr, err := sb.sysProcAttr()
+	if err != nil {
+		return nil, err
+	}
+	if err := sb.chown(dir); err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = sb.environ(dir)
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error { return kill(cmd) }
+	// processes the kernel started may hold its output open
+	cmd.WaitDelay = 5 * time.Second
+	return cmd, nil
+}
+
+// start starts cmd and limits its resources, before it is sent any code.
+func (sb *Sandbox) start(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := sb.limit(cmd.Process.Pid); err != nil {
+		kill(cmd)
+		cmd.Wait()
+		return fmt.Errorf("kernel: limiting resources: %w", err)
+	}
+	return nil
+}
+
+// chown gives name to the sandbox's user and group, if set.
+func (sb *Sandbox) chown(name string) error {
+	if sb.UID <= 0 && sb.GID <= 0 {
+		return nil
+	}
+	uid, gid := -1, -1
+	if sb.UID > 0 {
+		uid = sb.UID
+	}
+	if sb.GID > 0 {
+		gid = sb.GID
+	}
+	return os.Chown(name, uid, gid)
+}
@@ -0,0 +1,61 @@
+package kernel
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func (sb *Sandbox) sysProcAttr() (*syscall.SysProcAttr, error) {
+	// The kernel leads a process group so that kill reaches the processes
+	// it starts, and dies with nbsim.
+	attr := &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	uid, gid := os.Getuid(), os.Getgid()
+	if sb.UID > 0 {
+		uid = sb.UID
+	}
+	if sb.GID > 0 {
+		gid = sb.GID
+	}
+	if sb.Isolate {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID
+		// The user keeps its ID in the namespace, where it is the only one.
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), NoSetGroups: true}
+	} else if sb.UID > 0 || sb.GID > 0 {
+		attr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	}
+	return attr, nil
+}
+
+// limit sets the resource limits of the process pid, which the processes it
+// starts inherit.
+func (sb *Sandbox) limit(pid int) error {
+	for _, l := range []struct {
+		resource int
+		value    int64
+	}{
+		{unix.RLIMIT_CPU, int64((sb.CPUTime + 999_999_999) / 1e9)},
+		{unix.RLIMIT_AS, sb.Memory},
+		{unix.RLIMIT_FSIZE, sb.FileSize},
+	} {
+		if l.value <= 0 {
+			continue
+		}
+		rlim := &unix.Rlimit{Cur: uint64(l.value), Max: uint64(l.value)}
+		if err := unix.Prlimit(pid, l.resource, rlim, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kill kills the process of cmd and the processes it started.
+func kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,96 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+func init() {
+	stubCommands["dial"] = func(addr string) notebooks.Outputs {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return notebooks.Outputs{notebooks.NewErrorOutput("OSError", err.Error())}
+		}
+		conn.Close()
+		return notebooks.Outputs{notebooks.NewStreamOutput("stdout", "connected\n")}
+	}
+	stubCommands["limits"] = func(string) notebooks.Outputs {
+		var cpu, as, fsize syscall.Rlimit
+		syscall.Getrlimit(syscall.RLIMIT_CPU, &cpu)
+		syscall.Getrlimit(syscall.RLIMIT_AS, &as)
+		syscall.Getrlimit(syscall.RLIMIT_FSIZE, &fsize)
+		return notebooks.Outputs{notebooks.NewStreamOutput("stdout", fmt.Sprintf("%d %d %d", cpu.Cur, as.Cur, fsize.Cur))}
+	}
+	stubCommands["pid"] = func(string) notebooks.Outputs {
+		return notebooks.Outputs{notebooks.NewStreamOutput("stdout", fmt.Sprint(os.Getpid()))}
+	}
+}
+
+func stdout(t *testing.T, k Kernel, code string) string {
+	t.Helper()
+	res, err := k.Execute(context.Background(), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Outputs) != 1 {
+		t.Fatalf("%s: %d outputs, want 1", code, len(res.Outputs))
+	}
+	switch o := res.Outputs[0].(type) {
+	case *notebooks.StreamOutput:
+		return o.Text.String()
+	case *notebooks.ErrorOutput:
+		return o.EName + ": " + o.EValue
+	}
+	t.Fatalf("%s: unexpected output %T", code, res.Outputs[0])
+	return ""
+}
+
+func TestSandboxLimits(t *testing.T) {
+	k := startStub(t, context.Background(), &Sandbox{CPUTime: 1500 * time.Millisecond, Memory: 8 << 30, FileSize: 1 << 20})
+	if got, want := stdout(t, k, "limits"), fmt.Sprintf("2 %d %d", 8<<30, 1<<20); got != want {
+		t.Errorf("kernel limits = %s, want %s", got, want)
+	}
+}
+
+func TestSandboxIsolate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	open := startStub(t, context.Background(), nil)
+	if got := stdout(t, open, "dial "+l.Addr().String()); got != "connected\n" {
+		t.Fatalf("kernel cannot connect without isolation: %s", got)
+	}
+
+	sb := &Sandbox{Isolate: true, Env: []string{stubEnv}}
+	k, err := Subprocess(context.Background(), t.TempDir(), []string{os.Args[0]}, sb)
+	if err != nil {
+		t.Skipf("cannot create namespaces: %v", err)
+	}
+	defer k.Close()
+	if got := stdout(t, k, "dial "+l.Addr().String()); !strings.HasPrefix(got, "OSError: ") {
+		t.Errorf("isolated kernel dialing nbsim's listener: %s, want an error", got)
+	}
+	if got := stdout(t, k, "pid"); got != "1" {
+		t.Errorf("isolated kernel pid = %s, want 1 in its own PID namespace", got)
+	}
+}
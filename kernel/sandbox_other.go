@@ -0,0 +1,26 @@
+//go:build !linux
+
+package kernel
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+func (sb *Sandbox) sysProcAttr() (*syscall.SysProcAttr, error) {
+	if sb.Isolate || sb.UID > 0 || sb.GID > 0 || sb.CPUTime > 0 || sb.Memory > 0 || sb.FileSize > 0 {
+		return nil, fmt.Errorf("kernel: sandbox restrictions are not supported on %s", runtime.GOOS)
+	}
+	return nil, nil
+}
+
+func (sb *Sandbox) limit(pid int) error {
+	return nil
+}
+
+// kill kills the process of cmd.
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,118 @@
+package kernel
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// PythonDriver is a Python program implementing the subprocess protocol. It
+// can be run with Subprocess(ctx, dir, []string{"python3", "-c", PythonDriver}, sb).
+//
+//go:embed driver.py
+var PythonDriver string
+
+// subprocessKernel runs cells in a child process that reads one JSON request
+// per line on stdin, {"code": "..."}, and answers each with one JSON line on
+// stdout, {"execution_count": n, "outputs": [...]}, where outputs are nbformat
+// v4 output objects. A stub kernel for tests only needs to speak this
+// protocol.
+type subprocessKernel struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// Subprocess starts argv in dir within sb, if non-nil, as a kernel speaking
+// the subprocess protocol. The process is killed when ctx is done. Its stderr
+// is discarded.
+func Subprocess(ctx context.Context, dir string, argv []string, sb *Sandbox) (Kernel, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("kernel: empty command")
+	}
+	if sb == nil {
+		sb = &Sandbox{}
+	}
+	cmd, err := sb.command(ctx, dir, argv)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := sb.start(cmd); err != nil {
+		return nil, err
+	}
+	return &subprocessKernel{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+type subprocessReply struct {
+	ExecutionCount *int              `json:"execution_count"`
+	Outputs        notebooks.Outputs `json:"outputs"`
+}
+
+// Execute sends code to the process and waits for its reply. The process
+// cannot be interrupted, so it is killed if ctx is done first.
+func (k *subprocessKernel) Execute(ctx context.Context, code string) (*Result, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	req, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		return nil, err
+	}
+	type reply struct {
+		line []byte
+		err  error
+	}
+	done := make(chan reply, 1)
+	go func() {
+		if _, err := k.stdin.Write(append(req, '\n')); err != nil {
+			done <- reply{err: err}
+			return
+		}
+		line, err := k.stdout.ReadBytes('\n')
+		done <- reply{line, err}
+	}()
+	select {
+	case <-ctx.Done():
+		kill(k.cmd)
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("kernel process: %w", r.err)
+		}
+		var rep subprocessReply
+		if err := json.Unmarshal(r.line, &rep); err != nil {
+			return nil, fmt.Errorf("kernel process: invalid reply: %w", err)
+		}
+		if rep.Outputs == nil {
+			rep.Outputs = notebooks.Outputs{}
+		}
+		return &Result{ExecutionCount: rep.ExecutionCount, Outputs: rep.Outputs}, nil
+	}
+}
+
+// Close closes the process's stdin and waits for it to exit.
+func (k *subprocessKernel) Close() error {
+	k.stdin.Close()
+	err := k.cmd.Wait()
+	if _, ok := err.(*exec.ExitError); ok {
+		// The process was killed after a timeout or exited on its own.
+		return nil
+	}
+	return err
+}
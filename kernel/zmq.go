@@ -0,0 +1,509 @@
+package kernel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zeromq/zmq4"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// ConnectionInfo is the content of a Jupyter kernel connection file.
+type ConnectionInfo struct {
+	Transport       string `json:"transport"`
+	IP              string `json:"ip"`
+	ShellPort       int    `json:"shell_port"`
+	IOPubPort       int    `json:"iopub_port"`
+	StdinPort       int    `json:"stdin_port"`
+	ControlPort     int    `json:"control_port"`
+	HBPort          int    `json:"hb_port"`
+	Key             string `json:"key"`
+	SignatureScheme string `json:"signature_scheme"`
+	KernelName      string `json:"kernel_name,omitempty"`
+}
+
+// ReadConnectionFile reads a kernel connection file, as written by
+// `jupyter kernel` or a notebook server.
+func ReadConnectionFile(path string) (*ConnectionInfo, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info := &ConnectionInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil, fmt.Errorf("connection file %s: %w", path, err)
+	}
+	return info, nil
+}
+
+func (c *ConnectionInfo) endpoint(port int) string {
+	if c.Transport == "ipc" {
+		// IP is the path prefix of the sockets.
+		return fmt.Sprintf("ipc://%s-%d", c.IP, port)
+	}
+	return fmt.Sprintf("%s://%s:%d", c.Transport, c.IP, port)
+}
+
+// kernelStartTimeout bounds how long a kernel may take to answer its first
+// kernel_info_request.
+const kernelStartTimeout = 60 * time.Second
+
+// zmqKernel talks to a Jupyter kernel over the messaging protocol v5.
+type zmqKernel struct {
+	mu      sync.Mutex
+	info    ConnectionInfo
+	session string
+	cancel  context.CancelFunc
+
+	shell, control, iopub zmq4.Socket
+	shellCh, iopubCh      chan *message
+
+	// set when the kernel was launched by Launch
+	cmd      *exec.Cmd
+	connFile string
+}
+
+// Launch starts a kernel in dir within sb, if non-nil, with argv, in which
+// "{connection_file}" is replaced by the path of a freshly written connection
+// file, as in a kernelspec:
+//
+//	Launch(ctx, dir, []string{"python3", "-m", "ipykernel_launcher", "-f", "{connection_file}"}, nil)
+//
+// The kernel is killed when ctx is done. An isolated kernel, which has no
+// network, is connected to over Unix sockets in dir.
+func Launch(ctx context.Context, dir string, argv []string, sb *Sandbox) (Kernel, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("kernel: empty command")
+	}
+	if sb == nil {
+		sb = &Sandbox{}
+	}
+	var info *ConnectionInfo
+	var err error
+	if sb.Isolate {
+		info = newIPCConnectionInfo(dir)
+	} else {
+		info, err = newConnectionInfo()
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "nbsim-kernel-*.json")
+	if err != nil {
+		return nil, err
+	}
+	err = json.NewEncoder(f).Encode(info)
+	f.Close()
+	if err == nil {
+		err = sb.chown(f.Name())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	args := make([]string, len(argv))
+	for i, a := range argv {
+		args[i] = strings.ReplaceAll(a, "{connection_file}", f.Name())
+	}
+	cmd, err := sb.command(ctx, dir, args)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := sb.start(cmd); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	k, err := connect(ctx, info)
+	if err != nil {
+		kill(cmd)
+		cmd.Wait()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	k.cmd, k.connFile = cmd, f.Name()
+	return k, nil
+}
+
+// Connect connects to a running kernel.
+func Connect(ctx context.Context, info *ConnectionInfo) (Kernel, error) {
+	return connect(ctx, info)
+}
+
+func connect(ctx context.Context, info *ConnectionInfo) (*zmqKernel, error) {
+	if info.SignatureScheme != "" && info.SignatureScheme != "hmac-sha256" {
+		return nil, fmt.Errorf("kernel: unsupported signature scheme %q", info.SignatureScheme)
+	}
+	sockCtx, cancel := context.WithCancel(context.Background())
+	k := &zmqKernel{
+		info:    *info,
+		session: newID(),
+		cancel:  cancel,
+		shell:   zmq4.NewDealer(sockCtx),
+		control: zmq4.NewDealer(sockCtx),
+		iopub:   zmq4.NewSub(sockCtx),
+		shellCh: make(chan *message, 16),
+		iopubCh: make(chan *message, 256),
+	}
+	for _, s := range []struct {
+		sock zmq4.Socket
+		port int
+	}{{k.shell, info.ShellPort}, {k.control, info.ControlPort}, {k.iopub, info.IOPubPort}} {
+		if err := dialRetry(ctx, s.sock, info.endpoint(s.port)); err != nil {
+			k.closeSockets()
+			return nil, err
+		}
+	}
+	if err := k.iopub.SetOption(zmq4.OptionSubscribe, ""); err != nil {
+		k.closeSockets()
+		return nil, err
+	}
+	go k.read(k.shell, k.shellCh)
+	go k.read(k.iopub, k.iopubCh)
+	if err := k.waitReady(ctx); err != nil {
+		k.closeSockets()
+		return nil, err
+	}
+	return k, nil
+}
+
+// dialRetry dials endpoint until the kernel listens on it.
+func dialRetry(ctx context.Context, sock zmq4.Socket, endpoint string) error {
+	deadline := time.Now().Add(kernelStartTimeout)
+	for {
+		err := sock.Dial(endpoint)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("kernel: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitReady sends kernel_info_requests until the kernel replies and its
+// iopub messages arrive, so that no output of the first cell is missed.
+func (k *zmqKernel) waitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, kernelStartTimeout)
+	defer cancel()
+	var replied, subscribed bool
+	for !replied || !subscribed {
+		if _, err := k.send(k.shell, "kernel_info_request", map[string]any{}); err != nil {
+			return err
+		}
+		retry := time.After(500 * time.Millisecond)
+	wait:
+		for !replied || !subscribed {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("kernel: waiting for kernel: %w", ctx.Err())
+			case m, ok := <-k.shellCh:
+				if !ok {
+					return errors.New("kernel: shell channel closed")
+				}
+				replied = replied || m.Header.MsgType == "kernel_info_reply"
+			case _, ok := <-k.iopubCh:
+				if !ok {
+					return errors.New("kernel: iopub channel closed")
+				}
+				subscribed = true
+			case <-retry:
+				break wait
+			}
+		}
+	}
+	// Drop the replies to the retried requests.
+	for {
+		select {
+		case <-k.shellCh:
+		case <-k.iopubCh:
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+}
+
+func (k *zmqKernel) Execute(ctx context.Context, code string) (*Result, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	msgID, err := k.send(k.shell, "execute_request", map[string]any{
+		"code":             code,
+		"silent":           false,
+		"store_history":    true,
+		"user_expressions": map[string]any{},
+		"allow_stdin":      false,
+		"stop_on_error":    false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Outputs: notebooks.Outputs{}}
+	var replied, idle bool
+	for !replied || !idle {
+		select {
+		case <-ctx.Done():
+			k.interrupt()
+			return nil, ctx.Err()
+		case m, ok := <-k.shellCh:
+			if !ok {
+				return nil, errors.New("kernel: shell channel closed")
+			}
+			if m.ParentHeader.MsgID != msgID || m.Header.MsgType != "execute_reply" {
+				continue
+			}
+			var reply struct {
+				ExecutionCount *int `json:"execution_count"`
+			}
+			json.Unmarshal(m.Content, &reply)
+			if reply.ExecutionCount != nil {
+				res.ExecutionCount = reply.ExecutionCount
+			}
+			replied = true
+		case m, ok := <-k.iopubCh:
+			if !ok {
+				return nil, errors.New("kernel: iopub channel closed")
+			}
+			if m.ParentHeader.MsgID != msgID {
+				continue
+			}
+			idle = k.handleIOPub(m, res) || idle
+		}
+	}
+	return res, nil
+}
+
+// handleIOPub adds the output carried by m to res and reports whether m
+// announces that the kernel is idle again.
+func (k *zmqKernel) handleIOPub(m *message, res *Result) bool {
+	switch m.Header.MsgType {
+	case "status":
+		var status struct {
+			ExecutionState string `json:"execution_state"`
+		}
+		json.Unmarshal(m.Content, &status)
+		return status.ExecutionState == "idle"
+	case "execute_input":
+		var input struct {
+			ExecutionCount *int `json:"execution_count"`
+		}
+		json.Unmarshal(m.Content, &input)
+		res.ExecutionCount = input.ExecutionCount
+	case "clear_output":
+		res.Outputs = notebooks.Outputs{}
+	case "stream":
+		var o notebooks.StreamOutput
+		if err := json.Unmarshal(m.Content, &o); err != nil {
+			return false
+		}
+		if n := len(res.Outputs); n > 0 {
+			if prev, ok := res.Outputs[n-1].(*notebooks.StreamOutput); ok && prev.Name == o.Name {
+				prev.Text = notebooks.MultilineString{Value: prev.Text.String() + o.Text.String()}
+				return false
+			}
+		}
+		res.Outputs = append(res.Outputs, notebooks.NewStreamOutput(o.Name, o.Text.String()))
+	case "display_data", "execute_result":
+		// decode only the fields an output keeps, dropping transient data
+		var o notebooks.ExecuteResult
+		if err := json.Unmarshal(m.Content, &o); err != nil {
+			return false
+		}
+		if m.Header.MsgType == "display_data" {
+			res.Outputs = append(res.Outputs, &notebooks.DisplayData{Data: o.Data, Metadata: o.Metadata})
+		} else {
+			res.Outputs = append(res.Outputs, &notebooks.ExecuteResult{ExecutionCount: o.ExecutionCount, Data: o.Data, Metadata: o.Metadata})
+		}
+	case "error":
+		var o notebooks.ErrorOutput
+		if err := json.Unmarshal(m.Content, &o); err != nil {
+			return false
+		}
+		res.Outputs = append(res.Outputs, notebooks.NewErrorOutput(o.EName, o.EValue, o.Traceback...))
+	}
+	return false
+}
+
+// interrupt interrupts the running cell: by signal for kernels we launched,
+// and with an interrupt_request otherwise.
+func (k *zmqKernel) interrupt() {
+	if k.cmd != nil {
+		k.cmd.Process.Signal(os.Interrupt)
+		return
+	}
+	k.send(k.control, "interrupt_request", map[string]any{})
+}
+
+// Close shuts down a kernel started by Launch. A kernel joined with Connect
+// is left running.
+func (k *zmqKernel) Close() error {
+	if k.cmd != nil {
+		k.send(k.control, "shutdown_request", map[string]any{"restart": false})
+		done := make(chan struct{})
+		go func() {
+			k.cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			kill(k.cmd)
+			<-done
+		}
+		os.Remove(k.connFile)
+	}
+	k.closeSockets()
+	return nil
+}
+
+func (k *zmqKernel) closeSockets() {
+	k.cancel()
+	k.shell.Close()
+	k.control.Close()
+	k.iopub.Close()
+}
+
+// read forwards the messages received on sock to ch until sock is closed.
+func (k *zmqKernel) read(sock zmq4.Socket, ch chan<- *message) {
+	defer close(ch)
+	for {
+		zm, err := sock.Recv()
+		if err != nil {
+			return
+		}
+		m, err := k.decode(zm.Frames)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "kernel: dropping message:", err)
+			continue
+		}
+		ch <- m
+	}
+}
+
+type header struct {
+	MsgID    string `json:"msg_id"`
+	Session  string `json:"session"`
+	Username string `json:"username"`
+	Date     string `json:"date"`
+	MsgType  string `json:"msg_type"`
+	Version  string `json:"version"`
+}
+
+type message struct {
+	Header       header
+	ParentHeader header
+	Content      json.RawMessage
+}
+
+const delimiter = "<IDS|MSG>"
+
+func (k *zmqKernel) send(sock zmq4.Socket, msgType string, content any) (string, error) {
+	h := header{
+		MsgID:    newID(),
+		Session:  k.session,
+		Username: "nbsim",
+		Date:     time.Now().UTC().Format(time.RFC3339Nano),
+		MsgType:  msgType,
+		Version:  "5.3",
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	parts := [][]byte{hb, []byte("{}"), []byte("{}"), cb}
+	frames := append([][]byte{[]byte(delimiter), []byte(k.sign(parts))}, parts...)
+	return h.MsgID, sock.Send(zmq4.NewMsgFrom(frames...))
+}
+
+func (k *zmqKernel) decode(frames [][]byte) (*message, error) {
+	i := 0
+	for i < len(frames) && string(frames[i]) != delimiter {
+		i++
+	}
+	if len(frames) < i+6 {
+		return nil, errors.New("short message")
+	}
+	sig, parts := string(frames[i+1]), frames[i+2:i+6]
+	if k.info.Key != "" && !hmac.Equal([]byte(sig), []byte(k.sign(parts))) {
+		return nil, errors.New("invalid signature")
+	}
+	m := &message{Content: bytes.Clone(parts[3])}
+	if err := json.Unmarshal(parts[0], &m.Header); err != nil {
+		return nil, err
+	}
+	json.Unmarshal(parts[1], &m.ParentHeader)
+	return m, nil
+}
+
+func (k *zmqKernel) sign(parts [][]byte) string {
+	if k.info.Key == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(k.info.Key))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newConnectionInfo() (*ConnectionInfo, error) {
+	info := &ConnectionInfo{
+		Transport:       "tcp",
+		IP:              "127.0.0.1",
+		Key:             newID(),
+		SignatureScheme: "hmac-sha256",
+	}
+	for _, port := range []*int{&info.ShellPort, &info.IOPubPort, &info.StdinPort, &info.ControlPort, &info.HBPort} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		*port = l.Addr().(*net.TCPAddr).Port
+		defer l.Close()
+	}
+	return info, nil
+}
+
+// newIPCConnectionInfo returns the connection info of a kernel listening on
+// Unix sockets in dir.
+func newIPCConnectionInfo(dir string) *ConnectionInfo {
+	return &ConnectionInfo{
+		Transport:       "ipc",
+		IP:              filepath.Join(dir, "kernel"),
+		ShellPort:       1,
+		IOPubPort:       2,
+		StdinPort:       3,
+		ControlPort:     4,
+		HBPort:          5,
+		Key:             newID(),
+		SignatureScheme: "hmac-sha256",
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
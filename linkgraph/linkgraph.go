@@ -0,0 +1,236 @@
+// Package linkgraph extracts the nblinks of generated notebooks and builds the
+// directed graph of notebooks they connect.
+package linkgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+// Link is a link found in a markdown cell. Its URL is as written, which
+// Resolve turns into a node key.
+type Link struct {
+	URL  string `json:"url"`
+	Text string `json:"text,omitempty"`
+	Cell int    `json:"cell"`
+}
+
+var md = goldmark.New(goldmark.WithExtensions(extension.Linkify))
+
+// ExtractLinks returns the navigable links of the markdown cells of nb, in
+// order. Images, fragments and non-http schemes such as mailto: are skipped.
+func ExtractLinks(nb *notebooks.Notebook) []Link {
+	var links []Link
+	for i, c := range nb.Cells {
+		if c.CellType != "markdown" || c.Source == nil {
+			continue
+		}
+		source := []byte(c.Source.String())
+		doc := md.Parser().Parse(text.NewReader(source))
+		ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+			if !entering {
+				return ast.WalkContinue, nil
+			}
+			var dest, label string
+			switch n := n.(type) {
+			case *ast.Link:
+				dest, label = string(n.Destination), string(n.Text(source))
+			case *ast.AutoLink:
+				if n.AutoLinkType != ast.AutoLinkURL {
+					return ast.WalkSkipChildren, nil
+				}
+				dest, label = string(n.URL(source)), string(n.Label(source))
+			default:
+				return ast.WalkContinue, nil
+			}
+			dest = strings.TrimSpace(dest)
+			if _, ok := Normalize(dest); ok && !strings.HasPrefix(dest, "#") {
+				links = append(links, Link{URL: dest, Text: label, Cell: i})
+			}
+			return ast.WalkSkipChildren, nil
+		})
+	}
+	return links
+}
+
+// Normalize returns the form of a notebook URL used as a graph node key: its
+// path, without a trailing slash. The server keys notebooks by the path the
+// viewer requests them under, so the scheme, host, query and fragment of the
+// full URLs of nblinks are dropped. It reports false for URLs that do not
+// name a notebook.
+func Normalize(rawURL string) (string, bool) {
+	return Resolve("/", rawURL)
+}
+
+// Resolve is like Normalize but resolves ref, a link in the notebook at
+// base, relative to base.
+func Resolve(base, ref string) (string, bool) {
+	b, err := url.Parse(strings.TrimSpace(base))
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https":
+	default:
+		return "", false
+	}
+	p := b.ResolveReference(u).Path
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+	if p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// State describes how far a notebook in the graph has been explored.
+type State string
+
+const (
+	// StateGenerated notebooks have been generated successfully.
+	StateGenerated State = "generated"
+	// StateVisited notebooks have been requested but not generated yet, or
+	// their generation failed.
+	StateVisited State = "visited"
+	// StateDangling notebooks are linked to but were never requested.
+	StateDangling State = "dangling"
+)
+
+// Page is a notebook that has been requested.
+type Page struct {
+	URL string
+	// ID identifies the generation of the notebook.
+	ID string
+	// Notebook is the generated notebook, or nil if there is none yet.
+	Notebook *notebooks.Notebook
+}
+
+// Node is a notebook in the graph.
+type Node struct {
+	URL   string `json:"url"`
+	ID    string `json:"id,omitempty"`
+	State State  `json:"state"`
+}
+
+// Edge is a link from one notebook to another.
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Text string `json:"text,omitempty"`
+}
+
+// Graph is the directed graph of notebooks and their links.
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Build returns the graph of pages and the notebooks they link to.
+func Build(pages []Page) *Graph {
+	nodes := map[string]*Node{}
+	var edges []Edge
+	for _, p := range pages {
+		from, ok := Normalize(p.URL)
+		if !ok {
+			from = p.URL
+		}
+		state := StateVisited
+		if p.Notebook != nil {
+			state = StateGenerated
+		}
+		nodes[from] = &Node{URL: from, ID: p.ID, State: state}
+	}
+	for _, p := range pages {
+		if p.Notebook == nil {
+			continue
+		}
+		from, ok := Normalize(p.URL)
+		if !ok {
+			from = p.URL
+		}
+		seen := map[string]bool{}
+		for _, l := range ExtractLinks(p.Notebook) {
+			to, ok := Resolve(from, l.URL)
+			if !ok || seen[to] || to == from {
+				continue
+			}
+			seen[to] = true
+			edges = append(edges, Edge{From: from, To: to, Text: l.Text})
+			if _, ok := nodes[to]; !ok {
+				nodes[to] = &Node{URL: to, State: StateDangling}
+			}
+		}
+	}
+	g := &Graph{Nodes: make([]Node, 0, len(nodes)), Edges: edges}
+	for _, n := range nodes {
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].URL < g.Nodes[j].URL })
+	if g.Edges == nil {
+		g.Edges = []Edge{}
+	}
+	return g
+}
+
+// Dangling returns the nodes that are linked to but were never requested.
+func (g *Graph) Dangling() []Node {
+	var nodes []Node
+	for _, n := range g.Nodes {
+		if n.State == StateDangling {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// WriteJSON writes g as indented JSON.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+var dotStyles = map[State]string{
+	StateGenerated: `style=filled, fillcolor="#c8e6c9"`,
+	StateVisited:   `style=filled, fillcolor="#fff9c4"`,
+	StateDangling:  `style=dashed`,
+}
+
+// WriteDOT writes g in the Graphviz DOT language.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph nbsim {\n\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "\t%s [%s];\n", dotQuote(n.URL), dotStyles[n.State])
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(&b, "\t%s -> %s", dotQuote(e.From), dotQuote(e.To))
+		if e.Text != "" {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(e.Text))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
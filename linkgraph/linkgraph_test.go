@@ -0,0 +1,143 @@
+package linkgraph
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+func markdownNotebook(t *testing.T, sources ...string) *notebooks.Notebook {
+	t.Helper()
+	b := notebooks.NewBuilder()
+	for _, s := range sources {
+		b.Markdown(s)
+	}
+	nb, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nb
+}
+
+func TestExtractLinks(t *testing.T) {
+	nb := markdownNotebook(t,
+		"See [the intro](https://nbsim.example/ml/intro) and <https://nbsim.example/ml/next>.",
+		"![plot](https://nbsim.example/plot.png) [top](#top) [mail](mailto:a@example.com) [rel](advanced?level=2)",
+	)
+	nb.Cells = append(nb.Cells, notebooks.Cell{CellType: "code", Source: &notebooks.MultilineString{Value: "# [not](/a/link)"}})
+	var got []string
+	for _, l := range ExtractLinks(nb) {
+		got = append(got, fmt.Sprintf("%d %s %q", l.Cell, l.URL, l.Text))
+	}
+	want := []string{
+		`0 https://nbsim.example/ml/intro "the intro"`,
+		`0 https://nbsim.example/ml/next "https://nbsim.example/ml/next"`,
+		`1 advanced?level=2 "rel"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ExtractLinks =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		base, ref string
+		want      string
+		wantOK    bool
+	}{
+		{"/", "https://Nbsim.Example/ml/intro/#setup", "/ml/intro", true},
+		{"/", "http://nbsim.example", "/", true},
+		{"/", "/ml/intro?level=2", "/ml/intro", true},
+		{"/ml/intro", "advanced", "/ml/advanced", true},
+		{"/ml/intro", "../stats/", "/stats", true},
+		{"/ml/intro", "https://other.example/x", "/x", true},
+		{"/", "mailto:a@example.com", "", false},
+		{"/", "javascript:alert(1)", "", false},
+		{"/", "%zz", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := Resolve(tt.base, tt.ref); got != tt.want || ok != tt.wantOK {
+			t.Errorf("Resolve(%q, %q) = %q, %v; want %q, %v", tt.base, tt.ref, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	pages := []Page{
+		{URL: "/ml/intro", ID: "gen-intro.v1", Notebook: markdownNotebook(t,
+			"# Intro\n\n[Next](https://nbsim.example/ml/next) [Stats](../stats/)",
+			"[Again](https://nbsim.example/ml/next#part-2) [Self](/ml/intro) [Advanced](advanced)",
+		)},
+		{URL: "/ml/next", ID: "gen-next.v1", Notebook: markdownNotebook(t,
+			"[Back](http://nbsim.example/ml/intro/) [Pending](https://nbsim.example/ml/pending)",
+		)},
+		// requested but not generated yet
+		{URL: "/ml/pending", ID: "gen-pending.v1"},
+	}
+	g := Build(pages)
+
+	var nodes []string
+	for _, n := range g.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s %s %s", n.URL, n.State, n.ID))
+	}
+	wantNodes := []string{
+		"/ml/advanced dangling ",
+		"/ml/intro generated gen-intro.v1",
+		"/ml/next generated gen-next.v1",
+		"/ml/pending visited gen-pending.v1",
+		"/stats dangling ",
+	}
+	if strings.Join(nodes, "\n") != strings.Join(wantNodes, "\n") {
+		t.Errorf("nodes =\n%s\nwant\n%s", strings.Join(nodes, "\n"), strings.Join(wantNodes, "\n"))
+	}
+
+	var edges []string
+	for _, e := range g.Edges {
+		edges = append(edges, fmt.Sprintf("%s -> %s %q", e.From, e.To, e.Text))
+	}
+	wantEdges := []string{
+		`/ml/intro -> /ml/next "Next"`,
+		`/ml/intro -> /stats "Stats"`,
+		`/ml/intro -> /ml/advanced "Advanced"`,
+		`/ml/next -> /ml/intro "Back"`,
+		`/ml/next -> /ml/pending "Pending"`,
+	}
+	if strings.Join(edges, "\n") != strings.Join(wantEdges, "\n") {
+		t.Errorf("edges =\n%s\nwant\n%s", strings.Join(edges, "\n"), strings.Join(wantEdges, "\n"))
+	}
+
+	var dangling []string
+	for _, n := range g.Dangling() {
+		dangling = append(dangling, n.URL)
+	}
+	if got := strings.Join(dangling, " "); got != "/ml/advanced /stats" {
+		t.Errorf("Dangling = %s, want /ml/advanced /stats", got)
+	}
+}
+
+func TestBuildEmpty(t *testing.T) {
+	var b strings.Builder
+	if err := Build(nil).WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\n  \"nodes\": [],\n  \"edges\": []\n}\n"; b.String() != want {
+		t.Errorf("empty graph = %q, want %q", b.String(), want)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	g := Build([]Page{{URL: "/a", Notebook: markdownNotebook(t, `[say "hi"](/b)`)}})
+	var b strings.Builder
+	if err := g.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "digraph nbsim {\n\tnode [shape=box];\n" +
+		"\t\"/a\" [style=filled, fillcolor=\"#c8e6c9\"];\n" +
+		"\t\"/b\" [style=dashed];\n" +
+		"\t\"/a\" -> \"/b\" [label=\"say \\\"hi\\\"\"];\n}\n"
+	if b.String() != want {
+		t.Errorf("WriteDOT =\n%s\nwant\n%s", b.String(), want)
+	}
+}
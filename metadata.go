@@ -0,0 +1,56 @@
+package nbsim
+
+import (
+	"encoding/json"
+
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
+)
+
+// metadataKey is the notebook metadata key of GenerationMetadata.
+const metadataKey = "nbsim"
+
+// GenerationMetadata is what nbsim records about a generation in the metadata
+// of its notebook.
+type GenerationMetadata struct {
+	Model string          `json:"model,omitempty"`
+	Usage *registry.Usage `json:"usage,omitempty"`
+	// LatencyMS and TimeToFirstTokenMS are the timings of the model's
+	// answer, as recorded in the registry.
+	LatencyMS          int64 `json:"latency_ms,omitempty"`
+	TimeToFirstTokenMS int64 `json:"time_to_first_token_ms,omitempty"`
+	// Continuations is the number of requests that continued the notebook
+	// after the max-tokens limit cut it off, and Truncated whether it was
+	// still cut off after the last one allowed.
+	Continuations int  `json:"continuations,omitempty"`
+	Truncated     bool `json:"truncated,omitempty"`
+	// Turns is the number of requests of a generation in the tools format.
+	Turns int `json:"turns,omitempty"`
+	// Cancelled reports whether the generation was stopped before it
+	// finished, leaving the notebook partial, and CancelReason why.
+	Cancelled    bool   `json:"cancelled,omitempty"`
+	CancelReason string `json:"cancel_reason,omitempty"`
+}
+
+// ReadGenerationMetadata returns the generation metadata of nb, which is
+// zero if nb has none.
+func ReadGenerationMetadata(nb *notebooks.Notebook) GenerationMetadata {
+	var m GenerationMetadata
+	if raw, ok := nb.Metadata.Unknown[metadataKey]; ok {
+		json.Unmarshal(raw, &m)
+	}
+	return m
+}
+
+// SetGenerationMetadata sets the generation metadata of nb.
+func SetGenerationMetadata(nb *notebooks.Notebook, m GenerationMetadata) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if nb.Metadata.Unknown == nil {
+		nb.Metadata.Unknown = notebooks.Unknown{}
+	}
+	nb.Metadata.Unknown[metadataKey] = raw
+	return nil
+}
@@ -0,0 +1,85 @@
+package nbhtml
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+var ansiColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// ansiToHTML escapes s and converts its ANSI SGR escape sequences (as found in
+// IPython tracebacks) into styled spans. Other escape sequences are dropped.
+func ansiToHTML(s string) string {
+	var (
+		out        strings.Builder
+		fg, bg     string
+		bold, open bool
+	)
+	for {
+		i := strings.IndexByte(s, '\x1b')
+		if i < 0 {
+			out.WriteString(template.HTMLEscapeString(s))
+			break
+		}
+		out.WriteString(template.HTMLEscapeString(s[:i]))
+		s = s[i+1:]
+		if !strings.HasPrefix(s, "[") {
+			continue
+		}
+		end := strings.IndexFunc(s[1:], func(r rune) bool { return r >= '@' && r <= '~' })
+		if end < 0 {
+			break
+		}
+		params, final := s[1:end+1], s[end+1]
+		s = s[end+2:]
+		if final != 'm' {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			n, _ := strconv.Atoi(p)
+			switch {
+			case n == 0:
+				fg, bg, bold = "", "", false
+			case n == 1:
+				bold = true
+			case n == 22:
+				bold = false
+			case n >= 30 && n <= 37:
+				fg = ansiColors[n-30]
+			case n == 39:
+				fg = ""
+			case n >= 40 && n <= 47:
+				bg = ansiColors[n-40]
+			case n == 49:
+				bg = ""
+			case n >= 90 && n <= 97:
+				fg = ansiColors[n-90]
+			case n >= 100 && n <= 107:
+				bg = ansiColors[n-100]
+			}
+		}
+		if open {
+			out.WriteString("</span>")
+			open = false
+		}
+		var classes []string
+		if fg != "" {
+			classes = append(classes, "ansi-"+fg+"-fg")
+		}
+		if bg != "" {
+			classes = append(classes, "ansi-"+bg+"-bg")
+		}
+		if bold {
+			classes = append(classes, "ansi-bold")
+		}
+		if len(classes) > 0 {
+			out.WriteString(`<span class="` + strings.Join(classes, " ") + `">`)
+			open = true
+		}
+	}
+	if open {
+		out.WriteString("</span>")
+	}
+	return out.String()
+}
@@ -0,0 +1,223 @@
+// Package nbhtml renders notebooks as standalone HTML pages without relying
+// on jupyter nbconvert.
+//
+// A rendered page consists of a preamble (everything up to and including the
+// opening <main> tag), one top-level div per cell, and a closing footer, so
+// that cells can be streamed to a browser one at a time.
+//
+// Notebooks come from a model, so the HTML they carry, in markdown cells and
+// outputs, is sanitized: scripts, event handlers, styles and frames are
+// dropped, and SVG images are shown as images, where their scripts do not
+// run.
+package nbhtml
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/tmc/nbsim/notebooks"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+// Footer closes the page opened by WriteHeader.
+const Footer = "</main></body></html>"
+
+// Renderer converts notebooks and their cells to HTML.
+type Renderer struct {
+	// Language is the lexer used to highlight code cells.
+	Language string
+	// Style is the chroma style used for highlighting.
+	Style string
+
+	markdown  goldmark.Markdown
+	formatter *chromahtml.Formatter
+}
+
+// policy sanitizes the HTML of notebooks. It keeps the formatting, tables,
+// links and images of user-generated content, and the classes that pandas
+// and other libraries style their output with.
+var policy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Globally()
+	p.AllowDataURIImages()
+	return p
+}()
+
+// New returns a Renderer configured for the language of nb.
+func New(nb *notebooks.Notebook) *Renderer {
+	lang := "python"
+	if nb != nil {
+		if li := nb.Metadata.LanguageInfo; li != nil && li.Name != "" {
+			lang = li.Name
+		} else if ks := nb.Metadata.KernelSpec; ks != nil && ks.Name != "" {
+			lang = ks.Name
+		}
+	}
+	return &Renderer{
+		Language: lang,
+		Style:    "github",
+		markdown: goldmark.New(
+			goldmark.WithExtensions(extension.GFM),
+			goldmark.WithRendererOptions(gmhtml.WithUnsafe()),
+		),
+		formatter: chromahtml.New(chromahtml.WithClasses(true)),
+	}
+}
+
+// Render writes nb to w as a complete HTML page.
+func Render(w io.Writer, nb *notebooks.Notebook) error {
+	r := New(nb)
+	if err := r.WriteHeader(w, nb.Metadata.Title); err != nil {
+		return err
+	}
+	for i := range nb.Cells {
+		if err := r.WriteCell(w, &nb.Cells[i]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, Footer)
+	return err
+}
+
+var headerTmpl = template.Must(template.New("header").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>{{.Title}}</title>
+<style>
+{{.CSS}}
+</style>
+<script>
+window.MathJax = {tex: {inlineMath: [['$', '$'], ['\\(', '\\)']], processEscapes: true}};
+</script>
+<script src="https://cdn.jsdelivr.net/npm/mathjax@3/es5/tex-chtml.js" async></script>
+</head>
+<body>
+<main class="notebook">
+`))
+
+const baseCSS = `body { margin: 0; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; line-height: 1.5; color: #1f2328; }
+main.notebook { max-width: 1000px; margin: 0 auto; padding: 1em; }
+.cell { display: flex; flex-direction: column; margin: 0.5em 0; }
+.input, .output { display: flex; }
+.prompt { flex: 0 0 6em; padding: 0.4em; text-align: right; font-family: monospace; color: #303f9f; }
+.output .prompt { color: #d84315; }
+.source, .output-body { flex: 1; min-width: 0; overflow-x: auto; }
+.source pre { margin: 0; padding: 0.4em; background: #f7f7f7; border: 1px solid #cfcfcf; border-radius: 2px; }
+.output-body pre { margin: 0; padding: 0.4em; white-space: pre-wrap; }
+.output-stderr { background: #fdd; }
+.output-error pre { background: #fdd; }
+.markdown { padding: 0 0.4em 0 6.4em; }
+.raw pre { margin: 0 0 0 6em; padding: 0.4em; }
+img { max-width: 100%; }
+.ansi-bold { font-weight: bold; }
+.ansi-black-fg { color: #3e424d; } .ansi-red-fg { color: #e75c58; } .ansi-green-fg { color: #00a250; } .ansi-yellow-fg { color: #ddb62b; }
+.ansi-blue-fg { color: #208ffb; } .ansi-magenta-fg { color: #d160c4; } .ansi-cyan-fg { color: #60c6c8; } .ansi-white-fg { color: #c5c1b4; }
+.ansi-black-bg { background: #3e424d; } .ansi-red-bg { background: #e75c58; } .ansi-green-bg { background: #00a250; } .ansi-yellow-bg { background: #ddb62b; }
+.ansi-blue-bg { background: #208ffb; } .ansi-magenta-bg { background: #d160c4; } .ansi-cyan-bg { background: #60c6c8; } .ansi-white-bg { background: #c5c1b4; }
+`
+
+// WriteHeader writes the page preamble, up to and including the opening
+// <main> tag.
+func (r *Renderer) WriteHeader(w io.Writer, title string) error {
+	if title == "" {
+		title = "Notebook"
+	}
+	css := new(strings.Builder)
+	if err := r.WriteCSS(css); err != nil {
+		return err
+	}
+	return headerTmpl.Execute(w, map[string]any{
+		"Title": title,
+		"CSS":   template.CSS(css.String()),
+	})
+}
+
+// WriteCSS writes the stylesheet used by rendered cells.
+func (r *Renderer) WriteCSS(w io.Writer) error {
+	if _, err := io.WriteString(w, baseCSS); err != nil {
+		return err
+	}
+	return r.formatter.WriteCSS(w, r.style())
+}
+
+// WriteCell writes c as a single top-level div.
+func (r *Renderer) WriteCell(w io.Writer, c *notebooks.Cell) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, `<div class="cell %s-cell"`, template.HTMLEscapeString(c.CellType))
+	if c.ID != "" {
+		fmt.Fprintf(buf, ` id="cell-%s"`, template.HTMLEscapeString(c.ID))
+	}
+	buf.WriteString(">\n")
+	source := ""
+	if c.Source != nil {
+		source = c.Source.String()
+	}
+	switch c.CellType {
+	case "markdown":
+		buf.WriteString(`<div class="markdown">`)
+		if err := r.writeMarkdown(buf, source); err != nil {
+			return err
+		}
+		buf.WriteString("</div>\n")
+	case "code":
+		fmt.Fprintf(buf, `<div class="input"><div class="prompt">In&nbsp;[%s]:</div><div class="source">`, executionCount(c.ExecutionCount))
+		if err := r.highlight(buf, source); err != nil {
+			return err
+		}
+		buf.WriteString("</div></div>\n")
+		for _, o := range c.Outputs {
+			r.writeOutput(buf, o)
+		}
+	default:
+		fmt.Fprintf(buf, `<div class="raw"><pre>%s</pre></div>`+"\n", template.HTMLEscapeString(source))
+	}
+	buf.WriteString("</div>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeMarkdown writes source converted to sanitized HTML. Markdown may embed
+// HTML, which goldmark passes through and policy then sanitizes.
+func (r *Renderer) writeMarkdown(buf *bytes.Buffer, source string) error {
+	html := new(bytes.Buffer)
+	if err := r.markdown.Convert([]byte(source), html); err != nil {
+		return err
+	}
+	buf.Write(policy.SanitizeBytes(html.Bytes()))
+	return nil
+}
+
+func (r *Renderer) highlight(w io.Writer, source string) error {
+	lexer := lexers.Get(r.Language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, source)
+	if err != nil {
+		return err
+	}
+	return r.formatter.Format(w, r.style(), it)
+}
+
+func (r *Renderer) style() *chroma.Style {
+	return styles.Get(r.Style)
+}
+
+func executionCount(n *int) string {
+	if n == nil {
+		return "&nbsp;"
+	}
+	return fmt.Sprint(*n)
+}
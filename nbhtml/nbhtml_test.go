@@ -0,0 +1,149 @@
+package nbhtml
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const xss = `<script>alert(1)</script><img src="x" onerror="alert(2)"><a href="javascript:alert(3)">link</a><iframe src="https://example.com"></iframe><p style="position:fixed" onclick="alert(4)">text</p>`
+
+const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><script>alert(5)</script><rect width="10" height="10"/></svg>`
+
+// png is a 1x1 transparent PNG, base64-encoded as in notebooks.
+const png = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII=\n"
+
+func bundle(mime, value string) notebooks.MimeBundle {
+	return notebooks.MimeBundle{mime: {Value: value}}
+}
+
+var goldenCells = []struct {
+	name string
+	cell func(b *notebooks.Builder) *notebooks.Builder
+}{
+	{"markdown", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Markdown("# Title\n\nSome *emphasis*, `code` and $x < y$.\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n<details><summary>more</summary>hidden</details>\n\n" + xss + "\n")
+	}},
+	{"code", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("def f(x):\n    \"\"\"Add one.\"\"\"\n    return x + 1  # <b>\n").Executed()
+	}},
+	{"raw", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Raw("<script>raw</script>")
+	}},
+	{"stream", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("run()").Output(
+			notebooks.NewStreamOutput("stdout", "plain \x1b[1;31mbold red\x1b[0m \x1b[42mon green\x1b[49m & <tag>\n"),
+			notebooks.NewStreamOutput("stderr", "\x1b[93mwarning\x1b[39m\x1b[2K\n"),
+		)
+	}},
+	{"error", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("1/0").Output(notebooks.NewErrorOutput("ZeroDivisionError", "division by zero",
+			"\x1b[0;31m---------------------------------------------------------------------------\x1b[0m",
+			"\x1b[0;31mZeroDivisionError\x1b[0m: division by zero"))
+	}},
+	{"html", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("df").Output(notebooks.NewExecuteResult(1, notebooks.MimeBundle{
+			"text/html":  {Value: `<table class="dataframe"><tr><th>a</th></tr><tr><td>1</td></tr></table>` + xss},
+			"text/plain": {Value: "   a\n0  1"},
+		}))
+	}},
+	{"svg", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("plot()").Output(notebooks.NewDisplayData(bundle("image/svg+xml", svg)))
+	}},
+	{"png", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("plot()").Output(notebooks.NewDisplayData(bundle("image/png", png)))
+	}},
+	{"jpeg", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("plot()").Output(notebooks.NewDisplayData(bundle("image/jpeg", "/9j/4AAQ\nSkZJRg==\n")))
+	}},
+	{"output-markdown", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("Markdown(s)").Output(notebooks.NewDisplayData(bundle("text/markdown", "**bold** "+xss)))
+	}},
+	{"latex", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("Math(s)").Output(notebooks.NewDisplayData(bundle("text/latex", `$\frac{a}{b} < c$`)))
+	}},
+	{"json", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("JSON(d)").Output(notebooks.NewDisplayData(bundle("application/json", `{"a":[1,2],"b":"<i>"}`)))
+	}},
+	{"plain", func(b *notebooks.Builder) *notebooks.Builder {
+		return b.Code("x").Output(notebooks.NewExecuteResult(2, bundle("text/plain", "<object at 0x1>")))
+	}},
+}
+
+func TestWriteCellGolden(t *testing.T) {
+	for _, tt := range goldenCells {
+		t.Run(tt.name, func(t *testing.T) {
+			nb, err := tt.cell(notebooks.NewBuilder().Python()).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := new(bytes.Buffer)
+			if err := New(nb).WriteCell(buf, &nb.Cells[0]); err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", tt.name+".html")
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("WriteCell =\n%s\nwant (%s)\n%s", got, golden, want)
+			}
+		})
+	}
+}
+
+// TestWriteCellSanitizes checks that no cell's HTML can run scripts or load
+// frames.
+func TestWriteCellSanitizes(t *testing.T) {
+	for _, tt := range goldenCells {
+		nb, err := tt.cell(notebooks.NewBuilder().Python()).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := New(nb).WriteCell(buf, &nb.Cells[0]); err != nil {
+			t.Fatal(err)
+		}
+		html := strings.ToLower(buf.String())
+		for _, bad := range []string{"<script", "onerror=", "onclick=", "javascript:", "<iframe", "style=", "<svg"} {
+			if strings.Contains(html, bad) {
+				t.Errorf("%s: rendered HTML contains %q:\n%s", tt.name, bad, buf)
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	nb, err := notebooks.NewBuilder().Python().Title("A <title>").Markdown("# Hi").Code("1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := Render(buf, nb); err != nil {
+		t.Fatal(err)
+	}
+	page := buf.String()
+	if !strings.Contains(page, "<title>A &lt;title&gt;</title>") {
+		t.Errorf("page title is not escaped:\n%s", page)
+	}
+	if got := strings.Count(page, `<div class="cell `); got != 2 {
+		t.Errorf("page has %d cells, want 2", got)
+	}
+	if !strings.HasSuffix(page, Footer) {
+		t.Errorf("page does not end with the footer")
+	}
+}
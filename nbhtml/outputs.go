@@ -0,0 +1,86 @@
+package nbhtml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// mimeOrder lists the supported mime types from richest to plainest.
+var mimeOrder = []string{
+	"text/html",
+	"image/svg+xml",
+	"image/png",
+	"image/jpeg",
+	"text/markdown",
+	"text/latex",
+	"application/json",
+	"text/plain",
+}
+
+func (r *Renderer) writeOutput(buf *bytes.Buffer, o notebooks.Output) {
+	if o == nil {
+		return
+	}
+	prompt := "&nbsp;"
+	class := "output-" + o.OutputType()
+	switch o := o.(type) {
+	case *notebooks.ExecuteResult:
+		prompt = fmt.Sprintf("Out[%s]:", executionCount(o.ExecutionCount))
+	case *notebooks.StreamOutput:
+		class = "output-" + o.Name
+	}
+	fmt.Fprintf(buf, `<div class="output %s"><div class="prompt">%s</div><div class="output-body">`, template.HTMLEscapeString(class), prompt)
+	switch o := o.(type) {
+	case *notebooks.StreamOutput:
+		fmt.Fprintf(buf, "<pre>%s</pre>", ansiToHTML(o.Text.String()))
+	case *notebooks.ErrorOutput:
+		tb := strings.Join(o.Traceback, "\n")
+		if tb == "" {
+			tb = o.EName + ": " + o.EValue
+		}
+		fmt.Fprintf(buf, "<pre>%s</pre>", ansiToHTML(tb))
+	case *notebooks.DisplayData:
+		r.writeMimeBundle(buf, o.Data)
+	case *notebooks.ExecuteResult:
+		r.writeMimeBundle(buf, o.Data)
+	}
+	buf.WriteString("</div></div>\n")
+}
+
+func (r *Renderer) writeMimeBundle(buf *bytes.Buffer, data notebooks.MimeBundle) {
+	for _, mime := range mimeOrder {
+		v, ok := data[mime]
+		if !ok {
+			continue
+		}
+		s := v.String()
+		switch mime {
+		case "text/html":
+			buf.WriteString(policy.Sanitize(s))
+		case "image/svg+xml":
+			fmt.Fprintf(buf, `<img src="data:%s;base64,%s">`, mime, base64.StdEncoding.EncodeToString([]byte(s)))
+		case "image/png", "image/jpeg":
+			fmt.Fprintf(buf, `<img src="data:%s;base64,%s">`, mime, strings.Join(strings.Fields(s), ""))
+		case "text/markdown":
+			if err := r.writeMarkdown(buf, s); err != nil {
+				fmt.Fprintf(buf, "<pre>%s</pre>", template.HTMLEscapeString(s))
+			}
+		case "text/latex":
+			fmt.Fprintf(buf, `<div class="latex">%s</div>`, template.HTMLEscapeString(s))
+		case "application/json":
+			if indented, err := json.MarshalIndent(json.RawMessage(s), "", "  "); err == nil {
+				s = string(indented)
+			}
+			fmt.Fprintf(buf, `<pre class="json">%s</pre>`, template.HTMLEscapeString(s))
+		case "text/plain":
+			fmt.Fprintf(buf, "<pre>%s</pre>", ansiToHTML(s))
+		}
+		return
+	}
+}
@@ -1,20 +1,18 @@
 package nbsim
 
 import (
-	"context"
+	"bytes"
 	"embed"
 	_ "embed"
 	"encoding/json"
 	"fmt"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
-	"sync"
-	"time"
 
+	"github.com/tmc/nbsim/nbhtml"
 	"github.com/tmc/nbsim/notebooks"
+	"github.com/tmc/nbsim/registry"
 )
 
 //go:embed system-prompt.txt
@@ -32,27 +30,49 @@ func GetViewerFileAssets() (fs.FS, error) {
 	return s, nil
 }
 
-type gen struct {
-	contents string
-	done     bool
+// GenerationID returns the identifier of the notebook generated for url. It
+// names the generated notebook and its log files in the generation directory.
+func GenerationID(url string) string {
+	return registry.BaseID(url)
 }
 
-var mu = &sync.Mutex{}
-var genned map[string]gen
-
 type notebookWriter struct {
-	parts       []string
-	repaired    string
-	baseDir     string
-	outfileBase string
+	parser  *notebooks.StreamParser
+	cells   *notebooks.CellParser
+	builder *notebooks.Builder // the cells added with AddCell
+	added   int
+	// executionCount is the execution count of the last code cell added
+	// with outputs.
+	executionCount int
+	repaired       string
+	baseDir        string
+	outfileBase    string
+
+	// OnEvent, if set, is called with the progress events of the notebook
+	// as parts are added.
+	OnEvent   func(Event)
+	started   int
+	completed int
 }
 
-func NewNotebookWriter(baseDir string, outfileBase string) *notebookWriter {
-	return &notebookWriter{
-		parts:       []string{"{"},
+// NewNotebookWriter returns a writer of the notebook the model writes in
+// format, after the format's prefill.
+func NewNotebookWriter(baseDir string, outfileBase string, format Format) *notebookWriter {
+	nw := &notebookWriter{
 		baseDir:     baseDir,
 		outfileBase: outfileBase,
 	}
+	switch format {
+	case FormatCells:
+		nw.cells = notebooks.NewCellParser()
+		nw.cells.WriteString(format.Prefill())
+	case FormatTools:
+		nw.builder = notebooks.NewBuilder().Python()
+	default:
+		nw.parser = notebooks.NewStreamParser()
+		nw.parser.WriteString(format.Prefill())
+	}
+	return nw
 }
 
 func (nw *notebookWriter) filePath(suffix string) string {
@@ -60,23 +80,63 @@ func (nw *notebookWriter) filePath(suffix string) string {
 }
 
 func (nw *notebookWriter) AddPart(part string) {
-	nw.parts = append(nw.parts, part)
-	s := strings.Join(nw.parts, "")
-	var ok bool
-	nw.repaired, ok = notebooks.RepairNotebookJSON(s)
-	if !ok {
-		// fmt.Println("issue repairing json:", err)
-		// // write to partial.ipynb:
-		// os.WriteFile("partial.ipynb", []byte(s), 0644)
-	}
-	nb := &notebooks.Notebook{}
-	os.WriteFile(nw.filePath("-raw"), []byte(nw.repaired), 0644)
-	if err := json.Unmarshal([]byte(nw.repaired), nb); err != nil {
-		fmt.Println("issue unmarshalling json:", err)
+	nw.emit(Event{Type: EventToken, Text: part})
+	if nw.builder != nil {
+		// text around the tool calls is not part of the notebook
+		return
+	}
+	if nw.cells != nil {
+		nw.cells.WriteString(part)
+	} else if _, err := nw.parser.WriteString(part); err != nil {
+		fmt.Println("issue parsing json:", err)
+	}
+	nw.update()
+}
+
+// Flush ends the model's response. In the cell format it completes the last
+// cell, which outputs could have followed until then.
+func (nw *notebookWriter) Flush() {
+	if nw.cells == nil {
 		return
 	}
-	nb.Validate()
-	repaired, err := json.MarshalIndent(nb, "", "  ")
+	if err := nw.cells.Close(); err != nil {
+		fmt.Println("issue parsing cells:", err)
+	}
+	nw.update()
+}
+
+// update writes the notebook parsed so far and emits its cell events.
+func (nw *notebookWriter) update() {
+	var nb *notebooks.Notebook
+	if nw.cells != nil || nw.builder != nil {
+		if nw.cells != nil {
+			nb = nw.cells.Notebook()
+		} else {
+			var err error
+			if nb, err = nw.builder.Build(); err != nil {
+				fmt.Println("issue building notebook:", err)
+				return
+			}
+		}
+		raw, err := notebooks.Marshal(nb)
+		if err != nil {
+			fmt.Println("issue marshalling json:", err)
+			return
+		}
+		nw.repaired = string(raw)
+	} else {
+		nw.repaired = nw.parser.Closed()
+		nb = &notebooks.Notebook{}
+		if err := json.Unmarshal([]byte(nw.repaired), nb); err != nil {
+			fmt.Println("issue unmarshalling json:", err)
+			// fall back to the cells that were completely written:
+			nb = &notebooks.Notebook{Cells: nw.parser.Cells()}
+		}
+	}
+	os.WriteFile(nw.filePath("-raw"), []byte(nw.repaired), 0644)
+	nw.emitCellEvents(nb)
+	nb.Normalize()
+	repaired, err := notebooks.Marshal(nb)
 	if err != nil {
 		fmt.Println("issue marshalling json:", err)
 		return
@@ -86,45 +146,74 @@ func (nw *notebookWriter) AddPart(part string) {
 	os.WriteFile(of, []byte(repaired), 0644)
 }
 
-func (nw *notebookWriter) startConverter(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			nw.convert()
-			return
-		case <-time.After(1 * time.Second):
-			nw.convert()
-		}
+// Validate reports where the notebook as the model wrote it, before
+// normalization, violates the nbformat schema.
+func (nw *notebookWriter) Validate() notebooks.ValidationErrors {
+	return notebooks.ValidateJSON([]byte(nw.repaired))
+}
+
+// Finish emits the final event of the generation: an error event if err is
+// non-nil and generation-finished otherwise.
+func (nw *notebookWriter) Finish(err error) {
+	if err != nil {
+		nw.emit(Event{Type: EventError, Error: err.Error()})
+		return
+	}
+	nw.emit(Event{Type: EventFinished, Index: nw.completed})
+}
+
+func (nw *notebookWriter) emit(e Event) {
+	if nw.OnEvent != nil {
+		nw.OnEvent(e)
 	}
 }
 
-func (nw *notebookWriter) convert() {
-	nb := &notebooks.Notebook{}
-	if nw.repaired == "" {
+// emitCellEvents emits cell-started and cell-completed events for the cells
+// the parser has seen since the last call.
+func (nw *notebookWriter) emitCellEvents(nb *notebooks.Notebook) {
+	if nw.OnEvent == nil {
 		return
 	}
-	os.WriteFile(fmt.Sprintf("%s-raw.ipynb", nw.outfileBase), []byte(nw.repaired), 0644)
-	if err := json.Unmarshal([]byte(nw.repaired), nb); err != nil {
-		fmt.Println("issue unmarshalling json:", err)
+	var cells []notebooks.Cell
+	var started int
+	switch {
+	case nw.builder != nil:
+		cells, started = nb.Cells, len(nb.Cells)
+	case nw.cells != nil:
+		cells, started = nw.cells.Cells(), nw.cells.Started()
+	default:
+		cells, started = nw.parser.Cells(), nw.parser.Started()
+	}
+	r := nbhtml.New(nb)
+	completeUpTo := func(n int) {
+		for ; nw.completed < n && nw.completed < len(cells); nw.completed++ {
+			cell := cells[nw.completed]
+			buf := new(bytes.Buffer)
+			if err := r.WriteCell(buf, &cell); err != nil {
+				fmt.Println("issue rendering cell:", err)
+			}
+			nw.emit(Event{Type: EventCellDone, Index: nw.completed, Cell: &cell, HTML: buf.String()})
+		}
+	}
+	for ; nw.started < started; nw.started++ {
+		completeUpTo(nw.started)
+		nw.emit(Event{Type: EventCellStart, Index: nw.started})
+	}
+	completeUpTo(len(cells))
+}
+
+// TouchOutputFile writes an empty notebook to the output file, which stands
+// in for the notebook until the model has written some of it.
+func (nw *notebookWriter) TouchOutputFile() {
+	nb, err := notebooks.NewBuilder().Python().Build()
+	if err != nil {
+		fmt.Println("issue building notebook:", err)
 		return
 	}
-	nb.Validate()
-	repaired, err := json.MarshalIndent(nb, "", "  ")
+	empty, err := notebooks.Marshal(nb)
 	if err != nil {
 		fmt.Println("issue marshalling json:", err)
 		return
 	}
-	// write to generated.ipynb then run nbonvert:
-	of := fmt.Sprintf("%s.ipynb", nw.outfileBase)
-	os.WriteFile(of, []byte(repaired), 0644)
-	// run nbconvert:
-	cmd := exec.Command("jupyter", "nbconvert", "--to", "html", of)
-	// cmd.Stdout = os.Stdout
-	// cmd.Stderr = os.Stderr
-	cmd.Start()
-}
-
-func (nw *notebookWriter) TouchOutputFile() {
-	of := nw.filePath(fmt.Sprintf("%s.ipynb", nw.outfileBase))
-	os.WriteFile(of, []byte(nw.repaired), 0644)
+	os.WriteFile(nw.filePath(""), empty, 0644)
 }
@@ -10,8 +10,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/tmc/nbsim/nbhtml"
 	"github.com/tmc/nbsim/notebooks"
 	"golang.org/x/net/html"
 )
@@ -19,6 +21,14 @@ import (
 type Handler struct {
 	RootDir         string
 	NotFoundHandler http.Handler
+	// UseNbconvert renders notebooks with jupyter nbconvert instead of the
+	// built-in nbhtml renderer.
+	UseNbconvert bool
+	// Events, if set, has the events of the generations, which tell the
+	// notebooks still being generated from those that are done. Without it
+	// a notebook is done once its JSON is complete or unchanged for 30
+	// seconds.
+	Events *EventHub
 }
 
 // handleNotebookConversion handles the conversion of a notebook to html
@@ -67,11 +77,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // serveStreamedNotebookConversion serves the conversion of a notebook to html.
 // The algorithm is as follows:
-// 1. Check if the notebook has already finished generating. We know this by seeing if it parses successfully.
-// 2. If the notebook is not done generating, we need to stream the divs of the html body only if they are complete. if the notebook is not done we should only consider a cell complete if it has a subsequent cell.
-// 3. If the notebook is done generating, we can serve the remaining cells and the end of the html body.
-// 4. We periodically poll the input ipynb file to see if it has been updated. If it has, we determine the additional divs to send to the client.
-// 5. If we do not see an update to the ipynb file for a certain amount of time, we can assume the notebook is done generating and we can serve the remaining divs.
+// 1. Read the notebook and check if its generation has finished.
+// 2. If the notebook is not done generating, only the cells that have a subsequent cell are considered finished.
+// 3. Each finished cell is keyed by its ID and hashed by its rendered content. New cells are streamed as they finish,
+// cells whose content changed are sent as replacement fragments, and cells that disappeared are removed.
+// 4. We wait for the next event of the generation, or periodically poll the input ipynb file, and start over.
+// 5. Once the generation has finished we serve the remaining cells and the end of the html body.
 func (h *Handler) serveStreamedNotebookConversion(w http.ResponseWriter, r *http.Request) {
 	// Set the response headers for streaming
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -79,16 +90,16 @@ func (h *Handler) serveStreamedNotebookConversion(w http.ResponseWriter, r *http
 
 	// Initialize variables
 	var lastModTime time.Time
-	var prevDivCount int
-	var notebookDone bool
+	var stale bool
 	var headerWritten bool
-	var notebookJSON string
+	stream := &cellStream{}
 
 	// Derive the notebookPath from the URL (replace html with ipynb)
 	notebookPath := "." + strings.Replace(r.URL.Path, ".html", ".ipynb", 1)
 	if !strings.HasSuffix(notebookPath, ".ipynb") {
 		notebookPath = notebookPath + ".ipynb"
 	}
+	id := strings.TrimSuffix(filepath.Base(notebookPath), ".ipynb")
 
 	// Flush the response writer
 	flusher, ok := w.(http.Flusher)
@@ -99,11 +110,20 @@ func (h *Handler) serveStreamedNotebookConversion(w http.ResponseWriter, r *http
 
 	t1 := time.Now()
 	for {
-		fmt.Println("loop")
+		// Check if the notebook has finished generating before reading it,
+		// so that the last read has all of it
+		var changed <-chan struct{}
+		generating := false
+		if h.Events != nil {
+			var done bool
+			done, changed, generating = h.Events.Progress(id)
+			generating = generating && !done
+		}
+
 		// Read the notebook file
 		notebook, err := os.ReadFile(h.resolvePath(notebookPath))
 		if err != nil {
-			if os.IsNotExist(err) && time.Since(t1) < 5*time.Second {
+			if os.IsNotExist(err) && (generating || time.Since(t1) < 5*time.Second) {
 				time.Sleep(500 * time.Millisecond)
 				continue
 			}
@@ -111,53 +131,68 @@ func (h *Handler) serveStreamedNotebookConversion(w http.ResponseWriter, r *http
 			return
 		}
 
-		// Check if the notebook has finished generating
-		notebookJSON, notebookDone = notebooks.RepairNotebookJSON(string(notebook))
-		fmt.Fprintln(os.Stderr, "notebookDone", notebookDone)
-
-		// Generate the HTML body
-		htmlBody, err := generateNotebookHTML([]byte(notebookJSON))
-		if err != nil {
+		notebookJSON, complete := notebooks.RepairNotebookJSON(string(notebook))
+		notebookDone := !generating
+		if h.Events == nil {
+			notebookDone = complete || stale
+		}
+		nb := &notebooks.Notebook{}
+		if err := json.Unmarshal([]byte(notebookJSON), nb); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// Get the complete divs
-		divs, err := getCompleteDivs(notebookDone, htmlBody, prevDivCount)
+
+		// Render the finished cells and diff them against what has been sent
+		cells, err := h.renderCells(nb, notebookDone)
 		if err != nil {
-			fmt.Fprintln(w, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		patches := stream.diff(cells)
 
-		if !headerWritten && len(divs) > 0 {
+		if !headerWritten && (len(patches) > 0 || notebookDone) {
+			preamble, err := h.renderPreamble(nb)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			headerWritten = true
-			fmt.Fprint(w, getPreamble(htmlBody))
+			fmt.Fprint(w, preamble)
+			fmt.Fprint(w, patchScript)
 		}
 
-		// // Write the divs to the response
-		for _, div := range divs {
-			fmt.Println("writing div")
-			time.Sleep(650 * time.Millisecond)
-			fmt.Println(div)
-			fmt.Fprint(w, div)
+		// Write the patches to the response
+		for _, patch := range patches {
+			if patch.op == opAppend {
+				time.Sleep(650 * time.Millisecond)
+			}
+			fmt.Fprint(w, patch.html)
 			flusher.Flush()
 		}
 
 		// Flush the response
 		flusher.Flush()
 
-		// Update the previous div count
-		prevDivCount += len(divs)
-
 		// Check if the notebook is done generating
 		if notebookDone {
-			// Serve the remaining divs and end the HTML body
-			fmt.Fprint(w, "</main></body></html>")
+			// End the HTML body
+			fmt.Fprint(w, nbhtml.Footer)
 			break
 		}
 
+		if h.Events != nil {
+			// Wait for the generation to progress
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+			continue
+		}
+
 		// Check if the notebook file has been modified
-		fileInfo, err := os.Stat(notebookPath)
+		fileInfo, err := os.Stat(h.resolvePath(notebookPath))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -169,7 +204,7 @@ func (h *Handler) serveStreamedNotebookConversion(w http.ResponseWriter, r *http
 			// If no update for a certain amount of time, assume notebook is done
 			time.Sleep(5 * time.Second)
 			if time.Since(lastModTime) > 30*time.Second {
-				notebookDone = true
+				stale = true
 			}
 		}
 	}
@@ -180,15 +215,33 @@ func notebookParses(in []byte) bool {
 	return json.Unmarshal(in, &nb) == nil
 }
 
-// map of input md5 to output html
-var cache = make(map[string]string)
+// htmlCache maps the md5 of converted notebooks to their HTML.
+type htmlCache struct {
+	mu    sync.Mutex
+	pages map[string]string
+}
+
+func (c *htmlCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	html, ok := c.pages[key]
+	return html, ok
+}
+
+func (c *htmlCache) put(key, html string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages[key] = html
+}
+
+var cache = &htmlCache{pages: map[string]string{}}
 
 // generateNotebookHTML generates the HTML representation of a notebook.
 // it invokes jupyter nbconvert to convert the notebook to HTML.
 func generateNotebookHTML(in []byte) (string, error) {
 	// Check if the notebook has already been converted
 	md5 := fmt.Sprintf("%x", md5.Sum(in))
-	if html, ok := cache[md5]; ok {
+	if html, ok := cache.get(md5); ok {
 		return html, nil
 	}
 
@@ -206,7 +259,7 @@ func generateNotebookHTML(in []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	cache[md5] = string(html)
+	cache.put(md5, string(html))
 	return string(html), nil
 }
 
@@ -256,9 +309,8 @@ func getPreamble(htmlBody string) string {
 	return preamble
 }
 
-// getCompleteDivs gets all the div elements that are complete.
-// we do this by parsing the HTML body and returning all divs, except the last one if the notebook is not done.
-func getCompleteDivs(notebookDone bool, htmlBody string, prevDivCount int) ([]string, error) {
+// getTopLevelDivs gets the outermost div elements of the HTML body.
+func getTopLevelDivs(htmlBody string) ([]string, error) {
 	doc, err := html.Parse(strings.NewReader(htmlBody))
 	if err != nil {
 		return nil, err
@@ -267,8 +319,7 @@ func getCompleteDivs(notebookDone bool, htmlBody string, prevDivCount int) ([]st
 
 	var f func(*html.Node)
 	f = func(n *html.Node) {
-		// algo: walk the tree, if we see a div, render it to a buffer and append to divs (don't recurse into it)
-		// if we see a div, render it to a buffer and append to divs
+		// walk the tree, if we see a div, render it to a buffer and append to divs (don't recurse into it)
 		if n.Type == html.ElementNode && n.Data == "div" {
 			buf := new(bytes.Buffer)
 			html.Render(buf, n)
@@ -281,15 +332,7 @@ func getCompleteDivs(notebookDone bool, htmlBody string, prevDivCount int) ([]st
 
 	}
 	f(doc)
-
-	// If the notebook is not done, return all divs except the last one
-	if !notebookDone {
-		if len(divs) > 0 {
-			divs = divs[:len(divs)-1]
-		}
-	}
-	// Return the divs
-	return divs[prevDivCount:], nil
+	return divs, nil
 }
 
 // // walkNodes walks the nodes of a notebook and generates the HTML representation.
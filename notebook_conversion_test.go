@@ -0,0 +1,123 @@
+package nbsim
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tmc/nbsim/nbhtml"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// TestHTMLCacheConcurrent uses the cache from many goroutines, as concurrent
+// handlers do; run with -race.
+func TestHTMLCacheConcurrent(t *testing.T) {
+	c := &htmlCache{pages: map[string]string{}}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprint(i % 3)
+			c.put(key, "<html>"+key)
+			if html, ok := c.get(key); !ok || html != "<html>"+key {
+				t.Errorf("get(%s) = %q, %v", key, html, ok)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// syncBuffer is a bytes.Buffer safe for one writer and many readers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestStreamedConversion reads a notebook page while its generation runs,
+// and checks that each cell arrives once the model has started the next, and
+// the end of the page only once the generation has finished.
+func TestStreamedConversion(t *testing.T) {
+	const id = "gen-streamed.v1"
+	nb, err := notebooks.NewBuilder().Python().
+		Markdown("alpha").
+		Markdown("beta").
+		Markdown("gamma").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := notebooks.Marshal(nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := strings.TrimPrefix(string(b), FormatJSON.Prefill())
+
+	dir := t.TempDir()
+	hub := NewEventHub()
+	hub.Reset(id)
+	nw := NewNotebookWriter(dir, id, FormatJSON)
+	nw.OnEvent = func(e Event) { hub.Publish(id, e) }
+	nw.TouchOutputFile()
+	h := NewNotebookConversionHandler(dir, http.NotFoundHandler())
+	h.Events = hub
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/" + id + ".html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(syncBuffer)
+	go io.Copy(body, resp.Body)
+	waitFor := func(s string) {
+		t.Helper()
+		for start := time.Now(); !strings.Contains(body.String(), s); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("page lacks %q:\n%s", s, body.String())
+			}
+		}
+	}
+
+	written := 0
+	for _, cells := range [][2]string{{"alpha", "beta"}, {"beta", "gamma"}} {
+		// the model starts the next cell, which completes the previous one
+		end := strings.Index(recording, cells[1]) + len(cells[1])
+		nw.AddPart(recording[written:end])
+		written = end
+		waitFor(cells[0])
+		if page := body.String(); strings.Contains(page, cells[1]) || strings.Contains(page, nbhtml.Footer) {
+			t.Fatalf("page has more than the cells before %s while the generation runs:\n%s", cells[1], page)
+		}
+	}
+	nw.AddPart(recording[written:])
+	time.Sleep(100 * time.Millisecond)
+	if page := body.String(); strings.Contains(page, nbhtml.Footer) {
+		t.Fatalf("page ended before the generation finished:\n%s", page)
+	}
+	nw.Finish(nil)
+	waitFor(nbhtml.Footer)
+	page := body.String()
+	if !strings.Contains(page, "<html") || !strings.Contains(page, "gamma") {
+		t.Errorf("finished page lacks the header or the last cell:\n%s", page)
+	}
+}
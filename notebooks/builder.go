@@ -0,0 +1,241 @@
+package notebooks
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Builder builds a notebook cell by cell:
+//
+//	nb, err := notebooks.NewBuilder().
+//		Python().
+//		Markdown("# Sales").
+//		Code("df.head()").
+//		Output(notebooks.NewStreamOutput("stdout", "loaded\n")).
+//		Image("image/png", png).
+//		Build()
+//
+// Methods that change the current cell, such as Output, Tags and ID, apply
+// to the cell added last. The first misuse is reported by Build.
+type Builder struct {
+	nb    Notebook
+	ids   map[string]bool
+	count int
+	err   error
+}
+
+// NewBuilder returns a builder of an empty nbformat 4.5 notebook.
+func NewBuilder() *Builder {
+	return &Builder{
+		nb:  Notebook{NBFormat: 4, NBFormatMinor: LatestMinor, Cells: []Cell{}},
+		ids: map[string]bool{},
+	}
+}
+
+// KernelSpec sets the kernelspec metadata.
+func (b *Builder) KernelSpec(name, displayName string) *Builder {
+	b.nb.Metadata.KernelSpec = &KernelSpec{Name: name, DisplayName: displayName}
+	return b
+}
+
+// LanguageInfo sets the language_info metadata.
+func (b *Builder) LanguageInfo(info LanguageInfo) *Builder {
+	b.nb.Metadata.LanguageInfo = &info
+	return b
+}
+
+// Python sets the kernelspec and language_info metadata of the IPython
+// kernel.
+func (b *Builder) Python() *Builder {
+	return b.KernelSpec("python3", "Python 3").LanguageInfo(LanguageInfo{
+		Name:           "python",
+		CodeMirrorMode: map[string]any{"name": "ipython", "version": 3},
+		FileExtension:  ".py",
+		MimeType:       "text/x-python",
+		PygmentsLexer:  "ipython3",
+	})
+}
+
+// Title sets the title metadata.
+func (b *Builder) Title(title string) *Builder {
+	b.nb.Metadata.Title = title
+	return b
+}
+
+// Markdown adds a markdown cell.
+func (b *Builder) Markdown(source string) *Builder {
+	return b.add(Cell{CellType: "markdown", Source: &MultilineString{Value: source}})
+}
+
+// Code adds a code cell without outputs.
+func (b *Builder) Code(source string) *Builder {
+	return b.add(Cell{CellType: "code", Source: &MultilineString{Value: source}, Outputs: Outputs{}})
+}
+
+// Raw adds a raw cell.
+func (b *Builder) Raw(source string) *Builder {
+	return b.add(Cell{CellType: "raw", Source: &MultilineString{Value: source}})
+}
+
+// Cell adds a copy of c, giving it an ID if it has none.
+func (b *Builder) Cell(c Cell) *Builder {
+	return b.add(c)
+}
+
+func (b *Builder) add(c Cell) *Builder {
+	if c.Metadata == nil {
+		c.Metadata = &CellMetadata{}
+	}
+	switch {
+	case c.ID == "":
+		c.ID = stableID(&c, b.ids)
+	case !validCellID(c.ID):
+		b.fail(fmt.Errorf("invalid cell id %q", c.ID))
+	case b.ids[c.ID]:
+		b.fail(fmt.Errorf("duplicate cell id %q", c.ID))
+	}
+	b.ids[c.ID] = true
+	b.nb.Cells = append(b.nb.Cells, c)
+	return b
+}
+
+// stableID derives an ID not in ids from the type and source of c, so that
+// rebuilding a notebook gives its cells the same IDs even if other cells
+// changed.
+func stableID(c *Cell, ids map[string]bool) string {
+	source := ""
+	if c.Source != nil {
+		source = c.Source.String()
+	}
+	sum := sha256.Sum256([]byte(c.CellType + "\x00" + source))
+	base := hex.EncodeToString(sum[:4])
+	id := base
+	for n := 2; ids[id]; n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
+
+// current returns the cell added last if it has type cellType, or any type
+// if cellType is empty.
+func (b *Builder) current(method, cellType string) *Cell {
+	if len(b.nb.Cells) == 0 {
+		b.fail(fmt.Errorf("%s: no cell", method))
+		return nil
+	}
+	c := &b.nb.Cells[len(b.nb.Cells)-1]
+	if cellType != "" && c.CellType != cellType {
+		b.fail(fmt.Errorf("%s: cell %q is a %s cell, not a %s cell", method, c.ID, c.CellType, cellType))
+		return nil
+	}
+	return c
+}
+
+func (b *Builder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// ID replaces the generated ID of the current cell.
+func (b *Builder) ID(id string) *Builder {
+	c := b.current("ID", "")
+	if c == nil {
+		return b
+	}
+	if !validCellID(id) {
+		b.fail(fmt.Errorf("ID: invalid cell id %q", id))
+		return b
+	}
+	if b.ids[id] && id != c.ID {
+		b.fail(fmt.Errorf("ID: duplicate cell id %q", id))
+		return b
+	}
+	delete(b.ids, c.ID)
+	c.ID = id
+	b.ids[id] = true
+	return b
+}
+
+// Tags adds tags to the current cell.
+func (b *Builder) Tags(tags ...string) *Builder {
+	if c := b.current("Tags", ""); c != nil {
+		c.Metadata.Tags = append(c.Metadata.Tags, tags...)
+	}
+	return b
+}
+
+// Executed gives the current code cell the next execution count, and its
+// execute_result outputs too.
+func (b *Builder) Executed() *Builder {
+	c := b.current("Executed", "code")
+	if c == nil {
+		return b
+	}
+	b.count++
+	n := b.count
+	c.ExecutionCount = &n
+	for _, o := range c.Outputs {
+		if r, ok := o.(*ExecuteResult); ok {
+			r.ExecutionCount = &n
+		}
+	}
+	return b
+}
+
+// Output appends outputs to the current code cell.
+func (b *Builder) Output(outputs ...Output) *Builder {
+	if c := b.current("Output", "code"); c != nil {
+		c.Outputs = append(c.Outputs, outputs...)
+	}
+	return b
+}
+
+// Image appends a display_data output showing the image data of type mime,
+// such as image/png, to the current code cell.
+func (b *Builder) Image(mime string, data []byte) *Builder {
+	return b.Output(NewDisplayData(MimeBundle{
+		mime: {Value: base64.StdEncoding.EncodeToString(data)},
+	}))
+}
+
+// Attachment attaches the file name of type mime to the current markdown or
+// raw cell, where it can be referenced as attachment:name.
+func (b *Builder) Attachment(name, mime string, data []byte) *Builder {
+	c := b.current("Attachment", "")
+	if c == nil {
+		return b
+	}
+	if c.CellType == "code" {
+		b.fail(errors.New("Attachment: code cells cannot have attachments"))
+		return b
+	}
+	if c.Attachments == nil {
+		c.Attachments = map[string]MimeBundle{}
+	}
+	c.Attachments[name] = MimeBundle{mime: {Value: base64.StdEncoding.EncodeToString(data)}}
+	return b
+}
+
+// Build returns the notebook, or the first error of the builder's methods.
+// The builder can keep adding cells afterwards without changing the returned
+// notebook.
+func (b *Builder) Build() (*Notebook, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	// copy through JSON, which keeps every field
+	data, err := json.Marshal(&b.nb)
+	if err != nil {
+		return nil, err
+	}
+	nb := &Notebook{}
+	if err := json.Unmarshal(data, nb); err != nil {
+		return nil, err
+	}
+	return nb, nil
+}
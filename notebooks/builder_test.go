@@ -0,0 +1,61 @@
+package notebooks
+
+import "testing"
+
+func TestBuilder(t *testing.T) {
+	build := func(extra bool) *Notebook {
+		b := NewBuilder().Python().Title("Fixture").
+			Markdown("# Fixture").
+			Attachment("dot.png", "image/png", []byte("\x89PNG")).
+			Code("print('hi')\n1 + 1").
+			Output(NewStreamOutput("stdout", "hi\n"), NewExecuteResult(0, MimeBundle{"text/plain": {Value: "2"}})).
+			Executed().
+			Tags("demo")
+		if extra {
+			b.Markdown("an extra cell")
+		}
+		nb, err := b.Code("plot()").Image("image/png", []byte("\x89PNG")).Raw("raw").ID("the-end").Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nb
+	}
+	nb := build(false)
+	if errs := nb.Validate(); len(errs) > 0 {
+		t.Errorf("built notebook is invalid:\n%v", errs)
+	}
+	if got := *nb.Cells[1].ExecutionCount; got != 1 {
+		t.Errorf("execution count = %d, want 1", got)
+	}
+	if r := nb.Cells[1].Outputs[1].(*ExecuteResult); *r.ExecutionCount != 1 {
+		t.Errorf("execute_result count = %d, want 1", *r.ExecutionCount)
+	}
+	if got := nb.Cells[3].ID; got != "the-end" {
+		t.Errorf("ID = %q, want the-end", got)
+	}
+
+	// IDs depend on the cells' content, not their position.
+	other := build(true)
+	for i, j := range []int{0, 1, 3} {
+		if nb.Cells[i].ID != other.Cells[j].ID {
+			t.Errorf("cell %d has ID %q, then %q", i, nb.Cells[i].ID, other.Cells[j].ID)
+		}
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	for name, b := range map[string]*Builder{
+		"output on markdown": NewBuilder().Markdown("x").Output(NewStreamOutput("stdout", "x")),
+		"no cell":            NewBuilder().Tags("x"),
+		"attachment on code": NewBuilder().Code("x").Attachment("a.png", "image/png", nil),
+		"duplicate id":       NewBuilder().Code("x").ID("a").Code("y").ID("a"),
+		"invalid id":         NewBuilder().Code("x").ID("not valid"),
+		"invalid cell id":    NewBuilder().Cell(Cell{CellType: "raw", ID: "not valid"}),
+		"duplicate cell id":  NewBuilder().Code("x").ID("a").Cell(Cell{CellType: "raw", ID: "a"}),
+		"executed raw":       NewBuilder().Raw("x").Executed(),
+	} {
+		if _, err := b.Build(); err == nil {
+			t.Errorf("%s: Build succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// CellParser incrementally parses notebook cells written in a line-based
+// markup that is easier for a language model to write than notebook JSON.
+// Each cell and each output is a block opened by a header line and closed by
+// a line holding only ":::":
+//
+//	:::cell markdown
+//	# Sales
+//	:::
+//	:::cell code {"tags": ["parameters"]}
+//	print(total)
+//	:::
+//	:::output stream stdout
+//	42
+//	:::
+//	:::output execute_result text/html
+//	<b>42</b>
+//	:::
+//	:::output error ValueError: bad value
+//	Traceback (most recent call last):
+//	:::
+//
+// A cell header names the cell type and may end with the cell metadata as a
+// JSON object. Output blocks belong to the code cell before them: stream
+// outputs name the stream, display_data and execute_result outputs the mime
+// type of their body, and error outputs the exception, with the traceback as
+// body. Text outside blocks is ignored.
+type CellParser struct {
+	line    []byte // the incomplete last line
+	block   *markupBlock
+	cells   []Cell
+	pending bool // whether the last cell can still get outputs
+	started int
+	count   int
+	err     error
+}
+
+// markupBlock is a cell or output block being parsed.
+type markupBlock struct {
+	cell   *Cell  // set for cell blocks
+	output string // the output header, for output blocks
+	lines  []string
+}
+
+// NewCellParser returns a parser ready to accept the first block.
+func NewCellParser() *CellParser {
+	return &CellParser{}
+}
+
+// Write feeds more of the markup to the parser. Malformed headers do not
+// stop the parser; the first one is reported by Err.
+func (p *CellParser) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if c != '\n' {
+			p.line = append(p.line, c)
+			continue
+		}
+		p.parseLine(strings.TrimSuffix(string(p.line), "\r"))
+		p.line = p.line[:0]
+	}
+	return len(b), nil
+}
+
+// WriteString is like Write but takes a string.
+func (p *CellParser) WriteString(s string) (int, error) {
+	return p.Write([]byte(s))
+}
+
+// Close ends the input, completing the last cell. A block that is still
+// open keeps the lines written so far.
+func (p *CellParser) Close() error {
+	if len(p.line) > 0 {
+		p.parseLine(string(p.line))
+		p.line = p.line[:0]
+	}
+	if p.block != nil {
+		p.endBlock()
+	}
+	p.pending = false
+	return p.err
+}
+
+// Err returns the first malformed header encountered so far, if any.
+func (p *CellParser) Err() error {
+	return p.err
+}
+
+// Cells returns the cells that have been completely written so far. A code
+// cell is complete once the next cell starts or the input ends, as outputs
+// may follow it.
+func (p *CellParser) Cells() []Cell {
+	n := len(p.cells)
+	if p.pending {
+		n--
+	}
+	return p.cells[:n]
+}
+
+// Started returns the number of cells that have been opened so far,
+// including the one currently being written.
+func (p *CellParser) Started() int {
+	return p.started
+}
+
+// Notebook returns a copy of the notebook of the cells written so far,
+// including the partially written block. Cells without an ID get one from
+// their type and source, as Normalize gives them, so that a completed cell
+// keeps its ID as the cells after it stream in.
+func (p *CellParser) Notebook() *Notebook {
+	cells := append([]Cell(nil), p.cells...)
+	if b := p.block; b != nil {
+		lines := b.lines
+		if len(p.line) > 0 {
+			lines = append(lines[:len(lines):len(lines)], string(p.line))
+		}
+		if b.cell != nil {
+			c := *b.cell
+			c.Source = &MultilineString{Value: strings.Join(lines, "\n")}
+			cells = append(cells, c)
+		} else if len(cells) > 0 {
+			if o := p.output(b.output, lines); o != nil {
+				last := &cells[len(cells)-1]
+				last.Outputs = append(last.Outputs[:len(last.Outputs):len(last.Outputs)], o)
+			}
+		}
+	}
+	ids := map[string]bool{}
+	for i := range cells {
+		if id := cells[i].ID; validCellID(id) && !ids[id] {
+			ids[id] = true
+		} else {
+			cells[i].ID = ""
+		}
+	}
+	for i := range cells {
+		if cells[i].ID == "" {
+			cells[i].ID = stableID(&cells[i], ids)
+			ids[cells[i].ID] = true
+		}
+	}
+	b := NewBuilder().Python()
+	b.nb.Cells = cells
+	nb, err := b.Build()
+	if err != nil {
+		return &b.nb
+	}
+	return nb
+}
+
+func (p *CellParser) parseLine(line string) {
+	if p.block != nil {
+		if strings.TrimSpace(line) == ":::" {
+			p.endBlock()
+			return
+		}
+		p.block.lines = append(p.block.lines, line)
+		return
+	}
+	header, ok := strings.CutPrefix(strings.TrimSpace(line), ":::")
+	if !ok {
+		return
+	}
+	kind, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	switch kind {
+	case "cell":
+		p.startCell(strings.TrimSpace(rest))
+	case "output":
+		p.block = &markupBlock{output: strings.TrimSpace(rest)}
+	default:
+		p.fail(fmt.Errorf("unknown block %q", line))
+	}
+}
+
+func (p *CellParser) startCell(header string) {
+	cellType, metadata, _ := strings.Cut(header, " ")
+	switch cellType {
+	case "code", "markdown", "raw":
+	case "md":
+		cellType = "markdown"
+	default:
+		p.fail(fmt.Errorf("unknown cell type %q", cellType))
+		cellType = "markdown"
+	}
+	c := &Cell{CellType: cellType, Metadata: &CellMetadata{}}
+	if cellType == "code" {
+		c.Outputs = Outputs{}
+	}
+	if metadata = strings.TrimSpace(metadata); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), c.Metadata); err != nil {
+			p.fail(fmt.Errorf("cell metadata %s: %w", metadata, err))
+			c.Metadata = &CellMetadata{}
+		}
+	}
+	p.pending = false
+	p.started++
+	p.block = &markupBlock{cell: c}
+}
+
+func (p *CellParser) endBlock() {
+	b := p.block
+	p.block = nil
+	if b.cell != nil {
+		c := *b.cell
+		c.Source = &MultilineString{Value: strings.Join(b.lines, "\n")}
+		p.cells = append(p.cells, c)
+		p.pending = c.CellType == "code"
+		return
+	}
+	if len(p.cells) == 0 || !p.pending {
+		p.fail(fmt.Errorf("output %q does not follow a code cell", b.output))
+		return
+	}
+	if o := p.output(b.output, b.lines); o != nil {
+		c := &p.cells[len(p.cells)-1]
+		if c.ExecutionCount == nil {
+			p.count++
+			n := p.count
+			c.ExecutionCount = &n
+		}
+		if r, ok := o.(*ExecuteResult); ok {
+			r.ExecutionCount = c.ExecutionCount
+		}
+		c.Outputs = append(c.Outputs, o)
+	}
+}
+
+// output returns the output of the block with the given header and body.
+func (p *CellParser) output(header string, lines []string) Output {
+	outputType, arg, _ := strings.Cut(header, " ")
+	arg = strings.TrimSpace(arg)
+	body := strings.Join(lines, "\n")
+	switch outputType {
+	case "stream":
+		if arg == "" {
+			arg = "stdout"
+		}
+		if body != "" {
+			body += "\n"
+		}
+		return NewStreamOutput(arg, body)
+	case "display_data", "execute_result":
+		if arg == "" {
+			arg = "text/plain"
+		}
+		bundle := MimeBundle{arg: {Value: body}}
+		if outputType == "display_data" {
+			return NewDisplayData(bundle)
+		}
+		return &ExecuteResult{Data: bundle, Metadata: OutputMetadata{}}
+	case "error":
+		ename, evalue, _ := strings.Cut(arg, ":")
+		return NewErrorOutput(strings.TrimSpace(ename), strings.TrimSpace(evalue), lines...)
+	}
+	p.fail(fmt.Errorf("unknown output type %q", outputType))
+	return nil
+}
+
+func (p *CellParser) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
@@ -0,0 +1,117 @@
+package notebooks
+
+import (
+	"strings"
+	"testing"
+)
+
+const cellMarkup = `:::cell markdown
+# Sales
+:::
+:::cell code {"tags": ["parameters"]}
+print(total)
+total
+:::
+:::output stream stdout
+42
+:::
+:::output execute_result text/plain
+42
+:::
+:::cell code
+1/0
+:::
+:::output error ZeroDivisionError: division by zero
+:::
+`
+
+func TestCellParser(t *testing.T) {
+	p := NewCellParser()
+	// feed the markup in small chunks, as a model streams it
+	for rest := cellMarkup; rest != ""; {
+		n := min(7, len(rest))
+		p.WriteString(rest[:n])
+		rest = rest[n:]
+		if len(p.Cells()) > p.Started() {
+			t.Fatalf("%d cells complete but %d started", len(p.Cells()), p.Started())
+		}
+	}
+	if got := len(p.Cells()); got != 2 {
+		t.Errorf("before Close, %d cells complete, want 2", got)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	nb := p.Notebook()
+	nb.Normalize()
+	if errs := nb.Validate(); errs != nil {
+		t.Fatalf("invalid notebook: %v", errs)
+	}
+	if len(nb.Cells) != 3 {
+		t.Fatalf("got %d cells, want 3", len(nb.Cells))
+	}
+	code := nb.Cells[1]
+	if got := cellSource(&code); got != "print(total)\ntotal" {
+		t.Errorf("source = %q", got)
+	}
+	if tags := code.Metadata.Tags; len(tags) != 1 || tags[0] != "parameters" {
+		t.Errorf("tags = %q, want [parameters]", tags)
+	}
+	if len(code.Outputs) != 2 {
+		t.Fatalf("got %d outputs, want 2", len(code.Outputs))
+	}
+	if s, ok := code.Outputs[0].(*StreamOutput); !ok || s.Name != "stdout" || s.Text.String() != "42\n" {
+		t.Errorf("outputs[0] = %#v", code.Outputs[0])
+	}
+	r, ok := code.Outputs[1].(*ExecuteResult)
+	if !ok || r.ExecutionCount == nil || *r.ExecutionCount != 1 || *code.ExecutionCount != 1 {
+		t.Errorf("outputs[1] = %#v, want execute_result of execution 1", code.Outputs[1])
+	}
+	e, ok := nb.Cells[2].Outputs[0].(*ErrorOutput)
+	if !ok || e.EName != "ZeroDivisionError" || e.EValue != "division by zero" {
+		t.Errorf("error output = %#v", nb.Cells[2].Outputs[0])
+	}
+}
+
+func TestCellParserPartial(t *testing.T) {
+	p := NewCellParser()
+	p.WriteString(":::cell markdown\n# Sal")
+	nb := p.Notebook()
+	if len(nb.Cells) != 1 || cellSource(&nb.Cells[0]) != "# Sal" {
+		t.Errorf("partial notebook cells = %+v", nb.Cells)
+	}
+	p.WriteString("es\n:::\n:::cell pie\n")
+	if err := p.Err(); err == nil || !strings.Contains(err.Error(), "pie") {
+		t.Errorf("Err() = %v, want unknown cell type", err)
+	}
+}
+
+func TestCellParserIDs(t *testing.T) {
+	p := NewCellParser()
+	p.WriteString(":::cell markdown\n# Sales\n:::\n:::cell code\ntotal\n:::\n:::cell code\ntotal\n:::\n")
+	ids := func() []string {
+		var ids []string
+		for _, c := range p.Notebook().Cells {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	generated := ids()
+	if generated[1] == generated[2] {
+		t.Fatalf("cells with the same source got the same ID %q", generated[1])
+	}
+
+	// cells that already have IDs keep them, even as the cells before them
+	// change
+	p.cells[0].ID, p.cells[1].ID, p.cells[2].ID = "intro", "bad id", "intro"
+	got := ids()
+	if got[0] != "intro" {
+		t.Errorf("cell 0 ID = %q, want intro", got[0])
+	}
+	if got[1] != generated[1] {
+		t.Errorf("cell 1 with invalid ID got %q, want generated %q", got[1], generated[1])
+	}
+	if got[2] == "intro" || got[2] == got[1] || !validCellID(got[2]) {
+		t.Errorf("cell 2 with duplicate ID got %q", got[2])
+	}
+}
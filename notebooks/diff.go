@@ -0,0 +1,143 @@
+package notebooks
+
+// CellChange describes how a cell differs between two notebooks.
+type CellChange string
+
+const (
+	CellSame    CellChange = "same"
+	CellChanged CellChange = "changed"
+	CellAdded   CellChange = "added"
+	CellRemoved CellChange = "removed"
+	CellMoved   CellChange = "moved"
+)
+
+// CellDiff is the comparison of a cell of two notebooks. AIndex and BIndex
+// are the positions of the cell in each, or -1 where it has none.
+type CellDiff struct {
+	Change CellChange `json:"change"`
+	AIndex int        `json:"a_index"`
+	BIndex int        `json:"b_index"`
+	A      *Cell      `json:"a,omitempty"`
+	B      *Cell      `json:"b,omitempty"`
+}
+
+// DiffCells compares the cells of a and b. Cells are the same if they have
+// the same type and source. The longest run of cells the two have in common,
+// in order, is kept in place; the other cells of b that are also in a moved,
+// and the rest between two cells in common are paired up in order as changed
+// cells, with those left over added or removed. The diffs follow the order
+// of b.
+func DiffCells(a, b []Cell) []CellDiff {
+	keys := func(cells []Cell) []string {
+		ks := make([]string, len(cells))
+		for i := range cells {
+			ks[i] = cells[i].CellType + "\x00" + cellSource(&cells[i])
+		}
+		return ks
+	}
+	ka, kb := keys(a), keys(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of ka[i:]
+	// and kb[j:].
+	lcs := make([][]int, len(ka)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(kb)+1)
+	}
+	for i := len(ka) - 1; i >= 0; i-- {
+		for j := len(kb) - 1; j >= 0; j-- {
+			if ka[i] == kb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// gaps are the cells outside the common run before each of its cells,
+	// and after the last one, whose sameA and sameB are -1
+	type gap struct {
+		a, b         []int
+		sameA, sameB int
+	}
+	var gaps []gap
+	var g gap
+	var restA, restB []int
+	for i, j := 0, 0; i < len(ka) || j < len(kb); {
+		switch {
+		case i < len(ka) && j < len(kb) && ka[i] == kb[j]:
+			g.sameA, g.sameB = i, j
+			gaps = append(gaps, g)
+			g = gap{}
+			i++
+			j++
+		case j == len(kb) || i < len(ka) && lcs[i+1][j] > lcs[i][j+1]:
+			g.a = append(g.a, i)
+			restA = append(restA, i)
+			i++
+		default:
+			g.b = append(g.b, j)
+			restB = append(restB, j)
+			j++
+		}
+	}
+	g.sameA, g.sameB = -1, -1
+	gaps = append(gaps, g)
+
+	// moved pairs the cells of b outside the common run with the same cells
+	// of a
+	moved := map[int]int{}
+	movedA := map[int]bool{}
+	for _, j := range restB {
+		for _, i := range restA {
+			if !movedA[i] && ka[i] == kb[j] {
+				moved[j], movedA[i] = i, true
+				break
+			}
+		}
+	}
+
+	diffs := make([]CellDiff, 0, max(len(a), len(b)))
+	diff := func(change CellChange, i, j int) {
+		d := CellDiff{Change: change, AIndex: i, BIndex: j}
+		if i >= 0 {
+			d.A = &a[i]
+		}
+		if j >= 0 {
+			d.B = &b[j]
+		}
+		diffs = append(diffs, d)
+	}
+	for _, g := range gaps {
+		var removed []int
+		for _, i := range g.a {
+			if !movedA[i] {
+				removed = append(removed, i)
+			}
+		}
+		for _, j := range g.b {
+			switch i, ok := moved[j]; {
+			case ok:
+				diff(CellMoved, i, j)
+			case len(removed) > 0:
+				diff(CellChanged, removed[0], j)
+				removed = removed[1:]
+			default:
+				diff(CellAdded, -1, j)
+			}
+		}
+		for _, i := range removed {
+			diff(CellRemoved, i, -1)
+		}
+		if g.sameA >= 0 {
+			diff(CellSame, g.sameA, g.sameB)
+		}
+	}
+	return diffs
+}
+
+func cellSource(c *Cell) string {
+	if c.Source == nil {
+		return ""
+	}
+	return c.Source.String()
+}
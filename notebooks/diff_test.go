@@ -0,0 +1,57 @@
+package notebooks
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// diffCells builds cells from their sources, "m:" for markdown and code
+// otherwise.
+func diffCells(sources ...string) []Cell {
+	cells := make([]Cell, len(sources))
+	for i, s := range sources {
+		cells[i] = Cell{CellType: "code", Source: &MultilineString{Value: s}}
+		if src, ok := strings.CutPrefix(s, "m:"); ok {
+			cells[i] = Cell{CellType: "markdown", Source: &MultilineString{Value: src}}
+		}
+	}
+	return cells
+}
+
+func TestDiffCells(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []Cell
+		want string // change a-index b-index of each diff
+	}{
+		{"empty", nil, nil, ""},
+		{"same", diffCells("x", "y"), diffCells("x", "y"), "same 0 0, same 1 1"},
+		{"added", diffCells("x"), diffCells("x", "y"), "same 0 0, added -1 1"},
+		{"added first", diffCells("y"), diffCells("x", "y"), "added -1 0, same 0 1"},
+		{"removed", diffCells("x", "y", "z"), diffCells("x", "z"), "same 0 0, removed 1 -1, same 2 1"},
+		{"all removed", diffCells("x", "y"), nil, "removed 0 -1, removed 1 -1"},
+		{"changed", diffCells("x", "y", "z"), diffCells("x", "y2", "z"), "same 0 0, changed 1 1, same 2 2"},
+		{"changed type", diffCells("x"), diffCells("m:x"), "changed 0 0"},
+		{"changed and added", diffCells("x", "y"), diffCells("x2", "y2", "z"), "changed 0 0, changed 1 1, added -1 2"},
+		{"moved", diffCells("x", "y", "z"), diffCells("z", "x", "y"), "moved 2 0, same 0 1, same 1 2"},
+		{"swapped", diffCells("x", "y"), diffCells("y", "x"), "moved 1 0, same 0 1"},
+		{"moved and changed", diffCells("m:t", "x", "y", "z"), diffCells("m:t", "z", "x2", "y"), "same 0 0, moved 3 1, changed 1 2, same 2 3"},
+		{"repeated", diffCells("x", "x"), diffCells("x"), "same 0 0, removed 1 -1"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, d := range DiffCells(tt.a, tt.b) {
+			got = append(got, fmt.Sprintf("%s %d %d", d.Change, d.AIndex, d.BIndex))
+			if (d.A != nil) != (d.AIndex >= 0) || d.A != nil && d.A != &tt.a[d.AIndex] {
+				t.Errorf("%s: %s diff has cell %v of a", tt.name, d.Change, d.A)
+			}
+			if (d.B != nil) != (d.BIndex >= 0) || d.B != nil && d.B != &tt.b[d.BIndex] {
+				t.Errorf("%s: %s diff has cell %v of b", tt.name, d.Change, d.B)
+			}
+		}
+		if got := strings.Join(got, ", "); got != tt.want {
+			t.Errorf("%s: DiffCells = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package notebooks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// WriteMarkdown writes nb as plain markdown: code cells as code blocks
+// fenced with the notebook's language and their metadata, raw cells between
+// <!-- #raw --> and <!-- #endraw --> comments, and markdown cells as they
+// are. Markdown cells that follow another markdown cell or that have
+// metadata are wrapped in <!-- #region --> and <!-- #endregion --> comments
+// so they read back as separate cells.
+func WriteMarkdown(w io.Writer, nb *Notebook) error {
+	bw := bufio.NewWriter(w)
+	header, err := jupyterYAML(&nb.Metadata)
+	if err != nil {
+		return err
+	}
+	if header != "" {
+		fmt.Fprintf(bw, "---\n%s---\n\n", header)
+	}
+	language := nb.Language()
+	prevMarkdown := false
+	for i := range nb.Cells {
+		c := &nb.Cells[i]
+		source := cellSource(c)
+		attrs, err := cellAttrs(c.Metadata)
+		if err != nil {
+			return err
+		}
+		switch c.CellType {
+		case "markdown":
+			if prevMarkdown || attrs != "" {
+				region := "<!-- #region"
+				if attrs != "" {
+					b, err := json.Marshal(c.Metadata)
+					if err != nil {
+						return err
+					}
+					region += " " + string(b)
+				}
+				fmt.Fprintf(bw, "%s -->\n%s\n<!-- #endregion -->\n\n", region, source)
+			} else if source != "" {
+				fmt.Fprintf(bw, "%s\n\n", source)
+			}
+			prevMarkdown = true
+			continue
+		case "code":
+			f := fence(source)
+			info := language
+			if attrs != "" {
+				info += " " + attrs
+			}
+			fmt.Fprintf(bw, "%s%s\n", f, info)
+			if source != "" {
+				fmt.Fprintln(bw, source)
+			}
+			fmt.Fprintf(bw, "%s\n\n", f)
+		case "raw":
+			marker := "<!-- #raw"
+			if attrs != "" {
+				marker += " " + attrs
+			}
+			fmt.Fprintf(bw, "%s -->\n", marker)
+			if source != "" {
+				fmt.Fprintln(bw, source)
+			}
+			fmt.Fprint(bw, "<!-- #endraw -->\n\n")
+		default:
+			return fmt.Errorf("cells[%d]: unknown cell_type %q", i, c.CellType)
+		}
+		prevMarkdown = false
+	}
+	return bw.Flush()
+}
+
+var (
+	markdownRegion = regexp.MustCompile(`^<!--\s*#region\s*(.*?)\s*-->$`)
+	markdownRaw    = regexp.MustCompile(`^<!--\s*#raw\s*(.*?)\s*-->$`)
+)
+
+// ReadMarkdown reads a notebook in plain markdown. Code blocks fenced with
+// the notebook's language become code cells; other code blocks stay in the
+// markdown around them. Text between two code cells becomes a single
+// markdown cell unless it is split by region comments.
+func ReadMarkdown(r io.Reader) (*Notebook, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	if len(lines) > 0 && lines[0] == "---" {
+		end := indexLine(lines[1:], "---")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated front matter")
+		}
+		if metadata, err = parseJupyterYAML(strings.Join(lines[1:end+1], "\n")); err != nil {
+			return nil, err
+		}
+		lines = lines[end+2:]
+	}
+	language := (&Notebook{Metadata: metadata}).Language()
+
+	cells := newTextCells()
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := markdownRegion.FindStringSubmatch(line); m != nil {
+			end := indexLine(lines[i+1:], "<!-- #endregion -->")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated region", i+1)
+			}
+			var md *CellMetadata
+			if m[1] != "" {
+				md = &CellMetadata{}
+				if err := json.Unmarshal([]byte(m[1]), md); err != nil {
+					return nil, fmt.Errorf("line %d: invalid cell metadata: %w", i+1, err)
+				}
+			}
+			cells.start("markdown", md)
+			for _, l := range lines[i+1 : i+1+end] {
+				cells.add(l)
+			}
+			cells.flush()
+			i += end + 1
+			continue
+		}
+		if m := markdownRaw.FindStringSubmatch(line); m != nil {
+			end := indexLine(lines[i+1:], "<!-- #endraw -->")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated raw cell", i+1)
+			}
+			if err := addFenced(cells, "raw", m[1], lines[i+1:i+1+end]); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			i += end + 1
+			continue
+		}
+		if f := mystFence.FindString(line); f != "" {
+			end := closingFence(lines[i+1:], f)
+			info := strings.TrimSpace(line[len(f):])
+			lang, attrs, _ := strings.Cut(info, " ")
+			if end < len(lines[i+1:]) && strings.EqualFold(lang, language) {
+				if err := addFenced(cells, "code", attrs, lines[i+1:i+1+end]); err != nil {
+					return nil, fmt.Errorf("line %d: %w", i+1, err)
+				}
+				i += end + 1
+				continue
+			}
+			// a code block in another language, kept in the markdown
+			end = min(i+end+2, len(lines))
+			if !cells.open {
+				cells.start("markdown", nil)
+			}
+			for _, l := range lines[i:end] {
+				cells.add(l)
+			}
+			i = end - 1
+			continue
+		}
+		if !cells.open {
+			cells.start("markdown", nil)
+		}
+		cells.add(line)
+	}
+	return cells.notebook(metadata)
+}
+
+// addFenced adds a code or raw cell with the source lines and the cell
+// metadata attrs.
+func addFenced(cells *textCells, cellType, attrs string, lines []string) error {
+	var md *CellMetadata
+	if strings.TrimSpace(attrs) != "" {
+		var err error
+		if md, err = parseCellAttrs(attrs); err != nil {
+			return err
+		}
+	}
+	cells.start(cellType, md)
+	for _, l := range lines {
+		cells.add(l)
+	}
+	cells.flush()
+	return nil
+}
@@ -0,0 +1,203 @@
+package notebooks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WriteMyST writes nb as MyST markdown: the notebook metadata as a YAML
+// front matter, code cells as {code-cell} directives with their metadata as
+// YAML options, raw cells as {raw-cell} directives, and markdown cells as
+// text separated by "+++" lines, which carry the metadata of the markdown
+// cell that follows them as JSON.
+func WriteMyST(w io.Writer, nb *Notebook) error {
+	bw := bufio.NewWriter(w)
+	header, err := metadataYAML(&nb.Metadata)
+	if err != nil {
+		return err
+	}
+	if header != "" {
+		fmt.Fprintf(bw, "---\n%s---\n\n", header)
+	}
+	language := nb.Language()
+	prevMarkdown := false
+	for i := range nb.Cells {
+		c := &nb.Cells[i]
+		source := cellSource(c)
+		switch c.CellType {
+		case "markdown":
+			if prevMarkdown || !emptyMetadata(c.Metadata) {
+				marker := "+++"
+				if !emptyMetadata(c.Metadata) {
+					b, err := json.Marshal(c.Metadata)
+					if err != nil {
+						return err
+					}
+					marker += " " + string(b)
+				}
+				fmt.Fprintf(bw, "%s\n\n", marker)
+			}
+			if source != "" {
+				fmt.Fprintf(bw, "%s\n\n", source)
+			}
+			prevMarkdown = true
+			continue
+		case "code", "raw":
+		default:
+			return fmt.Errorf("cells[%d]: unknown cell_type %q", i, c.CellType)
+		}
+		f := fence(source)
+		if c.CellType == "code" {
+			fmt.Fprintf(bw, "%s{code-cell} %s\n", f, language)
+		} else {
+			fmt.Fprintf(bw, "%s{raw-cell}\n", f)
+		}
+		if !emptyMetadata(c.Metadata) {
+			m, err := toMap(c.Metadata)
+			if err != nil {
+				return err
+			}
+			options, err := marshalYAML(m)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "---\n%s---\n", options)
+		}
+		if source != "" {
+			fmt.Fprintln(bw, source)
+		}
+		fmt.Fprintf(bw, "%s\n\n", f)
+		prevMarkdown = false
+	}
+	return bw.Flush()
+}
+
+var (
+	mystDirective = regexp.MustCompile("^(```+|~~~+)\\s*\\{(code-cell|raw-cell)\\}")
+	mystFence     = regexp.MustCompile("^(```+|~~~+)")
+	mystOption    = regexp.MustCompile(`^:([\w-]+):\s*(.*)$`)
+)
+
+// ReadMyST reads a notebook in MyST markdown. Besides the YAML options
+// written by WriteMyST, code cells may set their metadata with ":key: value"
+// option lines.
+func ReadMyST(r io.Reader) (*Notebook, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	if len(lines) > 0 && lines[0] == "---" {
+		end := indexLine(lines[1:], "---")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated front matter")
+		}
+		if metadata, err = parseMetadataYAML(strings.Join(lines[1:end+1], "\n")); err != nil {
+			return nil, err
+		}
+		lines = lines[end+2:]
+	}
+
+	cells := newTextCells()
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "+++") {
+			var md *CellMetadata
+			if s := strings.TrimSpace(line[3:]); s != "" {
+				md = &CellMetadata{}
+				if err := json.Unmarshal([]byte(s), md); err != nil {
+					return nil, fmt.Errorf("line %d: invalid cell metadata: %w", i+1, err)
+				}
+			}
+			cells.start("markdown", md)
+			continue
+		}
+		d := mystDirective.FindStringSubmatch(line)
+		if d == nil {
+			if !cells.open {
+				cells.start("markdown", nil)
+			}
+			if f := mystFence.FindString(line); f != "" {
+				// a code block inside markdown, kept as it is
+				end := min(i+closingFence(lines[i+1:], f)+2, len(lines))
+				for _, l := range lines[i:end] {
+					cells.add(l)
+				}
+				i = end - 1
+				continue
+			}
+			cells.add(line)
+			continue
+		}
+		f, cellType := d[1], strings.TrimSuffix(d[2], "-cell")
+		end := closingFence(lines[i+1:], f)
+		if end == len(lines[i+1:]) {
+			return nil, fmt.Errorf("line %d: unterminated %s cell", i+1, d[2])
+		}
+		body := lines[i+1 : i+1+end]
+		i += end + 1
+		options := map[string]any{}
+		if len(body) > 0 && body[0] == "---" {
+			n := indexLine(body[1:], "---")
+			if n < 0 {
+				return nil, fmt.Errorf("line %d: unterminated cell options", i+1)
+			}
+			if err := yaml.Unmarshal([]byte(strings.Join(body[1:n+1], "\n")), &options); err != nil {
+				return nil, fmt.Errorf("line %d: cell options: %w", i+1, err)
+			}
+			body = body[n+2:]
+		} else {
+			for len(body) > 0 {
+				o := mystOption.FindStringSubmatch(body[0])
+				if o == nil {
+					break
+				}
+				var v any
+				if err := yaml.Unmarshal([]byte(o[2]), &v); err != nil {
+					return nil, fmt.Errorf("line %d: cell option %s: %w", i+1, o[1], err)
+				}
+				options[o[1]] = v
+				body = body[1:]
+			}
+		}
+		var md *CellMetadata
+		if len(options) > 0 {
+			md = &CellMetadata{}
+			if err := fromMap(options, md); err != nil {
+				return nil, fmt.Errorf("line %d: cell options: %w", i+1, err)
+			}
+		}
+		cells.start(cellType, md)
+		for _, l := range body {
+			cells.add(l)
+		}
+		cells.flush()
+	}
+	return cells.notebook(metadata)
+}
+
+// closingFence returns the index of the line closing a fence opened with f,
+// or len(lines) if there is none.
+func closingFence(lines []string, f string) int {
+	for i, line := range lines {
+		if strings.HasPrefix(line, f) && strings.TrimLeft(line, f[:1]) == "" {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+func indexLine(lines []string, s string) int {
+	for i, line := range lines {
+		if line == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,122 @@
+package notebooks
+
+import "strings"
+
+// Normalize fixes what it can of the schema violations Validate reports:
+// it upgrades the notebook to nbformat 4.5, fills in missing required
+// properties, gives every cell a unique ID and drops properties that do not
+// belong to a cell's or output's type. Cells and outputs of unknown types are
+// left alone.
+//
+// Cells without a valid ID get one derived from their type and source, as the
+// Builder gives them, so that normalizing a notebook again, or one that is
+// still being generated, keeps the IDs of its cells.
+func (n *Notebook) Normalize() {
+	n.NBFormat = 4
+	if n.NBFormatMinor < LatestMinor {
+		n.NBFormatMinor = LatestMinor
+	}
+	n.Metadata.normalize()
+	if n.Cells == nil {
+		n.Cells = []Cell{}
+	}
+	ids := map[string]bool{}
+	for i := range n.Cells {
+		c := &n.Cells[i]
+		if !validCellID(c.ID) || ids[c.ID] {
+			c.ID = ""
+			continue
+		}
+		ids[c.ID] = true
+	}
+	for i := range n.Cells {
+		c := &n.Cells[i]
+		if c.ID == "" {
+			c.ID = stableID(c, ids)
+			ids[c.ID] = true
+		}
+		c.normalize()
+	}
+}
+
+func (m *Metadata) normalize() {
+	if ks := m.KernelSpec; ks != nil {
+		if ks.DisplayName == "" {
+			ks.DisplayName = ks.Name
+		}
+		if ks.Name == "" {
+			ks.Name = ks.DisplayName
+		}
+	}
+}
+
+func validCellID(id string) bool {
+	return len(id) <= 64 && cellIDPattern.MatchString(id)
+}
+
+func (c *Cell) normalize() {
+	if c.Metadata == nil {
+		c.Metadata = &CellMetadata{}
+	}
+	c.Metadata.normalize(c.CellType)
+	if c.Source == nil {
+		c.Source = &MultilineString{}
+	}
+	switch c.CellType {
+	case "code":
+		c.Attachments = nil
+		if c.Outputs == nil {
+			c.Outputs = Outputs{}
+		}
+		if c.ExecutionCount != nil && *c.ExecutionCount < 0 {
+			c.ExecutionCount = nil
+		}
+		for _, o := range c.Outputs {
+			normalizeOutput(o, c.ExecutionCount)
+		}
+	case "markdown", "raw":
+		c.Outputs, c.ExecutionCount = nil, nil
+	}
+}
+
+func (cm *CellMetadata) normalize(cellType string) {
+	if cellType != "raw" {
+		cm.Format = ""
+	}
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range cm.Tags {
+		t = strings.TrimSpace(strings.ReplaceAll(t, ",", ""))
+		if t != "" && !seen[t] {
+			tags = append(tags, t)
+			seen[t] = true
+		}
+	}
+	cm.Tags = tags
+	switch s := cm.Scrolled.(type) {
+	case nil, bool:
+	case string:
+		if s != "auto" {
+			cm.Scrolled = nil
+		}
+	default:
+		cm.Scrolled = nil
+	}
+}
+
+func normalizeOutput(o Output, executionCount *int) {
+	switch o := o.(type) {
+	case *StreamOutput:
+		if o.Name == "" {
+			o.Name = "stdout"
+		}
+	case *ExecuteResult:
+		if o.ExecutionCount == nil || *o.ExecutionCount < 0 {
+			o.ExecutionCount = executionCount
+		}
+	case *ErrorOutput:
+		if o.EName == "" {
+			o.EName = "Error"
+		}
+	}
+}
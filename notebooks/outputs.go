@@ -0,0 +1,291 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Output is a cell output: a *StreamOutput, *DisplayData, *ExecuteResult,
+// *ErrorOutput or, for output types nbformat does not define, an
+// *UnknownOutput.
+type Output interface {
+	// OutputType returns the nbformat output_type.
+	OutputType() string
+	// Validate reports where the output violates the nbformat schema.
+	Validate() ValidationErrors
+	isOutput()
+}
+
+// StreamOutput is text written to stdout or stderr.
+type StreamOutput struct {
+	Name    string          `json:"name"`
+	Text    MultilineString `json:"text"`
+	Unknown Unknown         `json:"-"`
+}
+
+// NewStreamOutput returns an output of text written to the stream name,
+// stdout or stderr.
+func NewStreamOutput(name, text string) *StreamOutput {
+	return &StreamOutput{Name: name, Text: splitLines(text)}
+}
+
+// DisplayData is rich data displayed by a cell.
+type DisplayData struct {
+	Data     MimeBundle     `json:"data"`
+	Metadata OutputMetadata `json:"metadata"`
+	Unknown  Unknown        `json:"-"`
+}
+
+// NewDisplayData returns an output displaying bundle.
+func NewDisplayData(bundle MimeBundle) *DisplayData {
+	return &DisplayData{Data: splitBundle(bundle), Metadata: OutputMetadata{}}
+}
+
+// ExecuteResult is the value of the last expression of a cell.
+type ExecuteResult struct {
+	ExecutionCount *int           `json:"execution_count"`
+	Data           MimeBundle     `json:"data"`
+	Metadata       OutputMetadata `json:"metadata"`
+	Unknown        Unknown        `json:"-"`
+}
+
+// NewExecuteResult returns the result bundle of execution executionCount.
+func NewExecuteResult(executionCount int, bundle MimeBundle) *ExecuteResult {
+	return &ExecuteResult{ExecutionCount: &executionCount, Data: splitBundle(bundle), Metadata: OutputMetadata{}}
+}
+
+// ErrorOutput is an exception raised by a cell.
+type ErrorOutput struct {
+	EName     string   `json:"ename"`
+	EValue    string   `json:"evalue"`
+	Traceback []string `json:"traceback"`
+	Unknown   Unknown  `json:"-"`
+}
+
+// NewErrorOutput returns the output of an exception of type ename with
+// message evalue. Without traceback lines, the traceback is "ename: evalue".
+func NewErrorOutput(ename, evalue string, traceback ...string) *ErrorOutput {
+	if len(traceback) == 0 {
+		traceback = []string{ename + ": " + evalue}
+	}
+	return &ErrorOutput{EName: ename, EValue: evalue, Traceback: traceback}
+}
+
+// splitLines returns text as nbformat writes multiline strings: a list of its
+// lines, each with its newline, if it has more than one.
+func splitLines(text string) MultilineString {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= 1 {
+		return MultilineString{Value: text}
+	}
+	return MultilineString{Lines: lines}
+}
+
+// splitBundle returns a copy of bundle with its textual entries split into
+// lines, as nbformat splits text/*, SVG and JavaScript data. Other data,
+// such as base64 images and JSON, is left alone.
+func splitBundle(bundle MimeBundle) MimeBundle {
+	if bundle == nil {
+		return nil
+	}
+	split := make(MimeBundle, len(bundle))
+	for mime, v := range bundle {
+		textual := strings.HasPrefix(mime, "text/") || mime == "image/svg+xml" || mime == "application/javascript"
+		if textual && v.Lines == nil && len(v.JSON) == 0 {
+			v = splitLines(v.Value)
+		}
+		split[mime] = v
+	}
+	return split
+}
+
+// UnknownOutput is an output of a type nbformat does not define, kept
+// verbatim.
+type UnknownOutput struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+func (*StreamOutput) OutputType() string  { return "stream" }
+func (*DisplayData) OutputType() string   { return "display_data" }
+func (*ExecuteResult) OutputType() string { return "execute_result" }
+func (*ErrorOutput) OutputType() string   { return "error" }
+func (o *UnknownOutput) OutputType() string {
+	return o.Type
+}
+
+func (*StreamOutput) isOutput()  {}
+func (*DisplayData) isOutput()   {}
+func (*ExecuteResult) isOutput() {}
+func (*ErrorOutput) isOutput()   {}
+func (*UnknownOutput) isOutput() {}
+
+// Bundle returns the mime bundle of outputs that have one.
+func Bundle(o Output) (MimeBundle, bool) {
+	switch o := o.(type) {
+	case *DisplayData:
+		return o.Data, true
+	case *ExecuteResult:
+		return o.Data, true
+	}
+	return nil, false
+}
+
+// Outputs is the list of outputs of a code cell. It unmarshals each output
+// into the type its output_type names.
+type Outputs []Output
+
+func (outputs *Outputs) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*outputs = nil
+		return nil
+	}
+	*outputs = make(Outputs, len(raw))
+	for i, r := range raw {
+		o, err := UnmarshalOutput(r)
+		if err != nil {
+			return fmt.Errorf("outputs[%d]: %w", i, err)
+		}
+		(*outputs)[i] = o
+	}
+	return nil
+}
+
+// UnmarshalOutput decodes an output into the type its output_type names.
+func UnmarshalOutput(data []byte) (Output, error) {
+	var head struct {
+		OutputType string `json:"output_type"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+	var o Output
+	switch head.OutputType {
+	case "stream":
+		o = &StreamOutput{}
+	case "display_data":
+		o = &DisplayData{}
+	case "execute_result":
+		o = &ExecuteResult{}
+	case "error":
+		o = &ErrorOutput{}
+	default:
+		return &UnknownOutput{Type: head.OutputType, Raw: append(json.RawMessage(nil), data...)}, nil
+	}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// unmarshalOutput decodes data into v, the struct behind an output, and
+// returns its unknown properties other than output_type.
+func unmarshalOutput[T any](data []byte, v *T) (Unknown, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	unknown, err := unmarshalUnknown(data, v)
+	delete(unknown, "output_type")
+	if len(unknown) == 0 {
+		unknown = nil
+	}
+	return unknown, err
+}
+
+// marshalOutput marshals v, the struct behind an output of type outputType,
+// with its unknown properties.
+func marshalOutput(outputType string, v any, unknown Unknown) ([]byte, error) {
+	withType := Unknown{"output_type": json.RawMessage(fmt.Sprintf("%q", outputType))}
+	for k, raw := range unknown {
+		withType[k] = raw
+	}
+	return marshalUnknown(v, withType)
+}
+
+func (o *StreamOutput) UnmarshalJSON(data []byte) error {
+	type stream StreamOutput
+	unknown, err := unmarshalOutput(data, (*stream)(o))
+	o.Unknown = unknown
+	return err
+}
+
+func (o *StreamOutput) MarshalJSON() ([]byte, error) {
+	type stream StreamOutput
+	return marshalOutput(o.OutputType(), (*stream)(o), o.Unknown)
+}
+
+func (o *DisplayData) UnmarshalJSON(data []byte) error {
+	type displayData DisplayData
+	unknown, err := unmarshalOutput(data, (*displayData)(o))
+	o.Unknown = unknown
+	return err
+}
+
+func (o *DisplayData) MarshalJSON() ([]byte, error) {
+	type displayData DisplayData
+	v := displayData(*o)
+	if v.Data == nil {
+		v.Data = MimeBundle{}
+	}
+	if v.Metadata == nil {
+		v.Metadata = OutputMetadata{}
+	}
+	return marshalOutput(o.OutputType(), v, o.Unknown)
+}
+
+func (o *ExecuteResult) UnmarshalJSON(data []byte) error {
+	type executeResult ExecuteResult
+	unknown, err := unmarshalOutput(data, (*executeResult)(o))
+	o.Unknown = unknown
+	return err
+}
+
+func (o *ExecuteResult) MarshalJSON() ([]byte, error) {
+	type executeResult ExecuteResult
+	v := executeResult(*o)
+	if v.Data == nil {
+		v.Data = MimeBundle{}
+	}
+	if v.Metadata == nil {
+		v.Metadata = OutputMetadata{}
+	}
+	return marshalOutput(o.OutputType(), v, o.Unknown)
+}
+
+func (o *ErrorOutput) UnmarshalJSON(data []byte) error {
+	type errorOutput ErrorOutput
+	unknown, err := unmarshalOutput(data, (*errorOutput)(o))
+	o.Unknown = unknown
+	return err
+}
+
+func (o *ErrorOutput) MarshalJSON() ([]byte, error) {
+	type errorOutput ErrorOutput
+	v := errorOutput(*o)
+	if v.Traceback == nil {
+		v.Traceback = []string{}
+	}
+	return marshalOutput(o.OutputType(), v, o.Unknown)
+}
+
+func (o *UnknownOutput) MarshalJSON() ([]byte, error) {
+	return o.Raw, nil
+}
+
+func (o *StreamOutput) Validate() ValidationErrors  { return validateOutput(o) }
+func (o *DisplayData) Validate() ValidationErrors   { return validateOutput(o) }
+func (o *ExecuteResult) Validate() ValidationErrors { return validateOutput(o) }
+func (o *ErrorOutput) Validate() ValidationErrors   { return validateOutput(o) }
+func (o *UnknownOutput) Validate() ValidationErrors { return validateOutput(o) }
+
+type OutputMetadata map[string]interface{}
+
+type MimeBundle map[string]MultilineString
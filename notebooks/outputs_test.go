@@ -0,0 +1,161 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// canonicalJSON re-encodes data with sorted keys and no spaces.
+func canonicalJSON(t *testing.T, data []byte) string {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestOutputRoundTrip(t *testing.T) {
+	tests := []struct {
+		json     string
+		wantType string
+	}{
+		{`{"output_type": "stream", "name": "stdout", "text": ["a\n", "b"]}`, "*notebooks.StreamOutput"},
+		{`{"output_type": "stream", "name": "stderr", "text": "warning\n", "transient": {"x": 1}}`, "*notebooks.StreamOutput"},
+		{`{"output_type": "display_data", "data": {"image/png": "iVBOR\n", "application/vnd.plotly.v1+json": {"data": [1, 2]}}, "metadata": {"image/png": {"width": 10}}}`, "*notebooks.DisplayData"},
+		{`{"output_type": "execute_result", "execution_count": 3, "data": {"text/plain": ["1\n", "2"]}, "metadata": {}}`, "*notebooks.ExecuteResult"},
+		{`{"output_type": "execute_result", "execution_count": null, "data": {"text/html": "<b>x</b>"}, "metadata": {}}`, "*notebooks.ExecuteResult"},
+		{`{"output_type": "error", "ename": "ValueError", "evalue": "bad", "traceback": ["Traceback", "ValueError: bad"]}`, "*notebooks.ErrorOutput"},
+		{`{"output_type": "widget_view", "model_id": "abc", "state": {"value": [1, {"x": null}]}}`, "*notebooks.UnknownOutput"},
+	}
+	for _, tt := range tests {
+		o, err := UnmarshalOutput([]byte(tt.json))
+		if err != nil {
+			t.Errorf("UnmarshalOutput(%s): %v", tt.json, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", o); got != tt.wantType {
+			t.Errorf("UnmarshalOutput(%s) = %s, want %s", tt.json, got, tt.wantType)
+		}
+		b, err := json.Marshal(o)
+		if err != nil {
+			t.Errorf("marshalling %s: %v", tt.json, err)
+			continue
+		}
+		if got, want := canonicalJSON(t, b), canonicalJSON(t, []byte(tt.json)); got != want {
+			t.Errorf("round trip of %s = %s", want, got)
+		}
+	}
+}
+
+// TestUnknownOutput checks that outputs of types nbformat does not define are
+// kept byte for byte.
+func TestUnknownOutput(t *testing.T) {
+	in := `[{"output_type":"stream","name":"stdout","text":"x"}, {"output_type": "widget_view",  "state": {"b": 1, "a": 2}}]`
+	var outputs Outputs
+	if err := json.Unmarshal([]byte(in), &outputs); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := outputs[1].(*UnknownOutput)
+	if !ok {
+		t.Fatalf("outputs[1] is %T, want *UnknownOutput", outputs[1])
+	}
+	if u.OutputType() != "widget_view" {
+		t.Errorf("OutputType = %q, want widget_view", u.OutputType())
+	}
+	b, err := json.Marshal(outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"output_type":"widget_view","state":{"b":1,"a":2}}`; !strings.Contains(string(b), want) {
+		t.Errorf("marshalled outputs %s lack %s", b, want)
+	}
+}
+
+func TestOutputsUnmarshalError(t *testing.T) {
+	in := `[{"output_type": "stream", "name": "stdout", "text": ""}, {"output_type": "error", "traceback": "not a list"}]`
+	var outputs Outputs
+	err := json.Unmarshal([]byte(in), &outputs)
+	if err == nil || !strings.Contains(err.Error(), "outputs[1]: ") {
+		t.Errorf("Unmarshal = %v, want an error in outputs[1]", err)
+	}
+}
+
+// TestOutputHelpers checks that each output marshals only the properties of
+// its output_type.
+func TestOutputHelpers(t *testing.T) {
+	tests := []struct {
+		output Output
+		want   string
+	}{
+		{NewStreamOutput("stdout", "hi\n"), `{"name":"stdout","output_type":"stream","text":"hi\n"}`},
+		{NewDisplayData(nil), `{"data":{},"metadata":{},"output_type":"display_data"}`},
+		{NewExecuteResult(2, MimeBundle{"text/plain": {Value: "4"}}), `{"data":{"text/plain":"4"},"execution_count":2,"metadata":{},"output_type":"execute_result"}`},
+		{NewErrorOutput("KeyError", "'a'"), `{"ename":"KeyError","evalue":"'a'","output_type":"error","traceback":["KeyError: 'a'"]}`},
+		{&ErrorOutput{EName: "E", EValue: "v"}, `{"ename":"E","evalue":"v","output_type":"error","traceback":[]}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := canonicalJSON(t, b); got != tt.want {
+			t.Errorf("%T marshals to %s, want %s", tt.output, got, tt.want)
+		}
+		if errs := tt.output.Validate(); errs != nil {
+			t.Errorf("%s is invalid: %v", tt.want, errs)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", `""`},
+		{"one", `"one"`},
+		{"one\n", `"one\n"`},
+		{"a\nb", `["a\n","b"]`},
+		{"a\nb\n", `["a\n","b\n"]`},
+		{"\n\n", `["\n","\n"]`},
+	}
+	for _, tt := range tests {
+		o := NewStreamOutput("stdout", tt.text)
+		b, err := json.Marshal(o.Text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("NewStreamOutput(%q) text = %s, want %s", tt.text, b, tt.want)
+		}
+		if got := o.Text.String(); got != tt.text {
+			t.Errorf("NewStreamOutput(%q) text reads back as %q", tt.text, got)
+		}
+	}
+
+	bundle := MimeBundle{
+		"text/plain":       {Value: "a\nb"},
+		"image/svg+xml":    {Value: "<svg>\n</svg>"},
+		"image/png":        {Value: "iVBOR\nw0KG"},
+		"application/json": {JSON: json.RawMessage(`{"a":"x\ny"}`)},
+		"text/html":        {Lines: []string{"<p>\n<b>x</b>", "</p>"}},
+	}
+	b, err := json.Marshal(NewDisplayData(bundle).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"application/json":{"a":"x\ny"},"image/png":"iVBOR\nw0KG","image/svg+xml":["<svg>\n","</svg>"],"text/html":["<p>\n<b>x</b>","</p>"],"text/plain":["a\n","b"]}`
+	if got, want := canonicalJSON(t, b), canonicalJSON(t, []byte(want)); got != want {
+		t.Errorf("NewDisplayData data = %s, want %s", got, want)
+	}
+	if bundle["text/plain"].Lines != nil {
+		t.Errorf("NewDisplayData changed the bundle it was given")
+	}
+}
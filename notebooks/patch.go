@@ -0,0 +1,85 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PatchOp is one change of a Patch, addressing cells by ID.
+type PatchOp struct {
+	// Op is "replace", "insert" or "delete".
+	Op string `json:"op"`
+	// ID is the cell replaced or deleted.
+	ID string `json:"id,omitempty"`
+	// After is the cell an inserted cell follows; the cell is inserted
+	// first if After is empty.
+	After string `json:"after,omitempty"`
+	// Cell is the replacing or inserted cell.
+	Cell *Cell `json:"cell,omitempty"`
+}
+
+// Patch is a cell-level change of a notebook.
+type Patch []PatchOp
+
+// Apply returns a copy of n with the operations of p applied in order. A
+// replacing cell keeps the ID of the cell it replaces, and inserted cells
+// without an ID or with a taken one get a new one.
+func (p Patch) Apply(n *Notebook) (*Notebook, error) {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+	nb := &Notebook{}
+	if err := json.Unmarshal(b, nb); err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, c := range nb.Cells {
+		ids[c.ID] = true
+	}
+	index := func(id string) int {
+		for i, c := range nb.Cells {
+			if c.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	for i, op := range p {
+		if op.Op != "delete" && op.Cell == nil {
+			return nil, fmt.Errorf("patch op %d: %s without a cell", i, op.Op)
+		}
+		switch op.Op {
+		case "replace":
+			j := index(op.ID)
+			if j < 0 {
+				return nil, fmt.Errorf("patch op %d: no cell %q to replace", i, op.ID)
+			}
+			c := *op.Cell
+			c.ID = op.ID
+			nb.Cells[j] = c
+		case "insert":
+			j := 0
+			if op.After != "" {
+				if j = index(op.After) + 1; j == 0 {
+					return nil, fmt.Errorf("patch op %d: no cell %q to insert after", i, op.After)
+				}
+			}
+			c := *op.Cell
+			if c.ID == "" || ids[c.ID] {
+				c.ID = stableID(&c, ids)
+			}
+			ids[c.ID] = true
+			nb.Cells = append(nb.Cells[:j], append([]Cell{c}, nb.Cells[j:]...)...)
+		case "delete":
+			j := index(op.ID)
+			if j < 0 {
+				return nil, fmt.Errorf("patch op %d: no cell %q to delete", i, op.ID)
+			}
+			nb.Cells = append(nb.Cells[:j], nb.Cells[j+1:]...)
+		default:
+			return nil, fmt.Errorf("patch op %d: unknown op %q", i, op.Op)
+		}
+	}
+	return nb, nil
+}
@@ -0,0 +1,52 @@
+package notebooks
+
+import "testing"
+
+func TestPatchApply(t *testing.T) {
+	nb, err := NewBuilder().Python().
+		Markdown("# Title").ID("title").
+		Code("print(1)").ID("code").
+		Markdown("the end").ID("end").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := Patch{
+		{Op: "replace", ID: "code", Cell: &Cell{CellType: "code", Source: &MultilineString{Value: "print(2)"}}},
+		{Op: "insert", After: "code", Cell: &Cell{CellType: "markdown", ID: "title", Source: &MultilineString{Value: "## More"}}},
+		{Op: "insert", Cell: &Cell{CellType: "raw", Source: &MultilineString{Value: "first"}}},
+		{Op: "delete", ID: "end"},
+	}
+	got, err := patch.Apply(nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ id, source string }{
+		{"6d13737c", "first"},
+		{"title", "# Title"},
+		{"code", "print(2)"},
+		{"a78f1158", "## More"},
+	}
+	if len(got.Cells) != len(want) {
+		t.Fatalf("got %d cells, want %d", len(got.Cells), len(want))
+	}
+	for i, w := range want {
+		if c := got.Cells[i]; c.ID != w.id || c.Source.String() != w.source {
+			t.Errorf("cell %d = %s %q, want %s %q", i, c.ID, c.Source.String(), w.id, w.source)
+		}
+	}
+	if len(nb.Cells) != 3 || nb.Cells[1].Source.String() != "print(1)" {
+		t.Errorf("Apply changed the patched notebook")
+	}
+
+	for _, bad := range []Patch{
+		{{Op: "delete", ID: "missing"}},
+		{{Op: "insert", After: "missing", Cell: &Cell{CellType: "raw"}}},
+		{{Op: "replace", ID: "code"}},
+		{{Op: "move", ID: "code"}},
+	} {
+		if _, err := bad.Apply(nb); err == nil {
+			t.Errorf("Apply(%+v) succeeded, want an error", bad)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package notebooks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// WritePercent writes nb as a script in the percent format:
+//
+//	# %% [markdown]
+//	# # Title
+//
+//	# %% tags=["parameters"]
+//	x = 1
+//
+// Markdown and raw cells are commented out with the line comment marker of
+// the notebook's language. The notebook metadata is written as a YAML header
+// under "jupyter:".
+func WritePercent(w io.Writer, nb *Notebook) error {
+	bw := bufio.NewWriter(w)
+	prefix := commentPrefix(nb.Language())
+	header, err := jupyterYAML(&nb.Metadata)
+	if err != nil {
+		return err
+	}
+	if header != "" {
+		fmt.Fprintf(bw, "%s ---\n", prefix)
+		for _, line := range strings.Split(strings.TrimSuffix(header, "\n"), "\n") {
+			fmt.Fprintln(bw, commentLine(prefix, line))
+		}
+		fmt.Fprintf(bw, "%s ---\n\n", prefix)
+	}
+	for i := range nb.Cells {
+		c := &nb.Cells[i]
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		marker := prefix + " %%"
+		switch c.CellType {
+		case "code":
+		case "markdown", "raw":
+			marker += " [" + c.CellType + "]"
+		default:
+			return fmt.Errorf("cells[%d]: unknown cell_type %q", i, c.CellType)
+		}
+		attrs, err := cellAttrs(c.Metadata)
+		if err != nil {
+			return err
+		}
+		if attrs != "" {
+			marker += " " + attrs
+		}
+		fmt.Fprintln(bw, marker)
+		source := cellSource(c)
+		if source == "" {
+			continue
+		}
+		for _, line := range strings.Split(source, "\n") {
+			if c.CellType != "code" {
+				line = commentLine(prefix, line)
+			}
+			fmt.Fprintln(bw, line)
+		}
+	}
+	return bw.Flush()
+}
+
+func commentLine(prefix, line string) string {
+	if line == "" {
+		return prefix
+	}
+	return prefix + " " + line
+}
+
+// percentMarker matches a cell marker: the comment prefix, "%%", and an
+// optional cell type and metadata.
+var percentMarker = regexp.MustCompile(`^(#|//|%|--) %%(?:\s+(.*))?$`)
+
+var percentCellType = regexp.MustCompile(`^\[(markdown|md|raw)\]\s*`)
+
+// ReadPercent reads a notebook in the percent format written by
+// WritePercent. Lines before the first cell marker form a code cell.
+func ReadPercent(r io.Reader) (*Notebook, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+	prefix := "#"
+	for _, line := range lines {
+		if m := percentMarker.FindStringSubmatch(line); m != nil {
+			prefix = m[1]
+			break
+		}
+	}
+
+	var metadata Metadata
+	if len(lines) > 0 && lines[0] == prefix+" ---" {
+		var header []string
+		end := -1
+		for i := 1; i < len(lines); i++ {
+			if lines[i] == prefix+" ---" {
+				end = i
+				break
+			}
+			header = append(header, uncommentLine(prefix, lines[i]))
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated metadata header")
+		}
+		if metadata, err = parseJupyterYAML(strings.Join(header, "\n")); err != nil {
+			return nil, err
+		}
+		lines = lines[end+1:]
+	}
+
+	cells := newTextCells()
+	for i, line := range lines {
+		m := percentMarker.FindStringSubmatch(line)
+		if m == nil || m[1] != prefix {
+			if !cells.open {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				cells.start("code", nil)
+			}
+			if cells.typ != "code" {
+				line = uncommentLine(prefix, line)
+			}
+			cells.add(line)
+			continue
+		}
+		cellType, rest := "code", m[2]
+		if t := percentCellType.FindStringSubmatch(rest); t != nil {
+			cellType, rest = t[1], rest[len(t[0]):]
+			if cellType == "md" {
+				cellType = "markdown"
+			}
+		}
+		var md *CellMetadata
+		if strings.TrimSpace(rest) != "" {
+			if md, err = parseCellAttrs(rest); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+		cells.start(cellType, md)
+	}
+	return cells.notebook(metadata)
+}
+
+func uncommentLine(prefix, line string) string {
+	if line == prefix {
+		return ""
+	}
+	return strings.TrimPrefix(line, prefix+" ")
+}
@@ -2,22 +2,20 @@ package notebooks
 
 import "encoding/json"
 
+// RepairNotebookJSON closes a possibly truncated notebook JSON document and
+// returns it re-marshaled along with whether the input was already complete.
+// If the closed document still fails to parse, the cells that were fully
+// written are kept.
 func RepairNotebookJSON(s string) (string, bool) {
-	var suffixes = []string{
-		``, `}`, `}]}`, `"]}}`, `"]}]}`, `]}]}`, `"]}]}`,
-		`""]}]}`, `":null}]}`, `null}]}`,
-	}
+	p := NewStreamParser()
+	p.WriteString(s)
 	var o Notebook
-	var ok bool
-	var repaired []byte
-	for _, suffix := range suffixes {
-		if err := json.Unmarshal([]byte(s+suffix), &o); err == nil {
-			ok = suffix == ``
-			repaired = []byte(s + suffix)
-			break
-		}
+	ok := p.Complete()
+	if err := json.Unmarshal([]byte(p.Closed()), &o); err != nil {
+		o = Notebook{Cells: p.Cells()}
+		ok = false
 	}
-	o.Validate()
-	repaired, _ = json.Marshal(o)
+	o.Normalize()
+	repaired, _ := json.Marshal(o)
 	return string(repaired), ok
 }
@@ -0,0 +1,371 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// StreamParser incrementally tokenizes a notebook JSON document as it is
+// written. It tracks the stack of open containers and the string/escape state
+// so that any valid JSON prefix can be closed into a complete document, and it
+// collects each cell of the top-level "cells" array as soon as it is complete.
+type StreamParser struct {
+	buf   []byte
+	pos   int
+	stack []frame
+	err   error
+
+	inString    bool
+	stringIsKey bool
+	escStart    int // offset of the pending backslash, or -1
+	escHex      int // number of hex digits still expected for a \u escape
+	// surrogate is the offset of a \u escape of a high surrogate that ends
+	// the string so far, or -1. Without its low surrogate it decodes to
+	// U+FFFD, so Closed drops it.
+	surrogate int
+
+	inLiteral    bool
+	literalStart int
+
+	cells   []Cell
+	started int
+}
+
+type parseState int
+
+const (
+	stateValue parseState = iota // expecting a value
+	stateKey                     // expecting an object key
+	stateColon                   // expecting the colon after a key
+	stateComma                   // expecting a comma or the end of the container
+	stateDone                    // the root value is complete
+)
+
+type frame struct {
+	kind        byte // '{', '[' or 0 for the root
+	state       parseState
+	canClose    bool // the container may be closed in the current state
+	start       int  // offset of the opening delimiter
+	memberStart int  // offset where the current member begins, including its leading comma
+	keyStart    int
+	key         string
+	cell        bool // the container is an element of the top-level cells array
+}
+
+// NewStreamParser returns a parser ready to accept the start of a document.
+func NewStreamParser() *StreamParser {
+	return &StreamParser{
+		stack:     []frame{{state: stateValue}},
+		escStart:  -1,
+		surrogate: -1,
+	}
+}
+
+// Write feeds more of the document to the parser. Once the input stops being
+// valid JSON the parser ignores further writes and returns the error.
+func (p *StreamParser) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	p.buf = append(p.buf, b...)
+	p.scan()
+	return len(b), p.err
+}
+
+// WriteString is like Write but takes a string.
+func (p *StreamParser) WriteString(s string) (int, error) {
+	return p.Write([]byte(s))
+}
+
+// Err returns the syntax error encountered so far, if any.
+func (p *StreamParser) Err() error {
+	return p.err
+}
+
+// Complete reports whether the root value has been fully written.
+func (p *StreamParser) Complete() bool {
+	return p.err == nil && p.stack[0].state == stateDone
+}
+
+// Cells returns the cells of the top-level "cells" array that have been
+// completely written so far.
+func (p *StreamParser) Cells() []Cell {
+	return append([]Cell(nil), p.cells...)
+}
+
+// Started returns the number of cells of the top-level "cells" array that
+// have been opened so far, including the one currently being written.
+func (p *StreamParser) Started() int {
+	return p.started
+}
+
+// Closed returns the valid prefix written so far, closed into a complete JSON
+// document. Incomplete keys and members are dropped, partial string values
+// are kept and terminated, and all open containers are closed. It returns an
+// empty string if no value has been started.
+func (p *StreamParser) Closed() string {
+	end := p.pos
+	top := &p.stack[len(p.stack)-1]
+	var tail []byte
+	switch {
+	case top.state == stateDone:
+	case p.inString && p.stringIsKey:
+		end = top.memberStart
+	case p.inString:
+		if p.escStart >= 0 {
+			end = p.escStart
+		}
+		if p.surrogate >= 0 {
+			end = p.surrogate
+		}
+		end = trimPartialRune(p.buf[:end])
+		tail = append(tail, '"')
+	case p.inLiteral:
+		if lit, ok := completeLiteral(p.buf[p.literalStart:end]); ok {
+			end = p.literalStart
+			tail = append(tail, lit...)
+		} else {
+			end = top.memberStart
+		}
+	case top.state != stateComma:
+		end = top.memberStart
+	}
+	if len(p.stack) == 1 && top.state != stateDone && len(tail) == 0 {
+		return ""
+	}
+	out := append([]byte(nil), p.buf[:end]...)
+	out = append(out, tail...)
+	for i := len(p.stack) - 1; i > 0; i-- {
+		if p.stack[i].kind == '{' {
+			out = append(out, '}')
+		} else {
+			out = append(out, ']')
+		}
+	}
+	return string(out)
+}
+
+func (p *StreamParser) scan() {
+	for ; p.pos < len(p.buf); p.pos++ {
+		c := p.buf[p.pos]
+		if p.inString {
+			if err := p.scanString(c); err != nil {
+				p.err = fmt.Errorf("offset %d: %w", p.pos, err)
+				return
+			}
+			continue
+		}
+		if p.inLiteral {
+			if isLiteralByte(c) {
+				continue
+			}
+			if lit := p.buf[p.literalStart:p.pos]; !json.Valid(lit) {
+				// inLiteral stays set so that Closed salvages what it can
+				p.err = fmt.Errorf("offset %d: invalid literal %q", p.literalStart, lit)
+				return
+			}
+			p.inLiteral = false
+			p.valueDone()
+		}
+		if isSpace(c) {
+			continue
+		}
+		if err := p.scanStructural(c); err != nil {
+			p.err = fmt.Errorf("offset %d: %w", p.pos, err)
+			return
+		}
+	}
+}
+
+func (p *StreamParser) scanString(c byte) error {
+	switch {
+	case p.escHex > 0:
+		if !isHex(c) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		p.escHex--
+		if p.escHex == 0 {
+			p.surrogate = -1
+			if r, err := strconv.ParseUint(string(p.buf[p.escStart+2:p.pos+1]), 16, 16); err == nil && utf16.IsSurrogate(rune(r)) && r < 0xdc00 {
+				p.surrogate = p.escStart
+			}
+			p.escStart = -1
+		}
+	case p.escStart >= 0:
+		switch c {
+		case 'u':
+			p.escHex = 4
+			return nil
+		case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		default:
+			return fmt.Errorf("invalid escape %q", c)
+		}
+		p.escStart = -1
+		p.surrogate = -1
+	case c < 0x20:
+		return fmt.Errorf("invalid control character %q in string", c)
+	case c == '\\':
+		p.escStart = p.pos
+	case c == '"':
+		p.inString = false
+		p.surrogate = -1
+		if p.stringIsKey {
+			top := &p.stack[len(p.stack)-1]
+			json.Unmarshal(p.buf[top.keyStart:p.pos+1], &top.key)
+			top.state = stateColon
+			return nil
+		}
+		p.valueDone()
+	default:
+		p.surrogate = -1
+	}
+	return nil
+}
+
+func (p *StreamParser) scanStructural(c byte) error {
+	top := &p.stack[len(p.stack)-1]
+	switch top.state {
+	case stateDone:
+		return fmt.Errorf("unexpected %q after end of document", c)
+	case stateKey:
+		switch {
+		case c == '"':
+			p.inString, p.stringIsKey = true, true
+			top.keyStart = p.pos
+			return nil
+		case c == '}' && top.canClose:
+			p.pop()
+			return nil
+		}
+		return fmt.Errorf("unexpected %q, expecting object key", c)
+	case stateColon:
+		if c != ':' {
+			return fmt.Errorf("unexpected %q, expecting ':'", c)
+		}
+		top.state = stateValue
+		top.canClose = false
+		return nil
+	case stateComma:
+		switch {
+		case c == ',':
+			top.memberStart = p.pos
+			top.canClose = false
+			if top.kind == '{' {
+				top.state = stateKey
+			} else {
+				top.state = stateValue
+			}
+			return nil
+		case c == '}' && top.kind == '{', c == ']' && top.kind == '[':
+			p.pop()
+			return nil
+		}
+		return fmt.Errorf("unexpected %q, expecting ',' or end of container", c)
+	}
+	// stateValue
+	switch {
+	case c == '{', c == '[':
+		p.push(c)
+	case c == ']' && top.kind == '[' && top.canClose:
+		p.pop()
+	case c == '"':
+		p.inString, p.stringIsKey = true, false
+	case c == '-' || c >= '0' && c <= '9' || c == 't' || c == 'f' || c == 'n':
+		p.inLiteral, p.literalStart = true, p.pos
+	default:
+		return fmt.Errorf("unexpected %q, expecting value", c)
+	}
+	return nil
+}
+
+func (p *StreamParser) push(kind byte) {
+	f := frame{
+		kind:        kind,
+		state:       stateValue,
+		canClose:    true,
+		start:       p.pos,
+		memberStart: p.pos + 1,
+	}
+	if kind == '{' {
+		f.state = stateKey
+	}
+	// root, notebook object, cells array
+	if kind == '{' && len(p.stack) == 3 && p.stack[1].kind == '{' && p.stack[1].key == "cells" && p.stack[2].kind == '[' {
+		f.cell = true
+		p.started++
+	}
+	p.stack = append(p.stack, f)
+}
+
+func (p *StreamParser) pop() {
+	f := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	if f.cell {
+		var cell Cell
+		if err := json.Unmarshal(p.buf[f.start:p.pos+1], &cell); err == nil {
+			p.cells = append(p.cells, cell)
+		}
+	}
+	p.valueDone()
+}
+
+func (p *StreamParser) valueDone() {
+	top := &p.stack[len(p.stack)-1]
+	top.canClose = true
+	if len(p.stack) == 1 {
+		top.state = stateDone
+		return
+	}
+	top.state = stateComma
+}
+
+// completeLiteral closes a partially written number or keyword, reporting
+// false if nothing meaningful can be salvaged.
+func completeLiteral(lit []byte) ([]byte, bool) {
+	for _, kw := range []string{"true", "false", "null"} {
+		if len(lit) <= len(kw) && string(lit) == kw[:len(lit)] {
+			return []byte(kw), true
+		}
+	}
+	for len(lit) > 0 {
+		switch lit[len(lit)-1] {
+		case '.', 'e', 'E', '+', '-':
+			lit = lit[:len(lit)-1]
+			continue
+		}
+		break
+	}
+	if len(lit) == 0 || !json.Valid(lit) {
+		return nil, false
+	}
+	return lit, true
+}
+
+// trimPartialRune returns the length of b without a trailing incomplete UTF-8
+// sequence.
+func trimPartialRune(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isLiteralByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c == '.' || c == '+' || c == '-' || c == 'E'
+}
@@ -0,0 +1,202 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// escapesNotebook has strings with every kind of escape, including a
+// surrogate pair, and a code cell with outputs.
+const escapesNotebook = `{
+ "cells": [
+  {
+   "cell_type": "markdown",
+   "id": "intro",
+   "metadata": {},
+   "source": ["# Caf\u00e9 \ud83d\ude00\n", "quote \"q\", slash \/, backslash \\ and tab\t"]
+  },
+  {
+   "cell_type": "code",
+   "execution_count": 1,
+   "id": "code",
+   "metadata": {"tags": ["a", "b"]},
+   "outputs": [
+    {"name": "stdout", "output_type": "stream", "text": ["line\r\n", "\u001b[31mred\u001b[0m\n"]},
+    {"data": {"text/plain": ["1.5e-3"]}, "execution_count": 1, "metadata": {}, "output_type": "execute_result"}
+   ],
+   "source": ["print(\"\\u00e9\")\n", "1.5e-3"]
+  }
+ ],
+ "metadata": {"title": null, "flag": true, "n": -12.5},
+ "nbformat": 4,
+ "nbformat_minor": 5
+}
+`
+
+func streamCorpus(t *testing.T) map[string]string {
+	t.Helper()
+	docs := map[string]string{"escapes": escapesNotebook}
+	for _, file := range roundTripCorpus(t) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs[filepath.Base(file)] = string(data)
+	}
+	return docs
+}
+
+func cellJSON(t *testing.T, c Cell) string {
+	t.Helper()
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestStreamParserPrefixes feeds each notebook one byte at a time and checks
+// that every prefix closes into a notebook, and that the completed cells
+// only ever grow, as a prefix of the notebook's cells.
+func TestStreamParserPrefixes(t *testing.T) {
+	for name, doc := range streamCorpus(t) {
+		t.Run(name, func(t *testing.T) {
+			var want Notebook
+			if err := json.Unmarshal([]byte(doc), &want); err != nil {
+				t.Fatal(err)
+			}
+			p := NewStreamParser()
+			var cells int
+			for i := 0; i < len(doc); i++ {
+				if _, err := p.Write([]byte{doc[i]}); err != nil {
+					t.Fatalf("prefix %d: %v", i+1, err)
+				}
+				if closed := p.Closed(); closed != "" {
+					var nb Notebook
+					if err := json.Unmarshal([]byte(closed), &nb); err != nil {
+						t.Fatalf("prefix %d closes into invalid JSON: %v\n%s", i+1, err, closed)
+					}
+				}
+				got := p.Cells()
+				if len(got) < cells || len(got) > len(want.Cells) {
+					t.Fatalf("prefix %d: %d cells complete after %d", i+1, len(got), cells)
+				}
+				for ; cells < len(got); cells++ {
+					if g, w := cellJSON(t, got[cells]), cellJSON(t, want.Cells[cells]); g != w {
+						t.Fatalf("prefix %d: cell %d = %s, want %s", i+1, cells, g, w)
+					}
+				}
+				if repaired, _ := RepairNotebookJSON(doc[:i+1]); !json.Valid([]byte(repaired)) {
+					t.Fatalf("prefix %d repairs into invalid JSON:\n%s", i+1, repaired)
+				}
+			}
+			if !p.Complete() {
+				t.Errorf("Complete = false after the whole document")
+			}
+			if cells != len(want.Cells) {
+				t.Errorf("%d cells complete, want %d", cells, len(want.Cells))
+			}
+			if _, ok := RepairNotebookJSON(doc); !ok {
+				t.Errorf("RepairNotebookJSON reports the whole document incomplete")
+			}
+		})
+	}
+}
+
+// TestStreamParserStringPrefixes checks that the strings of each closed
+// prefix are prefixes of the final strings: escapes cut off by the end of a
+// chunk, including \u escapes and surrogate pairs, are dropped rather than
+// decoded wrongly.
+func TestStreamParserStringPrefixes(t *testing.T) {
+	var want Notebook
+	if err := json.Unmarshal([]byte(escapesNotebook), &want); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= len(escapesNotebook); i++ {
+		p := NewStreamParser()
+		p.WriteString(escapesNotebook[:i])
+		closed := p.Closed()
+		if closed == "" {
+			continue
+		}
+		var nb Notebook
+		if err := json.Unmarshal([]byte(closed), &nb); err != nil {
+			t.Fatalf("prefix %d: %v", i, err)
+		}
+		for j, c := range nb.Cells {
+			if c.Source == nil {
+				continue
+			}
+			if got, full := c.Source.String(), want.Cells[j].Source.String(); !strings.HasPrefix(full, got) {
+				t.Fatalf("prefix %d: source of cell %d = %q, not a prefix of %q", i, j, got, full)
+			}
+		}
+	}
+}
+
+// TestStreamParserChunks splits each notebook into two writes at every
+// offset, which cuts escapes, keywords, numbers and partial outputs arrays
+// between chunks.
+func TestStreamParserChunks(t *testing.T) {
+	for name, doc := range streamCorpus(t) {
+		t.Run(name, func(t *testing.T) {
+			var want Notebook
+			if err := json.Unmarshal([]byte(doc), &want); err != nil {
+				t.Fatal(err)
+			}
+			for i := range doc {
+				p := NewStreamParser()
+				p.WriteString(doc[:i])
+				if _, err := p.WriteString(doc[i:]); err != nil {
+					t.Fatalf("split at %d: %v", i, err)
+				}
+				if !p.Complete() || p.Closed() != doc {
+					t.Fatalf("split at %d: Complete = %v, Closed differs from the document", i, p.Complete())
+				}
+				got := p.Cells()
+				if len(got) != len(want.Cells) {
+					t.Fatalf("split at %d: %d cells, want %d", i, len(got), len(want.Cells))
+				}
+				for j := range got {
+					if g, w := cellJSON(t, got[j]), cellJSON(t, want.Cells[j]); g != w {
+						t.Fatalf("split at %d: cell %d = %s, want %s", i, j, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStreamParserErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"cells": [}`,
+		`{"a" 1}`,
+		`{"a": "\x"}`,
+		`{"a": "\u12g4"}`,
+		"{\"a\": \"\x01\"}",
+		`{} {}`,
+		`{"a": tru}`,
+		`{"a": 1x}`,
+		`{"a": 01}`,
+		`{"a": [1, -]}`,
+		`{"a": 1.e5}`,
+		`{"cells": [{"cell_type": "code", "execution_count": nul, "source": ""}]}`,
+	} {
+		p := NewStreamParser()
+		if _, err := p.WriteString(doc); err == nil {
+			t.Errorf("Write(%s) succeeded, want a syntax error", doc)
+		}
+		if p.Complete() {
+			t.Errorf("%s is complete", doc)
+		}
+		if closed := p.Closed(); closed != "" && !json.Valid([]byte(closed)) {
+			t.Errorf("%s closes into invalid JSON %s", doc, closed)
+		}
+		if _, err := p.WriteString("{}"); err == nil {
+			t.Errorf("Write after a syntax error in %s succeeded", doc)
+		}
+	}
+}
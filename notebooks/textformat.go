@@ -0,0 +1,268 @@
+package notebooks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The text formats convert notebooks to and from plain text that is easy to
+// review in diffs and to edit, following jupytext:
+//
+//   - the percent format, a script with "# %%" cell markers (WritePercent),
+//   - MyST markdown, with {code-cell} directives (WriteMyST),
+//   - plain markdown with fenced code cells (WriteMarkdown).
+//
+// Outputs, execution counts and the blank lines around cell sources are not
+// kept. Cells read from text get stable
+// IDs derived from their content, as the Builder gives them.
+
+// Language returns the programming language of the notebook's code cells,
+// from its language_info or kernelspec metadata, or "python".
+func (n *Notebook) Language() string {
+	if li := n.Metadata.LanguageInfo; li != nil && li.Name != "" {
+		return li.Name
+	}
+	if ks := n.Metadata.KernelSpec; ks != nil {
+		var lang string
+		if json.Unmarshal(ks.Unknown["language"], &lang) == nil && lang != "" {
+			return lang
+		}
+	}
+	return "python"
+}
+
+// commentPrefix returns the line comment marker of language.
+func commentPrefix(language string) string {
+	switch strings.ToLower(language) {
+	case "javascript", "typescript", "go", "rust", "c", "c++", "cpp", "java", "scala", "kotlin", "swift", "csharp", "c#", "groovy", "dart":
+		return "//"
+	case "matlab", "octave":
+		return "%"
+	case "sql", "haskell", "lua":
+		return "--"
+	}
+	return "#"
+}
+
+// metadataYAML returns the notebook metadata as YAML, or "" if it is empty.
+func metadataYAML(m *Metadata) (string, error) {
+	doc, err := toMap(m)
+	if err != nil || len(doc) == 0 {
+		return "", err
+	}
+	return marshalYAML(doc)
+}
+
+func marshalYAML(doc map[string]any) (string, error) {
+	var b strings.Builder
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return "", err
+	}
+	return b.String(), enc.Close()
+}
+
+// parseMetadataYAML decodes notebook metadata written by metadataYAML.
+func parseMetadataYAML(s string) (Metadata, error) {
+	var m Metadata
+	var doc map[string]any
+	if err := yaml.Unmarshal([]byte(s), &doc); err != nil {
+		return m, fmt.Errorf("metadata header: %w", err)
+	}
+	if doc == nil {
+		return m, nil
+	}
+	return m, fromMap(doc, &m)
+}
+
+// jupyterYAML returns the notebook metadata as YAML under a "jupyter" key,
+// the header of the percent and markdown formats, or "" if it is empty.
+func jupyterYAML(m *Metadata) (string, error) {
+	doc, err := toMap(m)
+	if err != nil || len(doc) == 0 {
+		return "", err
+	}
+	return marshalYAML(map[string]any{"jupyter": doc})
+}
+
+// parseJupyterYAML decodes notebook metadata written by jupyterYAML.
+func parseJupyterYAML(s string) (Metadata, error) {
+	var m Metadata
+	var doc struct {
+		Jupyter map[string]any `yaml:"jupyter"`
+	}
+	if err := yaml.Unmarshal([]byte(s), &doc); err != nil {
+		return m, fmt.Errorf("metadata header: %w", err)
+	}
+	if doc.Jupyter == nil {
+		return m, nil
+	}
+	if err := fromMap(doc.Jupyter, &m); err != nil {
+		return m, fmt.Errorf("metadata header: %w", err)
+	}
+	return m, nil
+}
+
+// toMap returns the JSON object of v as a map, without empty values.
+func toMap(v any) (map[string]any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func fromMap(m map[string]any, v any) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// cellAttrs formats the cell metadata as space-separated key=JSON pairs, the
+// way jupytext writes it on cell markers.
+func cellAttrs(md *CellMetadata) (string, error) {
+	if md == nil {
+		return "", nil
+	}
+	m, err := toMap(md)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]string, len(keys))
+	for i, k := range keys {
+		v, err := json.Marshal(m[k])
+		if err != nil {
+			return "", err
+		}
+		attrs[i] = k + "=" + string(v)
+	}
+	return strings.Join(attrs, " "), nil
+}
+
+// parseCellAttrs parses the key=JSON pairs written by cellAttrs.
+func parseCellAttrs(s string) (*CellMetadata, error) {
+	m := map[string]any{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid cell metadata %q", s)
+		}
+		dec := json.NewDecoder(strings.NewReader(rest))
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("invalid cell metadata %s: %w", key, err)
+		}
+		m[key] = v
+		s = rest[dec.InputOffset():]
+	}
+	md := &CellMetadata{}
+	return md, fromMap(m, md)
+}
+
+// fence returns a backtick fence longer than any backtick run in source.
+func fence(source string) string {
+	longest := 0
+	for _, run := range backtickRuns.FindAllString(source, -1) {
+		longest = max(longest, len(run))
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+var backtickRuns = regexp.MustCompile("`+")
+
+// textCells accumulates the cells of a text format.
+type textCells struct {
+	b     *Builder
+	typ   string
+	md    *CellMetadata
+	lines []string
+	open  bool
+}
+
+func newTextCells() *textCells {
+	return &textCells{b: NewBuilder()}
+}
+
+func (t *textCells) start(cellType string, md *CellMetadata) {
+	t.flush()
+	t.typ, t.md, t.lines, t.open = cellType, md, nil, true
+}
+
+func (t *textCells) add(line string) {
+	if !t.open {
+		t.start("markdown", nil)
+	}
+	t.lines = append(t.lines, line)
+}
+
+// flush adds the current cell without its leading and trailing blank lines.
+// Markdown cells left empty are dropped unless they carry metadata.
+func (t *textCells) flush() {
+	if !t.open {
+		return
+	}
+	t.open = false
+	lines := t.lines
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 && t.typ == "markdown" && t.md == nil {
+		return
+	}
+	c := Cell{CellType: t.typ, Metadata: t.md, Source: &MultilineString{Value: strings.Join(lines, "\n")}}
+	if t.typ == "code" {
+		c.Outputs = Outputs{}
+	}
+	t.b.Cell(c)
+}
+
+func (t *textCells) notebook(metadata Metadata) (*Notebook, error) {
+	t.flush()
+	nb, err := t.b.Build()
+	if err != nil {
+		return nil, err
+	}
+	nb.Metadata = metadata
+	return nb, nil
+}
+
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 64<<20)
+	for s.Scan() {
+		lines = append(lines, strings.TrimSuffix(s.Text(), "\r"))
+	}
+	return lines, s.Err()
+}
+
+// emptyMetadata reports whether the cell metadata has nothing to write.
+func emptyMetadata(md *CellMetadata) bool {
+	if md == nil {
+		return true
+	}
+	m, err := toMap(md)
+	return err == nil && len(m) == 0
+}
@@ -0,0 +1,114 @@
+package notebooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The text formats keep cell types, sources up to trailing blank lines and
+// metadata, and the notebook metadata.
+func TestTextFormats(t *testing.T) {
+	formats := []struct {
+		name  string
+		write func(io.Writer, *Notebook) error
+		read  func(io.Reader) (*Notebook, error)
+	}{
+		{"percent", WritePercent, ReadPercent},
+		{"myst", WriteMyST, ReadMyST},
+		{"markdown", WriteMarkdown, ReadMarkdown},
+	}
+	for _, file := range roundTripCorpus(t) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want Notebook
+		if err := json.Unmarshal(data, &want); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range formats {
+			t.Run(filepath.Base(file)+"/"+f.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := f.write(&buf, &want); err != nil {
+					t.Fatal(err)
+				}
+				got, err := f.read(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("%v\n%s", err, buf.Bytes())
+				}
+				if errs := got.Validate(); errs != nil {
+					t.Errorf("invalid notebook: %v", errs)
+				}
+				if !reflect.DeepEqual(mapOf(t, &got.Metadata), mapOf(t, &want.Metadata)) {
+					t.Errorf("metadata = %v, want %v", mapOf(t, &got.Metadata), mapOf(t, &want.Metadata))
+				}
+				if len(got.Cells) != len(want.Cells) {
+					t.Fatalf("got %d cells, want %d\n%s", len(got.Cells), len(want.Cells), buf.Bytes())
+				}
+				for i := range want.Cells {
+					g, w := &got.Cells[i], &want.Cells[i]
+					if g.CellType != w.CellType || cellSource(g) != strings.TrimRight(cellSource(w), "\n") {
+						t.Errorf("cells[%d] = %s %q, want %s %q", i, g.CellType, cellSource(g), w.CellType, cellSource(w))
+					}
+					if !reflect.DeepEqual(mapOf(t, g.Metadata), mapOf(t, w.Metadata)) {
+						t.Errorf("cells[%d] metadata = %v, want %v", i, mapOf(t, g.Metadata), mapOf(t, w.Metadata))
+					}
+				}
+			})
+		}
+	}
+}
+
+func mapOf(t *testing.T, v any) map[string]any {
+	t.Helper()
+	m, err := toMap(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestReadPercentScript(t *testing.T) {
+	script := `import os
+
+# %% [markdown]
+# # Title
+#
+# Some text.
+
+# %% tags=["parameters"]
+x = 1
+
+
+# %% [raw]
+# raw text
+`
+	nb, err := ReadPercent(bytes.NewReader([]byte(script)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ typ, source string }{
+		{"code", "import os"},
+		{"markdown", "# Title\n\nSome text."},
+		{"code", "x = 1"},
+		{"raw", "raw text"},
+	}
+	if len(nb.Cells) != len(want) {
+		t.Fatalf("got %d cells, want %d", len(nb.Cells), len(want))
+	}
+	for i, w := range want {
+		c := &nb.Cells[i]
+		if c.CellType != w.typ || cellSource(c) != w.source {
+			t.Errorf("cells[%d] = %s %q, want %s %q", i, c.CellType, cellSource(c), w.typ, w.source)
+		}
+	}
+	if tags := nb.Cells[2].Metadata.Tags; len(tags) != 1 || tags[0] != "parameters" {
+		t.Errorf("tags = %q, want [parameters]", tags)
+	}
+}
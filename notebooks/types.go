@@ -1,26 +1,37 @@
 package notebooks
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 type Notebook struct {
 	Metadata      Metadata `json:"metadata"`
 	NBFormatMinor int      `json:"nbformat_minor"`
 	NBFormat      int      `json:"nbformat"`
 	Cells         []Cell   `json:"cells"`
+	Unknown       Unknown  `json:"-"`
 }
 
-func (n *Notebook) Validate() {
-	n.Metadata.Validate()
-	if n.NBFormat == 0 {
-		n.NBFormat = 4
+// UnmarshalJSON decodes a notebook, upgrading nbformat 3 and older layouts
+// to nbformat 4.
+func (n *Notebook) UnmarshalJSON(data []byte) error {
+	data, err := UpgradeJSON(data)
+	if err != nil {
+		return err
 	}
-	if n.Cells == nil {
-		n.Cells = []Cell{}
-	}
-	for _, cell := range n.Cells {
-		cell.Validate()
+	type notebook Notebook
+	if err := json.Unmarshal(data, (*notebook)(n)); err != nil {
+		return err
 	}
+	n.Unknown, err = unmarshalUnknown(data, n)
+	return err
+}
 
+func (n Notebook) MarshalJSON() ([]byte, error) {
+	type notebook Notebook
+	return marshalUnknown(notebook(n), n.Unknown)
 }
 
 type Metadata struct {
@@ -29,26 +40,87 @@ type Metadata struct {
 	OrigNBFormat int           `json:"orig_nbformat,omitempty"`
 	Title        string        `json:"title,omitempty"`
 	Authors      []Author      `json:"authors,omitempty"`
+	Unknown      Unknown       `json:"-"`
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	type metadata Metadata
+	if err := json.Unmarshal(data, (*metadata)(m)); err != nil {
+		return err
+	}
+	var err error
+	m.Unknown, err = unmarshalUnknown(data, m)
+	return err
 }
 
-func (m *Metadata) Validate() {
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	type metadata Metadata
+	return marshalUnknown(metadata(m), m.Unknown)
 }
 
 type KernelSpec struct {
-	Name        string `json:"name,omitempty"`
-	DisplayName string `json:"display_name,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	DisplayName string  `json:"display_name,omitempty"`
+	Unknown     Unknown `json:"-"`
+}
+
+func (ks *KernelSpec) UnmarshalJSON(data []byte) error {
+	type kernelSpec KernelSpec
+	if err := json.Unmarshal(data, (*kernelSpec)(ks)); err != nil {
+		return err
+	}
+	var err error
+	ks.Unknown, err = unmarshalUnknown(data, ks)
+	return err
+}
+
+func (ks KernelSpec) MarshalJSON() ([]byte, error) {
+	type kernelSpec KernelSpec
+	return marshalUnknown(kernelSpec(ks), ks.Unknown)
 }
 
 type LanguageInfo struct {
 	Name           string      `json:"name"`
 	CodeMirrorMode interface{} `json:"codemirror_mode,omitempty"`
-	FileExtension  string      `json:"file_extension"`
-	MimeType       string      `json:"mimetype"`
-	PygmentsLexer  string      `json:"pygments_lexer"`
+	FileExtension  string      `json:"file_extension,omitempty"`
+	MimeType       string      `json:"mimetype,omitempty"`
+	PygmentsLexer  string      `json:"pygments_lexer,omitempty"`
+	Unknown        Unknown     `json:"-"`
+}
+
+func (li *LanguageInfo) UnmarshalJSON(data []byte) error {
+	type languageInfo LanguageInfo
+	if err := json.Unmarshal(data, (*languageInfo)(li)); err != nil {
+		return err
+	}
+	var err error
+	li.Unknown, err = unmarshalUnknown(data, li)
+	return err
+}
+
+func (li LanguageInfo) MarshalJSON() ([]byte, error) {
+	type languageInfo LanguageInfo
+	return marshalUnknown(languageInfo(li), li.Unknown)
 }
 
 type Author struct {
-	Name string `json:"name"`
+	Name    string  `json:"name"`
+	Unknown Unknown `json:"-"`
+}
+
+func (a *Author) UnmarshalJSON(data []byte) error {
+	type author Author
+	if err := json.Unmarshal(data, (*author)(a)); err != nil {
+		return err
+	}
+	var err error
+	a.Unknown, err = unmarshalUnknown(data, a)
+	return err
+}
+
+func (a Author) MarshalJSON() ([]byte, error) {
+	type author Author
+	return marshalUnknown(author(a), a.Unknown)
 }
 
 type Cell struct {
@@ -57,74 +129,151 @@ type Cell struct {
 	Metadata       *CellMetadata         `json:"metadata,omitempty"`
 	Source         *MultilineString      `json:"source,omitempty"`
 	Attachments    map[string]MimeBundle `json:"attachments,omitempty"`
-	Outputs        []Output              `json:"outputs"`
+	Outputs        Outputs               `json:"outputs"`
 	ExecutionCount *int                  `json:"execution_count"`
+	Unknown        Unknown               `json:"-"`
 }
 
-func (c *Cell) Validate() {
-	if c.Metadata != nil {
-		c.Metadata.Validate()
+func (c *Cell) UnmarshalJSON(data []byte) error {
+	type cell Cell
+	if err := json.Unmarshal(data, (*cell)(c)); err != nil {
+		return err
 	}
-	for _, output := range c.Outputs {
-		output.Validate()
+	var err error
+	c.Unknown, err = unmarshalUnknown(data, c)
+	return err
+}
+
+// MarshalJSON writes the properties the nbformat schema defines for the
+// cell's type. Code cells always have outputs and an execution count; other
+// cells have neither.
+func (c Cell) MarshalJSON() ([]byte, error) {
+	metadata := c.Metadata
+	if metadata == nil {
+		metadata = &CellMetadata{}
+	}
+	source := c.Source
+	if source == nil {
+		source = &MultilineString{}
+	}
+	if c.CellType != "code" {
+		return marshalUnknown(struct {
+			ID          string                `json:"id,omitempty"`
+			CellType    string                `json:"cell_type"`
+			Metadata    *CellMetadata         `json:"metadata"`
+			Source      *MultilineString      `json:"source"`
+			Attachments map[string]MimeBundle `json:"attachments,omitempty"`
+		}{c.ID, c.CellType, metadata, source, c.Attachments}, c.Unknown)
 	}
+	outputs := c.Outputs
+	if outputs == nil {
+		outputs = Outputs{}
+	}
+	return marshalUnknown(struct {
+		ID             string           `json:"id,omitempty"`
+		CellType       string           `json:"cell_type"`
+		Metadata       *CellMetadata    `json:"metadata"`
+		Source         *MultilineString `json:"source"`
+		Outputs        Outputs          `json:"outputs"`
+		ExecutionCount *int             `json:"execution_count"`
+	}{c.ID, c.CellType, metadata, source, outputs, c.ExecutionCount}, c.Unknown)
 }
 
 type CellMetadata struct {
-	Format    string            `json:"format"`
-	Jupyter   Jupyter           `json:"jupyter,omitempty"`
-	Name      string            `json:"name"`
-	Tags      []string          `json:"tags,omitempty"`
-	Execution map[string]string `json:"execution,omitempty"`
-	Collapsed bool              `json:"collapsed"`
-	Scrolled  interface{}       `json:"scrolled,omitempty"`
+	Format    string                 `json:"format,omitempty"`
+	Jupyter   *Jupyter               `json:"jupyter,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Tags      []string               `json:"tags,omitempty"`
+	Execution map[string]interface{} `json:"execution,omitempty"`
+	Collapsed *bool                  `json:"collapsed,omitempty"`
+	Scrolled  interface{}            `json:"scrolled,omitempty"`
+	Unknown   Unknown                `json:"-"`
 }
 
-func (cm *CellMetadata) Validate() {
-	if cm.Name == "" {
-		cm.Name = "cell"
+func (cm *CellMetadata) UnmarshalJSON(data []byte) error {
+	type cellMetadata CellMetadata
+	if err := json.Unmarshal(data, (*cellMetadata)(cm)); err != nil {
+		return err
 	}
+	var err error
+	cm.Unknown, err = unmarshalUnknown(data, cm)
+	return err
 }
 
-type Jupyter struct {
-	SourceHidden  bool `json:"source_hidden"`
-	OutputsHidden bool `json:"outputs_hidden"`
+func (cm CellMetadata) MarshalJSON() ([]byte, error) {
+	type cellMetadata CellMetadata
+	unknown := cm.Unknown
+	if cm.Tags != nil && len(cm.Tags) == 0 {
+		// keep an empty tag list, which omitempty would drop
+		unknown = Unknown{"tags": json.RawMessage("[]")}
+		for k, v := range cm.Unknown {
+			unknown[k] = v
+		}
+	}
+	return marshalUnknown(cellMetadata(cm), unknown)
 }
 
-type Output struct {
-	OutputType     string          `json:"output_type"`
-	ExecutionCount *int            `json:"execution_count"`
-	Data           MimeBundle      `json:"data,omitempty"`
-	Metadata       OutputMetadata  `json:"metadata,omitempty"`
-	Name           string          `json:"name"`
-	Text           MultilineString `json:"text,omitempty"`
-	EName          string          `json:"ename"`
-	EValue         string          `json:"evalue"`
-	Traceback      []string        `json:"traceback,omitempty"`
+type Jupyter struct {
+	SourceHidden  *bool   `json:"source_hidden,omitempty"`
+	OutputsHidden *bool   `json:"outputs_hidden,omitempty"`
+	Unknown       Unknown `json:"-"`
 }
 
-func (o *Output) Validate() {
+func (j *Jupyter) UnmarshalJSON(data []byte) error {
+	type jupyter Jupyter
+	if err := json.Unmarshal(data, (*jupyter)(j)); err != nil {
+		return err
+	}
+	var err error
+	j.Unknown, err = unmarshalUnknown(data, j)
+	return err
 }
 
-type OutputMetadata map[string]interface{}
-
-type MimeBundle map[string]MultilineString
+func (j Jupyter) MarshalJSON() ([]byte, error) {
+	type jupyter Jupyter
+	return marshalUnknown(jupyter(j), j.Unknown)
+}
 
+// MultilineString is a string that nbformat allows to be split into a list of
+// lines. Mime bundle entries such as application/json may instead hold an
+// arbitrary JSON value, which is kept verbatim in JSON.
 type MultilineString struct {
 	Value string
 	Lines []string
+	JSON  json.RawMessage
 }
 
 func (ms *MultilineString) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &ms.Value); err == nil {
 		return nil
 	}
-	return json.Unmarshal(data, &ms.Lines)
+	if err := json.Unmarshal(data, &ms.Lines); err == nil {
+		return nil
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("invalid multiline string: %s", data)
+	}
+	ms.JSON = append(json.RawMessage(nil), data...)
+	return nil
 }
 
 func (ms MultilineString) MarshalJSON() ([]byte, error) {
-	if len(ms.Lines) > 0 {
+	if len(ms.JSON) > 0 {
+		return ms.JSON, nil
+	}
+	if ms.Lines != nil {
 		return json.Marshal(ms.Lines)
 	}
 	return json.Marshal(ms.Value)
 }
+
+// String returns the joined text, or the raw JSON for non-string values.
+func (ms MultilineString) String() string {
+	if len(ms.JSON) > 0 {
+		return string(ms.JSON)
+	}
+	if len(ms.Lines) > 0 {
+		return strings.Join(ms.Lines, "")
+	}
+	return ms.Value
+}
@@ -0,0 +1,104 @@
+package notebooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Unknown holds the properties of a JSON object that its Go type does not
+// model, such as widget state or colab, vscode and papermill metadata, so
+// that they survive unmarshaling and marshaling.
+type Unknown map[string]json.RawMessage
+
+// unmarshalUnknown returns the properties of the JSON object data that are
+// not fields of v's struct type.
+func unmarshalUnknown(data []byte, v any) (Unknown, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	known := jsonFields(reflect.TypeOf(v))
+	var unknown Unknown
+	for k, raw := range all {
+		if known[k] {
+			continue
+		}
+		if unknown == nil {
+			unknown = Unknown{}
+		}
+		unknown[k] = raw
+	}
+	return unknown, nil
+}
+
+// marshalUnknown marshals v, a struct without JSON methods, and adds the
+// unknown properties to the resulting object.
+func marshalUnknown(v any, unknown Unknown) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(unknown) == 0 {
+		return data, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	for k, raw := range unknown {
+		if _, ok := all[k]; !ok {
+			all[k] = raw
+		}
+	}
+	return json.Marshal(all)
+}
+
+var fieldCache sync.Map // reflect.Type -> map[string]bool
+
+// jsonFields returns the JSON property names of the fields of struct type t,
+// or of the struct t points to.
+func jsonFields(t reflect.Type) map[string]bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.(map[string]bool)
+	}
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		switch {
+		case name == "-" || !f.IsExported():
+		case name == "":
+			fields[f.Name] = true
+		default:
+			fields[name] = true
+		}
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// Marshal encodes nb the way nbformat writes notebooks: with sorted keys,
+// one space of indentation, unescaped HTML and non-ASCII characters and a
+// trailing newline. Notebooks written by Jupyter thus round-trip byte for
+// byte through Unmarshal and Marshal.
+func Marshal(nb *Notebook) ([]byte, error) {
+	data, err := json.Marshal(nb)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
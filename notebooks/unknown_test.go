@@ -0,0 +1,102 @@
+package notebooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The notebooks in testdata/roundtrip are written the way nbformat writes
+// them and carry metadata the package does not model: colab, vscode,
+// papermill and widget state, and custom keys.
+func roundTripCorpus(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob("testdata/roundtrip/*.ipynb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no notebooks in testdata/roundtrip")
+	}
+	return files
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, file := range roundTripCorpus(t) {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			want, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var nb Notebook
+			if err := json.Unmarshal(want, &nb); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Marshal(&nb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareLines(t, got, want)
+		})
+	}
+}
+
+func TestRepairKeepsUnknownFields(t *testing.T) {
+	for _, file := range roundTripCorpus(t) {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want Notebook
+			if err := json.Unmarshal(data, &want); err != nil {
+				t.Fatal(err)
+			}
+			want.Normalize()
+			wantJSON, err := Marshal(&want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repaired, ok := RepairNotebookJSON(string(data))
+			if !ok {
+				t.Fatal("RepairNotebookJSON reported an incomplete notebook")
+			}
+			var got Notebook
+			if err := json.Unmarshal([]byte(repaired), &got); err != nil {
+				t.Fatal(err)
+			}
+			gotJSON, err := Marshal(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareLines(t, gotJSON, wantJSON)
+			if errs := got.Validate(); len(errs) > 0 {
+				t.Errorf("repaired notebook is invalid:\n%v", errs)
+			}
+		})
+	}
+}
+
+// compareLines reports the first line at which got and want differ.
+func compareLines(t *testing.T, got, want []byte) {
+	t.Helper()
+	if bytes.Equal(got, want) {
+		return
+	}
+	gotLines, wantLines := bytes.Split(got, []byte("\n")), bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			t.Fatalf("line %d differs:\ngot:  %s\nwant: %s", i+1, g, w)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// v3MimeTypes maps the output keys of nbformat 3 and older to mime types.
+var v3MimeTypes = map[string]string{
+	"text":       "text/plain",
+	"html":       "text/html",
+	"svg":        "image/svg+xml",
+	"png":        "image/png",
+	"jpeg":       "image/jpeg",
+	"latex":      "text/latex",
+	"json":       "application/json",
+	"javascript": "application/javascript",
+	"markdown":   "text/markdown",
+	"pdf":        "application/pdf",
+}
+
+// v3OutputTypes maps the output types of nbformat 3 to their v4 names.
+var v3OutputTypes = map[string]string{
+	"pyout": "execute_result",
+	"pyerr": "error",
+}
+
+// NeedsUpgrade reports whether the notebook document data uses a layout
+// older than nbformat 4: a version below 4, or worksheets instead of cells.
+func NeedsUpgrade(data []byte) bool {
+	var head struct {
+		NBFormat   *int            `json:"nbformat"`
+		Worksheets json.RawMessage `json:"worksheets"`
+		Cells      json.RawMessage `json:"cells"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return false
+	}
+	if head.NBFormat != nil {
+		return *head.NBFormat < 4
+	}
+	return head.Worksheets != nil && head.Cells == nil
+}
+
+// UpgradeJSON converts a notebook document in nbformat 3 or older to
+// nbformat 4.5, as nbformat's upgrade does: the cells of all worksheets are
+// concatenated, input becomes source, prompt_number execution_count, heading
+// cells become markdown, pyout and pyerr outputs become execute_result and
+// error outputs and short output keys such as png become mime types. The
+// original version is kept in the orig_nbformat metadata. Other documents
+// are returned unchanged.
+func UpgradeJSON(data []byte) ([]byte, error) {
+	if !NeedsUpgrade(data) {
+		return data, nil
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(upgradeNotebook(doc.(map[string]any)))
+}
+
+func upgradeNotebook(doc map[string]any) map[string]any {
+	metadata := objectValue(doc["metadata"])
+	delete(metadata, "name")
+	delete(metadata, "signature")
+	if _, ok := metadata["orig_nbformat"]; !ok {
+		orig, ok := intValue(doc["nbformat"])
+		if !ok {
+			orig = 3
+		}
+		metadata["orig_nbformat"] = orig
+	}
+	var v3Cells []any
+	if worksheets, ok := doc["worksheets"].([]any); ok {
+		for _, ws := range worksheets {
+			cells, _ := objectValue(ws)["cells"].([]any)
+			v3Cells = append(v3Cells, cells...)
+		}
+	} else {
+		// nbformat 1 had a flat list of cells.
+		v3Cells, _ = doc["cells"].([]any)
+	}
+	cells := make([]any, len(v3Cells))
+	ids := map[string]bool{}
+	for i, c := range v3Cells {
+		cells[i] = upgradeCell(c, ids)
+	}
+	return map[string]any{
+		"nbformat":       4,
+		"nbformat_minor": LatestMinor,
+		"metadata":       metadata,
+		"cells":          cells,
+	}
+}
+
+// upgradeCell converts a v3 cell to v4 and gives it a stable ID not in ids.
+func upgradeCell(c any, ids map[string]bool) any {
+	m, ok := c.(map[string]any)
+	if !ok {
+		return c
+	}
+	cell := map[string]any{
+		"metadata": objectValue(m["metadata"]),
+	}
+	defer func() {
+		id := stableID(&Cell{
+			CellType: cell["cell_type"].(string),
+			Source:   &MultilineString{Value: multilineValue(cell["source"])},
+		}, ids)
+		cell["id"] = id
+		ids[id] = true
+	}()
+	cellType, _ := m["cell_type"].(string)
+	switch cellType {
+	case "code":
+		cell["cell_type"] = "code"
+		cell["source"] = firstValue(m, "input", "code", "source")
+		if collapsed, ok := m["collapsed"]; ok {
+			cell["metadata"].(map[string]any)["collapsed"] = collapsed
+		}
+		execCount := m["prompt_number"]
+		if _, ok := intValue(execCount); !ok {
+			execCount = nil
+		}
+		cell["execution_count"] = execCount
+		v3Outputs, _ := m["outputs"].([]any)
+		outputs := make([]any, len(v3Outputs))
+		for i, o := range v3Outputs {
+			outputs[i] = upgradeOutput(o)
+		}
+		cell["outputs"] = outputs
+	case "heading":
+		level, ok := intValue(m["level"])
+		if !ok || level < 1 {
+			level = 1
+		}
+		heading := strings.ReplaceAll(strings.TrimSpace(multilineValue(m["source"])), "\n", " ")
+		cell["cell_type"] = "markdown"
+		cell["source"] = strings.Repeat("#", int(min(level, 6))) + " " + heading
+	case "raw":
+		cell["cell_type"] = "raw"
+		cell["source"] = firstValue(m, "source")
+	default:
+		// markdown, and the text and html cells of nbformat 1 and 2
+		cell["cell_type"] = "markdown"
+		cell["source"] = firstValue(m, "source", "text")
+	}
+	return cell
+}
+
+func upgradeOutput(o any) any {
+	m, ok := o.(map[string]any)
+	if !ok {
+		return o
+	}
+	outputType, _ := m["output_type"].(string)
+	if t, ok := v3OutputTypes[outputType]; ok {
+		outputType = t
+	}
+	switch outputType {
+	case "stream":
+		name, _ := m["stream"].(string)
+		if name == "" {
+			name = "stdout"
+		}
+		return map[string]any{"output_type": "stream", "name": name, "text": firstValue(m, "text")}
+	case "error":
+		traceback, ok := m["traceback"].([]any)
+		if !ok {
+			traceback = []any{}
+		}
+		return map[string]any{
+			"output_type": "error",
+			"ename":       firstValue(m, "ename"),
+			"evalue":      firstValue(m, "evalue"),
+			"traceback":   traceback,
+		}
+	}
+	data := map[string]any{}
+	for k, v := range m {
+		switch k {
+		case "output_type", "prompt_number", "metadata":
+			continue
+		}
+		mime := v3MimeType(k)
+		if s, ok := v.(string); ok && mime == "application/json" {
+			var parsed any
+			if json.Unmarshal([]byte(s), &parsed) == nil {
+				v = parsed
+			}
+		}
+		data[mime] = v
+	}
+	metadata := map[string]any{}
+	for k, v := range objectValue(m["metadata"]) {
+		metadata[v3MimeType(k)] = v
+	}
+	out := map[string]any{"output_type": outputType, "data": data, "metadata": metadata}
+	if outputType == "execute_result" {
+		execCount := m["prompt_number"]
+		if _, ok := intValue(execCount); !ok {
+			execCount = nil
+		}
+		out["execution_count"] = execCount
+	}
+	return out
+}
+
+func v3MimeType(key string) string {
+	if mime, ok := v3MimeTypes[key]; ok {
+		return mime
+	}
+	return key
+}
+
+// firstValue returns the first of the keys present in m, or the empty string.
+func firstValue(m map[string]any, keys ...string) any {
+	for _, k := range keys {
+		if v, ok := m[k]; ok && v != nil {
+			return v
+		}
+	}
+	return ""
+}
+
+func objectValue(v any) map[string]any {
+	if m, ok := v.(map[string]any); ok {
+		return m
+	}
+	return map[string]any{}
+}
+
+func multilineValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []any:
+		var b strings.Builder
+		for _, line := range v {
+			s, _ := line.(string)
+			b.WriteString(s)
+		}
+		return b.String()
+	}
+	return ""
+}
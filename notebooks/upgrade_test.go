@@ -0,0 +1,33 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestUpgradeV3(t *testing.T) {
+	data, err := os.ReadFile("testdata/upgrade/v3.ipynb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NeedsUpgrade(data) {
+		t.Fatal("NeedsUpgrade = false for a v3 notebook")
+	}
+	if errs := ValidateJSON(data); len(errs) > 0 {
+		t.Errorf("upgraded notebook is invalid:\n%v", errs)
+	}
+	var nb Notebook
+	if err := json.Unmarshal(data, &nb); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Marshal(&nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("testdata/upgrade/v3.want.ipynb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareLines(t, got, want)
+}
@@ -0,0 +1,428 @@
+package notebooks
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:generate sh -c "for v in 0 1 2 3 4 5; do curl -fsSL -o schema/nbformat.v4.$v.schema.json https://raw.githubusercontent.com/jupyter/nbformat/main/nbformat/v4/nbformat.v4.$v.schema.json || exit; done"
+
+// LatestMinor is the newest nbformat 4 minor version the package knows.
+const LatestMinor = 5
+
+// schemaFS holds the nbformat v4 JSON schemas published by Jupyter, one for
+// each minor version.
+//
+//go:embed schema/*.json
+var schemaFS embed.FS
+
+// ValidationError is a schema violation at Path, a JSON path such as
+// "cells[3].outputs[0]". The notebook root has the empty path.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidationErrors lists the schema violations of a notebook. It is nil for
+// valid notebooks.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ValidateJSON validates a notebook document against the nbformat v4 schema
+// of its minor version, 4.0 to 4.5. Documents with newer minor versions are
+// checked against 4.5, and nbformat 3 and older documents are upgraded first,
+// as Jupyter does when opening them.
+func ValidateJSON(data []byte) ValidationErrors {
+	data, err := UpgradeJSON(data)
+	if err != nil {
+		return ValidationErrors{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return ValidationErrors{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+	minor := int64(LatestMinor)
+	if m, ok := doc.(map[string]any); ok {
+		if n, ok := intValue(m["nbformat_minor"]); ok {
+			minor = n
+		}
+	}
+	return validateNotebook(doc, minor)
+}
+
+// Validate reports where n, as it would be written, violates the nbformat
+// schema of its minor version.
+func (n *Notebook) Validate() ValidationErrors {
+	doc, errs := marshalDoc(n)
+	if errs != nil {
+		return errs
+	}
+	return validateNotebook(doc, int64(n.NBFormatMinor))
+}
+
+// Validate reports where m violates the notebook metadata schema.
+func (m *Metadata) Validate() ValidationErrors {
+	return validateValue(m, "#/properties/metadata")
+}
+
+// Validate reports where c violates the nbformat 4.5 cell schema. Paths are
+// relative to the cell.
+func (c *Cell) Validate() ValidationErrors {
+	return validateValue(c, "#/definitions/cell")
+}
+
+func validateOutput(o Output) ValidationErrors {
+	return validateValue(o, "#/definitions/output")
+}
+
+func validateNotebook(doc any, minor int64) ValidationErrors {
+	minor = min(max(minor, 0), LatestMinor)
+	s, err := compileSchema(int(minor), "")
+	if err != nil {
+		return ValidationErrors{{Message: err.Error()}}
+	}
+	errs := schemaErrors(s, doc)
+	if minor >= 5 {
+		errs = append(errs, duplicateIDs(doc)...)
+		sortErrors(errs)
+	}
+	return errs
+}
+
+func validateValue(x any, ref string) ValidationErrors {
+	doc, errs := marshalDoc(x)
+	if errs != nil {
+		return errs
+	}
+	s, err := compileSchema(LatestMinor, ref)
+	if err != nil {
+		return ValidationErrors{{Message: err.Error()}}
+	}
+	return schemaErrors(s, doc)
+}
+
+func marshalDoc(x any) (any, ValidationErrors) {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return nil, ValidationErrors{{Message: err.Error()}}
+	}
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return nil, ValidationErrors{{Message: err.Error()}}
+	}
+	return doc, nil
+}
+
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+var cellIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-_]+$`)
+
+var (
+	schemaMu sync.Mutex
+	compiler *jsonschema.Compiler
+	compiled = map[string]*jsonschema.Schema{}
+)
+
+// schemaBase is where Jupyter publishes the schemas, used to name them.
+const schemaBase = "https://raw.githubusercontent.com/jupyter/nbformat/main/nbformat/v4/"
+
+func schemaFile(minor int) string {
+	return fmt.Sprintf("nbformat.v4.%d.schema.json", minor)
+}
+
+// compileSchema returns the schema of nbformat 4.minor, or its part at ref, a
+// JSON pointer fragment such as "#/definitions/cell".
+func compileSchema(minor int, ref string) (*jsonschema.Schema, error) {
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	url := schemaBase + schemaFile(minor) + ref
+	if s, ok := compiled[url]; ok {
+		return s, nil
+	}
+	if compiler == nil {
+		c := jsonschema.NewCompiler()
+		c.Draft = jsonschema.Draft4
+		for minor := 0; minor <= LatestMinor; minor++ {
+			f, err := schemaFS.Open("schema/" + schemaFile(minor))
+			if err != nil {
+				return nil, err
+			}
+			err = c.AddResource(schemaBase+schemaFile(minor), f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		compiler = c
+	}
+	s, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("compiling the nbformat schema: %w", err)
+	}
+	compiled[url] = s
+	return s, nil
+}
+
+// schemaErrors validates doc against s and turns the errors of the schema
+// library into ValidationErrors, sorted by path.
+func schemaErrors(s *jsonschema.Schema, doc any) ValidationErrors {
+	err := s.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return ValidationErrors{{Message: err.Error()}}
+	}
+	var errs ValidationErrors
+	seen := map[ValidationError]bool{}
+	for _, leaf := range leafErrors(ve, doc) {
+		e := ValidationError{Path: jsonPath(doc, leaf.InstanceLocation), Message: leaf.Message}
+		if !seen[e] {
+			seen[e] = true
+			errs = append(errs, e)
+		}
+	}
+	sortErrors(errs)
+	return errs
+}
+
+// discriminators name the property that selects the branch of the oneOf
+// schemas of cells and outputs.
+var discriminators = map[string]string{
+	"/definitions/cell/oneOf":   "cell_type",
+	"/definitions/output/oneOf": "output_type",
+}
+
+// leafErrors returns the errors under e that explain it. The library reports
+// a failed oneOf with the errors of all its branches, which for a cell would
+// list the errors of a code cell under a markdown cell; leafErrors keeps the
+// errors of the branch the value was meant to match.
+func leafErrors(e *jsonschema.ValidationError, doc any) []*jsonschema.ValidationError {
+	if len(e.Causes) == 0 {
+		return []*jsonschema.ValidationError{e}
+	}
+	if strings.HasSuffix(e.KeywordLocation, "/oneOf") {
+		return oneOfErrors(e, doc)
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, c := range e.Causes {
+		leaves = append(leaves, leafErrors(c, doc)...)
+	}
+	return leaves
+}
+
+func oneOfErrors(e *jsonschema.ValidationError, doc any) []*jsonschema.ValidationError {
+	_, fragment, _ := strings.Cut(e.AbsoluteKeywordLocation, "#")
+	if prop, ok := discriminators[fragment]; ok {
+		m, _ := lookup(doc, e.InstanceLocation).(map[string]any)
+		value, ok := m[prop].(string)
+		if !ok {
+			return []*jsonschema.ValidationError{leaf(e, "missing "+prop)}
+		}
+		at := e.InstanceLocation + "/" + prop
+		for _, branch := range e.Causes {
+			if !slices.ContainsFunc(flatten(branch), func(c *jsonschema.ValidationError) bool {
+				return c.InstanceLocation == at && strings.HasSuffix(c.KeywordLocation, "/enum")
+			}) {
+				return leafErrors(branch, doc)
+			}
+		}
+		return []*jsonschema.ValidationError{leaf(e, fmt.Sprintf("unknown %s %q", prop, value))}
+	}
+
+	// Otherwise the branches differ in type, as those of multiline strings.
+	var match []*jsonschema.ValidationError
+	var types []string
+	got := ""
+	for _, branch := range e.Causes {
+		i := slices.IndexFunc(flatten(branch), func(c *jsonschema.ValidationError) bool {
+			return c.InstanceLocation == e.InstanceLocation && strings.HasSuffix(c.KeywordLocation, "/type")
+		})
+		if i < 0 {
+			match = append(match, branch)
+			continue
+		}
+		want, g, ok := strings.Cut(strings.TrimPrefix(flatten(branch)[i].Message, "expected "), ", but got ")
+		if ok {
+			types, got = append(types, want), g
+		}
+	}
+	switch {
+	case len(match) == 1:
+		return leafErrors(match[0], doc)
+	case len(match) == 0 && got != "":
+		return []*jsonschema.ValidationError{leaf(e, fmt.Sprintf("expected %s, but got %s", strings.Join(types, " or "), got))}
+	}
+	return []*jsonschema.ValidationError{leaf(e, e.Message)}
+}
+
+func leaf(e *jsonschema.ValidationError, msg string) *jsonschema.ValidationError {
+	return &jsonschema.ValidationError{
+		KeywordLocation:         e.KeywordLocation,
+		AbsoluteKeywordLocation: e.AbsoluteKeywordLocation,
+		InstanceLocation:        e.InstanceLocation,
+		Message:                 msg,
+	}
+}
+
+func flatten(e *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	all := []*jsonschema.ValidationError{e}
+	for _, c := range e.Causes {
+		all = append(all, flatten(c)...)
+	}
+	return all
+}
+
+// pointerTokens splits a JSON pointer such as "/cells/3/source" into its
+// unescaped reference tokens.
+func pointerTokens(ptr string) []string {
+	if ptr == "" {
+		return nil
+	}
+	tokens := strings.Split(strings.TrimPrefix(ptr, "/"), "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens
+}
+
+// lookup returns the value at the JSON pointer ptr in doc, or nil.
+func lookup(doc any, ptr string) any {
+	for _, t := range pointerTokens(ptr) {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[t]
+		case []any:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+// jsonPath turns the JSON pointer ptr in doc into a path such as
+// "cells[3].outputs[0]".
+func jsonPath(doc any, ptr string) string {
+	var b strings.Builder
+	for _, t := range pointerTokens(ptr) {
+		switch v := doc.(type) {
+		case []any:
+			b.WriteString("[" + t + "]")
+			if i, err := strconv.Atoi(t); err == nil && i >= 0 && i < len(v) {
+				doc = v[i]
+			} else {
+				doc = nil
+			}
+			continue
+		case map[string]any:
+			doc = v[t]
+		default:
+			doc = nil
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+// sortErrors sorts errs by path, comparing array indexes as numbers, and
+// then by message.
+func sortErrors(errs ValidationErrors) {
+	slices.SortStableFunc(errs, func(a, b ValidationError) int {
+		if c := comparePaths(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Message, b.Message)
+	})
+}
+
+func comparePaths(a, b string) int {
+	for a != "" && b != "" {
+		i, j := strings.IndexAny(a, "0123456789"), strings.IndexAny(b, "0123456789")
+		if i < 0 || j < 0 || a[:i] != b[:j] {
+			return strings.Compare(a, b)
+		}
+		a, b = a[i:], b[j:]
+		i = len(a) - len(strings.TrimLeft(a, "0123456789"))
+		j = len(b) - len(strings.TrimLeft(b, "0123456789"))
+		m, _ := strconv.Atoi(a[:i])
+		n, _ := strconv.Atoi(b[:j])
+		if m != n {
+			return m - n
+		}
+		a, b = a[i:], b[j:]
+	}
+	return strings.Compare(a, b)
+}
+
+// duplicateIDs reports the cells whose id an earlier cell has, which the
+// schema cannot express.
+func duplicateIDs(doc any) ValidationErrors {
+	m, _ := doc.(map[string]any)
+	cells, _ := m["cells"].([]any)
+	var errs ValidationErrors
+	ids := map[string]int{}
+	for i, c := range cells {
+		id, ok := objectValue(c)["id"].(string)
+		if !ok {
+			continue
+		}
+		if j, dup := ids[id]; dup {
+			errs = append(errs, ValidationError{
+				Path:    fmt.Sprintf("cells[%d]", i),
+				Message: fmt.Sprintf("duplicate id %q, also used by cells[%d]", id, j),
+			})
+		} else {
+			ids[id] = i
+		}
+	}
+	return errs
+}
+
+func intValue(val any) (int64, bool) {
+	n, ok := val.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
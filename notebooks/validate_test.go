@@ -0,0 +1,209 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// notebookJSON returns an nbformat 4.minor document with the given cells,
+// written as JSON objects.
+func notebookJSON(minor int, cells ...string) string {
+	return fmt.Sprintf(`{"nbformat": 4, "nbformat_minor": %d, "metadata": {}, "cells": [%s]}`, minor, strings.Join(cells, ","))
+}
+
+const (
+	markdownCell = `{"id": "md", "cell_type": "markdown", "metadata": {}, "source": "# Title"}`
+	codeCell     = `{"id": "code", "cell_type": "code", "metadata": {}, "source": "1 + 1", "outputs": [], "execution_count": null}`
+)
+
+// codeWithOutputs returns a code cell with the given outputs.
+func codeWithOutputs(id string, outputs ...string) string {
+	return fmt.Sprintf(`{"id": %q, "cell_type": "code", "metadata": {}, "source": "", "outputs": [%s], "execution_count": 1}`, id, strings.Join(outputs, ","))
+}
+
+func TestValidateJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"valid", notebookJSON(5, markdownCell, codeCell), nil},
+		{"empty", notebookJSON(5), nil},
+		{"valid outputs", notebookJSON(5, codeWithOutputs("c",
+			`{"output_type": "stream", "name": "stdout", "text": ["a\n", "b"]}`,
+			`{"output_type": "execute_result", "execution_count": 1, "data": {"text/plain": "2", "application/vnd.custom+json": {"x": [1]}}, "metadata": {}}`,
+			`{"output_type": "error", "ename": "E", "evalue": "v", "traceback": []}`,
+		)), nil},
+		{"missing envelope", `{"cells": []}`, []string{
+			`missing properties: 'metadata', 'nbformat_minor', 'nbformat'`,
+		}},
+		{"nbformat 5", `{"nbformat": 5, "nbformat_minor": 0, "metadata": {}, "cells": []}`, []string{
+			`nbformat: must be <= 4 but found 5`,
+		}},
+		{"attachments in 4.0", notebookJSON(0,
+			`{"cell_type": "markdown", "metadata": {}, "source": "", "attachments": {}}`,
+		), []string{
+			`cells[0]: additionalProperties 'attachments' not allowed`,
+		}},
+		{"attachments in 4.1", notebookJSON(1,
+			`{"cell_type": "markdown", "metadata": {}, "source": "![a](attachment:a.png)", "attachments": {"a.png": {"image/png": "iVBOR"}}}`,
+		), nil},
+		{"id in 4.4", notebookJSON(4, markdownCell), []string{
+			`cells[0]: additionalProperties 'id' not allowed`,
+		}},
+		{"missing id in 4.5", notebookJSON(5,
+			`{"cell_type": "markdown", "metadata": {}, "source": ""}`,
+		), []string{
+			`cells[0]: missing properties: 'id'`,
+		}},
+		{"newer minor", notebookJSON(7, markdownCell), nil},
+		{"bad id", notebookJSON(5,
+			`{"id": "not valid", "cell_type": "raw", "metadata": {}, "source": ""}`,
+		), []string{
+			`cells[0].id: does not match pattern '^[a-zA-Z0-9-_]+$'`,
+		}},
+		{"duplicate ids", notebookJSON(5, markdownCell, codeCell, markdownCell), []string{
+			`cells[2]: duplicate id "md", also used by cells[0]`,
+		}},
+		{"missing outputs", notebookJSON(5,
+			`{"id": "c", "cell_type": "code", "metadata": {}, "source": ""}`,
+		), []string{
+			`cells[0]: missing properties: 'outputs', 'execution_count'`,
+		}},
+		{"bad stream text", notebookJSON(5, markdownCell, codeCell, markdownCell, codeWithOutputs("c",
+			`{"output_type": "stream", "name": "stdout", "text": 3}`,
+		)), []string{
+			`cells[2]: duplicate id "md", also used by cells[0]`,
+			`cells[3].outputs[0].text: expected string or array, but got number`,
+		}},
+		{"bad source line", notebookJSON(5,
+			`{"id": "md", "cell_type": "markdown", "metadata": {}, "source": ["a\n", 1]}`,
+		), []string{
+			`cells[0].source[1]: expected string, but got number`,
+		}},
+		{"unknown cell_type", notebookJSON(5,
+			`{"id": "x", "cell_type": "heading", "metadata": {}, "source": ""}`,
+		), []string{
+			`cells[0]: unknown cell_type "heading"`,
+		}},
+		{"missing cell_type", notebookJSON(5, `{"id": "x", "metadata": {}, "source": ""}`), []string{
+			`cells[0]: missing cell_type`,
+		}},
+		{"unknown output_type", notebookJSON(5, codeWithOutputs("c",
+			`{"output_type": "stream", "name": "stdout", "text": ""}`,
+			`{"output_type": "widget"}`,
+		)), []string{
+			`cells[0].outputs[1]: unknown output_type "widget"`,
+		}},
+		{"bad output", notebookJSON(5, codeWithOutputs("c",
+			`{"output_type": "execute_result", "data": {"text/plain": {"x": 1}}, "metadata": {}, "execution_count": -1}`,
+		)), []string{
+			`cells[0].outputs[0].data.text/plain: expected string or array, but got object`,
+			`cells[0].outputs[0].execution_count: must be >= 0 but found -1`,
+		}},
+		{"bad metadata", notebookJSON(5,
+			`{"id": "c", "cell_type": "code", "metadata": {"scrolled": "yes", "tags": ["a,b"]}, "source": "", "outputs": [], "execution_count": null}`,
+		), []string{
+			`cells[0].metadata.scrolled: value must be one of true, false, "auto"`,
+			`cells[0].metadata.tags[0]: does not match pattern '^[^,]+$'`,
+		}},
+		{"kernelspec", `{"nbformat": 4, "nbformat_minor": 5, "metadata": {"kernelspec": {"name": "python3"}}, "cells": []}`, []string{
+			`metadata.kernelspec: missing properties: 'display_name'`,
+		}},
+		{"nbformat 3", `{"nbformat": 3, "nbformat_minor": 0, "metadata": {}, "worksheets": [{"cells": [{"cell_type": "code", "input": "1", "outputs": [], "prompt_number": 1}]}]}`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range ValidateJSON([]byte(tt.doc)) {
+				got = append(got, e.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("ValidateJSON =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateJSONInvalid(t *testing.T) {
+	errs := ValidateJSON([]byte(`{"cells": [`))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Message, "invalid JSON: ") {
+		t.Errorf("ValidateJSON of truncated JSON = %v, want an invalid JSON error", errs)
+	}
+}
+
+// TestValidateOrder checks that errors are sorted by path, with array
+// indexes compared as numbers.
+func TestValidateOrder(t *testing.T) {
+	cells := make([]string, 12)
+	for i := range cells {
+		cells[i] = fmt.Sprintf(`{"id": "c%d", "cell_type": "markdown", "metadata": {}, "source": ""}`, i)
+	}
+	cells[2] = `{"id": "c2", "cell_type": "markdown", "source": ""}`
+	cells[10] = `{"id": "c10", "cell_type": "markdown", "metadata": {}}`
+	var got []string
+	for _, e := range ValidateJSON([]byte(notebookJSON(5, cells...))) {
+		got = append(got, e.Path)
+	}
+	if want := []string{"cells[2]", "cells[10]"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("error paths = %q, want %q", got, want)
+	}
+}
+
+func TestValidateParts(t *testing.T) {
+	c := Cell{ID: "a b", CellType: "code", Source: &MultilineString{Value: "x"}}
+	if got, want := c.Validate().Error(), "id: does not match pattern '^[a-zA-Z0-9-_]+$'"; got != want {
+		t.Errorf("Cell.Validate = %q, want %q", got, want)
+	}
+	m := Metadata{KernelSpec: &KernelSpec{Name: "python3"}}
+	if got, want := m.Validate().Error(), "kernelspec: missing properties: 'display_name'"; got != want {
+		t.Errorf("Metadata.Validate = %q, want %q", got, want)
+	}
+	if errs := NewStreamOutput("stdout", "x").Validate(); errs != nil {
+		t.Errorf("StreamOutput.Validate = %v", errs)
+	}
+	nb := Notebook{NBFormat: 4, NBFormatMinor: 4, Cells: []Cell{{ID: "c", CellType: "raw", Source: &MultilineString{}}}}
+	if got, want := nb.Validate().Error(), "cells[0]: additionalProperties 'id' not allowed"; got != want {
+		t.Errorf("Notebook.Validate of 4.4 = %q, want %q", got, want)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	doc := notebookJSON(4,
+		`{"cell_type": "markdown", "metadata": {}, "source": "# Title"}`,
+		`{"id": "bad id", "cell_type": "code", "metadata": {"tags": ["a,b", "ab"]}, "source": "1 + 1", "outputs": [{"output_type": "stream", "text": "2"}]}`,
+		`{"id": "keep", "cell_type": "raw", "metadata": {}, "source": "x"}`,
+		`{"id": "keep", "cell_type": "markdown", "metadata": {}, "source": "# Title"}`,
+	)
+	var nb Notebook
+	if err := json.Unmarshal([]byte(doc), &nb); err != nil {
+		t.Fatal(err)
+	}
+	nb.Normalize()
+	if errs := nb.Validate(); errs != nil {
+		t.Errorf("normalized notebook is invalid:\n%v", errs)
+	}
+
+	// Cells without a valid ID get the ID the Builder would give them.
+	built, err := NewBuilder().Markdown("# Title").Code("1 + 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	title, code := built.Cells[0].ID, built.Cells[1].ID
+	want := []string{title, code, "keep", title + "-2"}
+	for i, c := range nb.Cells {
+		if c.ID != want[i] {
+			t.Errorf("cells[%d].ID = %q, want %q", i, c.ID, want[i])
+		}
+	}
+
+	// IDs do not depend on the position of the cells.
+	nb.Cells = append([]Cell{{CellType: "markdown", Source: &MultilineString{Value: "new"}}}, nb.Cells...)
+	nb.Cells[1].ID, nb.Cells[2].ID = "", ""
+	nb.Normalize()
+	if nb.Cells[1].ID != title || nb.Cells[2].ID != code {
+		t.Errorf("after inserting a cell, IDs = %q, %q; want %q, %q", nb.Cells[1].ID, nb.Cells[2].ID, title, code)
+	}
+}
@@ -0,0 +1,93 @@
+package nbsim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tmc/nbsim/linkgraph"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+const (
+	maxReferrerHeadings  = 20
+	maxReferrerCodeCells = 3
+	maxReferrerCodeLines = 15
+)
+
+// ReferrerContext condenses nb, the notebook at referrerURL, into a short
+// description for the generation of the notebook at targetURL: its title,
+// headings, a few code cells and the text of the link that leads to
+// targetURL.
+func ReferrerContext(referrerURL string, nb *notebooks.Notebook, targetURL string) string {
+	var headings, code []string
+	title := nb.Metadata.Title
+	for _, c := range nb.Cells {
+		if c.Source == nil {
+			continue
+		}
+		source := c.Source.String()
+		switch c.CellType {
+		case "markdown":
+			for _, line := range strings.Split(source, "\n") {
+				if !strings.HasPrefix(line, "#") {
+					continue
+				}
+				line = strings.TrimSpace(line)
+				if title == "" && strings.HasPrefix(line, "# ") {
+					title = strings.TrimPrefix(line, "# ")
+				}
+				if len(headings) < maxReferrerHeadings {
+					headings = append(headings, line)
+				}
+			}
+		case "code":
+			if len(code) < maxReferrerCodeCells && strings.TrimSpace(source) != "" {
+				code = append(code, truncateLines(source, maxReferrerCodeLines))
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<referrer url=%q>\n", referrerURL)
+	b.WriteString("The user followed a link from this notebook. Keep the new notebook consistent with it.\n")
+	if title != "" {
+		fmt.Fprintf(&b, "Title: %s\n", title)
+	}
+	if len(headings) > 0 {
+		b.WriteString("Headings:\n")
+		for _, h := range headings {
+			fmt.Fprintf(&b, "%s\n", h)
+		}
+	}
+	for _, c := range code {
+		fmt.Fprintf(&b, "Code:\n```\n%s\n```\n", c)
+	}
+	if text := linkText(referrerURL, nb, targetURL); text != "" {
+		fmt.Fprintf(&b, "Clicked link: %q\n", text)
+	}
+	b.WriteString("</referrer>")
+	return b.String()
+}
+
+// linkText returns the text of the first link in nb, the notebook at
+// referrerURL, to targetURL.
+func linkText(referrerURL string, nb *notebooks.Notebook, targetURL string) string {
+	target, ok := linkgraph.Normalize(targetURL)
+	if !ok {
+		return ""
+	}
+	for _, l := range linkgraph.ExtractLinks(nb) {
+		if u, ok := linkgraph.Resolve(referrerURL, l.URL); ok && u == target {
+			return l.Text
+		}
+	}
+	return ""
+}
+
+func truncateLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) <= n {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:n], "\n") + "\n# ..."
+}
@@ -0,0 +1,56 @@
+package nbsim
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+func referrerNotebook(t *testing.T) *notebooks.Notebook {
+	t.Helper()
+	nb, err := notebooks.NewBuilder().Python().
+		Markdown("# Transformers\n\n## Attention\n\nRead [how attention scales](https://nbsim.example/ml/attention-scaling?depth=2) or [the basics](basics).").
+		Code("import torch\n" + strings.Repeat("x = 1\n", 20)).
+		Code("").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nb
+}
+
+func TestReferrerContext(t *testing.T) {
+	nb := referrerNotebook(t)
+	tests := []struct {
+		name, referrer, target string
+		wantLink               string // the clicked link, if any
+	}{
+		{"absolute referrer", "https://nbsim.example/ml/transformers", "/ml/attention-scaling", "how attention scales"},
+		{"path referrer", "/ml/transformers", "/ml/attention-scaling", "how attention scales"},
+		{"relative link", "/ml/transformers", "/ml/basics", "the basics"},
+		{"absolute target", "/ml/transformers", "http://localhost:8080/ml/basics", "the basics"},
+		{"no link", "/ml/transformers", "/ml/elsewhere", ""},
+	}
+	for _, tt := range tests {
+		got := ReferrerContext(tt.referrer, nb, tt.target)
+		for _, want := range []string{
+			`<referrer url="` + tt.referrer + `">`,
+			"Title: Transformers\n",
+			"Headings:\n# Transformers\n## Attention\n",
+			"Code:\n```\nimport torch\n",
+			"x = 1\n# ...\n```\n",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: context lacks %q:\n%s", tt.name, want, got)
+			}
+		}
+		if n := strings.Count(got, "Code:"); n != 1 {
+			t.Errorf("%s: context has %d code cells, want the non-empty one", tt.name, n)
+		}
+		link := `Clicked link: "` + tt.wantLink + `"`
+		if has := strings.Contains(got, "Clicked link:"); has != (tt.wantLink != "") || has && !strings.Contains(got, link) {
+			t.Errorf("%s: context =\n%s\nwant clicked link %q", tt.name, got, tt.wantLink)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// Package registry records notebook generations in a JSON index file so that
+// their status survives restarts.
+package registry
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of a generation.
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+	// StatusCancelled is the status of generations stopped before they
+	// finished, which keep their partial notebook.
+	StatusCancelled Status = "cancelled"
+)
+
+// Usage is the token usage reported by the model, or estimated if the model
+// reported none.
+type Usage struct {
+	InputTokens  int  `json:"input_tokens"`
+	OutputTokens int  `json:"output_tokens"`
+	Estimated    bool `json:"estimated,omitempty"`
+	// Estimator names how estimated tokens were counted.
+	Estimator string `json:"estimator,omitempty"`
+}
+
+// Generation is the record of one notebook generation. Each generation is a
+// version of the notebook for its URL; one version per URL is canonical.
+type Generation struct {
+	ID        string `json:"id"`
+	Base      string `json:"base"`
+	Version   int    `json:"version"`
+	Canonical bool   `json:"canonical"`
+	URL       string `json:"url"`
+	Referrer  string `json:"referrer,omitempty"`
+	Model     string `json:"model"`
+	// Format is the format the model was asked to write the notebook in,
+	// json if empty.
+	Format     string     `json:"format,omitempty"`
+	PromptHash string     `json:"prompt_hash"`
+	Status     Status     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Usage      *Usage     `json:"usage,omitempty"`
+	// LatencyMS is how long the model took to answer, over all its
+	// requests, and TimeToFirstTokenMS how long until the first token
+	// arrived, in milliseconds.
+	LatencyMS          int64 `json:"latency_ms,omitempty"`
+	TimeToFirstTokenMS int64 `json:"time_to_first_token_ms,omitempty"`
+	// Continuations is the number of requests that continued the notebook
+	// after the max-tokens limit cut it off, and Truncated whether it was
+	// still cut off after the last one.
+	Continuations int  `json:"continuations,omitempty"`
+	Truncated     bool `json:"truncated,omitempty"`
+	// Turns is the number of requests of a generation in the tools format,
+	// each answering the model's previous tool calls.
+	Turns int `json:"turns,omitempty"`
+	// EditOf is the ID of the version this version revises as Instruction
+	// asks, if it is an edit.
+	EditOf      string `json:"edit_of,omitempty"`
+	Instruction string `json:"instruction,omitempty"`
+	// Cell is the index of the only cell of EditOf that the edit
+	// regenerates, if it regenerates one.
+	Cell      *int       `json:"cell,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Execution *Execution `json:"execution,omitempty"`
+	// ValidationErrors are the nbformat schema violations of the notebook
+	// as the model wrote it.
+	ValidationErrors []string `json:"validation_errors,omitempty"`
+}
+
+// Execution is the record of running the code cells of a generated notebook.
+// The executed notebook is kept beside the generated one.
+type Execution struct {
+	Status     Status     `json:"status"`
+	Kernel     string     `json:"kernel"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Active reports whether the generation is pending or running.
+func (g *Generation) Active() bool {
+	return g.Status == StatusPending || g.Status == StatusRunning
+}
+
+// succeeded reports whether the generation is done or may still be.
+func (g *Generation) succeeded() bool {
+	return g.Status != StatusFailed && g.Status != StatusCancelled
+}
+
+var (
+	// ErrNotFound is returned for unknown generation IDs.
+	ErrNotFound = errors.New("generation not found")
+	// ErrCancelled is wrapped by the errors that Finish records as
+	// cancellations.
+	ErrCancelled = errors.New("generation cancelled")
+)
+
+// Registry is a concurrency-safe set of generations persisted to a JSON file.
+// Changes are made to copies of the generations, which replace them only once
+// the file is saved, so that a failed save leaves the registry unchanged.
+type Registry struct {
+	mu   sync.Mutex
+	path string
+	gens map[string]*Generation
+}
+
+// Open loads the registry stored at path, creating an empty one if the file
+// does not exist.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, gens: map[string]*Generation{}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var gens []*Generation
+	if err := json.Unmarshal(b, &gens); err != nil {
+		return nil, fmt.Errorf("registry %s: %w", path, err)
+	}
+	for _, g := range gens {
+		if g.Version == 0 {
+			// Recorded before versioning: the generation becomes version 1.
+			g.Base, g.Version, g.Canonical = g.ID, 1, true
+			g.ID = VersionID(g.Base, g.Version)
+		}
+		r.gens[g.ID] = g
+	}
+	return r, nil
+}
+
+// BaseID returns the ID of the notebook generated for url, which its versions
+// share. It names the generated notebook and its log files in the generation
+// directory.
+func BaseID(url string) string {
+	return fmt.Sprintf("gen-%x", md5.Sum([]byte(url)))
+}
+
+// VersionID returns the ID of a version of the notebook identified by base.
+func VersionID(base string, version int) string {
+	return fmt.Sprintf("%s.v%d", base, version)
+}
+
+// Get returns the generation with the given ID.
+func (r *Registry) Get(id string) (Generation, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.gens[id]
+	if !ok {
+		return Generation{}, false
+	}
+	return *clone(g), true
+}
+
+// List returns all generations, oldest first.
+func (r *Registry) List() []Generation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	gens := make([]Generation, 0, len(r.gens))
+	for _, g := range r.gens {
+		gens = append(gens, *clone(g))
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		if !gens[i].CreatedAt.Equal(gens[j].CreatedAt) {
+			return gens[i].CreatedAt.Before(gens[j].CreatedAt)
+		}
+		return gens[i].ID < gens[j].ID
+	})
+	return gens
+}
+
+// Versions returns the versions of the notebook identified by base, oldest
+// first.
+func (r *Registry) Versions(base string) []Generation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.versions(base)
+}
+
+// versions is like Versions. r.mu must be held.
+func (r *Registry) versions(base string) []Generation {
+	var gens []Generation
+	for _, g := range r.gens {
+		if g.Base == base {
+			gens = append(gens, *clone(g))
+		}
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i].Version < gens[j].Version })
+	return gens
+}
+
+// Canonical returns the canonical version of the notebook identified by base.
+func (r *Registry) Canonical(base string) (Generation, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, g := range r.versions(base) {
+		if g.Canonical {
+			return g, true
+		}
+	}
+	return Generation{}, false
+}
+
+// Create records a new pending version of the notebook identified by g.Base.
+// Unless regenerate is set, the canonical version is returned instead if it
+// has not failed or been cancelled, and created is false. The first version
+// of a notebook is canonical.
+func (r *Registry) Create(g Generation, regenerate bool) (gen Generation, created bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := r.versions(g.Base)
+	if !regenerate {
+		for _, v := range versions {
+			if v.Canonical && v.succeeded() {
+				return v, false, nil
+			}
+		}
+	}
+	g.Version = 1
+	if len(versions) > 0 {
+		g.Version = versions[len(versions)-1].Version + 1
+	}
+	g.ID = VersionID(g.Base, g.Version)
+	g.Canonical = len(versions) == 0
+	g.Status = StatusPending
+	if g.CreatedAt.IsZero() {
+		g.CreatedAt = time.Now()
+	}
+	if err := r.commit(clone(&g)); err != nil {
+		return Generation{}, false, err
+	}
+	return g, true, nil
+}
+
+// SetCanonical makes the given version the canonical version of the notebook
+// identified by base.
+func (r *Registry) SetCanonical(base string, version int) (Generation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.gens[VersionID(base, version)]
+	if !ok {
+		return Generation{}, fmt.Errorf("%w: %s", ErrNotFound, VersionID(base, version))
+	}
+	g = clone(g)
+	if err := r.commit(r.setCanonical(g)...); err != nil {
+		return Generation{}, err
+	}
+	return *g, nil
+}
+
+// setCanonical makes g, a copy, the canonical version of its notebook, and
+// returns it with copies of the other versions it makes non-canonical. r.mu
+// must be held.
+func (r *Registry) setCanonical(g *Generation) []*Generation {
+	changed := []*Generation{g}
+	for _, other := range r.gens {
+		if other.Base == g.Base && other.ID != g.ID && other.Canonical {
+			other = clone(other)
+			other.Canonical = false
+			changed = append(changed, other)
+		}
+	}
+	g.Canonical = true
+	return changed
+}
+
+// Update applies fn to a copy of the generation with the given ID and
+// persists the result.
+func (r *Registry) Update(id string, fn func(*Generation)) (Generation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.gens[id]
+	if !ok {
+		return Generation{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	g = clone(g)
+	fn(g)
+	if err := r.commit(g); err != nil {
+		return Generation{}, err
+	}
+	return *g, nil
+}
+
+// Start marks the generation as running.
+func (r *Registry) Start(id string) (Generation, error) {
+	return r.Update(id, func(g *Generation) {
+		now := time.Now()
+		g.Status = StatusRunning
+		g.StartedAt = &now
+		g.FinishedAt = nil
+		g.Error = ""
+		g.Execution = nil
+		g.ValidationErrors = nil
+		g.Continuations, g.Truncated, g.Turns = 0, false, 0
+		g.LatencyMS, g.TimeToFirstTokenMS = 0, 0
+	})
+}
+
+// Finish marks the generation as done, or as failed if err is non-nil, or as
+// cancelled if err wraps ErrCancelled. A generation that succeeds becomes
+// canonical if its notebook has no successful canonical version.
+func (r *Registry) Finish(id string, usage *Usage, err error) (Generation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.gens[id]
+	if !ok {
+		return Generation{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	g = clone(g)
+	changed := []*Generation{g}
+	now := time.Now()
+	g.FinishedAt = &now
+	g.Usage = usage
+	g.Status = StatusDone
+	if err != nil {
+		g.Status = StatusFailed
+		if errors.Is(err, ErrCancelled) {
+			g.Status = StatusCancelled
+		}
+		g.Error = err.Error()
+	}
+	if g.Status == StatusDone && !g.Canonical {
+		hasCanonical := false
+		for _, v := range r.versions(g.Base) {
+			hasCanonical = hasCanonical || v.Canonical && v.succeeded()
+		}
+		if !hasCanonical {
+			changed = r.setCanonical(g)
+		}
+	}
+	if err := r.commit(changed...); err != nil {
+		return Generation{}, err
+	}
+	return *g, nil
+}
+
+// StartExecution records that the code cells of the generation are being run
+// on kernel.
+func (r *Registry) StartExecution(id, kernel string) (Generation, error) {
+	return r.Update(id, func(g *Generation) {
+		g.Execution = &Execution{Status: StatusRunning, Kernel: kernel, StartedAt: time.Now()}
+	})
+}
+
+// FinishExecution marks the execution of the generation as done, or as failed
+// if err is non-nil.
+func (r *Registry) FinishExecution(id string, err error) (Generation, error) {
+	return r.Update(id, func(g *Generation) {
+		if g.Execution == nil {
+			g.Execution = &Execution{StartedAt: time.Now()}
+		}
+		now := time.Now()
+		g.Execution.FinishedAt = &now
+		g.Execution.Status = StatusDone
+		if err != nil {
+			g.Execution.Status = StatusFailed
+			g.Execution.Error = err.Error()
+		}
+	})
+}
+
+// commit saves the registry with the changed generations, which must not be
+// shared with it, and replaces them in the registry if that succeeds. r.mu
+// must be held.
+func (r *Registry) commit(changed ...*Generation) error {
+	gens := make(map[string]*Generation, len(r.gens)+1)
+	for id, g := range r.gens {
+		gens[id] = g
+	}
+	for _, g := range changed {
+		gens[g.ID] = g
+	}
+	if err := save(r.path, gens); err != nil {
+		return err
+	}
+	r.gens = gens
+	return nil
+}
+
+// clone returns a copy of g that shares nothing it could change in place.
+func clone(g *Generation) *Generation {
+	c := *g
+	if g.Usage != nil {
+		u := *g.Usage
+		c.Usage = &u
+	}
+	if g.Cell != nil {
+		i := *g.Cell
+		c.Cell = &i
+	}
+	if g.Execution != nil {
+		e := *g.Execution
+		c.Execution = &e
+	}
+	c.ValidationErrors = slices.Clone(g.ValidationErrors)
+	return &c
+}
+
+// save writes gens to the index at path atomically.
+func save(path string, gens map[string]*Generation) error {
+	list := make([]*Generation, 0, len(gens))
+	for _, g := range gens {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// UsageFromGenerationInfo extracts the token usage from the generation info
+// of a langchaingo response, which names the counts differently per
+// provider. It returns nil if no counts are present.
+func UsageFromGenerationInfo(info map[string]any) *Usage {
+	in, okIn := intValue(info, "InputTokens", "PromptTokens", "input_tokens")
+	out, okOut := intValue(info, "OutputTokens", "CompletionTokens", "output_tokens")
+	if !okIn && !okOut {
+		return nil
+	}
+	return &Usage{InputTokens: in, OutputTokens: out}
+}
+
+func intValue(info map[string]any, keys ...string) (int, bool) {
+	for _, k := range keys {
+		switch v := info[k].(type) {
+		case int:
+			return v, true
+		case int32:
+			return int(v), true
+		case int64:
+			return int(v), true
+		case float64:
+			return int(v), true
+		}
+	}
+	return 0, false
+}
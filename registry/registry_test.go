@@ -0,0 +1,287 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func open(t *testing.T) *Registry {
+	t.Helper()
+	r, err := Open(filepath.Join(t.TempDir(), "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func create(t *testing.T, r *Registry, base string, regenerate bool) (Generation, bool) {
+	t.Helper()
+	g, created, err := r.Create(Generation{Base: base, URL: "/" + base}, regenerate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, created
+}
+
+func TestCreate(t *testing.T) {
+	r := open(t)
+	v1, created := create(t, r, "a", false)
+	if !created || v1.ID != "a.v1" || v1.Version != 1 || !v1.Canonical || v1.Status != StatusPending || v1.CreatedAt.IsZero() {
+		t.Fatalf("first Create = %+v, %v; want a canonical pending a.v1", v1, created)
+	}
+	if g, created := create(t, r, "a", false); created || g.ID != "a.v1" {
+		t.Errorf("Create of a canonical notebook = %s, created %v; want a.v1", g.ID, created)
+	}
+	v2, created := create(t, r, "a", true)
+	if !created || v2.ID != "a.v2" || v2.Canonical {
+		t.Errorf("Create regenerating = %+v, %v; want a non-canonical a.v2", v2, created)
+	}
+	if g, _ := create(t, r, "b", false); g.ID != "b.v1" || !g.Canonical {
+		t.Errorf("Create of another notebook = %+v, want a canonical b.v1", g)
+	}
+	if got := len(r.Versions("a")); got != 2 {
+		t.Errorf("a has %d versions, want 2", got)
+	}
+}
+
+// TestFinish checks that only a successful version becomes canonical, and
+// only if the notebook has no successful canonical version.
+func TestFinish(t *testing.T) {
+	failed := errors.New("model error")
+	cancelled := fmt.Errorf("stopped: %w", ErrCancelled)
+	tests := []struct {
+		name          string
+		first, second error // outcomes of versions 1 and 2; nil is done
+		finishFirst   bool  // or leave version 1 running
+		wantCanonical int
+		wantStatus    [2]Status
+	}{
+		{"first succeeds", nil, nil, true, 1, [2]Status{StatusDone, StatusDone}},
+		{"first failed", failed, nil, true, 2, [2]Status{StatusFailed, StatusDone}},
+		{"first cancelled", cancelled, nil, true, 2, [2]Status{StatusCancelled, StatusDone}},
+		{"both failed", failed, failed, true, 1, [2]Status{StatusFailed, StatusFailed}},
+		{"second cancelled", nil, cancelled, true, 1, [2]Status{StatusDone, StatusCancelled}},
+		{"first running", nil, nil, false, 1, [2]Status{StatusRunning, StatusDone}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := open(t)
+			create(t, r, "a", false)
+			create(t, r, "a", true)
+			for _, id := range []string{"a.v1", "a.v2"} {
+				if _, err := r.Start(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.finishFirst {
+				if _, err := r.Finish("a.v1", nil, tt.first); err != nil {
+					t.Fatal(err)
+				}
+			}
+			usage := &Usage{InputTokens: 1, OutputTokens: 2}
+			g, err := r.Finish("a.v2", usage, tt.second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.FinishedAt == nil || !reflect.DeepEqual(g.Usage, usage) {
+				t.Errorf("Finish = %+v, want the finish time and usage", g)
+			}
+			if tt.second != nil && g.Error != tt.second.Error() {
+				t.Errorf("Error = %q, want %q", g.Error, tt.second)
+			}
+			canonical, ok := r.Canonical("a")
+			if !ok || canonical.Version != tt.wantCanonical {
+				t.Errorf("canonical version = %d, want %d", canonical.Version, tt.wantCanonical)
+			}
+			canonicals := 0
+			for i, v := range r.Versions("a") {
+				if v.Status != tt.wantStatus[i] {
+					t.Errorf("version %d status = %s, want %s", v.Version, v.Status, tt.wantStatus[i])
+				}
+				if v.Canonical {
+					canonicals++
+				}
+			}
+			if canonicals != 1 {
+				t.Errorf("%d canonical versions, want 1", canonicals)
+			}
+		})
+	}
+}
+
+func TestCreateAfterFailure(t *testing.T) {
+	r := open(t)
+	create(t, r, "a", false)
+	if _, err := r.Finish("a.v1", nil, errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if g, created := create(t, r, "a", false); !created || g.ID != "a.v2" {
+		t.Errorf("Create after a failure = %s, created %v; want a new a.v2", g.ID, created)
+	}
+}
+
+func TestSetCanonical(t *testing.T) {
+	r := open(t)
+	create(t, r, "a", false)
+	create(t, r, "a", true)
+	if g, err := r.SetCanonical("a", 2); err != nil || !g.Canonical {
+		t.Fatalf("SetCanonical = %+v, %v", g, err)
+	}
+	if g, _ := r.Canonical("a"); g.ID != "a.v2" {
+		t.Errorf("canonical = %s, want a.v2", g.ID)
+	}
+	if g, _ := r.Get("a.v1"); g.Canonical {
+		t.Errorf("a.v1 is still canonical")
+	}
+	if _, err := r.SetCanonical("a", 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetCanonical of a missing version = %v, want ErrNotFound", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create(t, r, "a", false)
+	create(t, r, "a", true)
+	create(t, r, "b", false)
+	r.Start("a.v2")
+	r.Finish("a.v2", &Usage{InputTokens: 3, Estimated: true}, nil)
+	r.StartExecution("a.v2", "python3")
+	r.FinishExecution("a.v2", errors.New("kernel died"))
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := reopened.List(), r.List()
+	if len(got) != len(want) {
+		t.Fatalf("reopened registry has %d generations, want %d", len(got), len(want))
+	}
+	for i := range got {
+		// times lose their monotonic clock reading in JSON
+		if g, w := mustJSON(t, got[i]), mustJSON(t, want[i]); g != w {
+			t.Errorf("reopened generation %d = %s, want %s", i, g, w)
+		}
+	}
+	if g, _ := reopened.Get("a.v2"); g.Execution == nil || g.Execution.Status != StatusFailed || g.Execution.Error != "kernel died" {
+		t.Errorf("reopened execution = %+v, want a failed execution", g.Execution)
+	}
+}
+
+// TestOpenMigrates opens an index written before versioning, whose
+// generations become the canonical first version of their notebook.
+func TestOpenMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.json")
+	index := `[
+  {"id": "gen-abc", "url": "/a.ipynb", "status": "done", "created_at": "2024-05-01T00:00:00Z"},
+  {"id": "gen-def.v2", "base": "gen-def", "version": 2, "url": "/d.ipynb", "status": "failed", "created_at": "2024-05-02T00:00:00Z"}
+]`
+	if err := os.WriteFile(path, []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := r.Get("gen-abc.v1")
+	if !ok || g.Base != "gen-abc" || g.Version != 1 || !g.Canonical || g.Status != StatusDone {
+		t.Errorf("migrated generation = %+v, %v; want the canonical gen-abc.v1", g, ok)
+	}
+	if _, ok := r.Get("gen-abc"); ok {
+		t.Errorf("the unversioned ID is still registered")
+	}
+	if g, ok := r.Get("gen-def.v2"); !ok || g.Version != 2 || g.Canonical {
+		t.Errorf("versioned generation = %+v, %v; want it unchanged", g, ok)
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Errorf("Open of a corrupt index succeeded")
+	}
+}
+
+// TestSaveFailure checks that changes that cannot be saved are not made.
+func TestSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	r, err := Open(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	create(t, r, "a", false)
+	create(t, r, "a", true)
+	r.Finish("a.v1", nil, errors.New("failed"))
+	before := r.List()
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := r.Create(Generation{Base: "b"}, false); err == nil {
+		t.Errorf("Create succeeded without saving")
+	}
+	if _, err := r.Start("a.v2"); err == nil {
+		t.Errorf("Start succeeded without saving")
+	}
+	if _, err := r.Finish("a.v2", &Usage{InputTokens: 1}, nil); err == nil {
+		t.Errorf("Finish succeeded without saving")
+	}
+	if _, err := r.SetCanonical("a", 2); err == nil {
+		t.Errorf("SetCanonical succeeded without saving")
+	}
+	if _, err := r.Update("a.v2", func(g *Generation) { g.ValidationErrors = []string{"x"} }); err == nil {
+		t.Errorf("Update succeeded without saving")
+	}
+	if after := r.List(); !reflect.DeepEqual(after, before) {
+		t.Errorf("generations after failed saves =\n%+v\nwant\n%+v", after, before)
+	}
+}
+
+// TestGetReturnsCopies checks that changing a returned generation does not
+// change the registry.
+func TestGetReturnsCopies(t *testing.T) {
+	r := open(t)
+	create(t, r, "a", false)
+	r.Finish("a.v1", &Usage{InputTokens: 1}, nil)
+	g, _ := r.Get("a.v1")
+	g.Usage.InputTokens = 100
+	g.Status = StatusFailed
+	if g, _ := r.Get("a.v1"); g.Usage.InputTokens != 1 || g.Status != StatusDone {
+		t.Errorf("registry changed through a returned generation: %+v", g)
+	}
+}
+
+func TestUsageFromGenerationInfo(t *testing.T) {
+	tests := []struct {
+		info map[string]any
+		want *Usage
+	}{
+		{nil, nil},
+		{map[string]any{"StopReason": "end_turn"}, nil},
+		{map[string]any{"InputTokens": 10, "OutputTokens": 20}, &Usage{InputTokens: 10, OutputTokens: 20}},
+		{map[string]any{"PromptTokens": int32(3), "CompletionTokens": int64(4)}, &Usage{InputTokens: 3, OutputTokens: 4}},
+		{map[string]any{"input_tokens": 5.0}, &Usage{InputTokens: 5}},
+	}
+	for _, tt := range tests {
+		if got := UsageFromGenerationInfo(tt.info); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("UsageFromGenerationInfo(%v) = %+v, want %+v", tt.info, got, tt.want)
+		}
+	}
+}
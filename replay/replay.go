@@ -0,0 +1,256 @@
+// Package replay implements an llms.Model that streams back generations
+// recorded in the .claude.log files nbsim writes to its generation directory.
+// It lets the generation pipeline run end to end without a live model.
+package replay
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim/registry"
+)
+
+// LogSuffix is the suffix of the recorded generation logs.
+const LogSuffix = ".claude.log"
+
+// LLM replays recorded generations. The recording for a request is chosen by
+// the notebook ID (see registry.BaseID) of its last human message, preferring
+// the latest version; requests without a recording deterministically get one
+// of the other recordings in Dir.
+type LLM struct {
+	// Dir is the directory holding the recorded logs.
+	Dir string
+	// ChunkSize is the number of bytes streamed per chunk. Zero streams the
+	// whole recording at once. Chunks never split a UTF-8 sequence.
+	ChunkSize int
+	// Delay is the pause before each chunk.
+	Delay time.Duration
+	// MaxBytes, if positive, simulates the max-tokens limit: a response
+	// stops after MaxBytes bytes with the max_tokens stop reason. A request
+	// whose response is prefilled with part of the recording continues it.
+	MaxBytes int
+}
+
+var _ llms.Model = (*LLM)(nil)
+
+// New returns an LLM replaying the recordings in dir.
+func New(dir string) (*LLM, error) {
+	logs, err := filepath.Glob(filepath.Join(dir, "*"+LogSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("replay: no recorded generations in %s", dir)
+	}
+	return &LLM{Dir: dir, ChunkSize: 64}, nil
+}
+
+// GenerateContent streams the recording for messages to the streaming
+// function, if any, and returns it as the response. Requests with tools
+// replay a recording of tool calls instead.
+func (l *LLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opts := &llms.CallOptions{}
+	for _, opt := range options {
+		opt(opts)
+	}
+	recording, err := l.recording(messages)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Tools) > 0 {
+		return replayToolCall(recording, messages)
+	}
+	recording = recording[continuedAt(recording, messages):]
+	stopReason := "end_turn"
+	if l.MaxBytes > 0 && len(recording) > l.MaxBytes {
+		recording = recording[:chunkLen(recording, l.MaxBytes)]
+		stopReason = "max_tokens"
+	}
+	if opts.StreamingFunc != nil {
+		for rest := recording; len(rest) > 0; {
+			n := chunkLen(rest, l.ChunkSize)
+			if l.Delay > 0 {
+				select {
+				case <-time.After(l.Delay):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			if err := opts.StreamingFunc(ctx, rest[:n]); err != nil {
+				return nil, err
+			}
+			rest = rest[n:]
+		}
+	}
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{{Content: string(recording), StopReason: stopReason}},
+	}, nil
+}
+
+// Call implements the deprecated llms.Model text interface.
+func (l *LLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, l, prompt, options...)
+}
+
+func (l *LLM) recording(messages []llms.MessageContent) ([]byte, error) {
+	input := lastHumanText(messages)
+	base := registry.BaseID(input)
+	b, err := os.ReadFile(filepath.Join(l.Dir, base+LogSuffix))
+	if err == nil || !os.IsNotExist(err) {
+		return b, err
+	}
+	// Versioned recordings are named <base>.v<N>.claude.log; replay the
+	// latest.
+	versions, err := filepath.Glob(filepath.Join(l.Dir, base+".v*"+LogSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) > 0 {
+		sort.Slice(versions, func(i, j int) bool {
+			return versionOf(versions[i]) < versionOf(versions[j])
+		})
+		return os.ReadFile(versions[len(versions)-1])
+	}
+	logs, err := filepath.Glob(filepath.Join(l.Dir, "*"+LogSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("replay: no recorded generations in %s", l.Dir)
+	}
+	sort.Strings(logs)
+	sum := md5.Sum([]byte(input))
+	i := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), big.NewInt(int64(len(logs))))
+	return os.ReadFile(logs[i.Int64()])
+}
+
+// continuedAt returns how much of the recording the prefilled response of
+// messages already holds: the longest prefix of the recording, past the
+// prefill of the first request, that the response ends with.
+//
+// It matches the prefill against the recording in a single scan, falling
+// back on a mismatch as in Knuth-Morris-Pratt.
+func continuedAt(recording []byte, messages []llms.MessageContent) int {
+	if len(messages) == 0 || messages[len(messages)-1].Role != llms.ChatMessageTypeAI {
+		return 0
+	}
+	var prefill string
+	for _, part := range messages[len(messages)-1].Parts {
+		if t, ok := part.(llms.TextContent); ok {
+			prefill += t.Text
+		}
+	}
+	pattern := recording[:min(len(prefill), len(recording))]
+	if len(pattern) == 0 {
+		return 0
+	}
+	// fail[i] is the length of the longest proper prefix of pattern[:i+1]
+	// that is also a suffix of it.
+	fail := make([]int, len(pattern))
+	for i, k := 1, 0; i < len(pattern); i++ {
+		for k > 0 && pattern[i] != pattern[k] {
+			k = fail[k-1]
+		}
+		if pattern[i] == pattern[k] {
+			k++
+		}
+		fail[i] = k
+	}
+	n := 0 // the length of the prefix of pattern that prefill[:i] ends with
+	for i := 0; i < len(prefill); i++ {
+		if n == len(pattern) {
+			n = fail[n-1]
+		}
+		for n > 0 && prefill[i] != pattern[n] {
+			n = fail[n-1]
+		}
+		if prefill[i] == pattern[n] {
+			n++
+		}
+	}
+	return n
+}
+
+// replayToolCall answers a request with tools from a recording of tool
+// calls, one JSON-encoded llms.FunctionCall per line: each request gets the
+// call after the ones already answered in messages, and requests after the
+// last call get a response without tool calls.
+func replayToolCall(recording []byte, messages []llms.MessageContent) (*llms.ContentResponse, error) {
+	answered := 0
+	for _, m := range messages {
+		for _, part := range m.Parts {
+			if _, ok := part.(llms.ToolCallResponse); ok {
+				answered++
+			}
+		}
+	}
+	var calls []llms.FunctionCall
+	for _, line := range strings.Split(string(recording), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var call llms.FunctionCall
+		if err := json.Unmarshal([]byte(line), &call); err != nil {
+			return nil, fmt.Errorf("replay: recording is not a list of tool calls: %w", err)
+		}
+		calls = append(calls, call)
+	}
+	choice := &llms.ContentChoice{StopReason: "end_turn"}
+	if answered < len(calls) {
+		choice.StopReason = "tool_use"
+		choice.ToolCalls = []llms.ToolCall{{
+			ID:           fmt.Sprintf("call_%d", answered),
+			Type:         "function",
+			FunctionCall: &calls[answered],
+		}}
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+}
+
+// versionOf returns N of a <base>.v<N>.claude.log path.
+func versionOf(path string) int {
+	name := strings.TrimSuffix(filepath.Base(path), LogSuffix)
+	n, _ := strconv.Atoi(name[strings.LastIndex(name, ".v")+2:])
+	return n
+}
+
+func lastHumanText(messages []llms.MessageContent) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != llms.ChatMessageTypeHuman {
+			continue
+		}
+		// The requested URL is the last text part; earlier parts carry
+		// context such as the referring notebook.
+		parts := messages[i].Parts
+		for j := len(parts) - 1; j >= 0; j-- {
+			if t, ok := parts[j].(llms.TextContent); ok {
+				return t.Text
+			}
+		}
+	}
+	return ""
+}
+
+// chunkLen returns the length of the next chunk of b, extended so that it
+// does not end inside a UTF-8 sequence.
+func chunkLen(b []byte, size int) int {
+	if size <= 0 || size >= len(b) {
+		return len(b)
+	}
+	n := size
+	for n < len(b) && !utf8.RuneStart(b[n]) {
+		n++
+	}
+	return n
+}
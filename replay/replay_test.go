@@ -0,0 +1,254 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim/registry"
+)
+
+// record writes the recordings, by file name without LogSuffix, to a new
+// directory.
+func record(t *testing.T, recordings map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range recordings {
+		if err := os.WriteFile(filepath.Join(dir, name+LogSuffix), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func request(url string, prefill ...string) []llms.MessageContent {
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "system prompt"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "referrer context", url),
+	}
+	if len(prefill) > 0 {
+		messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, prefill...))
+	}
+	return messages
+}
+
+func generate(t *testing.T, l *LLM, messages []llms.MessageContent) (*llms.ContentChoice, []string) {
+	t.Helper()
+	var chunks []string
+	resp, err := l.GenerateContent(context.Background(), messages, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Choices[0], chunks
+}
+
+func TestRecordingSelection(t *testing.T) {
+	dir := record(t, map[string]string{
+		registry.BaseID("/a.ipynb"):          "a",
+		registry.BaseID("/b.ipynb") + ".v2":  "b2",
+		registry.BaseID("/b.ipynb") + ".v10": "b10",
+		registry.BaseID("/b.ipynb") + ".v9":  "b9",
+		"other":                              "other",
+	})
+	l := &LLM{Dir: dir}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/a.ipynb", "a"},
+		{"/b.ipynb", "b10"}, // the latest version, not the last by name
+	}
+	for _, tt := range tests {
+		if got, _ := generate(t, l, request(tt.url)); got.Content != tt.want {
+			t.Errorf("recording of %s = %q, want %q", tt.url, got.Content, tt.want)
+		}
+	}
+
+	// A request without a recording gets the same one of the others each
+	// time.
+	first, _ := generate(t, l, request("/missing.ipynb"))
+	if !strings.Contains("a b2 b9 b10 other", first.Content) {
+		t.Errorf("recording of /missing.ipynb = %q, want one of the recordings", first.Content)
+	}
+	for i := 0; i < 3; i++ {
+		if got, _ := generate(t, l, request("/missing.ipynb")); got.Content != first.Content {
+			t.Errorf("recording of /missing.ipynb = %q, then %q", first.Content, got.Content)
+		}
+	}
+}
+
+func TestNoRecordings(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(dir); err == nil {
+		t.Errorf("New of an empty directory succeeded")
+	}
+	l := &LLM{Dir: dir}
+	if _, err := l.GenerateContent(context.Background(), request("/a.ipynb")); err == nil {
+		t.Errorf("GenerateContent without recordings succeeded")
+	}
+}
+
+func TestChunks(t *testing.T) {
+	const recording = "héllo, wörld — ünïcode ✓"
+	dir := record(t, map[string]string{registry.BaseID("/a.ipynb"): recording})
+	for _, size := range []int{0, 1, 2, 3, 5, 64} {
+		l := &LLM{Dir: dir, ChunkSize: size}
+		choice, chunks := generate(t, l, request("/a.ipynb"))
+		if choice.Content != recording || strings.Join(chunks, "") != recording {
+			t.Errorf("ChunkSize %d: response %q, chunks %q; want %q", size, choice.Content, chunks, recording)
+		}
+		for _, c := range chunks {
+			if !utf8.ValidString(c) {
+				t.Errorf("ChunkSize %d: chunk %q splits a UTF-8 sequence", size, c)
+			}
+			if size > 0 && len(c) > size+utf8.UTFMax-1 {
+				t.Errorf("ChunkSize %d: chunk %q is too long", size, c)
+			}
+		}
+		if size == 0 && len(chunks) != 1 {
+			t.Errorf("ChunkSize 0 streamed %d chunks, want 1", len(chunks))
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	dir := record(t, map[string]string{registry.BaseID("/a.ipynb"): "abcd"})
+	l := &LLM{Dir: dir, ChunkSize: 1, Delay: 5 * time.Millisecond}
+	start := time.Now()
+	generate(t, l, request("/a.ipynb"))
+	if elapsed := time.Since(start); elapsed < 4*l.Delay {
+		t.Errorf("4 chunks took %v, want at least %v", elapsed, 4*l.Delay)
+	}
+
+	l.Delay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := l.GenerateContent(ctx, request("/a.ipynb"), llms.WithStreamingFunc(func(context.Context, []byte) error { return nil }))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GenerateContent after the deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestMaxBytes continues a recording cut off by MaxBytes the way nbsim does,
+// prefilling the response with what was written so far.
+func TestMaxBytes(t *testing.T) {
+	const recording = `"cells": [{"cell_type": "markdown", "source": "ünïcode"}]}`
+	dir := record(t, map[string]string{registry.BaseID("/a.ipynb"): recording})
+	l := &LLM{Dir: dir, ChunkSize: 4, MaxBytes: 16}
+	written := ""
+	for i := 0; ; i++ {
+		messages := request("/a.ipynb", "{")
+		if written != "" {
+			// the prefill ends in no whitespace
+			messages = request("/a.ipynb", "{"+strings.TrimRight(written, " "))
+		}
+		choice, chunks := generate(t, l, messages)
+		if len(choice.Content) > l.MaxBytes+utf8.UTFMax-1 {
+			t.Fatalf("response %d is %d bytes, over MaxBytes %d", i, len(choice.Content), l.MaxBytes)
+		}
+		if strings.Join(chunks, "") != choice.Content {
+			t.Fatalf("response %d: chunks %q, content %q", i, chunks, choice.Content)
+		}
+		written = strings.TrimRight(written, " ") + choice.Content
+		if choice.StopReason == "end_turn" {
+			break
+		}
+		if choice.StopReason != "max_tokens" {
+			t.Fatalf("response %d stopped for %q", i, choice.StopReason)
+		}
+		if i > len(recording) {
+			t.Fatalf("no end after %d continuations", i)
+		}
+	}
+	if written != recording {
+		t.Errorf("continued responses = %q, want %q", written, recording)
+	}
+}
+
+func TestContinuedAt(t *testing.T) {
+	tests := []struct {
+		recording, prefill string
+		want               int
+	}{
+		{"abc", "", 0},
+		{"abc", "{", 0},
+		{"abc", "{ab", 2},
+		{"abc", "{abc", 3},
+		{"abc", "{abcabc", 3},
+		{"aab", "{aaab", 3},
+		{"abab", "{abaaba", 3},
+		{"aaaa", "aaaaaaa", 4},
+		{"ab", "{abx", 0},
+	}
+	for _, tt := range tests {
+		if got := continuedAt([]byte(tt.recording), request("/a", tt.prefill)); got != tt.want {
+			t.Errorf("continuedAt(%q, %q) = %d, want %d", tt.recording, tt.prefill, got, tt.want)
+		}
+	}
+	if got := continuedAt([]byte("abc"), request("/a")); got != 0 {
+		t.Errorf("continuedAt without a prefill = %d, want 0", got)
+	}
+
+	// Compare with the longest match found by trying every length.
+	r := rand.New(rand.NewPCG(1, 2))
+	word := func(n int) string {
+		b := make([]byte, r.IntN(n))
+		for i := range b {
+			b[i] = "ab"[r.IntN(2)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 2000; i++ {
+		recording, prefill := word(12), word(16)
+		want := 0
+		for n := min(len(prefill), len(recording)); n > 0; n-- {
+			if strings.HasSuffix(prefill, recording[:n]) {
+				want = n
+				break
+			}
+		}
+		if got := continuedAt([]byte(recording), request("/a", prefill)); got != want {
+			t.Fatalf("continuedAt(%q, %q) = %d, want %d", recording, prefill, got, want)
+		}
+	}
+}
+
+func TestReplayToolCall(t *testing.T) {
+	dir := record(t, map[string]string{registry.BaseID("/a.ipynb"): `{"name": "add_cell", "arguments": "{\"cell_type\": \"markdown\"}"}
+{"name": "add_cell", "arguments": "{}"}
+`})
+	l := &LLM{Dir: dir}
+	messages := request("/a.ipynb")
+	tools := llms.WithTools([]llms.Tool{{Type: "function", Function: &llms.FunctionDefinition{Name: "add_cell"}}})
+	for i := 0; ; i++ {
+		resp, err := l.GenerateContent(context.Background(), messages, tools)
+		if err != nil {
+			t.Fatal(err)
+		}
+		choice := resp.Choices[0]
+		if i == 2 {
+			if len(choice.ToolCalls) != 0 || choice.StopReason != "end_turn" {
+				t.Errorf("response after the last call = %+v, want no tool calls", choice)
+			}
+			break
+		}
+		if len(choice.ToolCalls) != 1 || choice.StopReason != "tool_use" {
+			t.Fatalf("response %d = %+v, want one tool call", i, choice)
+		}
+		call := choice.ToolCalls[0]
+		messages = append(messages,
+			llms.MessageContent{Role: llms.ChatMessageTypeAI, Parts: []llms.ContentPart{call}},
+			llms.MessageContent{Role: llms.ChatMessageTypeTool, Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: call.ID, Name: call.FunctionCall.Name, Content: "ok"}}},
+		)
+	}
+}
@@ -0,0 +1,147 @@
+package nbsim
+
+import (
+	"slices"
+	"sync"
+)
+
+// Scheduler runs generations on a bounded number of workers, in the order
+// they are submitted. Each job has a key, such as the notebook it generates,
+// and at most one job per key is queued or running at a time.
+type Scheduler struct {
+	// OnQueue, if set, is called with the queue position of each waiting
+	// job, starting at 1, when it is queued and whenever it moves up. It is
+	// called without locks held.
+	OnQueue func(id string, position int)
+
+	mu      sync.Mutex
+	workers int
+	running int
+	queue   []*job
+	active  map[string]*job // queued or running jobs by key
+	wg      sync.WaitGroup
+}
+
+type job struct {
+	key, id string
+	run     func()
+}
+
+// NewScheduler returns a scheduler that runs up to workers jobs at once.
+func NewScheduler(workers int) *Scheduler {
+	return &Scheduler{workers: max(workers, 1), active: map[string]*job{}}
+}
+
+// Submit queues run as the job id under key. If a job with key is queued or
+// running already, run is dropped and that job's id is returned with ok
+// false.
+func (s *Scheduler) Submit(key, id string, run func()) (activeID string, ok bool) {
+	s.mu.Lock()
+	if j, ok := s.active[key]; ok {
+		s.mu.Unlock()
+		return j.id, false
+	}
+	j := &job{key: key, id: id, run: run}
+	s.active[key] = j
+	s.queue = append(s.queue, j)
+	s.wg.Add(1)
+	queued := s.dispatch()
+	s.mu.Unlock()
+	s.notify(queued)
+	return id, true
+}
+
+// Active returns the id of the job with key if it is queued or running.
+func (s *Scheduler) Active(key string) (id string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.active[key]; ok {
+		return j.id, true
+	}
+	return "", false
+}
+
+// Position returns the queue position of the job id, starting at 1, or 0 if
+// the job is running or unknown.
+func (s *Scheduler) Position(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range s.queue {
+		if j.id == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Remove removes the job id from the queue without running it, and reports
+// whether it was waiting.
+func (s *Scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	i := slices.IndexFunc(s.queue, func(j *job) bool { return j.id == id })
+	if i < 0 {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.active, s.queue[i].key)
+	s.queue = slices.Delete(s.queue, i, i+1)
+	moved := append([]*job(nil), s.queue[i:]...)
+	s.mu.Unlock()
+	s.wg.Done()
+	s.notify(moved)
+	return true
+}
+
+// Wait waits until all submitted jobs have run or been removed.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// dispatch starts queued jobs while workers are free and returns the waiting
+// jobs whose position changed: all of them if any job started, and the job
+// queued last otherwise. s.mu must be held.
+func (s *Scheduler) dispatch() []*job {
+	started := false
+	for s.running < s.workers && len(s.queue) > 0 {
+		j := s.queue[0]
+		s.queue = s.queue[1:]
+		s.running++
+		started = true
+		go s.runJob(j)
+	}
+	if !started && len(s.queue) > 0 {
+		// only the job queued last has a new position
+		return s.queue[len(s.queue)-1:]
+	}
+	return append([]*job(nil), s.queue...)
+}
+
+func (s *Scheduler) runJob(j *job) {
+	defer s.wg.Done()
+	j.run()
+	s.mu.Lock()
+	s.running--
+	delete(s.active, j.key)
+	queued := s.dispatch()
+	s.mu.Unlock()
+	s.notify(queued)
+}
+
+// notify reports the current positions of the queued jobs that are still
+// waiting.
+func (s *Scheduler) notify(queued []*job) {
+	if s.OnQueue == nil || len(queued) == 0 {
+		return
+	}
+	s.mu.Lock()
+	positions := make(map[string]int, len(s.queue))
+	for i, j := range s.queue {
+		positions[j.id] = i + 1
+	}
+	s.mu.Unlock()
+	for _, j := range queued {
+		if p, ok := positions[j.id]; ok {
+			s.OnQueue(j.id, p)
+		}
+	}
+}
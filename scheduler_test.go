@@ -0,0 +1,160 @@
+package nbsim
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(2)
+	var mu sync.Mutex
+	positions := map[string][]int{}
+	s.OnQueue = func(id string, position int) {
+		mu.Lock()
+		defer mu.Unlock()
+		positions[id] = append(positions[id], position)
+	}
+
+	release := make(chan struct{})
+	started := make(chan string, 4)
+	var running, maxRunning atomic.Int32
+	var order []string
+	job := func(id string) func() {
+		return func() {
+			n := running.Add(1)
+			started <- id
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			<-release
+			mu.Lock()
+			order = append(order, id)
+			mu.Unlock()
+			running.Add(-1)
+		}
+	}
+	for i := range 4 {
+		id := fmt.Sprintf("j%d", i)
+		if _, ok := s.Submit(id, id, job(id)); !ok {
+			t.Fatalf("Submit(%s) was refused", id)
+		}
+	}
+	if got, ok := s.Submit("j3", "other", job("other")); ok || got != "j3" {
+		t.Errorf("Submit of a queued key = %q, %v; want j3, false", got, ok)
+	}
+	if id, ok := s.Active("j0"); !ok || id != "j0" {
+		t.Errorf("Active(j0) = %q, %v; want j0, true", id, ok)
+	}
+	if p := s.Position("j3"); p != 2 {
+		t.Errorf("Position(j3) = %d, want 2", p)
+	}
+	if p := s.Position("j0"); p != 0 {
+		t.Errorf("Position(j0) of a running job = %d, want 0", p)
+	}
+
+	// Release the jobs one at a time: each completion starts the next.
+	<-started
+	<-started
+	for i := range 4 {
+		release <- struct{}{}
+		if i < 2 {
+			<-started
+		}
+	}
+	s.Wait()
+	if m := maxRunning.Load(); m != 2 {
+		t.Errorf("at most %d jobs ran at once, want 2", m)
+	}
+	if _, ok := s.Active("j3"); ok {
+		t.Errorf("j3 is still active after Wait")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(positions["j3"]); got != "[2 1]" {
+		t.Errorf("positions of j3 = %s, want [2 1]", got)
+	}
+	if got := fmt.Sprint(positions["j2"]); got != "[1]" {
+		t.Errorf("positions of j2 = %s, want [1]", got)
+	}
+	if len(order) != 4 {
+		t.Errorf("ran %d jobs, want 4", len(order))
+	}
+}
+
+// TestSchedulerSingleFlight submits the same key from many goroutines, as
+// concurrent viewers of one URL do; run with -race.
+func TestSchedulerSingleFlight(t *testing.T) {
+	s := NewScheduler(4)
+	release := make(chan struct{})
+	var runs atomic.Int32
+	var wg sync.WaitGroup
+	ids := make([]string, 20)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids[i], _ = s.Submit("url", fmt.Sprint(i), func() {
+				runs.Add(1)
+				<-release
+			})
+			s.Position(ids[i])
+		}()
+	}
+	wg.Wait()
+	close(release)
+	s.Wait()
+	if n := runs.Load(); n != 1 {
+		t.Errorf("%d jobs ran, want 1", n)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Fatalf("Submit returned ids %v, want one shared id", ids)
+		}
+	}
+}
+
+func TestSchedulerRemove(t *testing.T) {
+	s := NewScheduler(1)
+	release := make(chan struct{})
+	var ran []string
+	var mu sync.Mutex
+	job := func(id string) func() {
+		return func() {
+			<-release
+			mu.Lock()
+			ran = append(ran, id)
+			mu.Unlock()
+		}
+	}
+	var moved []int
+	s.OnQueue = func(id string, position int) {
+		if id == "c" {
+			moved = append(moved, position)
+		}
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		s.Submit(id, id, job(id))
+	}
+	if s.Remove("a") {
+		t.Errorf("Remove of a running job succeeded")
+	}
+	if !s.Remove("b") {
+		t.Errorf("Remove of a queued job failed")
+	}
+	if _, ok := s.Active("b"); ok {
+		t.Errorf("removed job b is still active")
+	}
+	close(release)
+	s.Wait()
+	if got := fmt.Sprint(ran); got != "[a c]" {
+		t.Errorf("ran %s, want [a c]", got)
+	}
+	if got := fmt.Sprint(moved); got != "[2 1]" {
+		t.Errorf("positions of c = %s, want [2 1]", got)
+	}
+}
@@ -0,0 +1,116 @@
+package nbsim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// AddCellTool is the tool the model calls in FormatTools to append a cell to
+// the notebook. Outputs are a JSON-encoded string rather than an array since
+// not every provider accepts nested parameter schemas.
+var AddCellTool = llms.Tool{
+	Type: "function",
+	Function: &llms.FunctionDefinition{
+		Name:        "add_cell",
+		Description: "Append a cell to the end of the notebook.",
+		Parameters: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"cell_type": map[string]any{
+					"type":        "string",
+					"description": "The type of the cell: markdown, code or raw.",
+					"enum":        []string{"markdown", "code", "raw"},
+				},
+				"source": map[string]any{
+					"type":        "string",
+					"description": "The source of the cell.",
+				},
+				"outputs": map[string]any{
+					"type":        "string",
+					"description": "For code cells, the outputs of the cell as a JSON array of nbformat 4 output objects, such as {\"output_type\": \"stream\", \"name\": \"stdout\", \"text\": \"hello\\n\"}.",
+				},
+			},
+			"required": []string{"cell_type", "source"},
+		},
+	},
+}
+
+// addCellArgs are the arguments of an add_cell call.
+type addCellArgs struct {
+	CellType string          `json:"cell_type"`
+	Source   string          `json:"source"`
+	Outputs  json.RawMessage `json:"outputs"`
+}
+
+// AddCell appends the cell of an add_cell call with the given JSON
+// arguments, and returns its index. A cell that is not valid nbformat is not
+// added, and the error says why, for the model to correct it.
+func (nw *notebookWriter) AddCell(arguments string) (int, error) {
+	if nw.builder == nil {
+		return 0, errors.New("the notebook is not written with tools")
+	}
+	var args addCellArgs
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return 0, fmt.Errorf("invalid arguments: %w", err)
+	}
+	outputs, err := parseToolOutputs(args.Outputs)
+	if err != nil {
+		return 0, err
+	}
+	c := notebooks.Cell{
+		ID:       fmt.Sprintf("cell-%d", nw.added),
+		CellType: args.CellType,
+		Metadata: &notebooks.CellMetadata{},
+		Source:   &notebooks.MultilineString{Value: args.Source},
+	}
+	if c.CellType == "code" {
+		c.Outputs = notebooks.Outputs{}
+		if len(outputs) > 0 {
+			n := nw.executionCount + 1
+			c.ExecutionCount = &n
+			for _, o := range outputs {
+				if r, ok := o.(*notebooks.ExecuteResult); ok {
+					r.ExecutionCount = &n
+				}
+				c.Outputs = append(c.Outputs, o)
+			}
+		}
+	} else if len(outputs) > 0 {
+		return 0, fmt.Errorf("%s cells have no outputs", c.CellType)
+	}
+	if errs := c.Validate(); errs != nil {
+		return 0, errs
+	}
+	if c.ExecutionCount != nil {
+		nw.executionCount = *c.ExecutionCount
+	}
+	nw.builder.Cell(c)
+	nw.added++
+	nw.emit(Event{Type: EventToken, Text: arguments + "\n"})
+	nw.update()
+	return nw.added - 1, nil
+}
+
+// parseToolOutputs decodes the outputs argument of add_cell, given as a
+// JSON-encoded string or, by models that ignore the schema, as an array.
+func parseToolOutputs(raw json.RawMessage) (notebooks.Outputs, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if s == "" {
+			return nil, nil
+		}
+		raw = json.RawMessage(s)
+	}
+	var outputs notebooks.Outputs
+	if err := json.Unmarshal(raw, &outputs); err != nil {
+		return nil, fmt.Errorf("invalid outputs: %w", err)
+	}
+	return outputs, nil
+}
@@ -0,0 +1,110 @@
+package nbsim
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tmc/nbsim/notebooks"
+)
+
+// TestAddCell checks the notebook a scripted sequence of add_cell calls
+// builds, with the calls the model got wrong rejected.
+func TestAddCell(t *testing.T) {
+	dir := t.TempDir()
+	nw := NewNotebookWriter(dir, "gen", FormatTools)
+	var events []string
+	nw.OnEvent = func(e Event) { events = append(events, e.Type) }
+
+	calls := []struct {
+		arguments string
+		want      int    // the index of the added cell
+		wantErr   string // a substring of the error, if the cell is rejected
+	}{
+		{`{"cell_type": "markdown", "source": "# Title"}`, 0, ""},
+		{`{"cell_type": "code", "source": "print(1)", "outputs": "[{\"output_type\": \"stream\", \"name\": \"stdout\", \"text\": \"1\\n\"}]"}`, 1, ""},
+		{`{"cell_type": "code", "source": "x = `, 0, "invalid arguments: "},
+		{`{"cell_type": "code", "source": "x", "outputs": "[{\"output_type\": "}`, 0, "invalid outputs: "},
+		{`{"cell_type": "markdown", "source": "x", "outputs": "[{\"output_type\": \"stream\", \"name\": \"stdout\", \"text\": \"\"}]"}`, 0, "markdown cells have no outputs"},
+		{`{"cell_type": "heading", "source": "x"}`, 0, `unknown cell_type "heading"`},
+		{`{"cell_type": "code", "source": "x", "outputs": [{"output_type": "stream", "name": "stdout", "text": 3}]}`, 0, "outputs[0].text: "},
+		// models that ignore the schema pass outputs as an array
+		{`{"cell_type": "code", "source": "1 + 1", "outputs": [{"output_type": "execute_result", "data": {"text/plain": "2"}, "metadata": {}, "execution_count": 7}]}`, 2, ""},
+		{`{"cell_type": "code", "source": "def f():\n    pass", "outputs": ""}`, 3, ""},
+	}
+	for _, c := range calls {
+		i, err := nw.AddCell(c.arguments)
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("AddCell(%s): %v", c.arguments, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("AddCell(%s) = %d, %v; want an error with %q", c.arguments, i, err, c.wantErr)
+		case c.wantErr == "" && i != c.want:
+			t.Errorf("AddCell(%s) = %d, want %d", c.arguments, i, c.want)
+		}
+	}
+	nw.Flush()
+
+	data, err := os.ReadFile(nw.filePath(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nb notebooks.Notebook
+	if err := json.Unmarshal(data, &nb); err != nil {
+		t.Fatal(err)
+	}
+	if errs := nb.Validate(); errs != nil {
+		t.Errorf("written notebook is invalid:\n%v", errs)
+	}
+	want := []struct {
+		cellType, source string
+		executionCount   int // 0 for none
+		outputs          string
+	}{
+		{"markdown", "# Title", 0, "null"},
+		{"code", "print(1)", 1, `[{"name":"stdout","output_type":"stream","text":"1\n"}]`},
+		{"code", "1 + 1", 2, `[{"data":{"text/plain":"2"},"execution_count":2,"metadata":{},"output_type":"execute_result"}]`},
+		{"code", "def f():\n    pass", 0, `[]`},
+	}
+	if len(nb.Cells) != len(want) {
+		t.Fatalf("notebook has %d cells, want %d", len(nb.Cells), len(want))
+	}
+	for i, w := range want {
+		c := nb.Cells[i]
+		if c.CellType != w.cellType || c.Source.String() != w.source {
+			t.Errorf("cells[%d] = %s %q, want %s %q", i, c.CellType, c.Source.String(), w.cellType, w.source)
+		}
+		count := 0
+		if c.ExecutionCount != nil {
+			count = *c.ExecutionCount
+		}
+		if count != w.executionCount {
+			t.Errorf("cells[%d] execution count = %d, want %d", i, count, w.executionCount)
+		}
+		outputs, err := json.Marshal(c.Outputs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(outputs) != w.outputs {
+			t.Errorf("cells[%d] outputs = %s, want %s", i, outputs, w.outputs)
+		}
+	}
+
+	var done int
+	for _, e := range events {
+		if e == EventCellDone {
+			done++
+		}
+	}
+	if done != len(want) {
+		t.Errorf("%d cell-completed events, want %d: %v", done, len(want), events)
+	}
+}
+
+func TestAddCellWithoutTools(t *testing.T) {
+	nw := NewNotebookWriter(t.TempDir(), "gen", FormatJSON)
+	if _, err := nw.AddCell(`{"cell_type": "markdown", "source": "x"}`); err == nil {
+		t.Errorf("AddCell on a JSON format writer succeeded")
+	}
+}
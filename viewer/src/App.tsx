@@ -1,39 +1,146 @@
-import { useState, useEffect, useRef } from 'react'
+import { useState, useEffect } from 'react'
 import './App.css'
 
+const server = 'http://localhost:8080';
+
+type Cell = {
+  index: number;
+  html: string;
+};
+
+type GenEvent = {
+  type: string;
+  text?: string;
+  index: number;
+  html?: string;
+  error?: string;
+};
+
 function App() {
   const [path] = useState(window.location.pathname);
-  const [dest, setDest] = useState('http://localhost:8080/generated.html');
-  const [fetching] = useState(false);
-  const iframe = useRef() as React.MutableRefObject<HTMLIFrameElement>;
+  const [id, setId] = useState('');
+  const [cells, setCells] = useState<Cell[]>([]);
+  const [pending, setPending] = useState('');
+  const [status, setStatus] = useState('generating');
+  const [position, setPosition] = useState(0);
+
+  const generate = async (regenerate: boolean) => {
+    const o = await fetch(`${server}/_gen`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ url: path, regenerate, referrer: document.referrer }),
+    });
+    const data = await o.json();
+    setCells([]);
+    setPending('');
+    setStatus('generating');
+    setPosition(data.position ?? 0);
+    setId(data.id);
+  };
+
+  const cancel = async () => {
+    const o = await fetch(`${server}/_gen/${id}`, { method: 'DELETE' });
+    if (!o.ok) {
+      setStatus(`error: ${await o.text()}`);
+    }
+  };
+
+  // regenerateCell starts a version that regenerates only cell index; its
+  // events swap that cell and keep the others.
+  const regenerateCell = async (index: number) => {
+    const o = await fetch(`${server}/_cell`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ id, index }),
+    });
+    if (!o.ok) {
+      setStatus(`error: ${await o.text()}`);
+      return;
+    }
+    const data = await o.json();
+    setPending('');
+    setStatus('generating');
+    setPosition(data.position ?? 0);
+    setId(data.id);
+  };
+
+  useEffect(() => {
+    generate(false).catch(console.error);
+  }, [path]);
 
   useEffect(() => {
-    console.log("useEffect fetching", fetching, path);
-    if (fetching) return;
-    console.log("fetching", path);
-    const fetchfn = async () => {
-      const o = await fetch('http://localhost:8080/_gen', {
-        method: 'POST',
-        headers: {
-          'Content-Type': 'application/json',
-        },
-        body: JSON.stringify({ url: path}),
-      });
-      const data = await o.json();
-      setDest(`http://localhost:8080/${data.url}`);
-    };
-    fetchfn().catch(console.error);
-  }, [fetching, path]);
+    if (!id) return;
+    const es = new EventSource(`${server}/_events/${id}`);
+    const parse = (e: Event) => JSON.parse((e as MessageEvent).data) as GenEvent;
+    es.addEventListener('queued', (e) => {
+      setPosition(parse(e).index);
+    });
+    es.addEventListener('token', (e) => {
+      const ev = parse(e);
+      setPosition(0);
+      setPending((p) => p + (ev.text ?? ''));
+    });
+    es.addEventListener('cell-started', () => {
+      setPending('');
+    });
+    es.addEventListener('cell-completed', (e) => {
+      const ev = parse(e);
+      const cell = { index: ev.index, html: ev.html ?? '' };
+      setCells((cs) => cs.some((c) => c.index === ev.index)
+        ? cs.map((c) => (c.index === ev.index ? cell : c))
+        : [...cs, cell]);
+      setPending('');
+    });
+    es.addEventListener('generation-finished', () => {
+      setStatus('done');
+      setPending('');
+      es.close();
+    });
+    es.addEventListener('generation-cancelled', () => {
+      setStatus('cancelled');
+      setPosition(0);
+      setPending('');
+      es.close();
+    });
+    es.addEventListener('error', (e) => {
+      const data = (e as MessageEvent).data;
+      if (data) {
+        setStatus(`error: ${parse(e).error}`);
+      }
+      es.close();
+    });
+    return () => es.close();
+  }, [id]);
 
   return (
     <>
-      <iframe
-        id="if1"
-        ref={iframe}
-        style={{ width: '100%', height: '1024px', position: 'absolute'}}
-        src={dest}
-        title="gen1"
-      />
+      <link rel="stylesheet" href={`${server}/_nbhtml.css`} />
+      <button className="regenerate" disabled={status === 'generating'} onClick={() => generate(true).catch(console.error)}>
+        Regenerate
+      </button>
+      {status === 'generating' && (
+        <button className="cancel" onClick={() => cancel().catch(console.error)}>
+          Cancel
+        </button>
+      )}
+      <main className="notebook">
+        {cells.map((c) => (
+          <div key={c.index} className="cell-wrapper">
+            <button className="regenerate-cell" disabled={status === 'generating'} onClick={() => regenerateCell(c.index).catch(console.error)}>
+              Regenerate cell
+            </button>
+            <div dangerouslySetInnerHTML={{ __html: c.html }} />
+          </div>
+        ))}
+        {status === 'generating' && position > 0 && <p className="queued">Waiting for a worker: position {position} in the queue</p>}
+        {status === 'generating' && <pre className="pending">{pending}</pre>}
+        {status === 'cancelled' && <p className="cancelled">Generation cancelled; the notebook is incomplete.</p>}
+        {status.startsWith('error') && <pre className="error">{status}</pre>}
+      </main>
     </>
   );
 }